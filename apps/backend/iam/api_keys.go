@@ -0,0 +1,441 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/middleware"
+)
+
+// API keys authenticate programmatic clients: OpenAI SDKs and server-to-server
+// integrations that cannot script a login. A key belongs to a tenant and
+// optionally to one of its projects, and carries scopes that decide which
+// endpoints it may call. The token is shown once when the key is created,
+// only its hash is stored. AuthHandler accepts it as a bearer token and acts
+// as the user who created the key.
+
+const (
+	apiKeyTokenPrefix = "mk-"
+	// apiKeyDisplayLen is how much of the token is kept to tell keys apart.
+	apiKeyDisplayLen = 10
+	maxAPIKeyName    = 100
+	// apiKeyTouchInterval limits how often last_used_at is written.
+	apiKeyTouchInterval = time.Minute
+)
+
+// API key scopes
+const (
+	ScopeConversationsRead = "conversations:read"
+	ScopeGenerate          = "generate"
+	ScopeFilesManage       = "files:manage"
+)
+
+var apiKeyScopes = []string{ScopeConversationsRead, ScopeGenerate, ScopeFilesManage}
+
+type APIKey struct {
+	ID         string   `json:"id"`
+	TenantID   string   `json:"tenant_id"`
+	ProjectID  string   `json:"project_id,omitempty"` // empty for tenant-wide keys
+	Name       string   `json:"name"`
+	KeyPrefix  string   `json:"key_prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedBy  string   `json:"created_by,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+}
+
+// APIKeyInfo is what a verified key grants access to.
+type APIKeyInfo struct {
+	ID        string
+	TenantID  string
+	ProjectID string
+	Scopes    []string
+	CreatedBy string
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKeyInfo) HasScope(scope string) bool {
+	return hasScope(k.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+	// ProjectID limits the key to one project; empty allows all projects of the tenant.
+	ProjectID string `json:"project_id"`
+	// Scopes are conversations:read, generate and files:manage; empty grants generate.
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is an RFC 3339 time; empty keys do not expire.
+	ExpiresAt string `json:"expires_at"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey *APIKey `json:"api_key"`
+	// Key is the token to send as "Authorization: Bearer <key>". It is not shown again.
+	Key string `json:"key"`
+}
+
+type ListAPIKeysRequest struct {
+	ProjectID string `query:"project_id"`
+	// IncludeRevoked also lists revoked keys
+	IncludeRevoked bool `query:"include_revoked"`
+}
+
+type ListAPIKeysResponse struct {
+	Items []*APIKey `json:"items"`
+}
+
+// apiKeyAdmin returns the tenant admin session managing API keys. Admins
+// bound to a project only manage that project's keys.
+func apiKeyAdmin() (*AuthData, error) {
+	data, ok := auth.Data().(*AuthData)
+	if !ok || data == nil || data.ScopeType != scopeTenant {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "tenant session required"}
+	}
+	if data.Role != roleAdmin {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "only tenant admin can manage api keys"}
+	}
+	if data.APIKeyID != "" {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "api keys cannot manage api keys"}
+	}
+	return data, nil
+}
+
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return []string{ScopeGenerate}, nil
+	}
+	var out []string
+	for _, s := range scopes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !hasScope(apiKeyScopes, s) {
+			return nil, badRequest(fmt.Sprintf("unknown scope %q, use one of %s", s, strings.Join(apiKeyScopes, ", ")))
+		}
+		if !hasScope(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func decodeScopes(raw string) []string {
+	var scopes []string
+	if err := json.Unmarshal([]byte(raw), &scopes); err != nil {
+		fmt.Printf("[WARN] Invalid api key scopes %q: %v\n", raw, err)
+	}
+	return scopes
+}
+
+const apiKeyColumns = `id, tenant_id, project_id, name, key_prefix, scopes, created_by, created_at,
+	COALESCE(expires_at, ''), COALESCE(last_used_at, ''), COALESCE(revoked_at, '')`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	k := &APIKey{}
+	var scopes string
+	if err := row.Scan(&k.ID, &k.TenantID, &k.ProjectID, &k.Name, &k.KeyPrefix, &scopes, &k.CreatedBy, &k.CreatedAt,
+		&k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+		return nil, err
+	}
+	k.Scopes = decodeScopes(scopes)
+	for _, ts := range []*string{&k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt} {
+		if *ts != "" {
+			*ts = parseStoredTime(*ts).Format(time.RFC3339)
+		}
+	}
+	return k, nil
+}
+
+// CreateAPIKey creates an API key for the tenant or one of its projects.
+//
+//encore:api auth method=POST path=/api-keys
+func CreateAPIKey(ctx context.Context, req *CreateAPIKeyRequest) (*CreateAPIKeyResponse, error) {
+	data, err := apiKeyAdmin()
+	if err != nil {
+		return nil, err
+	}
+	if req == nil || strings.TrimSpace(req.Name) == "" {
+		return nil, badRequest("name is required")
+	}
+	name := strings.TrimSpace(req.Name)
+	if len(name) > maxAPIKeyName {
+		return nil, badRequest("name is too long")
+	}
+	projectID := strings.TrimSpace(req.ProjectID)
+	if data.ProjectID != "" {
+		if projectID != "" && projectID != data.ProjectID {
+			return nil, &errs.Error{Code: errs.PermissionDenied, Message: "project not accessible"}
+		}
+		projectID = data.ProjectID
+	}
+	if projectID != "" {
+		exists, _, _, err := projectOwnedByTenant(ctx, projectID, data.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "project not found"}
+		}
+	}
+	scopes, err := normalizeScopes(req.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := sql.NullString{}
+	if v := strings.TrimSpace(req.ExpiresAt); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, badRequest("expires_at must be an RFC 3339 timestamp")
+		}
+		if !t.After(time.Now()) {
+			return nil, badRequest("expires_at must be in the future")
+		}
+		expiresAt = sql.NullString{String: formatStoredTime(t), Valid: true}
+	}
+	rawScopes, _ := json.Marshal(scopes)
+
+	token := apiKeyTokenPrefix + newToken()
+	id := newID("key")
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, tenant_id, project_id, name, key_prefix, token_hash, scopes, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, data.TenantID, projectID, name, token[:apiKeyDisplayLen], hashToken(token), string(rawScopes), data.UserID,
+		formatStoredTime(time.Now()), expiresAt); err != nil {
+		return nil, err
+	}
+
+	key, err := scanAPIKey(db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("[IAM] API key %s created for tenant %s (project=%q scopes=%v)\n", id, data.TenantID, projectID, scopes)
+	return &CreateAPIKeyResponse{APIKey: key, Key: token}, nil
+}
+
+// ListAPIKeys lists the tenant's API keys, newest first.
+//
+//encore:api auth method=GET path=/api-keys
+func ListAPIKeys(ctx context.Context, req *ListAPIKeysRequest) (*ListAPIKeysResponse, error) {
+	data, err := apiKeyAdmin()
+	if err != nil {
+		return nil, err
+	}
+	if req == nil {
+		req = &ListAPIKeysRequest{}
+	}
+
+	where := "tenant_id = ?"
+	args := []interface{}{data.TenantID}
+	projectID := strings.TrimSpace(req.ProjectID)
+	if data.ProjectID != "" {
+		projectID = data.ProjectID
+	}
+	if projectID != "" {
+		where += " AND project_id = ?"
+		args = append(args, projectID)
+	}
+	if !req.IncludeRevoked {
+		where += " AND revoked_at IS NULL"
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE `+where+` ORDER BY created_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &ListAPIKeysResponse{Items: []*APIKey{}}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		resp.Items = append(resp.Items, key)
+	}
+	return resp, rows.Err()
+}
+
+// RevokeAPIKey revokes an API key. Requests with it fail right away.
+//
+//encore:api auth method=DELETE path=/api-keys/:id
+func RevokeAPIKey(ctx context.Context, id string) (*successResponse, error) {
+	data, err := apiKeyAdmin()
+	if err != nil {
+		return nil, err
+	}
+	query := `UPDATE api_keys SET revoked_at = ? WHERE id = ? AND tenant_id = ? AND revoked_at IS NULL`
+	args := []interface{}{formatStoredTime(time.Now()), id, data.TenantID}
+	if data.ProjectID != "" {
+		query += ` AND project_id = ?`
+		args = append(args, data.ProjectID)
+	}
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "api key not found"}
+	}
+	fmt.Printf("[IAM] API key %s revoked by %s\n", id, data.UserID)
+	return &successResponse{Success: true}, nil
+}
+
+// VerifyAPIKey returns the tenant, project and scopes an API key grants
+// access to, and records its use.
+func VerifyAPIKey(ctx context.Context, token string) (*APIKeyInfo, error) {
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, apiKeyTokenPrefix) {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid api key"}
+	}
+	info := &APIKeyInfo{}
+	var scopes string
+	var expiresAt, revokedAt sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT id, tenant_id, project_id, scopes, created_by, expires_at, revoked_at FROM api_keys WHERE token_hash = ?
+	`, hashToken(token)).Scan(&info.ID, &info.TenantID, &info.ProjectID, &scopes, &info.CreatedBy, &expiresAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid api key"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "api key revoked"}
+	}
+	if expiresAt.Valid && time.Now().After(parseStoredTime(expiresAt.String)) {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "api key expired"}
+	}
+	info.Scopes = decodeScopes(scopes)
+
+	now := time.Now()
+	if _, err := db.ExecContext(ctx, `
+		UPDATE api_keys SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)
+	`, formatStoredTime(now), info.ID, formatStoredTime(now.Add(-apiKeyTouchInterval))); err != nil {
+		fmt.Printf("[WARN] Recording use of api key %s failed: %v\n", info.ID, err)
+	}
+	return info, nil
+}
+
+// apiKeyAuth authenticates a bearer API key as the user who created it,
+// limited to the key's project. Hosts are checked like tenant sessions.
+func apiKeyAuth(ctx context.Context, token, host string) (auth.UID, *AuthData, error) {
+	key, err := VerifyAPIKey(ctx, token)
+	if err != nil {
+		return "", nil, err
+	}
+	if encore.Meta().Environment.Type != "development" {
+		if host = normalizeHost(host); host == "" {
+			host = "*"
+		}
+		if err := ensureTenantHost(ctx, key.TenantID, host); err != nil {
+			return "", nil, err
+		}
+	}
+	user, err := q().GetUserByID(ctx, key.CreatedBy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil, &errs.Error{Code: errs.Unauthenticated, Message: "api key owner not found"}
+		}
+		return "", nil, err
+	}
+	if toString(user.TenantID) != key.TenantID {
+		return "", nil, &errs.Error{Code: errs.Unauthenticated, Message: "invalid api key"}
+	}
+
+	data := &AuthData{
+		UserID:       key.CreatedBy,
+		Role:         role(user.Role),
+		TenantID:     key.TenantID,
+		ProjectID:    firstNonEmptyString(key.ProjectID, toString(user.ProjectID)),
+		ScopeType:    scopeTenant,
+		ScopeID:      key.TenantID,
+		Username:     user.Username,
+		APIKeyID:     key.ID,
+		APIKeyScopes: key.Scopes,
+	}
+	return auth.UID(key.CreatedBy), data, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(header string) string {
+	header = strings.TrimSpace(header)
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// apiKeyScopeFor returns the scope an API key needs to call an endpoint,
+// or "" when API keys may not call it.
+func apiKeyScopeFor(service, method, path string) string {
+	switch {
+	case service == "files":
+		return ScopeFilesManage
+	case service == "llm" && (strings.HasPrefix(path, "/llm/generate") || path == "/llm/embeddings" || strings.HasPrefix(path, "/v1/")):
+		return ScopeGenerate
+	case service == "iam" && method == http.MethodGet && strings.Contains(path, "/conversations"):
+		return ScopeConversationsRead
+	}
+	return ""
+}
+
+// RequireAPIKeyScope limits requests authenticated with an API key to the
+// endpoints its scopes cover and, for project keys, to that project.
+//
+//encore:middleware global target=all
+func RequireAPIKeyScope(req middleware.Request, next middleware.Next) middleware.Response {
+	data, ok := auth.Data().(*AuthData)
+	if !ok || data == nil || data.APIKeyID == "" {
+		return next(req)
+	}
+	// Public endpoints such as /llm/generate are checked too, the key's auth
+	// data still applies there.
+	rd := req.Data()
+	scope := apiKeyScopeFor(rd.Service, rd.Method, rd.Path)
+	if scope == "" || !hasScope(data.APIKeyScopes, scope) {
+		return middleware.Response{Err: &errs.Error{Code: errs.PermissionDenied, Message: "api key is not allowed to call this endpoint"}}
+	}
+	if data.ProjectID != "" {
+		if err := apiKeyProjectAccess(req.Context(), data.ProjectID, rd.PathParams); err != nil {
+			return middleware.Response{Err: err}
+		}
+	}
+	return next(req)
+}
+
+// apiKeyProjectAccess checks that the project or subclient in the path
+// belongs to the key's project.
+func apiKeyProjectAccess(ctx context.Context, projectID string, params encore.PathParams) error {
+	for _, p := range params {
+		switch p.Name {
+		case "projectID", "projectId", "project":
+			if p.Value != projectID {
+				return &errs.Error{Code: errs.PermissionDenied, Message: "project not accessible"}
+			}
+		case "subclientID":
+			subclient, err := q().GetSubclientFullByID(ctx, p.Value)
+			if err != nil || subclient.ProjectID != projectID {
+				return &errs.Error{Code: errs.PermissionDenied, Message: "subclient not accessible"}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package iam
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+func TestVerifyAPIKey(t *testing.T) {
+	ctx := context.Background()
+	insert := func(tenantID, projectID string) (string, string) {
+		t.Helper()
+		token, id := apiKeyTokenPrefix+newToken(), newID("key")
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO api_keys (id, tenant_id, project_id, name, key_prefix, token_hash, created_at)
+			VALUES (?, ?, ?, 'test', ?, ?, ?)
+		`, id, tenantID, projectID, token[:apiKeyDisplayLen], hashToken(token), formatStoredTime(time.Now())); err != nil {
+			t.Fatal(err)
+		}
+		return id, token
+	}
+	tenantID := newID("tnt")
+	if _, err := db.ExecContext(ctx, `INSERT INTO tenants (id, name, domain) VALUES (?, ?, ?)`, tenantID, tenantID, tenantID+".test"); err != nil {
+		t.Fatal(err)
+	}
+
+	id, token := insert(tenantID, "")
+	info, err := VerifyAPIKey(ctx, " "+token+" ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != id || info.TenantID != tenantID || info.ProjectID != "" {
+		t.Errorf("tenant key = %+v", info)
+	}
+	projectKeyID, projectToken := insert(tenantID, "prj_1")
+	if info, err := VerifyAPIKey(ctx, projectToken); err != nil || info.ID != projectKeyID || info.ProjectID != "prj_1" {
+		t.Errorf("project key = %+v, %v", info, err)
+	}
+
+	var lastUsed string
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(last_used_at, '') FROM api_keys WHERE id = ?`, id).Scan(&lastUsed); err != nil || lastUsed == "" {
+		t.Errorf("last_used_at = %q, %v, want the verification time", lastUsed, err)
+	}
+
+	if _, err := db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = ? WHERE id = ?`, formatStoredTime(time.Now()), id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE api_keys SET expires_at = ? WHERE id = ?`, formatStoredTime(time.Now().Add(-time.Minute)), projectKeyID); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{token, "api key revoked"},
+		{projectToken, "api key expired"},
+		{apiKeyTokenPrefix + "unknown", "invalid api key"},
+		{"sk-" + token[len(apiKeyTokenPrefix):], "invalid api key"},
+		{"", "invalid api key"},
+	}
+	for _, tt := range tests {
+		_, err := VerifyAPIKey(ctx, tt.token)
+		var e *errs.Error
+		if !errors.As(err, &e) || e.Code != errs.Unauthenticated || e.Message != tt.want {
+			t.Errorf("VerifyAPIKey(%q) error = %#v, want %q", tt.token, err, tt.want)
+		}
+	}
+}
+
+func TestAPIKeyScopeFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		method  string
+		path    string
+		want    string
+	}{
+		{"generate", "llm", http.MethodPost, "/llm/generate", ScopeGenerate},
+		{"generate stream", "llm", http.MethodPost, "/llm/generate/stream", ScopeGenerate},
+		{"embeddings", "llm", http.MethodPost, "/llm/embeddings", ScopeGenerate},
+		{"openai chat completions", "llm", http.MethodPost, "/v1/chat/completions", ScopeGenerate},
+		{"openai models", "llm", http.MethodGet, "/v1/models", ScopeGenerate},
+		{"llm admin endpoint", "llm", http.MethodGet, "/llm/endpoints", ""},
+		{"key rotation", "llm", http.MethodPost, "/llm/keys/rotate", ""},
+		{"files upload", "files", http.MethodPost, "/projects/p1/files", ScopeFilesManage},
+		{"files delete", "files", http.MethodDelete, "/projects/p1/files/f1", ScopeFilesManage},
+		{"list conversations", "iam", http.MethodGet, "/projects/p1/conversations", ScopeConversationsRead},
+		{"read conversation", "iam", http.MethodGet, "/projects/p1/conversations/c1", ScopeConversationsRead},
+		{"write conversation", "iam", http.MethodPost, "/projects/p1/conversations", ""},
+		{"delete conversation", "iam", http.MethodDelete, "/projects/p1/conversations/c1", ""},
+		{"api key management", "iam", http.MethodPost, "/api-keys", ""},
+		{"embed page", "iam", http.MethodGet, "/embed/p1", ""},
+		{"other service", "tenant", http.MethodGet, "/tenant", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := apiKeyScopeFor(tt.service, tt.method, tt.path); got != tt.want {
+				t.Errorf("apiKeyScopeFor(%s, %s, %s) = %q, want %q", tt.service, tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []string
+		want    []string
+		wantErr bool
+	}{
+		{"empty grants generate", nil, []string{ScopeGenerate}, false},
+		{"normalized and deduplicated", []string{" Generate ", "generate", "FILES:manage"}, []string{ScopeGenerate, ScopeFilesManage}, false},
+		{"all scopes", []string{ScopeConversationsRead, ScopeGenerate, ScopeFilesManage}, []string{ScopeConversationsRead, ScopeGenerate, ScopeFilesManage}, false},
+		{"unknown scope", []string{"generate", "admin"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeScopes(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeScopes(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"Bearer mk_abc", "mk_abc"},
+		{"bearer   mk_abc  ", "mk_abc"},
+		{"BEARER mk_abc", "mk_abc"},
+		{"Basic dXNlcjpwYXNz", ""},
+		{"Bearer", ""},
+		{"mk_abc", ""},
+	}
+	for _, tt := range tests {
+		if got := bearerToken(tt.header); got != tt.want {
+			t.Errorf("bearerToken(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+// Chat roles live in SQLite. Rows with an empty tenant_id are the global
+// roles every tenant sees; a tenant's own rows add roles or override a
+// global role with the same ID. Every edit stores a new version, and a
+// project can pin one with projects.context_role_version.
+
+const globalRoleTenant = ""
+
+var roleIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,63}$`)
+
+// seedGlobalRoles fills the global roles from roles.json or the defaults the
+// first time the chat_roles table is used.
+func seedGlobalRoles(ctx context.Context, db *sql.DB, dataDir string) error {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM chat_roles WHERE tenant_id = ''").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, role := range legacyRoles(dataDir) {
+		if err := insertRole(ctx, tx, globalRoleTenant, &role, "", now); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("[setupSQLite] Seeded global chat roles\n")
+	return tx.Commit()
+}
+
+// insertRole creates a role with version 1.
+func insertRole(ctx context.Context, tx *sql.Tx, tenantID string, role *RoleDefinition, userID, now string) error {
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO chat_roles (tenant_id, id, current_version, created_by, created_at, updated_at)
+		VALUES (?, ?, 1, ?, ?, ?)
+	`, tenantID, role.ID, userID, now, now); err != nil {
+		return err
+	}
+	return insertRoleVersion(ctx, tx, tenantID, role, 1, userID, now)
+}
+
+func insertRoleVersion(ctx context.Context, tx *sql.Tx, tenantID string, role *RoleDefinition, version int, userID, now string) error {
+	scope, _ := json.Marshal(nonNilStrings(role.Scope))
+	suggestions, _ := json.Marshal(nonNilStrings(role.Suggestions))
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO chat_role_versions (tenant_id, role_id, version, name, description, category, scope, refusal_msg, system_prompt, suggestions, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, tenantID, role.ID, version, role.Name, role.Description, role.Category, string(scope), role.RefusalMsg, role.SystemPrompt, string(suggestions), userID, now)
+	return err
+}
+
+func nonNilStrings(v []string) []string {
+	if v == nil {
+		return []string{}
+	}
+	return v
+}
+
+const roleVersionColumns = `v.tenant_id, v.role_id, v.version, v.name, v.description, v.category, v.scope, v.refusal_msg, v.system_prompt, v.suggestions, v.created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRole(row rowScanner) (*RoleDefinition, error) {
+	role := &RoleDefinition{}
+	var scope, suggestions string
+	if err := row.Scan(&role.TenantID, &role.ID, &role.Version, &role.Name, &role.Description, &role.Category,
+		&scope, &role.RefusalMsg, &role.SystemPrompt, &suggestions, &role.UpdatedAt); err != nil {
+		return nil, err
+	}
+	_ = json.Unmarshal([]byte(scope), &role.Scope)
+	_ = json.Unmarshal([]byte(suggestions), &role.Suggestions)
+	return role, nil
+}
+
+// listRoles returns the current version of every role a tenant sees. An
+// empty tenantID lists the global roles only.
+func listRoles(ctx context.Context, tenantID string) ([]RoleDefinition, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+roleVersionColumns+`
+		FROM chat_roles r
+		JOIN chat_role_versions v ON v.tenant_id = r.tenant_id AND v.role_id = r.id AND v.version = r.current_version
+		WHERE r.tenant_id = ''
+			OR r.tenant_id = ?
+		ORDER BY (r.id = 'general') DESC, r.created_at, r.id
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make([]RoleDefinition, 0)
+	index := map[string]int{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		// A tenant role replaces the global role with the same ID
+		if i, ok := index[role.ID]; ok {
+			if role.TenantID != globalRoleTenant {
+				roles[i] = *role
+			}
+			continue
+		}
+		index[role.ID] = len(roles)
+		roles = append(roles, *role)
+	}
+	return roles, rows.Err()
+}
+
+// findRole returns a role as a tenant sees it. version 0 is the current one.
+func findRole(ctx context.Context, tenantID, roleID string, version int) (*RoleDefinition, error) {
+	return scanRole(db.QueryRowContext(ctx, `
+		SELECT `+roleVersionColumns+`
+		FROM chat_roles r
+		JOIN chat_role_versions v ON v.tenant_id = r.tenant_id AND v.role_id = r.id
+		WHERE r.id = ?
+			AND (r.tenant_id = '' OR r.tenant_id = ?)
+			AND v.version = CASE WHEN ? > 0 THEN ? ELSE r.current_version END
+		ORDER BY r.tenant_id DESC
+		LIMIT 1
+	`, roleID, tenantID, version, version))
+}
+
+// roleEditorTenant returns the tenant whose roles the caller may edit: the
+// empty global tenant for system admins, their own tenant for tenant admins.
+func roleEditorTenant() (string, *AuthData, error) {
+	data, ok := auth.Data().(*AuthData)
+	if !ok || data == nil {
+		return "", nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	switch {
+	case data.Role == roleSystem:
+		return globalRoleTenant, data, nil
+	case data.ScopeType == scopeTenant && data.Role == roleAdmin && data.TenantID != "":
+		return data.TenantID, data, nil
+	default:
+		return "", nil, &errs.Error{Code: errs.PermissionDenied, Message: "only admins can edit chat roles"}
+	}
+}
+
+// roleReaderTenant returns the tenant whose roles the caller sees.
+func roleReaderTenant() (string, error) {
+	data, ok := auth.Data().(*AuthData)
+	if !ok || data == nil {
+		return "", &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	if data.Role == roleSystem {
+		return globalRoleTenant, nil
+	}
+	return data.TenantID, nil
+}
+
+func roleNotFound(roleID string) error {
+	return &errs.Error{Code: errs.NotFound, Message: "role not found: " + roleID}
+}
+
+// GetRolesResponse returns all roles available to the caller
+//
+//encore:api auth method=GET path=/roles
+func GetRolesResponse(ctx context.Context) (*RoleResponse, error) {
+	tenantID, err := roleReaderTenant()
+	if err != nil {
+		return nil, err
+	}
+	roles, err := listRoles(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return &RoleResponse{Roles: roles}, nil
+}
+
+type getRoleRequest struct {
+	// Version to return, 0 for the current one
+	Version int `query:"version"`
+}
+
+// GetRole returns one role, optionally at an older version
+//
+//encore:api auth method=GET path=/roles/:roleId
+func GetRole(ctx context.Context, roleId string, req *getRoleRequest) (*RoleDefinition, error) {
+	tenantID, err := roleReaderTenant()
+	if err != nil {
+		return nil, err
+	}
+	version := 0
+	if req != nil {
+		version = req.Version
+	}
+	role, err := findRole(ctx, tenantID, roleId, version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, roleNotFound(roleId)
+	}
+	return role, err
+}
+
+type roleVersionsResponse struct {
+	Versions []RoleDefinition `json:"versions"`
+}
+
+// ListRoleVersions returns every stored version of a role, newest first
+//
+//encore:api auth method=GET path=/roles/:roleId/versions
+func ListRoleVersions(ctx context.Context, roleId string) (*roleVersionsResponse, error) {
+	tenantID, err := roleReaderTenant()
+	if err != nil {
+		return nil, err
+	}
+	current, err := findRole(ctx, tenantID, roleId, 0)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, roleNotFound(roleId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+roleVersionColumns+`
+		FROM chat_role_versions v
+		WHERE v.tenant_id = ? AND v.role_id = ?
+		ORDER BY v.version DESC
+	`, current.TenantID, roleId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]RoleDefinition, 0)
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &roleVersionsResponse{Versions: versions}, nil
+}
+
+type roleRequest struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Category     string   `json:"category"`
+	Scope        []string `json:"scope"`
+	RefusalMsg   string   `json:"refusal_msg"`
+	SystemPrompt string   `json:"system_prompt"`
+	Suggestions  []string `json:"suggestions"`
+}
+
+func (r *roleRequest) definition() *RoleDefinition {
+	return &RoleDefinition{
+		ID:           strings.TrimSpace(r.ID),
+		Name:         strings.TrimSpace(r.Name),
+		Description:  strings.TrimSpace(r.Description),
+		Category:     strings.TrimSpace(r.Category),
+		Scope:        trimStrings(r.Scope),
+		RefusalMsg:   strings.TrimSpace(r.RefusalMsg),
+		SystemPrompt: strings.TrimSpace(r.SystemPrompt),
+		Suggestions:  trimStrings(r.Suggestions),
+	}
+}
+
+func trimStrings(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func validateRole(role *RoleDefinition) error {
+	if !roleIDPattern.MatchString(role.ID) {
+		return badRequest("role id must be 2-64 lowercase letters, digits, '-' or '_'")
+	}
+	if role.Name == "" {
+		return badRequest("name is required")
+	}
+	if role.SystemPrompt == "" {
+		return badRequest("system_prompt is required")
+	}
+	if role.ID != "general" && len(role.Scope) == 0 {
+		return badRequest("scope needs at least one topic")
+	}
+	return nil
+}
+
+// CreateRole adds a chat role. System admins create global roles, tenant
+// admins create roles for their tenant.
+//
+//encore:api auth method=POST path=/roles
+func CreateRole(ctx context.Context, req *roleRequest) (*RoleDefinition, error) {
+	if req == nil {
+		return nil, badRequest("role is required")
+	}
+	tenantID, data, err := roleEditorTenant()
+	if err != nil {
+		return nil, err
+	}
+	role := req.definition()
+	if err := validateRole(role); err != nil {
+		return nil, err
+	}
+	return createRole(ctx, tenantID, role, data.UserID)
+}
+
+func createRole(ctx context.Context, tenantID string, role *RoleDefinition, userID string) (*RoleDefinition, error) {
+	var exists int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM chat_roles WHERE tenant_id = ? AND id = ?", tenantID, role.ID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists > 0 {
+		return nil, &errs.Error{Code: errs.AlreadyExists, Message: "role already exists: " + role.ID}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := insertRole(ctx, tx, tenantID, role, userID, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return findRole(ctx, tenantID, role.ID, 0)
+}
+
+// UpdateRole stores a new version of a role. Empty fields keep their current
+// value. Projects that pinned an older version keep using it.
+//
+//encore:api auth method=PUT path=/roles/:roleId
+func UpdateRole(ctx context.Context, roleId string, req *roleRequest) (*RoleDefinition, error) {
+	if req == nil {
+		return nil, badRequest("role is required")
+	}
+	tenantID, data, err := roleEditorTenant()
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := findRole(ctx, tenantID, roleId, 0)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, roleNotFound(roleId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current.TenantID != tenantID {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "global roles can only be edited by system admins; clone the role to customize it"}
+	}
+
+	next := req.definition()
+	next.ID = roleId
+	next.Name = firstNonEmptyString(next.Name, current.Name)
+	next.Description = firstNonEmptyString(next.Description, current.Description)
+	next.Category = firstNonEmptyString(next.Category, current.Category)
+	next.RefusalMsg = firstNonEmptyString(next.RefusalMsg, current.RefusalMsg)
+	next.SystemPrompt = firstNonEmptyString(next.SystemPrompt, current.SystemPrompt)
+	if req.Scope == nil {
+		next.Scope = current.Scope
+	}
+	if req.Suggestions == nil {
+		next.Suggestions = current.Suggestions
+	}
+	if err := validateRole(next); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	version := current.Version + 1
+	if err := insertRoleVersion(ctx, tx, tenantID, next, version, data.UserID, now); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chat_roles SET current_version = ?, updated_at = ? WHERE tenant_id = ? AND id = ?", version, now, tenantID, roleId); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return findRole(ctx, tenantID, roleId, 0)
+}
+
+func firstNonEmptyString(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+type deleteRoleResponse struct {
+	Deleted bool `json:"deleted"`
+}
+
+// DeleteRole removes a role and all its versions. Roles still used by a
+// project cannot be deleted.
+//
+//encore:api auth method=DELETE path=/roles/:roleId
+func DeleteRole(ctx context.Context, roleId string) (*deleteRoleResponse, error) {
+	tenantID, _, err := roleEditorTenant()
+	if err != nil {
+		return nil, err
+	}
+	if tenantID == globalRoleTenant && roleId == "general" {
+		return nil, badRequest("the general role cannot be deleted")
+	}
+
+	var exists int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM chat_roles WHERE tenant_id = ? AND id = ?", tenantID, roleId).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		if _, err := findRole(ctx, tenantID, roleId, 0); err == nil {
+			return nil, &errs.Error{Code: errs.PermissionDenied, Message: "global roles can only be deleted by system admins"}
+		}
+		return nil, roleNotFound(roleId)
+	}
+
+	var inUse int
+	if tenantID == globalRoleTenant {
+		err = db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM projects p
+			WHERE p.context_role = ?
+				AND NOT EXISTS (SELECT 1 FROM chat_roles r WHERE r.tenant_id = p.tenant_id AND r.id = p.context_role)
+		`, roleId).Scan(&inUse)
+	} else {
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM projects WHERE tenant_id = ? AND context_role = ?", tenantID, roleId).Scan(&inUse)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if inUse > 0 {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: fmt.Sprintf("role is used by %d project(s)", inUse)}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chat_role_versions WHERE tenant_id = ? AND role_id = ?", tenantID, roleId); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chat_roles WHERE tenant_id = ? AND id = ?", tenantID, roleId); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &deleteRoleResponse{Deleted: true}, nil
+}
+
+type cloneRoleRequest struct {
+	// ID of the new role; defaults to the source ID, which for a tenant
+	// admin overrides the global role of that name
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Version of the source role to copy, 0 for the current one
+	Version int `json:"version"`
+}
+
+// CloneRole copies a role the caller can see into the caller's own roles.
+// This is how tenant admins customize a global role.
+//
+//encore:api auth method=POST path=/roles/:roleId/clone
+func CloneRole(ctx context.Context, roleId string, req *cloneRoleRequest) (*RoleDefinition, error) {
+	if req == nil {
+		req = &cloneRoleRequest{}
+	}
+	tenantID, data, err := roleEditorTenant()
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := findRole(ctx, tenantID, roleId, req.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, roleNotFound(roleId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	clone := *source
+	clone.ID = firstNonEmptyString(strings.TrimSpace(req.ID), source.ID)
+	clone.Name = firstNonEmptyString(strings.TrimSpace(req.Name), source.Name)
+	if err := validateRole(&clone); err != nil {
+		return nil, err
+	}
+	return createRole(ctx, tenantID, &clone, data.UserID)
+}
@@ -0,0 +1,130 @@
+package iam
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+func TestValidateRole(t *testing.T) {
+	valid := RoleDefinition{ID: "pharmacist", Name: "Pharmacist", SystemPrompt: "You are a pharmacist.", Scope: []string{"medicine"}}
+	tests := []struct {
+		name    string
+		edit    func(r *RoleDefinition)
+		wantErr bool
+	}{
+		{"valid", func(r *RoleDefinition) {}, false},
+		{"general needs no scope", func(r *RoleDefinition) { r.ID = "general"; r.Scope = nil }, false},
+		{"uppercase id", func(r *RoleDefinition) { r.ID = "Pharmacist" }, true},
+		{"one character id", func(r *RoleDefinition) { r.ID = "p" }, true},
+		{"id with a slash", func(r *RoleDefinition) { r.ID = "../roles" }, true},
+		{"missing name", func(r *RoleDefinition) { r.Name = "" }, true},
+		{"missing prompt", func(r *RoleDefinition) { r.SystemPrompt = "" }, true},
+		{"missing scope", func(r *RoleDefinition) { r.Scope = nil }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role := valid
+			tt.edit(&role)
+			if err := validateRole(&role); (err != nil) != tt.wantErr {
+				t.Errorf("validateRole = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTenantRoleOverridesGlobal(t *testing.T) {
+	ctx := context.Background()
+	tenantID := newID("tnt")
+
+	global, err := findRole(ctx, tenantID, "pharmacist", 0)
+	if err != nil {
+		t.Fatalf("seeded global role: %v", err)
+	}
+	if global.TenantID != globalRoleTenant {
+		t.Fatalf("tenant_id = %q, want the global tenant", global.TenantID)
+	}
+
+	custom := &RoleDefinition{ID: "pharmacist", Name: "Apotek Sehat", SystemPrompt: "You answer for Apotek Sehat.", Scope: []string{"obat"}}
+	created, err := createRole(ctx, tenantID, custom, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.TenantID != tenantID || created.Version != 1 || created.Name != "Apotek Sehat" {
+		t.Errorf("created = %+v", created)
+	}
+	var e *errs.Error
+	if _, err := createRole(ctx, tenantID, custom, "u1"); !errors.As(err, &e) || e.Code != errs.AlreadyExists {
+		t.Errorf("duplicate create err = %v", err)
+	}
+
+	roles, err := listRoles(ctx, tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) == 0 || roles[0].ID != "general" {
+		t.Fatalf("general role is not listed first: %v", roles)
+	}
+	found := 0
+	for _, r := range roles {
+		if r.ID == "pharmacist" {
+			found++
+			if r.TenantID != tenantID {
+				t.Errorf("listed pharmacist is from tenant %q", r.TenantID)
+			}
+		}
+	}
+	if found != 1 {
+		t.Errorf("pharmacist listed %d times", found)
+	}
+
+	// Other tenants still see the global role
+	other, err := findRole(ctx, newID("tnt"), "pharmacist", 0)
+	if err != nil || other.TenantID != globalRoleTenant {
+		t.Errorf("other tenant role = %+v, err = %v", other, err)
+	}
+}
+
+func TestRoleVersions(t *testing.T) {
+	ctx := context.Background()
+	tenantID := newID("tnt")
+	v1 := &RoleDefinition{ID: "support", Name: "Support", SystemPrompt: "Help with orders.", Scope: []string{"order"}}
+	if _, err := createRole(ctx, tenantID, v1, "u1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := *v1
+	v2.SystemPrompt = "Help with orders and refunds."
+	v2.Scope = []string{"order", "refund"}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := insertRoleVersion(ctx, tx, tenantID, &v2, 2, "u1", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE chat_roles SET current_version = 2 WHERE tenant_id = ? AND id = ?", tenantID, "support"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := findRole(ctx, tenantID, "support", 0)
+	if err != nil || current.Version != 2 || len(current.Scope) != 2 {
+		t.Errorf("current = %+v, err = %v", current, err)
+	}
+	pinned, err := findRole(ctx, tenantID, "support", 1)
+	if err != nil || pinned.Version != 1 || pinned.SystemPrompt != "Help with orders." {
+		t.Errorf("pinned = %+v, err = %v", pinned, err)
+	}
+
+	// A missing version falls back to the general role for the llm service
+	if role := GetRoleDefinition(ctx, tenantID, "support", 9); role == nil || role.ID != "general" {
+		t.Errorf("missing version resolved to %+v", role)
+	}
+}
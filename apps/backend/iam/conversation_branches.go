@@ -0,0 +1,320 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+// branchPath returns the messages from the first message down to leafID,
+// with sibling information filled in. messages must be in creation order.
+// An unknown or empty leaf falls back to the newest message.
+func branchPath(messages []ChatMessage, leafID string) []ChatMessage {
+	if len(messages) == 0 {
+		return []ChatMessage{}
+	}
+
+	byID := make(map[string]int, len(messages))
+	children := map[string][]string{}
+	for i, msg := range messages {
+		byID[msg.ID] = i
+		children[msg.ParentID] = append(children[msg.ParentID], msg.ID)
+	}
+	if _, ok := byID[leafID]; !ok {
+		leafID = messages[len(messages)-1].ID
+	}
+
+	var path []ChatMessage
+	for id := leafID; id != "" && len(path) < len(messages); {
+		i, ok := byID[id]
+		if !ok {
+			break
+		}
+		path = append(path, messages[i])
+		id = messages[i].ParentID
+	}
+
+	// Reverse into conversation order
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	for i := range path {
+		siblings := children[path[i].ParentID]
+		path[i].Siblings = siblings
+		path[i].SiblingCount = len(siblings)
+		for n, id := range siblings {
+			if id == path[i].ID {
+				path[i].SiblingIndex = n + 1
+				break
+			}
+		}
+	}
+	return path
+}
+
+// latestLeaf follows the newest child from messageID down to a leaf.
+func latestLeaf(messages []ChatMessage, messageID string) string {
+	newest := map[string]string{}
+	for _, msg := range messages {
+		// messages are in creation order, so later children win
+		newest[msg.ParentID] = msg.ID
+	}
+	leaf := messageID
+	for steps := 0; steps < len(messages); steps++ {
+		child, ok := newest[leaf]
+		if !ok {
+			break
+		}
+		leaf = child
+	}
+	return leaf
+}
+
+// getMessage loads one message of a conversation.
+func getMessage(ctx context.Context, conversationID, messageID string) (*ChatMessage, error) {
+	msg := &ChatMessage{}
+	var createdAt string
+	err := db.QueryRowContext(ctx, `
+		SELECT id, parent_id, role, content, endpoint_id, model, context_role, context_role_version, created_at
+		FROM conversation_messages
+		WHERE id = ? AND conversation_id = ?
+	`, messageID, conversationID).Scan(&msg.ID, &msg.ParentID, &msg.Role, &msg.Content, &msg.EndpointID, &msg.Model, &msg.ContextRole, &msg.ContextRoleVersion, &createdAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "message not found"}
+		}
+		return nil, err
+	}
+	msg.Timestamp = parseStoredTime(createdAt)
+	return msg, nil
+}
+
+// addSibling stores msg as an alternative version of messageID, which must
+// have the same role, and switches the conversation to the new branch.
+// Editing a user message and regenerating an assistant reply both use it.
+func addSibling(ctx context.Context, scope conversationScope, conversationID, messageID string, msg *ChatMessage) (*ChatMessage, error) {
+	ok, err := conversationExists(ctx, scope, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conversationNotFound()
+	}
+	original, err := getMessage(ctx, conversationID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if original.Role != msg.Role {
+		return nil, badRequest("message is not a " + msg.Role + " message")
+	}
+
+	msg.ID = generateMsgID()
+	msg.ParentID = original.ParentID
+	msg.Timestamp = time.Now()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := insertMessage(ctx, tx, conversationID, msg, true); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// switchBranch makes the branch through messageID active, continuing down
+// its newest replies, and returns the conversation on that branch.
+func switchBranch(ctx context.Context, scope conversationScope, conversationID, messageID string) (*Conversation, error) {
+	ok, err := conversationExists(ctx, scope, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conversationNotFound()
+	}
+	messages, err := loadMessages(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, msg := range messages {
+		if msg.ID == messageID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "message not found"}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := setActiveLeaf(ctx, tx, conversationID, latestLeaf(messages, messageID), ""); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getConversation(ctx, scope, conversationID)
+}
+
+// LoadConversationBranch returns the messages of a conversation from the
+// first message down to leafID, or down to the active leaf when leafID is
+// empty. Used by the llm service to regenerate a reply on another branch.
+func LoadConversationBranch(ctx context.Context, tenantID, projectID, subclientID, conversationID, leafID string) ([]ChatMessage, error) {
+	if leafID == "" {
+		return LoadConversationMessages(ctx, tenantID, projectID, subclientID, conversationID)
+	}
+	scope := conversationScope{TenantID: tenantID, ProjectID: projectID, SubclientID: subclientID}
+	ok, err := conversationExists(ctx, scope, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conversationNotFound()
+	}
+	if _, err := getMessage(ctx, conversationID, leafID); err != nil {
+		return nil, err
+	}
+	messages, err := loadMessages(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	return branchPath(messages, leafID), nil
+}
+
+type EditMessageRequest struct {
+	Content string `json:"content"`
+}
+
+type RegenerateMessageRequest struct {
+	// Content is the new reply, generated by calling /llm/generate with
+	// parent_message_id set to the parent of the message being regenerated
+	Content string `json:"content"`
+}
+
+type SwitchBranchRequest struct {
+	// MessageID is the sibling to show; the branch continues down its newest replies
+	MessageID string `json:"message_id"`
+}
+
+func conversationResponse(conv *Conversation) *GetConversationResponse {
+	return &GetConversationResponse{
+		ID:          conv.ID,
+		Title:       conv.Title,
+		TitleSource: conv.TitleSource,
+		CreatedAt:   conv.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:   conv.UpdatedAt.Format(time.RFC3339),
+		Messages:    conv.Messages,
+	}
+}
+
+// EditProjectMessage adds an edited version of a user message as a new
+// branch. The earlier version and its replies stay reachable as siblings.
+//
+//encore:api auth method=POST path=/projects/:projectID/conversations/:conversationID/messages/:messageID/edit
+func EditProjectMessage(ctx context.Context, projectID, conversationID, messageID string, req *EditMessageRequest) (*ChatMessage, error) {
+	if req == nil || strings.TrimSpace(req.Content) == "" {
+		return nil, badRequest("content is required")
+	}
+	scope, err := conversationAccessScope(ctx, projectID, "")
+	if err != nil {
+		return nil, err
+	}
+	return addSibling(ctx, scope, conversationID, messageID, &ChatMessage{Role: "user", Content: strings.TrimSpace(req.Content)})
+}
+
+// RegenerateProjectMessage adds a regenerated version of an assistant reply
+// as a new branch.
+//
+//encore:api auth method=POST path=/projects/:projectID/conversations/:conversationID/messages/:messageID/regenerate
+func RegenerateProjectMessage(ctx context.Context, projectID, conversationID, messageID string, req *RegenerateMessageRequest) (*ChatMessage, error) {
+	if req == nil || strings.TrimSpace(req.Content) == "" {
+		return nil, badRequest("content is required")
+	}
+	scope, err := conversationAccessScope(ctx, projectID, "")
+	if err != nil {
+		return nil, err
+	}
+	return addSibling(ctx, scope, conversationID, messageID, &ChatMessage{Role: "assistant", Content: strings.TrimSpace(req.Content)})
+}
+
+// SwitchProjectBranch shows another version of a message and returns the
+// conversation on that branch.
+//
+//encore:api auth method=PUT path=/projects/:projectID/conversations/:conversationID/branch
+func SwitchProjectBranch(ctx context.Context, projectID, conversationID string, req *SwitchBranchRequest) (*GetConversationResponse, error) {
+	if req == nil || strings.TrimSpace(req.MessageID) == "" {
+		return nil, badRequest("message_id is required")
+	}
+	scope, err := conversationAccessScope(ctx, projectID, "")
+	if err != nil {
+		return nil, err
+	}
+	conv, err := switchBranch(ctx, scope, conversationID, strings.TrimSpace(req.MessageID))
+	if err != nil {
+		return nil, err
+	}
+	return conversationResponse(conv), nil
+}
+
+// EditSubclientMessage adds an edited version of a user message as a new branch.
+//
+//encore:api auth method=POST path=/subclients/:subclientID/conversations/:conversationID/messages/:messageID/edit
+func EditSubclientMessage(ctx context.Context, subclientID, conversationID, messageID string, req *EditMessageRequest) (*ChatMessage, error) {
+	if req == nil || strings.TrimSpace(req.Content) == "" {
+		return nil, badRequest("content is required")
+	}
+	scope, err := conversationAccessScope(ctx, "", subclientID)
+	if err != nil {
+		return nil, err
+	}
+	return addSibling(ctx, scope, conversationID, messageID, &ChatMessage{Role: "user", Content: strings.TrimSpace(req.Content)})
+}
+
+// RegenerateSubclientMessage adds a regenerated version of an assistant reply
+// as a new branch.
+//
+//encore:api auth method=POST path=/subclients/:subclientID/conversations/:conversationID/messages/:messageID/regenerate
+func RegenerateSubclientMessage(ctx context.Context, subclientID, conversationID, messageID string, req *RegenerateMessageRequest) (*ChatMessage, error) {
+	if req == nil || strings.TrimSpace(req.Content) == "" {
+		return nil, badRequest("content is required")
+	}
+	scope, err := conversationAccessScope(ctx, "", subclientID)
+	if err != nil {
+		return nil, err
+	}
+	return addSibling(ctx, scope, conversationID, messageID, &ChatMessage{Role: "assistant", Content: strings.TrimSpace(req.Content)})
+}
+
+// SwitchSubclientBranch shows another version of a message and returns the
+// conversation on that branch.
+//
+//encore:api auth method=PUT path=/subclients/:subclientID/conversations/:conversationID/branch
+func SwitchSubclientBranch(ctx context.Context, subclientID, conversationID string, req *SwitchBranchRequest) (*GetConversationResponse, error) {
+	if req == nil || strings.TrimSpace(req.MessageID) == "" {
+		return nil, badRequest("message_id is required")
+	}
+	scope, err := conversationAccessScope(ctx, "", subclientID)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := switchBranch(ctx, scope, conversationID, strings.TrimSpace(req.MessageID))
+	if err != nil {
+		return nil, err
+	}
+	return conversationResponse(conv), nil
+}
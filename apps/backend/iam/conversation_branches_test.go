@@ -0,0 +1,186 @@
+package iam
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// branchFixture is a conversation where the first reply was regenerated
+// twice (a1b, a1c) and the second question edited once (u2b), in creation
+// order.
+func branchFixture() []ChatMessage {
+	return []ChatMessage{
+		{ID: "u1", Role: "user"},
+		{ID: "a1", ParentID: "u1", Role: "assistant"},
+		{ID: "u2", ParentID: "a1", Role: "user"},
+		{ID: "a2", ParentID: "u2", Role: "assistant"},
+		{ID: "u2b", ParentID: "a1", Role: "user"},
+		{ID: "a3", ParentID: "u2b", Role: "assistant"},
+		{ID: "a1b", ParentID: "u1", Role: "assistant"},
+		{ID: "a1c", ParentID: "u1", Role: "assistant"},
+	}
+}
+
+func TestBranchPath(t *testing.T) {
+	tests := []struct {
+		leaf     string
+		wantPath string
+		// "index/count" per message on the path
+		wantSiblings string
+	}{
+		{"a2", "u1,a1,u2,a2", "1/1,1/3,1/2,1/1"},
+		{"a3", "u1,a1,u2b,a3", "1/1,1/3,2/2,1/1"},
+		{"a1b", "u1,a1b", "1/1,2/3"},
+		{"a1c", "u1,a1c", "1/1,3/3"},
+		{"u2", "u1,a1,u2", "1/1,1/3,1/2"},
+		// Unknown and empty leaves fall back to the newest message
+		{"missing", "u1,a1c", "1/1,3/3"},
+		{"", "u1,a1c", "1/1,3/3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.leaf, func(t *testing.T) {
+			path := branchPath(branchFixture(), tt.leaf)
+			var ids, siblings []string
+			for _, m := range path {
+				ids = append(ids, m.ID)
+				siblings = append(siblings, fmt.Sprintf("%d/%d", m.SiblingIndex, m.SiblingCount))
+				if len(m.Siblings) != m.SiblingCount {
+					t.Errorf("%s: siblings %v do not match count %d", m.ID, m.Siblings, m.SiblingCount)
+				}
+			}
+			if got := strings.Join(ids, ","); got != tt.wantPath {
+				t.Errorf("path = %s, want %s", got, tt.wantPath)
+			}
+			if got := strings.Join(siblings, ","); got != tt.wantSiblings {
+				t.Errorf("siblings = %s, want %s", got, tt.wantSiblings)
+			}
+		})
+	}
+
+	if path := branchPath(nil, "a1"); path == nil || len(path) != 0 {
+		t.Errorf("empty conversation path = %#v", path)
+	}
+	// The fixture must not be modified
+	if fixture := branchFixture(); fixture[1].SiblingCount != 0 {
+		t.Error("branchPath changed its input")
+	}
+}
+
+func TestBranchPathCycle(t *testing.T) {
+	messages := []ChatMessage{
+		{ID: "a", ParentID: "b", Role: "user"},
+		{ID: "b", ParentID: "a", Role: "assistant"},
+	}
+	if path := branchPath(messages, "b"); len(path) != 2 {
+		t.Errorf("cyclic parents gave a path of %d messages", len(path))
+	}
+}
+
+func TestLatestLeaf(t *testing.T) {
+	tests := []struct {
+		from string
+		want string
+	}{
+		{"u1", "a1c"},
+		{"a1", "a3"},
+		{"u2", "a2"},
+		{"a2", "a2"},
+		{"", "a1c"},
+	}
+	for _, tt := range tests {
+		if got := latestLeaf(branchFixture(), tt.from); got != tt.want {
+			t.Errorf("latestLeaf(%q) = %q, want %q", tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestAddSiblingAndSwitchBranch(t *testing.T) {
+	ctx := context.Background()
+	scope := testConversationScope()
+	conv, err := createConversation(ctx, scope, "Branches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]string{}
+	for _, m := range []struct{ key, role, content string }{
+		{"u1", "user", "Berapa dosis paracetamol?"},
+		{"a1", "assistant", "500 mg."},
+		{"u2", "user", "Untuk anak?"},
+		{"a2", "assistant", "Tergantung berat badan."},
+	} {
+		msg, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{Role: m.role, Content: m.content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[m.key] = msg.ID
+	}
+
+	if _, err := addSibling(ctx, scope, conv.ID, ids["a1"], &ChatMessage{Role: "user", Content: "edited"}); err == nil {
+		t.Error("edited an assistant message as a user message")
+	}
+
+	edited, err := addSibling(ctx, scope, conv.ID, ids["u2"], &ChatMessage{Role: "user", Content: "Untuk anak 5 tahun?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.ParentID != ids["a1"] {
+		t.Errorf("edit parent = %q, want %q", edited.ParentID, ids["a1"])
+	}
+	active, err := getConversation(ctx, scope, conv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageIDs(active.Messages); got != strings.Join([]string{ids["u1"], ids["a1"], edited.ID}, ",") {
+		t.Fatalf("active branch after edit = %s", got)
+	}
+	last := active.Messages[len(active.Messages)-1]
+	if last.SiblingCount != 2 || last.SiblingIndex != 2 {
+		t.Errorf("edited message sibling %d/%d, want 2/2", last.SiblingIndex, last.SiblingCount)
+	}
+	list, err := listConversations(ctx, scope)
+	if err != nil || len(list) != 1 || list[0].MessageCount != 3 || list[0].LastMessage != "Untuk anak 5 tahun?" {
+		t.Errorf("list after edit = %+v, err = %v", list, err)
+	}
+
+	// A reply to the edit continues the new branch
+	reply, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{Role: "assistant", Content: "10-15 mg/kg."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.ParentID != edited.ID {
+		t.Errorf("reply parent = %q, want %q", reply.ParentID, edited.ID)
+	}
+
+	// Switching to the original question follows it down to its reply
+	switched, err := switchBranch(ctx, scope, conv.ID, ids["u2"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageIDs(switched.Messages); got != strings.Join([]string{ids["u1"], ids["a1"], ids["u2"], ids["a2"]}, ",") {
+		t.Errorf("switched branch = %s", got)
+	}
+	if _, err := switchBranch(ctx, scope, conv.ID, "msg_missing"); err == nil {
+		t.Error("switched to a missing message")
+	}
+
+	branch, err := LoadConversationBranch(ctx, scope.TenantID, scope.ProjectID, "", conv.ID, reply.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageIDs(branch); got != strings.Join([]string{ids["u1"], ids["a1"], edited.ID, reply.ID}, ",") {
+		t.Errorf("LoadConversationBranch = %s", got)
+	}
+	if _, err := LoadConversationBranch(ctx, newID("tnt"), scope.ProjectID, "", conv.ID, reply.ID); err == nil {
+		t.Error("loaded a branch of another tenant's conversation")
+	}
+}
+
+func messageIDs(messages []ChatMessage) string {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return strings.Join(ids, ",")
+}
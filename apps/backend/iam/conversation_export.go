@@ -0,0 +1,617 @@
+package iam
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+// Conversation export formats. JSON Lines is the interchange format: the
+// import endpoint reads it back, one conversation header line followed by
+// its message lines.
+const (
+	exportFormatMarkdown = "md"
+	exportFormatJSONL    = "jsonl"
+	exportFormatHTML     = "html"
+)
+
+// Import limits. maxImportBytes also caps the total uncompressed size of a
+// zip, and maxImportEntries its number of entries.
+const (
+	maxImportBytes   = 50 << 20
+	maxImportEntries = 1000
+)
+
+// ConversationExportLine is one line of a JSON Lines export. Type is
+// "conversation" for the header line and "message" for each message.
+type ConversationExportLine struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	Title     string    `json:"title,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Content   string    `json:"content,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+func normalizeExportFormat(format string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "md", "markdown":
+		return exportFormatMarkdown, nil
+	case "jsonl", "ndjson", "json":
+		return exportFormatJSONL, nil
+	case "html", "htm":
+		return exportFormatHTML, nil
+	}
+	return "", badRequest("format must be md, jsonl or html")
+}
+
+func exportContentType(format string) string {
+	switch format {
+	case exportFormatJSONL:
+		return "application/x-ndjson; charset=utf-8"
+	case exportFormatHTML:
+		return "text/html; charset=utf-8"
+	}
+	return "text/markdown; charset=utf-8"
+}
+
+// writeConversation renders a conversation in the given format.
+func writeConversation(w io.Writer, conv *Conversation, format string) error {
+	switch format {
+	case exportFormatJSONL:
+		return writeConversationJSONL(w, conv)
+	case exportFormatHTML:
+		return conversationHTML.Execute(w, conv)
+	}
+	return writeConversationMarkdown(w, conv)
+}
+
+func writeConversationJSONL(w io.Writer, conv *Conversation) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(ConversationExportLine{
+		Type:      "conversation",
+		ID:        conv.ID,
+		Title:     conv.Title,
+		CreatedAt: conv.CreatedAt,
+		UpdatedAt: conv.UpdatedAt,
+	}); err != nil {
+		return err
+	}
+	for _, msg := range conv.Messages {
+		if err := enc.Encode(ConversationExportLine{
+			Type:      "message",
+			ID:        msg.ID,
+			Role:      msg.Role,
+			Content:   msg.Content,
+			CreatedAt: msg.Timestamp,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func messageRoleLabel(role string) string {
+	switch role {
+	case "user":
+		return "User"
+	case "assistant":
+		return "Assistant"
+	case "system":
+		return "System"
+	}
+	return role
+}
+
+func writeConversationMarkdown(w io.Writer, conv *Conversation) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %s\n\n", firstNonEmptyString(conv.Title, conv.ID))
+	fmt.Fprintf(bw, "- Conversation: `%s`\n- Created: %s\n- Updated: %s\n- Messages: %d\n",
+		conv.ID, conv.CreatedAt.Format(time.RFC3339), conv.UpdatedAt.Format(time.RFC3339), len(conv.Messages))
+	for _, msg := range conv.Messages {
+		fmt.Fprintf(bw, "\n---\n\n**%s** · %s\n\n%s\n", messageRoleLabel(msg.Role), msg.Timestamp.Format(time.RFC3339), msg.Content)
+	}
+	return bw.Flush()
+}
+
+var conversationHTML = template.Must(template.New("conversation").Funcs(template.FuncMap{
+	"role": messageRoleLabel,
+	"time": func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; color: #1f2937; }
+header { border-bottom: 1px solid #e5e7eb; margin-bottom: 1.5rem; }
+.meta { color: #6b7280; font-size: 0.875rem; }
+.message { margin: 1rem 0; padding: 0.75rem 1rem; border-radius: 0.5rem; background: #f3f4f6; }
+.message.user { background: #e0f2fe; }
+.message .content { white-space: pre-wrap; margin-top: 0.25rem; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<p class="meta">Created {{time .CreatedAt}} · Updated {{time .UpdatedAt}} · {{len .Messages}} messages</p>
+</header>
+{{range .Messages}}<div class="message {{.Role}}">
+<div class="meta"><strong>{{role .Role}}</strong> · {{time .Timestamp}}</div>
+<div class="content">{{.Content}}</div>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// conversationAccessScope resolves the conversation scope of a project
+// (subclientID empty) or subclient for the caller. Tenant sessions can reach
+// every subclient of their projects; subclient sessions only their own.
+func conversationAccessScope(ctx context.Context, projectID, subclientID string) (conversationScope, error) {
+	data, ok := auth.Data().(*AuthData)
+	if !ok || data == nil {
+		return conversationScope{}, &errs.Error{Code: errs.Unauthenticated, Message: "authentication required"}
+	}
+
+	if subclientID == "" {
+		if data.ScopeType != scopeTenant {
+			return conversationScope{}, &errs.Error{Code: errs.PermissionDenied, Message: "tenant session required"}
+		}
+		ok, _, _, err := projectOwnedByTenant(ctx, projectID, data.TenantID)
+		if err != nil {
+			return conversationScope{}, err
+		}
+		if !ok {
+			return conversationScope{}, &errs.Error{Code: errs.PermissionDenied, Message: "project not found"}
+		}
+		return conversationScope{TenantID: data.TenantID, ProjectID: projectID}, nil
+	}
+
+	subClient, err := q().GetSubclientFullByID(ctx, subclientID)
+	if err != nil {
+		return conversationScope{}, &errs.Error{Code: errs.NotFound, Message: "subclient not found"}
+	}
+	switch {
+	case data.ScopeType == scopeSubclient && data.ScopeID == subclientID:
+	case data.ScopeType == scopeTenant && data.TenantID == subClient.TenantID:
+	default:
+		return conversationScope{}, &errs.Error{Code: errs.PermissionDenied, Message: "subclient not accessible"}
+	}
+	if projectID != "" && projectID != subClient.ProjectID {
+		return conversationScope{}, &errs.Error{Code: errs.NotFound, Message: "subclient not found"}
+	}
+	return conversationScope{TenantID: subClient.TenantID, ProjectID: subClient.ProjectID, SubclientID: subclientID}, nil
+}
+
+func exportFilename(name, ext string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '"' || r == '/' || r == '\\' || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, name)
+	return name + "." + ext
+}
+
+// exportOne writes a single conversation as a download.
+func exportOne(w http.ResponseWriter, r *http.Request, projectID, subclientID, conversationID string) {
+	format, err := normalizeExportFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	ctx := r.Context()
+	scope, err := conversationAccessScope(ctx, projectID, subclientID)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	conv, err := getConversation(ctx, scope, conversationID)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeConversation(&buf, conv, format); err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", exportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(conv.ID, format)))
+	w.Write(buf.Bytes())
+}
+
+// exportZip writes every conversation of the scope as a zip, one file per
+// conversation. A project export also includes its subclients' conversations
+// under subs/{subclient-id}/.
+func exportZip(w http.ResponseWriter, r *http.Request, projectID, subclientID string) {
+	format, err := normalizeExportFormat(firstNonEmptyString(r.URL.Query().Get("format"), exportFormatJSONL))
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	ctx := r.Context()
+	scope, err := conversationAccessScope(ctx, projectID, subclientID)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	scopes := []conversationScope{scope}
+	if subclientID == "" {
+		subs, err := conversationSubclients(ctx, scope.TenantID, scope.ProjectID)
+		if err != nil {
+			errs.HTTPError(w, err)
+			return
+		}
+		for _, sub := range subs {
+			scopes = append(scopes, conversationScope{TenantID: scope.TenantID, ProjectID: scope.ProjectID, SubclientID: sub})
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, sc := range scopes {
+		dir := ""
+		if sc.SubclientID != "" {
+			dir = path.Join("subs", sc.SubclientID)
+		}
+		summaries, err := listConversations(ctx, sc)
+		if err != nil {
+			errs.HTTPError(w, err)
+			return
+		}
+		for _, summary := range summaries {
+			conv, err := getConversation(ctx, sc, summary.ID)
+			if err != nil {
+				errs.HTTPError(w, err)
+				return
+			}
+			f, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     path.Join(dir, exportFilename(conv.ID, format)),
+				Method:   zip.Deflate,
+				Modified: conv.UpdatedAt,
+			})
+			if err != nil {
+				errs.HTTPError(w, err)
+				return
+			}
+			if err := writeConversation(f, conv, format); err != nil {
+				errs.HTTPError(w, err)
+				return
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	name := firstNonEmptyString(subclientID, projectID) + "-conversations"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(name, "zip")))
+	w.Write(buf.Bytes())
+}
+
+// conversationSubclients lists the subclients of a project that have conversations.
+func conversationSubclients(ctx context.Context, tenantID, projectID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT subclient_id FROM conversations
+		WHERE tenant_id = ? AND project_id = ? AND subclient_id != ''
+		ORDER BY subclient_id
+	`, tenantID, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		subs = append(subs, id)
+	}
+	return subs, rows.Err()
+}
+
+// pathSegments splits a request path into its non-empty segments.
+func pathSegments(r *http.Request) []string {
+	var parts []string
+	for _, p := range strings.Split(r.URL.Path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// ExportProjectConversation downloads one project conversation as md, jsonl or html.
+//
+//encore:api auth raw method=GET path=/projects/:projectID/conversations/:conversationID/export
+func ExportProjectConversation(w http.ResponseWriter, r *http.Request) {
+	// /projects/:projectID/conversations/:conversationID/export
+	parts := pathSegments(r)
+	if len(parts) < 5 {
+		errs.HTTPError(w, badRequest("invalid path"))
+		return
+	}
+	exportOne(w, r, parts[1], "", parts[3])
+}
+
+// ExportProjectConversations downloads all conversations of a project,
+// including its subclients, as a zip.
+//
+//encore:api auth raw method=GET path=/projects/:projectID/conversations/export
+func ExportProjectConversations(w http.ResponseWriter, r *http.Request) {
+	// /projects/:projectID/conversations/export
+	parts := pathSegments(r)
+	if len(parts) < 4 {
+		errs.HTTPError(w, badRequest("invalid path"))
+		return
+	}
+	exportZip(w, r, parts[1], "")
+}
+
+// ExportSubclientConversation downloads one subclient conversation as md, jsonl or html.
+//
+//encore:api auth raw method=GET path=/subclients/:subclientID/conversations/:conversationID/export
+func ExportSubclientConversation(w http.ResponseWriter, r *http.Request) {
+	// /subclients/:subclientID/conversations/:conversationID/export
+	parts := pathSegments(r)
+	if len(parts) < 5 {
+		errs.HTTPError(w, badRequest("invalid path"))
+		return
+	}
+	exportOne(w, r, "", parts[1], parts[3])
+}
+
+// ExportSubclientConversations downloads all conversations of a subclient as a zip.
+//
+//encore:api auth raw method=GET path=/subclients/:subclientID/conversations/export
+func ExportSubclientConversations(w http.ResponseWriter, r *http.Request) {
+	// /subclients/:subclientID/conversations/export
+	parts := pathSegments(r)
+	if len(parts) < 4 {
+		errs.HTTPError(w, badRequest("invalid path"))
+		return
+	}
+	exportZip(w, r, "", parts[1])
+}
+
+// ImportedConversation reports one conversation created by an import.
+type ImportedConversation struct {
+	ID           string `json:"id"`
+	SourceID     string `json:"source_id"`
+	Title        string `json:"title"`
+	MessageCount int    `json:"message_count"`
+}
+
+// ImportConversationsResponse lists the conversations created by an import.
+type ImportConversationsResponse struct {
+	Imported      int                    `json:"imported"`
+	Conversations []ImportedConversation `json:"conversations"`
+}
+
+// ImportProjectConversations imports conversations into a project, or into
+// one of its subclients with ?subclient_id=. The body is a JSON Lines export
+// (one or more conversations), a zip of JSON Lines files as produced by the
+// bulk export, or a legacy chats/*.json conversation file. Imported
+// conversations and messages get new IDs so data from another tenant or
+// install cannot collide with existing rows.
+//
+//encore:api auth raw method=POST path=/projects/:projectID/conversations/import
+func ImportProjectConversations(w http.ResponseWriter, r *http.Request) {
+	// /projects/:projectID/conversations/import
+	parts := pathSegments(r)
+	if len(parts) < 4 {
+		errs.HTTPError(w, badRequest("invalid path"))
+		return
+	}
+	ctx := r.Context()
+	scope, err := conversationAccessScope(ctx, parts[1], strings.TrimSpace(r.URL.Query().Get("subclient_id")))
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		errs.HTTPError(w, badRequest("import body too large or unreadable"))
+		return
+	}
+
+	var convs []*Conversation
+	if strings.Contains(r.Header.Get("Content-Type"), "zip") || bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+		convs, err = parseConversationZip(body)
+	} else {
+		convs, err = parseConversationJSON(body)
+	}
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	if len(convs) == 0 {
+		errs.HTTPError(w, badRequest("no conversations found in import"))
+		return
+	}
+
+	resp := &ImportConversationsResponse{Conversations: make([]ImportedConversation, 0, len(convs))}
+	for _, conv := range convs {
+		sourceID := conv.ID
+		if err := importConversation(ctx, scope, conv); err != nil {
+			errs.HTTPError(w, err)
+			return
+		}
+		resp.Conversations = append(resp.Conversations, ImportedConversation{
+			ID:           conv.ID,
+			SourceID:     sourceID,
+			Title:        conv.Title,
+			MessageCount: len(conv.Messages),
+		})
+	}
+	resp.Imported = len(resp.Conversations)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseConversationZip reads every .jsonl or .json file of a zip.
+func parseConversationZip(body []byte) ([]*Conversation, error) {
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, badRequest("invalid zip file")
+	}
+	if len(zr.File) > maxImportEntries {
+		return nil, badRequest(fmt.Sprintf("zip has more than %d entries", maxImportEntries))
+	}
+	var convs []*Conversation
+	remaining := int64(maxImportBytes)
+	for _, f := range zr.File {
+		ext := strings.ToLower(path.Ext(f.Name))
+		if f.FileInfo().IsDir() || (ext != ".jsonl" && ext != ".json") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, badRequest("invalid zip entry " + f.Name)
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, remaining+1))
+		rc.Close()
+		if err != nil {
+			return nil, badRequest("invalid zip entry " + f.Name)
+		}
+		if int64(len(data)) > remaining {
+			return nil, badRequest(fmt.Sprintf("zip contents exceed %d MB", maxImportBytes>>20))
+		}
+		remaining -= int64(len(data))
+		parsed, err := parseConversationJSON(data)
+		if err != nil {
+			return nil, badRequest(fmt.Sprintf("%s: %v", f.Name, errs.Convert(err).(*errs.Error).Message))
+		}
+		convs = append(convs, parsed...)
+	}
+	return convs, nil
+}
+
+// parseConversationJSON reads JSON Lines exports, or a legacy conversation
+// JSON document.
+func parseConversationJSON(body []byte) ([]*Conversation, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+
+	// A legacy chats/*.json file is one indented JSON object with messages
+	var legacy struct {
+		Conversation
+		Type string `json:"type"`
+	}
+	if !bytes.Contains(trimmed, []byte("\n{")) && json.Unmarshal(trimmed, &legacy) == nil && legacy.Type == "" {
+		conv := legacy.Conversation
+		for i := range conv.Messages {
+			conv.Messages[i].Role = strings.TrimSpace(conv.Messages[i].Role)
+			if !importableRole(conv.Messages[i].Role) {
+				return nil, badRequest(fmt.Sprintf("message %d: role must be user, assistant or system", i+1))
+			}
+		}
+		return []*Conversation{&conv}, nil
+	}
+
+	var convs []*Conversation
+	var current *Conversation
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportBytes)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec ConversationExportLine
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, badRequest(fmt.Sprintf("line %d: invalid JSON", lineNo))
+		}
+		switch rec.Type {
+		case "conversation":
+			current = &Conversation{ID: rec.ID, Title: rec.Title, CreatedAt: rec.CreatedAt, UpdatedAt: rec.UpdatedAt}
+			convs = append(convs, current)
+		case "message":
+			if current == nil {
+				return nil, badRequest(fmt.Sprintf("line %d: message before conversation header", lineNo))
+			}
+			rec.Role = strings.TrimSpace(rec.Role)
+			if !importableRole(rec.Role) {
+				return nil, badRequest(fmt.Sprintf("line %d: message role must be user, assistant or system", lineNo))
+			}
+			current.Messages = append(current.Messages, ChatMessage{ID: rec.ID, Role: rec.Role, Content: rec.Content, Timestamp: rec.CreatedAt})
+		default:
+			return nil, badRequest(fmt.Sprintf("line %d: unknown type %q", lineNo, rec.Type))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, badRequest("invalid JSON Lines input")
+	}
+	return convs, nil
+}
+
+// importableRole reports whether an imported message may have role.
+func importableRole(role string) bool {
+	switch role {
+	case "user", "assistant", "system":
+		return true
+	}
+	return false
+}
+
+// importConversation stores conv under a new ID with new message IDs,
+// keeping titles and timestamps. conv.ID is updated to the new ID.
+func importConversation(ctx context.Context, scope conversationScope, conv *Conversation) error {
+	now := time.Now()
+	if conv.CreatedAt.IsZero() {
+		conv.CreatedAt = now
+	}
+	if conv.UpdatedAt.IsZero() {
+		conv.UpdatedAt = conv.CreatedAt
+	}
+	conv.ID = generateConvID()
+	conv.Title = firstNonEmptyString(strings.TrimSpace(conv.Title), "Imported conversation")
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO conversations (id, tenant_id, project_id, subclient_id, title, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, conv.ID, scope.TenantID, scope.ProjectID, scope.SubclientID, conv.Title, formatStoredTime(conv.CreatedAt), formatStoredTime(conv.UpdatedAt)); err != nil {
+		return err
+	}
+	for i := range conv.Messages {
+		msg := &conv.Messages[i]
+		msg.ID = generateMsgID()
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = conv.UpdatedAt
+		}
+		if err := insertMessage(ctx, tx, conv.ID, msg, false); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,295 @@
+package iam
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+func TestConversationJSONLRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	scope := testConversationScope()
+	conv, err := createConversation(ctx, scope, "Dosis anak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []struct{ role, content string }{
+		{"system", "Jawab singkat."},
+		{"user", "Berapa dosis paracetamol?\nAnak saya 5 tahun."},
+		{"assistant", `Untuk anak 5 tahun: "10-15 mg/kg" setiap 4-6 jam.`},
+	} {
+		if _, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{Role: m.role, Content: m.content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	original, err := getConversation(ctx, scope, conv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeConversationJSONL(&buf, original); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 4 {
+		t.Fatalf("export has %d lines, want a header and 3 messages:\n%s", lines, buf.String())
+	}
+
+	parsed, err := parseConversationJSON(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 {
+		t.Fatalf("parsed %d conversations", len(parsed))
+	}
+	target := testConversationScope()
+	if err := importConversation(ctx, target, parsed[0]); err != nil {
+		t.Fatal(err)
+	}
+	if parsed[0].ID == original.ID {
+		t.Error("import kept the original conversation ID")
+	}
+
+	imported, err := getConversation(ctx, target, parsed[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Title != original.Title || !imported.CreatedAt.Equal(original.CreatedAt) || !imported.UpdatedAt.Equal(original.UpdatedAt) {
+		t.Errorf("imported = %q %v %v, want %q %v %v", imported.Title, imported.CreatedAt, imported.UpdatedAt,
+			original.Title, original.CreatedAt, original.UpdatedAt)
+	}
+	if len(imported.Messages) != len(original.Messages) {
+		t.Fatalf("imported %d messages, want %d", len(imported.Messages), len(original.Messages))
+	}
+	for i, got := range imported.Messages {
+		want := original.Messages[i]
+		if got.ID == want.ID {
+			t.Errorf("message %d kept its ID", i)
+		}
+		if got.Role != want.Role || got.Content != want.Content || !got.Timestamp.Equal(want.Timestamp) {
+			t.Errorf("message %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestParseConversationJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantConvs int
+		wantMsgs  []int
+		wantErr   string
+	}{
+		{"empty", "  \n", 0, nil, ""},
+		{
+			name:      "legacy document",
+			body:      "{\n  \"id\": \"c1\",\n  \"title\": \"Old\",\n  \"messages\": [\n    {\"role\": \"user\", \"content\": \"Hi\"}\n  ]\n}",
+			wantConvs: 1,
+			wantMsgs:  []int{1},
+		},
+		{
+			name: "two conversations",
+			body: `{"type":"conversation","id":"c1","title":"One","created_at":"2025-01-01T00:00:00Z"}
+{"type":"message","id":"m1","role":"user","content":"Hi","created_at":"2025-01-01T00:00:00Z"}
+
+{"type":"conversation","id":"c2","title":"Two","created_at":"2025-01-02T00:00:00Z"}
+{"type":"message","id":"m2","role":"user","content":"Hello","created_at":"2025-01-02T00:00:00Z"}
+{"type":"message","id":"m3","role":"assistant","content":"Hi!","created_at":"2025-01-02T00:00:01Z"}`,
+			wantConvs: 2,
+			wantMsgs:  []int{1, 2},
+		},
+		{
+			name:    "message before header",
+			body:    `{"type":"message","role":"user","content":"Hi","created_at":"2025-01-01T00:00:00Z"}`,
+			wantErr: "line 1: message before conversation header",
+		},
+		{
+			name: "missing role",
+			body: `{"type":"conversation","id":"c1","created_at":"2025-01-01T00:00:00Z"}
+{"type":"message","content":"Hi","created_at":"2025-01-01T00:00:00Z"}`,
+			wantErr: "line 2: message role must be user, assistant or system",
+		},
+		{
+			name: "unknown role",
+			body: `{"type":"conversation","id":"c1","created_at":"2025-01-01T00:00:00Z"}
+{"type":"message","role":"tool","content":"{}","created_at":"2025-01-01T00:00:00Z"}`,
+			wantErr: "line 2: message role must be user, assistant or system",
+		},
+		{
+			name:    "legacy document with an unknown role",
+			body:    `{"id":"c1","title":"Old","messages":[{"role":"user","content":"Hi"},{"role":"admin","content":"Grant"}]}`,
+			wantErr: "message 2: role must be user, assistant or system",
+		},
+		{
+			name: "unknown type",
+			body: `{"type":"conversation","id":"c1","created_at":"2025-01-01T00:00:00Z"}
+{"type":"attachment","created_at":"2025-01-01T00:00:00Z"}`,
+			wantErr: `line 2: unknown type "attachment"`,
+		},
+		{
+			name: "invalid line",
+			body: `{"type":"conversation","id":"c1","created_at":"2025-01-01T00:00:00Z"}
+not json`,
+			wantErr: "line 2: invalid JSON",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			convs, err := parseConversationJSON([]byte(tt.body))
+			if tt.wantErr != "" {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != errs.InvalidArgument || e.Message != tt.wantErr {
+					t.Fatalf("err = %#v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(convs) != tt.wantConvs {
+				t.Fatalf("parsed %d conversations, want %d", len(convs), tt.wantConvs)
+			}
+			for i, n := range tt.wantMsgs {
+				if len(convs[i].Messages) != n {
+					t.Errorf("conversation %d has %d messages, want %d", i, len(convs[i].Messages), n)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConversationZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := map[string]string{
+		"export/one.jsonl": `{"type":"conversation","id":"c1","title":"One","created_at":"2025-01-01T00:00:00Z"}
+{"type":"message","role":"user","content":"Hi","created_at":"2025-01-01T00:00:00Z"}`,
+		"export/two.JSON":   `{"id":"c2","title":"Two","messages":[{"role":"user","content":"Halo"}]}`,
+		"export/readme.txt": "not a conversation",
+	}
+	for name, body := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	convs, err := parseConversationZip(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := map[string]bool{}
+	for _, c := range convs {
+		titles[c.Title] = true
+	}
+	if len(convs) != 2 || !titles["One"] || !titles["Two"] {
+		t.Errorf("parsed %+v", convs)
+	}
+
+	if _, err := parseConversationZip([]byte("not a zip")); err == nil {
+		t.Error("invalid zip was accepted")
+	}
+}
+
+func TestWriteConversationFormats(t *testing.T) {
+	ts := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	conv := &Conversation{
+		ID:        "conv_1",
+		Title:     "Opening <hours>",
+		CreatedAt: ts,
+		UpdatedAt: ts,
+		Messages: []ChatMessage{
+			{ID: "m1", Role: "user", Content: "When do you open?", Timestamp: ts},
+			{ID: "m2", Role: "assistant", Content: "<script>alert(1)</script> At 8am.", Timestamp: ts},
+		},
+	}
+
+	var md bytes.Buffer
+	if err := writeConversation(&md, conv, exportFormatMarkdown); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Opening <hours>", "- Messages: 2", "**User** · 2025-01-02T03:04:05Z", "**Assistant**"} {
+		if !strings.Contains(md.String(), want) {
+			t.Errorf("markdown missing %q:\n%s", want, md.String())
+		}
+	}
+
+	var page bytes.Buffer
+	if err := writeConversation(&page, conv, exportFormatHTML); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(page.String(), "<script>") || !strings.Contains(page.String(), "&lt;script&gt;") {
+		t.Errorf("html export does not escape message content:\n%s", page.String())
+	}
+	if !strings.Contains(page.String(), "<title>Opening &lt;hours&gt;</title>") {
+		t.Errorf("html export title:\n%s", page.String())
+	}
+}
+
+func TestNormalizeExportFormat(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", exportFormatMarkdown, false},
+		{"Markdown", exportFormatMarkdown, false},
+		{"ndjson", exportFormatJSONL, false},
+		{" json ", exportFormatJSONL, false},
+		{"HTM", exportFormatHTML, false},
+		{"pdf", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeExportFormat(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("normalizeExportFormat(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestParseConversationZipLimits(t *testing.T) {
+	zipOf := func(files map[string][]byte) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, body := range files {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(body)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	wantErr := func(body []byte, want string) {
+		t.Helper()
+		_, err := parseConversationZip(body)
+		var e *errs.Error
+		if !errors.As(err, &e) || e.Code != errs.InvalidArgument || e.Message != want {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+
+	many := map[string][]byte{}
+	for i := 0; i <= maxImportEntries; i++ {
+		many[fmt.Sprintf("skip/%d.txt", i)] = nil
+	}
+	wantErr(zipOf(many), fmt.Sprintf("zip has more than %d entries", maxImportEntries))
+
+	// Each file fits on its own; together they exceed the limit
+	half := bytes.Repeat([]byte(" "), maxImportBytes/2+1)
+	wantErr(zipOf(map[string][]byte{"a.jsonl": half, "b.jsonl": half}), fmt.Sprintf("zip contents exceed %d MB", maxImportBytes>>20))
+}
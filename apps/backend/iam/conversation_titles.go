@@ -0,0 +1,121 @@
+package iam
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Where a conversation title came from. The llm service generates a title
+// from the first exchange for default and client titles; a rename always
+// wins and is never overwritten.
+const (
+	titleSourceDefault   = "default"
+	titleSourceClient    = "client"
+	titleSourceGenerated = "generated"
+	titleSourceUser      = "user"
+
+	defaultConversationTitle = "New conversation"
+	// MaxConversationTitleLength caps titles in characters.
+	MaxConversationTitleLength = 80
+)
+
+// clampTitle trims a title and cuts it to MaxConversationTitleLength characters.
+func clampTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	if utf8.RuneCountInString(title) <= MaxConversationTitleLength {
+		return title
+	}
+	return strings.TrimSpace(string([]rune(title)[:MaxConversationTitleLength]))
+}
+
+// ConversationNeedsTitle reports whether the conversation still has a
+// placeholder or client-supplied title that may be replaced by a generated one.
+func ConversationNeedsTitle(ctx context.Context, tenantID, projectID, subclientID, conversationID string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM conversations
+		WHERE id = ? AND tenant_id = ? AND project_id = ? AND subclient_id = ? AND title_source IN (?, ?)
+	`, conversationID, tenantID, projectID, subclientID, titleSourceDefault, titleSourceClient).Scan(&n)
+	return n > 0, err
+}
+
+// SetGeneratedConversationTitle stores a generated title unless the
+// conversation has been renamed or titled in the meantime. It reports
+// whether the title was stored.
+func SetGeneratedConversationTitle(ctx context.Context, tenantID, projectID, subclientID, conversationID, title string) (bool, error) {
+	title = clampTitle(title)
+	if title == "" {
+		return false, nil
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE conversations SET title = ?, title_source = ?
+		WHERE id = ? AND tenant_id = ? AND project_id = ? AND subclient_id = ? AND title_source IN (?, ?)
+	`, title, titleSourceGenerated, conversationID, tenantID, projectID, subclientID, titleSourceDefault, titleSourceClient)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// renameConversation sets a user-chosen title, which stops title generation.
+func renameConversation(ctx context.Context, scope conversationScope, conversationID, title string) (*Conversation, error) {
+	title = clampTitle(title)
+	if title == "" {
+		return nil, badRequest("title is required")
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE conversations SET title = ?, title_source = ?, updated_at = MAX(updated_at, ?)
+		WHERE id = ? AND tenant_id = ? AND project_id = ? AND subclient_id = ?
+	`, title, titleSourceUser, formatStoredTime(time.Now()), conversationID, scope.TenantID, scope.ProjectID, scope.SubclientID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, conversationNotFound()
+	}
+	return getConversation(ctx, scope, conversationID)
+}
+
+type RenameConversationRequest struct {
+	Title string `json:"title"`
+}
+
+// RenameProjectConversation renames a project conversation. Renamed
+// conversations keep their title; no title is generated for them.
+//
+//encore:api auth method=PUT path=/projects/:projectID/conversations/:conversationID
+func RenameProjectConversation(ctx context.Context, projectID, conversationID string, req *RenameConversationRequest) (*GetConversationResponse, error) {
+	if req == nil || strings.TrimSpace(req.Title) == "" {
+		return nil, badRequest("title is required")
+	}
+	scope, err := conversationAccessScope(ctx, projectID, "")
+	if err != nil {
+		return nil, err
+	}
+	conv, err := renameConversation(ctx, scope, conversationID, req.Title)
+	if err != nil {
+		return nil, err
+	}
+	return conversationResponse(conv), nil
+}
+
+// RenameSubclientConversation renames a subclient conversation.
+//
+//encore:api auth method=PUT path=/subclients/:subclientID/conversations/:conversationID
+func RenameSubclientConversation(ctx context.Context, subclientID, conversationID string, req *RenameConversationRequest) (*GetConversationResponse, error) {
+	if req == nil || strings.TrimSpace(req.Title) == "" {
+		return nil, badRequest("title is required")
+	}
+	scope, err := conversationAccessScope(ctx, "", subclientID)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := renameConversation(ctx, scope, conversationID, req.Title)
+	if err != nil {
+		return nil, err
+	}
+	return conversationResponse(conv), nil
+}
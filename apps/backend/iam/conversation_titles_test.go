@@ -0,0 +1,95 @@
+package iam
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestClampTitle(t *testing.T) {
+	long := strings.Repeat("obat ", 30)
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"  Dosis   paracetamol\n anak ", "Dosis paracetamol anak"},
+		{"", ""},
+		{long, strings.TrimSpace(long[:MaxConversationTitleLength])},
+		{strings.Repeat("é", 100), strings.Repeat("é", MaxConversationTitleLength)},
+	}
+	for _, tt := range tests {
+		if got := clampTitle(tt.in); got != tt.want {
+			t.Errorf("clampTitle(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGeneratedTitles(t *testing.T) {
+	ctx := context.Background()
+	scope := testConversationScope()
+	set := func(conversationID, title string) bool {
+		t.Helper()
+		stored, err := SetGeneratedConversationTitle(ctx, scope.TenantID, scope.ProjectID, scope.SubclientID, conversationID, title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	needs := func(conversationID string) bool {
+		t.Helper()
+		needed, err := ConversationNeedsTitle(ctx, scope.TenantID, scope.ProjectID, scope.SubclientID, conversationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return needed
+	}
+
+	untitled, err := createConversation(ctx, scope, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if untitled.Title != defaultConversationTitle || !needs(untitled.ID) {
+		t.Fatalf("new conversation %+v does not need a title", untitled)
+	}
+	if set(untitled.ID, "  ") {
+		t.Error("stored an empty generated title")
+	}
+	if !set(untitled.ID, "Dosis Paracetamol") {
+		t.Fatal("generated title was not stored")
+	}
+	if needs(untitled.ID) || set(untitled.ID, "Another title") {
+		t.Error("a generated title was replaced")
+	}
+
+	// Another tenant cannot title the conversation
+	if stored, _ := SetGeneratedConversationTitle(ctx, newID("tnt"), scope.ProjectID, "", untitled.ID, "Hijacked"); stored {
+		t.Error("titled another tenant's conversation")
+	}
+
+	// A rename wins over title generation
+	client, err := createConversation(ctx, scope, "Chat 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !needs(client.ID) {
+		t.Error("client titled conversation does not need a generated title")
+	}
+	renamed, err := renameConversation(ctx, scope, client.ID, "  My   chat ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Title != "My chat" || renamed.TitleSource != titleSourceUser {
+		t.Errorf("renamed = %q (%s)", renamed.Title, renamed.TitleSource)
+	}
+	if needs(client.ID) || set(client.ID, "Generated") {
+		t.Error("generated title replaced a rename")
+	}
+	if _, err := renameConversation(ctx, scope, client.ID, " "); err == nil {
+		t.Error("renamed to an empty title")
+	}
+	other := scope
+	other.ProjectID = newID("prj")
+	if _, err := renameConversation(ctx, other, client.ID, "Nope"); err == nil {
+		t.Error("renamed another project's conversation")
+	}
+}
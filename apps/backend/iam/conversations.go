@@ -0,0 +1,488 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+// Conversations and their messages are stored in SQLite. Each message gets
+// the next seq number of its conversation inside the insert statement, so
+// concurrent AddMessage calls cannot overwrite each other the way the old
+// read-modify-write of chats/*.json could. conversation_messages_fts mirrors
+// message content for search and is written in the same transaction.
+//
+// Messages form a tree through parent_id: editing or regenerating a message
+// adds a sibling instead of rewriting history, and conversations.active_leaf_id
+// selects the branch that is shown and sent to the model.
+
+// conversationScope identifies who owns a conversation. SubclientID is empty
+// for project conversations.
+type conversationScope struct {
+	TenantID    string
+	ProjectID   string
+	SubclientID string
+}
+
+// ConversationSummary is a conversation without its messages.
+type ConversationSummary struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	TitleSource  string `json:"title_source"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+	MessageCount int    `json:"message_count"`
+	LastMessage  string `json:"last_message,omitempty"`
+}
+
+// storedTimeLayout is fixed width so stored timestamps sort as text.
+const storedTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+func formatStoredTime(t time.Time) string {
+	return t.UTC().Format(storedTimeLayout)
+}
+
+func parseStoredTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func conversationNotFound() error {
+	return &errs.Error{Code: errs.NotFound, Message: "conversation not found"}
+}
+
+// lastMessagePreview truncates a message for conversation lists.
+func lastMessagePreview(content string) string {
+	if len(content) > 100 {
+		return content[:100] + "..."
+	}
+	return content
+}
+
+// createConversation starts a conversation. An empty title gets a
+// placeholder; either way the title is replaced by a generated one after the
+// first reply unless the conversation is renamed first.
+func createConversation(ctx context.Context, scope conversationScope, title string) (*Conversation, error) {
+	now := time.Now()
+	conv := &Conversation{
+		ID:          generateConvID(),
+		Title:       title,
+		TitleSource: titleSourceClient,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Messages:    []ChatMessage{},
+	}
+	if conv.Title == "" {
+		conv.Title, conv.TitleSource = defaultConversationTitle, titleSourceDefault
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO conversations (id, tenant_id, project_id, subclient_id, title, title_source, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, conv.ID, scope.TenantID, scope.ProjectID, scope.SubclientID, conv.Title, conv.TitleSource, formatStoredTime(now), formatStoredTime(now))
+	if err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// conversationExists reports whether the conversation belongs to the scope.
+func conversationExists(ctx context.Context, scope conversationScope, conversationID string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM conversations
+		WHERE id = ? AND tenant_id = ? AND project_id = ? AND subclient_id = ?
+	`, conversationID, scope.TenantID, scope.ProjectID, scope.SubclientID).Scan(&n)
+	return n > 0, err
+}
+
+// getConversation loads a conversation with the messages of its active branch.
+func getConversation(ctx context.Context, scope conversationScope, conversationID string) (*Conversation, error) {
+	conv := &Conversation{}
+	var createdAt, updatedAt, leafID string
+	err := db.QueryRowContext(ctx, `
+		SELECT id, title, title_source, created_at, updated_at, active_leaf_id FROM conversations
+		WHERE id = ? AND tenant_id = ? AND project_id = ? AND subclient_id = ?
+	`, conversationID, scope.TenantID, scope.ProjectID, scope.SubclientID).Scan(&conv.ID, &conv.Title, &conv.TitleSource, &createdAt, &updatedAt, &leafID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, conversationNotFound()
+		}
+		return nil, err
+	}
+	conv.CreatedAt = parseStoredTime(createdAt)
+	conv.UpdatedAt = parseStoredTime(updatedAt)
+
+	messages, err := loadMessages(ctx, conv.ID)
+	if err != nil {
+		return nil, err
+	}
+	conv.Messages = branchPath(messages, leafID)
+	return conv, nil
+}
+
+// loadMessages returns every message of a conversation, all branches, in
+// creation order.
+func loadMessages(ctx context.Context, conversationID string) ([]ChatMessage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, parent_id, role, content, endpoint_id, model, context_role, context_role_version, created_at
+		FROM conversation_messages
+		WHERE conversation_id = ?
+		ORDER BY seq
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ChatMessage{}
+	for rows.Next() {
+		var msg ChatMessage
+		var createdAt string
+		if err := rows.Scan(&msg.ID, &msg.ParentID, &msg.Role, &msg.Content, &msg.EndpointID, &msg.Model, &msg.ContextRole, &msg.ContextRoleVersion, &createdAt); err != nil {
+			return nil, err
+		}
+		msg.Timestamp = parseStoredTime(createdAt)
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// appendMessage adds msg to the end of the conversation's active branch.
+// The caller sets the role, content and provenance; the ID and timestamp
+// are assigned here.
+func appendMessage(ctx context.Context, scope conversationScope, conversationID string, msg *ChatMessage) (*ChatMessage, error) {
+	ok, err := conversationExists(ctx, scope, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conversationNotFound()
+	}
+
+	msg.ID = generateMsgID()
+	msg.Timestamp = time.Now()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := insertMessage(ctx, tx, conversationID, msg, false); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// insertMessage writes the message, its search row and the conversation
+// counters, and makes the message the active leaf. Assistant messages take
+// the provenance the llm service recorded for the reply. With branch set the
+// message is added under msg.ParentID (empty for a new first message);
+// otherwise it follows the current active leaf, which is read inside the
+// INSERT so the transaction takes the write lock before reading anything.
+func insertMessage(ctx context.Context, tx *sql.Tx, conversationID string, msg *ChatMessage, branch bool) error {
+	if msg.Role == "assistant" {
+		if err := takeReplyProvenance(ctx, tx, conversationID, msg); err != nil {
+			return err
+		}
+	}
+	ts := formatStoredTime(msg.Timestamp)
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO conversation_messages (id, conversation_id, seq, parent_id, role, content,
+			endpoint_id, model, context_role, context_role_version, created_at)
+		SELECT ?, ?, COALESCE(MAX(seq), 0) + 1,
+			CASE WHEN ? THEN ? ELSE (SELECT active_leaf_id FROM conversations WHERE id = ?) END,
+			?, ?, ?, ?, ?, ?, ?
+		FROM conversation_messages WHERE conversation_id = ?
+		RETURNING parent_id
+	`, msg.ID, conversationID, branch, msg.ParentID, conversationID, msg.Role, msg.Content,
+		msg.EndpointID, msg.Model, msg.ContextRole, msg.ContextRoleVersion, ts, conversationID).Scan(&msg.ParentID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO conversation_messages_fts (message_id, conversation_id, content) VALUES (?, ?, ?)
+	`, msg.ID, conversationID, msg.Content); err != nil {
+		return err
+	}
+	return setActiveLeaf(ctx, tx, conversationID, msg.ID, ts)
+}
+
+// setActiveLeaf points the conversation at the branch ending in leafID and
+// refreshes the list counters from it: message_count is the length of the
+// branch and last_message previews the leaf. updated_at only moves forward.
+func setActiveLeaf(ctx context.Context, tx *sql.Tx, conversationID, leafID, ts string) error {
+	var count int
+	var content string
+	if err := tx.QueryRowContext(ctx, `
+		WITH RECURSIVE branch(id, parent_id) AS (
+			SELECT id, parent_id FROM conversation_messages WHERE id = ? AND conversation_id = ?
+			UNION ALL
+			SELECT m.id, m.parent_id FROM conversation_messages m JOIN branch b ON m.id = b.parent_id
+		)
+		SELECT (SELECT COUNT(*) FROM branch), COALESCE((SELECT content FROM conversation_messages WHERE id = ?), '')
+	`, leafID, conversationID, leafID).Scan(&count, &content); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE conversations
+		SET active_leaf_id = ?, message_count = ?, last_message = ?, updated_at = MAX(updated_at, ?)
+		WHERE id = ?
+	`, leafID, count, lastMessagePreview(content), ts, conversationID)
+	return err
+}
+
+// listConversations returns the scope's conversations, most recently updated first.
+func listConversations(ctx context.Context, scope conversationScope) ([]ConversationSummary, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, title, title_source, created_at, updated_at, message_count, last_message FROM conversations
+		WHERE tenant_id = ? AND project_id = ? AND subclient_id = ?
+		ORDER BY updated_at DESC
+	`, scope.TenantID, scope.ProjectID, scope.SubclientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []ConversationSummary{}
+	for rows.Next() {
+		var c ConversationSummary
+		var createdAt, updatedAt string
+		if err := rows.Scan(&c.ID, &c.Title, &c.TitleSource, &createdAt, &updatedAt, &c.MessageCount, &c.LastMessage); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = parseStoredTime(createdAt).Format(time.RFC3339)
+		c.UpdatedAt = parseStoredTime(updatedAt).Format(time.RFC3339)
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+// ConversationSearchMatch is one matching message with a highlighted snippet.
+// Snippets are HTML-escaped with matches wrapped in <mark></mark>.
+type ConversationSearchMatch struct {
+	MessageID string `json:"message_id"`
+	Role      string `json:"role"`
+	Snippet   string `json:"snippet"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ConversationSearchResult groups the matches of one conversation.
+type ConversationSearchResult struct {
+	ConversationID string                    `json:"conversation_id"`
+	Title          string                    `json:"title"`
+	UpdatedAt      string                    `json:"updated_at"`
+	Matches        []ConversationSearchMatch `json:"matches"`
+}
+
+const (
+	snippetOpen          = "\x01"
+	snippetClose         = "\x02"
+	maxMatchesPerResult  = 3
+	maxSearchResultLimit = 50
+)
+
+// ftsQuery turns free text into an FTS5 query: every word must appear, and
+// the last word may be a prefix. Quoting each word keeps FTS5 operators in
+// user input from being interpreted.
+func ftsQuery(q string) string {
+	words := strings.Fields(q)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	if len(words) == 0 {
+		return ""
+	}
+	words[len(words)-1] += "*"
+	return strings.Join(words, " ")
+}
+
+// searchConversations runs a full-text search over the scope's messages and
+// returns up to limit conversations, best match first.
+func searchConversations(ctx context.Context, scope conversationScope, q string, limit int) ([]ConversationSearchResult, error) {
+	query := ftsQuery(q)
+	if query == "" {
+		return []ConversationSearchResult{}, nil
+	}
+	if limit <= 0 || limit > maxSearchResultLimit {
+		limit = 20
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, c.title, c.updated_at, m.id, m.role, m.created_at,
+			snippet(conversation_messages_fts, 2, ?, ?, '…', 16)
+		FROM conversation_messages_fts f
+		JOIN conversation_messages m ON m.id = f.message_id
+		JOIN conversations c ON c.id = m.conversation_id
+		WHERE conversation_messages_fts MATCH ?
+			AND c.tenant_id = ? AND c.project_id = ? AND c.subclient_id = ?
+		ORDER BY bm25(conversation_messages_fts)
+		LIMIT ?
+	`, snippetOpen, snippetClose, query, scope.TenantID, scope.ProjectID, scope.SubclientID, limit*maxMatchesPerResult*2)
+	if err != nil {
+		if strings.Contains(err.Error(), "fts5") {
+			return nil, badRequest("invalid search query")
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []ConversationSearchResult{}
+	index := map[string]int{}
+	for rows.Next() {
+		var convID, title, updatedAt, snippet string
+		var match ConversationSearchMatch
+		if err := rows.Scan(&convID, &title, &updatedAt, &match.MessageID, &match.Role, &match.CreatedAt, &snippet); err != nil {
+			return nil, err
+		}
+		match.CreatedAt = parseStoredTime(match.CreatedAt).Format(time.RFC3339)
+		match.Snippet = highlightSnippet(snippet)
+
+		i, ok := index[convID]
+		if !ok {
+			if len(results) >= limit {
+				continue
+			}
+			i = len(results)
+			index[convID] = i
+			results = append(results, ConversationSearchResult{
+				ConversationID: convID,
+				Title:          title,
+				UpdatedAt:      parseStoredTime(updatedAt).Format(time.RFC3339),
+			})
+		}
+		if len(results[i].Matches) < maxMatchesPerResult {
+			results[i].Matches = append(results[i].Matches, match)
+		}
+	}
+	return results, rows.Err()
+}
+
+// highlightSnippet escapes the snippet and turns the FTS markers into <mark> tags.
+func highlightSnippet(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, snippetOpen, "<mark>")
+	return strings.ReplaceAll(s, snippetClose, "</mark>")
+}
+
+// importConversationFiles moves chats/*.json files written by older versions
+// into SQLite and renames each imported file to *.json.imported. Files that
+// fail to import are left in place and retried on the next start.
+func importConversationFiles(ctx context.Context, db *sql.DB, dataDir string) {
+	patterns := []string{
+		filepath.Join(dataDir, "tenants", "*", "projects", "*", "chats", "*.json"),
+		filepath.Join(dataDir, "tenants", "*", "projects", "*", "subs", "*", "chats", "*.json"),
+	}
+	imported, failed := 0, 0
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			scope, ok := conversationScopeFromPath(dataDir, file)
+			if !ok {
+				continue
+			}
+			if err := importConversationFile(ctx, db, scope, file); err != nil {
+				fmt.Printf("[WARN] conversation import failed for %s: %v\n", file, err)
+				failed++
+				continue
+			}
+			if err := os.Rename(file, file+".imported"); err != nil {
+				fmt.Printf("[WARN] conversation import: rename %s: %v\n", file, err)
+			}
+			imported++
+		}
+	}
+	if imported > 0 || failed > 0 {
+		fmt.Printf("[setupSQLite] Imported %d conversation file(s), %d failed\n", imported, failed)
+	}
+}
+
+// conversationScopeFromPath reads tenant, project and subclient IDs from
+// tenants/{t}/projects/{p}/chats/x.json or .../projects/{p}/subs/{s}/chats/x.json.
+func conversationScopeFromPath(dataDir, file string) (conversationScope, bool) {
+	rel, err := filepath.Rel(filepath.Join(dataDir, "tenants"), file)
+	if err != nil {
+		return conversationScope{}, false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	switch {
+	case len(parts) == 5 && parts[1] == "projects" && parts[3] == "chats":
+		return conversationScope{TenantID: parts[0], ProjectID: parts[2]}, true
+	case len(parts) == 7 && parts[1] == "projects" && parts[3] == "subs" && parts[5] == "chats":
+		return conversationScope{TenantID: parts[0], ProjectID: parts[2], SubclientID: parts[4]}, true
+	}
+	return conversationScope{}, false
+}
+
+func importConversationFile(ctx context.Context, db *sql.DB, scope conversationScope, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var conv Conversation
+	if err := json.Unmarshal(data, &conv); err != nil {
+		return fmt.Errorf("failed to parse conversation: %w", err)
+	}
+	if conv.ID == "" {
+		conv.ID = strings.TrimSuffix(filepath.Base(file), ".json")
+	}
+	if conv.CreatedAt.IsZero() {
+		if info, err := os.Stat(file); err == nil {
+			conv.CreatedAt = info.ModTime()
+		} else {
+			conv.CreatedAt = time.Now()
+		}
+	}
+	if conv.UpdatedAt.IsZero() {
+		conv.UpdatedAt = conv.CreatedAt
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO conversations (id, tenant_id, project_id, subclient_id, title, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, conv.ID, scope.TenantID, scope.ProjectID, scope.SubclientID, conv.Title, formatStoredTime(conv.CreatedAt), formatStoredTime(conv.UpdatedAt))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Already imported (e.g. the rename failed last time)
+		return tx.Commit()
+	}
+
+	for i := range conv.Messages {
+		msg := conv.Messages[i]
+		if msg.ID == "" {
+			msg.ID = generateMsgID()
+		}
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = conv.UpdatedAt
+		}
+		if err := insertMessage(ctx, tx, conv.ID, &msg, false); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,240 @@
+package iam
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testConversationScope() conversationScope {
+	return conversationScope{TenantID: newID("tnt"), ProjectID: newID("prj")}
+}
+
+func TestAppendMessageConcurrent(t *testing.T) {
+	ctx := context.Background()
+	scope := testConversationScope()
+	conv, err := createConversation(ctx, scope, "Concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{Role: "user", Content: fmt.Sprintf("message %d", i)}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("appendMessage: %v", err)
+	}
+
+	// seq has no gaps and every message follows the one before it, so the
+	// concurrent appends form a single branch
+	rows, err := db.QueryContext(ctx, "SELECT seq, id, parent_id FROM conversation_messages WHERE conversation_id = ? ORDER BY seq", conv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want, previous := 1, ""
+	for rows.Next() {
+		var seq int
+		var id, parentID string
+		if err := rows.Scan(&seq, &id, &parentID); err != nil {
+			t.Fatal(err)
+		}
+		if seq != want {
+			t.Fatalf("seq = %d, want %d", seq, want)
+		}
+		if parentID != previous {
+			t.Fatalf("message %d parent = %q, want %q", seq, parentID, previous)
+		}
+		want, previous = want+1, id
+	}
+	if want-1 != writers {
+		t.Fatalf("stored %d messages, want %d", want-1, writers)
+	}
+
+	got, err := getConversation(ctx, scope, conv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != writers {
+		t.Errorf("loaded %d messages, want %d", len(got.Messages), writers)
+	}
+	list, err := listConversations(ctx, scope)
+	if err != nil || len(list) != 1 || list[0].MessageCount != writers {
+		t.Errorf("list = %+v, err = %v", list, err)
+	}
+}
+
+func TestAppendMessageOtherScope(t *testing.T) {
+	ctx := context.Background()
+	scope := testConversationScope()
+	conv, err := createConversation(ctx, scope, "Mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := scope
+	other.SubclientID = "sub1"
+	if _, err := appendMessage(ctx, other, conv.ID, &ChatMessage{Role: "user", Content: "hello"}); err == nil {
+		t.Error("appended to a conversation of another scope")
+	}
+	if _, err := getConversation(ctx, other, conv.ID); err == nil {
+		t.Error("loaded a conversation of another scope")
+	}
+}
+
+func TestFTSQuery(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"paracetamol", `"paracetamol"*`},
+		{"dosis  anak", `"dosis" "anak"*`},
+		{`obat" OR content:*`, `"obat""" "OR" "content:*"*`},
+	}
+	for _, tt := range tests {
+		if got := ftsQuery(tt.in); got != tt.want {
+			t.Errorf("ftsQuery(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSearchConversations(t *testing.T) {
+	ctx := context.Background()
+	scope := testConversationScope()
+	first, err := createConversation(ctx, scope, "Dosage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := createConversation(ctx, scope, "Opening hours")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []struct{ conv, role, content string }{
+		{first.ID, "user", "Berapa dosis paracetamol untuk anak?"},
+		{first.ID, "assistant", "Dosis paracetamol untuk anak <b>tergantung</b> berat badan."},
+		{second.ID, "user", "Jam buka apotek hari Minggu?"},
+	} {
+		if _, err := appendMessage(ctx, scope, m.conv, &ChatMessage{Role: m.role, Content: m.content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another tenant's message must not show up
+	other := testConversationScope()
+	foreign, err := createConversation(ctx, other, "Foreign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appendMessage(ctx, other, foreign.ID, &ChatMessage{Role: "user", Content: "paracetamol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := searchConversations(ctx, scope, "paraceta", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ConversationID != first.ID {
+		t.Fatalf("results = %+v", results)
+	}
+	if len(results[0].Matches) != 2 {
+		t.Fatalf("matches = %+v", results[0].Matches)
+	}
+	for _, m := range results[0].Matches {
+		if !strings.Contains(m.Snippet, "<mark>paracetamol</mark>") {
+			t.Errorf("snippet = %q", m.Snippet)
+		}
+		if strings.Contains(m.Snippet, "<b>") {
+			t.Errorf("snippet is not escaped: %q", m.Snippet)
+		}
+	}
+
+	results, err = searchConversations(ctx, scope, "minggu", 10)
+	if err != nil || len(results) != 1 || results[0].ConversationID != second.ID {
+		t.Errorf("results = %+v, err = %v", results, err)
+	}
+	results, err = searchConversations(ctx, scope, "  ", 10)
+	if err != nil || len(results) != 0 {
+		t.Errorf("empty query results = %+v, err = %v", results, err)
+	}
+}
+
+func TestImportConversationFiles(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	tenantID, projectID := newID("tnt"), newID("prj")
+	chats := filepath.Join(dataDir, "tenants", tenantID, "projects", projectID, "subs", "sub1", "chats")
+	if err := os.MkdirAll(chats, 0755); err != nil {
+		t.Fatal(err)
+	}
+	convID := newID("conv")
+	legacy := `{"id":"` + convID + `","title":"Legacy","created_at":"2025-01-02T03:04:05Z","updated_at":"2025-01-02T03:05:00Z",
+		"messages":[{"id":"m1","role":"user","content":"Halo","timestamp":"2025-01-02T03:04:05Z"},{"role":"assistant","content":"Halo juga"}]}`
+	file := filepath.Join(chats, convID+".json")
+	if err := os.WriteFile(file, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	importConversationFiles(ctx, db, dataDir)
+	if _, err := os.Stat(file + ".imported"); err != nil {
+		t.Fatalf("imported file was not renamed: %v", err)
+	}
+
+	scope := conversationScope{TenantID: tenantID, ProjectID: projectID, SubclientID: "sub1"}
+	conv, err := getConversation(ctx, scope, convID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conv.Title != "Legacy" || len(conv.Messages) != 2 {
+		t.Fatalf("conversation = %+v", conv)
+	}
+	if conv.Messages[0].ID != "m1" || conv.Messages[1].Content != "Halo juga" || conv.Messages[1].ID == "" {
+		t.Errorf("messages = %+v", conv.Messages)
+	}
+	if !conv.Messages[1].Timestamp.Equal(conv.UpdatedAt) {
+		t.Errorf("missing timestamp = %v, want the conversation's updated_at %v", conv.Messages[1].Timestamp, conv.UpdatedAt)
+	}
+
+	// A second import of the same file is a no-op
+	if err := importConversationFile(ctx, db, scope, file+".imported"); err != nil {
+		t.Fatal(err)
+	}
+	conv, err = getConversation(ctx, scope, convID)
+	if err != nil || len(conv.Messages) != 2 {
+		t.Errorf("after re-import: %+v, err = %v", conv, err)
+	}
+}
+
+func TestConversationScopeFromPath(t *testing.T) {
+	dataDir := "/data"
+	tests := []struct {
+		file string
+		want conversationScope
+		ok   bool
+	}{
+		{"/data/tenants/t1/projects/p1/chats/c1.json", conversationScope{TenantID: "t1", ProjectID: "p1"}, true},
+		{"/data/tenants/t1/projects/p1/subs/s1/chats/c1.json", conversationScope{TenantID: "t1", ProjectID: "p1", SubclientID: "s1"}, true},
+		{"/data/tenants/t1/projects/p1/files/c1.json", conversationScope{}, false},
+		{"/other/tenants/t1/projects/p1/chats/c1.json", conversationScope{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := conversationScopeFromPath(dataDir, tt.file)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("conversationScopeFromPath(%q) = %+v, %v", tt.file, got, ok)
+		}
+	}
+}
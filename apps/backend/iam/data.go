@@ -2,7 +2,6 @@ package iam
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -44,18 +43,10 @@ func getProjectFilesPath(tenantID, projectID string) string {
 	return filepath.Join(getProjectPath(tenantID, projectID), "files")
 }
 
-func getProjectChatsPath(tenantID, projectID string) string {
-	return filepath.Join(getProjectPath(tenantID, projectID), "chats")
-}
-
 func getProjectWAMetaPath(tenantID, projectID string) string {
 	return filepath.Join(getProjectPath(tenantID, projectID), "wa_meta")
 }
 
-func getConversationPath(tenantID, projectID, conversationID string) string {
-	return filepath.Join(getProjectChatsPath(tenantID, projectID), conversationID)
-}
-
 func getSubclientPath(tenantID, projectID, subclientID string) string {
 	return filepath.Join(getProjectPath(tenantID, projectID), "subs", subclientID)
 }
@@ -64,20 +55,11 @@ func getSubclientFilesPath(tenantID, projectID, subclientID string) string {
 	return filepath.Join(getSubclientPath(tenantID, projectID, subclientID), "files")
 }
 
-func getSubclientChatsPath(tenantID, projectID, subclientID string) string {
-	return filepath.Join(getSubclientPath(tenantID, projectID, subclientID), "chats")
-}
-
-func getSubclientConversationPath(tenantID, projectID, subclientID, conversationID string) string {
-	return filepath.Join(getSubclientChatsPath(tenantID, projectID, subclientID), conversationID)
-}
-
 // ensureProjectDirs creates the project directory structure
 func ensureProjectDirs(tenantID, projectID string) error {
 	paths := []string{
 		getProjectPath(tenantID, projectID),
 		getProjectFilesPath(tenantID, projectID),
-		getProjectChatsPath(tenantID, projectID),
 		getProjectWAMetaPath(tenantID, projectID),
 	}
 
@@ -103,7 +85,6 @@ func ensureSubclientDirs(tenantID, projectID, subclientID string) error {
 	paths := []string{
 		getSubclientPath(tenantID, projectID, subclientID),
 		getSubclientFilesPath(tenantID, projectID, subclientID),
-		getSubclientChatsPath(tenantID, projectID, subclientID),
 	}
 
 	for _, p := range paths {
@@ -121,14 +102,28 @@ type ChatMessage struct {
 	Role      string    `json:"role"` // user, assistant, system
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
+	// ParentID is the previous message on the branch, empty for the first message
+	ParentID string `json:"parent_id,omitempty"`
+	// Siblings are the alternative versions of this message (edits or
+	// regenerations) in creation order, including itself. SiblingIndex is
+	// its 1-based position, so the UI can show "< 2/3 >".
+	Siblings     []string `json:"siblings,omitempty"`
+	SiblingIndex int      `json:"sibling_index,omitempty"`
+	SiblingCount int      `json:"sibling_count,omitempty"`
+	// Endpoint, model and chat role that produced an assistant message
+	EndpointID         string `json:"endpoint_id,omitempty"`
+	Model              string `json:"model,omitempty"`
+	ContextRole        string `json:"context_role,omitempty"`
+	ContextRoleVersion int    `json:"context_role_version,omitempty"`
 }
 
 type Conversation struct {
-	ID        string        `json:"id"`
-	Title     string        `json:"title"`
-	CreatedAt time.Time     `json:"created_at"`
-	UpdatedAt time.Time     `json:"updated_at"`
-	Messages  []ChatMessage `json:"messages"`
+	ID          string        `json:"id"`
+	Title       string        `json:"title"`
+	TitleSource string        `json:"title_source,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	Messages    []ChatMessage `json:"messages"`
 }
 
 // File types
@@ -143,6 +138,8 @@ type FileMetadata struct {
 
 // API types
 type CreateConversationRequest struct {
+	// Title is optional; it is replaced by a generated title after the
+	// first reply unless the conversation is renamed
 	Title string `json:"title"`
 }
 
@@ -150,28 +147,31 @@ type CreateConversationResponse struct {
 	ID string `json:"id"`
 }
 
+// AddMessageRequest adds a message. The provenance of an assistant reply is
+// recorded by the llm service when it generates the reply, not sent here.
 type AddMessageRequest struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
 }
 
+func (r *AddMessageRequest) message() *ChatMessage {
+	return &ChatMessage{
+		Role:    strings.TrimSpace(r.Role),
+		Content: strings.TrimSpace(r.Content),
+	}
+}
+
 type GetConversationResponse struct {
-	ID        string        `json:"id"`
-	Title     string        `json:"title"`
-	CreatedAt string        `json:"created_at"`
-	UpdatedAt string        `json:"updated_at"`
-	Messages  []ChatMessage `json:"messages"`
+	ID          string        `json:"id"`
+	Title       string        `json:"title"`
+	TitleSource string        `json:"title_source"`
+	CreatedAt   string        `json:"created_at"`
+	UpdatedAt   string        `json:"updated_at"`
+	Messages    []ChatMessage `json:"messages"`
 }
 
 type ListConversationsResponse struct {
-	Conversations []struct {
-		ID          string `json:"id"`
-		Title       string `json:"title"`
-		CreatedAt   string `json:"created_at"`
-		UpdatedAt   string `json:"updated_at"`
-		MessageCount int    `json:"message_count"`
-		LastMessage string `json:"last_message,omitempty"`
-	} `json:"conversations"`
+	Conversations []ConversationSummary `json:"conversations"`
 }
 
 type UploadFileResponse struct {
@@ -191,41 +191,25 @@ type UpdateContextRequest struct {
 	Content string `json:"content"`
 }
 
-// Helper function to load conversation
-func loadConversation(filePath string) (*Conversation, error) {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, &errs.Error{Code: errs.NotFound, Message: "conversation not found"}
-		}
-		return nil, err
-	}
-
-	var conv Conversation
-	if err := json.Unmarshal(data, &conv); err != nil {
-		return nil, fmt.Errorf("failed to parse conversation: %w", err)
+// LoadConversationMessages returns the stored messages of a project conversation,
+// or of a subclient conversation when subclientID is set. Used by the llm service
+// to rebuild chat history.
+func LoadConversationMessages(ctx context.Context, tenantID, projectID, subclientID, conversationID string) ([]ChatMessage, error) {
+	if tenantID == "" || projectID == "" || conversationID == "" {
+		return nil, badRequest("tenant, project and conversation are required")
 	}
 
-	return &conv, nil
-}
-
-// Helper function to save conversation
-func saveConversation(filePath string, conv *Conversation) error {
-	data, err := json.MarshalIndent(conv, "", "  ")
+	conv, err := getConversation(ctx, conversationScope{TenantID: tenantID, ProjectID: projectID, SubclientID: subclientID}, conversationID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal conversation: %w", err)
-	}
-
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write conversation: %w", err)
+		return nil, err
 	}
+	return conv.Messages, nil
+}
 
-	return nil
+// ConversationExists reports whether the conversation belongs to the tenant,
+// project and subclient.
+func ConversationExists(ctx context.Context, tenantID, projectID, subclientID, conversationID string) (bool, error) {
+	return conversationExists(ctx, conversationScope{TenantID: tenantID, ProjectID: projectID, SubclientID: subclientID}, conversationID)
 }
 
 // Helper to generate IDs for conversations and messages
@@ -278,8 +262,8 @@ func canAccessSubclient(ctx context.Context, tenantID, projectID, subclientID st
 //
 //encore:api auth method=POST path=/projects/:projectID/conversations
 func CreateProjectConversation(ctx context.Context, projectID string, req *CreateConversationRequest) (*CreateConversationResponse, error) {
-	if req == nil || strings.TrimSpace(req.Title) == "" {
-		return nil, badRequest("title is required")
+	if req == nil {
+		req = &CreateConversationRequest{}
 	}
 
 	raw := auth.Data()
@@ -297,28 +281,12 @@ func CreateProjectConversation(ctx context.Context, projectID string, req *Creat
 		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "project not found"}
 	}
 
-	// Ensure directories exist
-	if err := ensureProjectDirs(data.TenantID, projectID); err != nil {
-		return nil, err
-	}
-
-	convID := generateConvID()
-	now := time.Now()
-
-	conv := &Conversation{
-		ID:        convID,
-		Title:     strings.TrimSpace(req.Title),
-		CreatedAt: now,
-		UpdatedAt: now,
-		Messages:  []ChatMessage{},
-	}
-
-	convPath := filepath.Join(getProjectChatsPath(data.TenantID, projectID), convID+".json")
-	if err := saveConversation(convPath, conv); err != nil {
+	conv, err := createConversation(ctx, conversationScope{TenantID: data.TenantID, ProjectID: projectID}, strings.TrimSpace(req.Title))
+	if err != nil {
 		return nil, err
 	}
 
-	return &CreateConversationResponse{ID: convID}, nil
+	return &CreateConversationResponse{ID: conv.ID}, nil
 }
 
 // AddProjectMessage adds a message to a project conversation
@@ -344,27 +312,8 @@ func AddProjectMessage(ctx context.Context, projectID, conversationID string, re
 		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "project not found"}
 	}
 
-	convPath := filepath.Join(getProjectChatsPath(data.TenantID, projectID), conversationID+".json")
-	conv, err := loadConversation(convPath)
-	if err != nil {
-		return nil, err
-	}
-
-	msg := ChatMessage{
-		ID:        generateMsgID(),
-		Role:      strings.TrimSpace(req.Role),
-		Content:   strings.TrimSpace(req.Content),
-		Timestamp: time.Now(),
-	}
-
-	conv.Messages = append(conv.Messages, msg)
-	conv.UpdatedAt = time.Now()
-
-	if err := saveConversation(convPath, conv); err != nil {
-		return nil, err
-	}
-
-	return &msg, nil
+	scope := conversationScope{TenantID: data.TenantID, ProjectID: projectID}
+	return appendMessage(ctx, scope, conversationID, req.message())
 }
 
 // GetProjectConversation retrieves a conversation with all messages
@@ -386,18 +335,18 @@ func GetProjectConversation(ctx context.Context, projectID, conversationID strin
 		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "project not found"}
 	}
 
-	convPath := filepath.Join(getProjectChatsPath(data.TenantID, projectID), conversationID+".json")
-	conv, err := loadConversation(convPath)
+	conv, err := getConversation(ctx, conversationScope{TenantID: data.TenantID, ProjectID: projectID}, conversationID)
 	if err != nil {
 		return nil, err
 	}
 
 	return &GetConversationResponse{
-		ID:        conv.ID,
-		Title:     conv.Title,
-		CreatedAt: conv.CreatedAt.Format(time.RFC3339),
-		UpdatedAt: conv.UpdatedAt.Format(time.RFC3339),
-		Messages:  conv.Messages,
+		ID:          conv.ID,
+		Title:       conv.Title,
+		TitleSource: conv.TitleSource,
+		CreatedAt:   conv.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:   conv.UpdatedAt.Format(time.RFC3339),
+		Messages:    conv.Messages,
 	}, nil
 }
 
@@ -420,67 +369,52 @@ func ListProjectConversations(ctx context.Context, projectID string) (*ListConve
 		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "project not found"}
 	}
 
-	chatsPath := getProjectChatsPath(data.TenantID, projectID)
-	entries, err := os.ReadDir(chatsPath)
+	conversations, err := listConversations(ctx, conversationScope{TenantID: data.TenantID, ProjectID: projectID})
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &ListConversationsResponse{Conversations: []struct {
-				ID          string `json:"id"`
-				Title       string `json:"title"`
-				CreatedAt   string `json:"created_at"`
-				UpdatedAt   string `json:"updated_at"`
-				MessageCount int    `json:"message_count"`
-				LastMessage string `json:"last_message,omitempty"`
-			}{}}, nil
-		}
 		return nil, err
 	}
 
-	var conversations []struct {
-		ID          string `json:"id"`
-		Title       string `json:"title"`
-		CreatedAt   string `json:"created_at"`
-		UpdatedAt   string `json:"updated_at"`
-		MessageCount int    `json:"message_count"`
-		LastMessage string `json:"last_message,omitempty"`
+	return &ListConversationsResponse{Conversations: conversations}, nil
+}
+
+type SearchConversationsRequest struct {
+	Q     string `query:"q"`
+	Limit int    `query:"limit"`
+}
+
+type SearchConversationsResponse struct {
+	Results []ConversationSearchResult `json:"results"`
+}
+
+// SearchProjectConversations searches the messages of a project's conversations
+//
+//encore:api auth method=GET path=/projects/:projectID/conversations/search
+func SearchProjectConversations(ctx context.Context, projectID string, req *SearchConversationsRequest) (*SearchConversationsResponse, error) {
+	if req == nil || strings.TrimSpace(req.Q) == "" {
+		return nil, badRequest("q is required")
 	}
 
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
-			convPath := filepath.Join(chatsPath, entry.Name())
-			conv, err := loadConversation(convPath)
-			if err != nil {
-				continue
-			}
+	raw := auth.Data()
+	data, ok := raw.(*AuthData)
+	if !ok || data == nil || data.ScopeType != scopeTenant {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "tenant session required"}
+	}
 
-			lastMsg := ""
-			if len(conv.Messages) > 0 {
-				lastMsg = conv.Messages[len(conv.Messages)-1].Content
-				// Truncate last message if too long
-				if len(lastMsg) > 100 {
-					lastMsg = lastMsg[:100] + "..."
-				}
-			}
+	// Verify project exists
+	ok, _, _, err := projectOwnedByTenant(ctx, projectID, data.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "project not found"}
+	}
 
-			conversations = append(conversations, struct {
-				ID          string `json:"id"`
-				Title       string `json:"title"`
-				CreatedAt   string `json:"created_at"`
-				UpdatedAt   string `json:"updated_at"`
-				MessageCount int    `json:"message_count"`
-				LastMessage string `json:"last_message,omitempty"`
-			}{
-				ID:          conv.ID,
-				Title:       conv.Title,
-				CreatedAt:   conv.CreatedAt.Format(time.RFC3339),
-				UpdatedAt:   conv.UpdatedAt.Format(time.RFC3339),
-				MessageCount: len(conv.Messages),
-				LastMessage: lastMsg,
-			})
-		}
+	results, err := searchConversations(ctx, conversationScope{TenantID: data.TenantID, ProjectID: projectID}, req.Q, req.Limit)
+	if err != nil {
+		return nil, err
 	}
 
-	return &ListConversationsResponse{Conversations: conversations}, nil
+	return &SearchConversationsResponse{Results: results}, nil
 }
 
 // GetProjectContext retrieves the project context.md file
@@ -551,8 +485,8 @@ func UpdateProjectContext(ctx context.Context, projectID string, req *UpdateCont
 //
 //encore:api auth method=POST path=/subclients/:subclientID/conversations
 func CreateSubclientConversation(ctx context.Context, subclientID string, req *CreateConversationRequest) (*CreateConversationResponse, error) {
-	if req == nil || strings.TrimSpace(req.Title) == "" {
-		return nil, badRequest("title is required")
+	if req == nil {
+		req = &CreateConversationRequest{}
 	}
 
 	raw := auth.Data()
@@ -583,28 +517,13 @@ func CreateSubclientConversation(ctx context.Context, subclientID string, req *C
 		}
 	}
 
-	// Ensure directories exist
-	if err := ensureSubclientDirs(subClient.TenantID, subClient.ProjectID, subclientID); err != nil {
-		return nil, err
-	}
-
-	convID := generateConvID()
-	now := time.Now()
-
-	conv := &Conversation{
-		ID:        convID,
-		Title:     strings.TrimSpace(req.Title),
-		CreatedAt: now,
-		UpdatedAt: now,
-		Messages:  []ChatMessage{},
-	}
-
-	convPath := filepath.Join(getSubclientChatsPath(subClient.TenantID, subClient.ProjectID, subclientID), convID+".json")
-	if err := saveConversation(convPath, conv); err != nil {
+	scope := conversationScope{TenantID: subClient.TenantID, ProjectID: subClient.ProjectID, SubclientID: subclientID}
+	conv, err := createConversation(ctx, scope, strings.TrimSpace(req.Title))
+	if err != nil {
 		return nil, err
 	}
 
-	return &CreateConversationResponse{ID: convID}, nil
+	return &CreateConversationResponse{ID: conv.ID}, nil
 }
 
 // AddSubclientMessage adds a message to a subclient conversation
@@ -627,27 +546,8 @@ func AddSubclientMessage(ctx context.Context, subclientID, conversationID string
 		return nil, &errs.Error{Code: errs.NotFound, Message: "subclient not found"}
 	}
 
-	convPath := filepath.Join(getSubclientChatsPath(subClient.TenantID, subClient.ProjectID, subclientID), conversationID+".json")
-	conv, err := loadConversation(convPath)
-	if err != nil {
-		return nil, err
-	}
-
-	msg := ChatMessage{
-		ID:        generateMsgID(),
-		Role:      strings.TrimSpace(req.Role),
-		Content:   strings.TrimSpace(req.Content),
-		Timestamp: time.Now(),
-	}
-
-	conv.Messages = append(conv.Messages, msg)
-	conv.UpdatedAt = time.Now()
-
-	if err := saveConversation(convPath, conv); err != nil {
-		return nil, err
-	}
-
-	return &msg, nil
+	scope := conversationScope{TenantID: subClient.TenantID, ProjectID: subClient.ProjectID, SubclientID: subclientID}
+	return appendMessage(ctx, scope, conversationID, req.message())
 }
 
 // GetSubclientConversation retrieves a subclient conversation
@@ -666,18 +566,19 @@ func GetSubclientConversation(ctx context.Context, subclientID, conversationID s
 		return nil, &errs.Error{Code: errs.NotFound, Message: "subclient not found"}
 	}
 
-	convPath := filepath.Join(getSubclientChatsPath(subClient.TenantID, subClient.ProjectID, subclientID), conversationID+".json")
-	conv, err := loadConversation(convPath)
+	scope := conversationScope{TenantID: subClient.TenantID, ProjectID: subClient.ProjectID, SubclientID: subclientID}
+	conv, err := getConversation(ctx, scope, conversationID)
 	if err != nil {
 		return nil, err
 	}
 
 	return &GetConversationResponse{
-		ID:        conv.ID,
-		Title:     conv.Title,
-		CreatedAt: conv.CreatedAt.Format(time.RFC3339),
-		UpdatedAt: conv.UpdatedAt.Format(time.RFC3339),
-		Messages:  conv.Messages,
+		ID:          conv.ID,
+		Title:       conv.Title,
+		TitleSource: conv.TitleSource,
+		CreatedAt:   conv.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:   conv.UpdatedAt.Format(time.RFC3339),
+		Messages:    conv.Messages,
 	}, nil
 }
 
@@ -697,65 +598,11 @@ func ListSubclientConversations(ctx context.Context, subclientID string) (*ListC
 		return nil, &errs.Error{Code: errs.NotFound, Message: "subclient not found"}
 	}
 
-	chatsPath := getSubclientChatsPath(subClient.TenantID, subClient.ProjectID, subclientID)
-	entries, err := os.ReadDir(chatsPath)
+	scope := conversationScope{TenantID: subClient.TenantID, ProjectID: subClient.ProjectID, SubclientID: subclientID}
+	conversations, err := listConversations(ctx, scope)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &ListConversationsResponse{Conversations: []struct {
-				ID          string `json:"id"`
-				Title       string `json:"title"`
-				CreatedAt   string `json:"created_at"`
-				UpdatedAt   string `json:"updated_at"`
-				MessageCount int    `json:"message_count"`
-				LastMessage string `json:"last_message,omitempty"`
-			}{}}, nil
-		}
 		return nil, err
 	}
 
-	var conversations []struct {
-		ID          string `json:"id"`
-		Title       string `json:"title"`
-		CreatedAt   string `json:"created_at"`
-		UpdatedAt   string `json:"updated_at"`
-		MessageCount int    `json:"message_count"`
-		LastMessage string `json:"last_message,omitempty"`
-	}
-
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
-			convPath := filepath.Join(chatsPath, entry.Name())
-			conv, err := loadConversation(convPath)
-			if err != nil {
-				continue
-			}
-
-			lastMsg := ""
-			if len(conv.Messages) > 0 {
-				lastMsg = conv.Messages[len(conv.Messages)-1].Content
-				// Truncate last message if too long
-				if len(lastMsg) > 100 {
-					lastMsg = lastMsg[:100] + "..."
-				}
-			}
-
-			conversations = append(conversations, struct {
-				ID          string `json:"id"`
-				Title       string `json:"title"`
-				CreatedAt   string `json:"created_at"`
-				UpdatedAt   string `json:"updated_at"`
-				MessageCount int    `json:"message_count"`
-				LastMessage string `json:"last_message,omitempty"`
-			}{
-				ID:          conv.ID,
-				Title:       conv.Title,
-				CreatedAt:   conv.CreatedAt.Format(time.RFC3339),
-				UpdatedAt:   conv.UpdatedAt.Format(time.RFC3339),
-				MessageCount: len(conv.Messages),
-				LastMessage: lastMsg,
-			})
-		}
-	}
-
 	return &ListConversationsResponse{Conversations: conversations}, nil
 }
@@ -91,12 +91,8 @@ func GetEmbedConversation(ctx context.Context, projectID string, conversationID
 	}
 
 	// Get conversation
-	convPath := filepath.Join(getProjectPath(project.TenantID, projectID), "chats", conversationID+".json")
-	conv, err := loadConversation(convPath)
+	conv, err := getConversation(ctx, conversationScope{TenantID: project.TenantID, ProjectID: projectID}, conversationID)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, &errs.Error{Code: errs.NotFound, Message: "conversation not found"}
-		}
 		return nil, err
 	}
 
@@ -143,44 +139,20 @@ func ListEmbedConversations(ctx context.Context, projectID string) (*EmbedListCo
 		}{}}, nil
 	}
 
-	// Get conversations from file system
-	chatsPath := filepath.Join(getProjectPath(project.TenantID, projectID), "chats")
-	entries, err := os.ReadDir(chatsPath)
+	summaries, err := listConversations(ctx, conversationScope{TenantID: project.TenantID, ProjectID: projectID})
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &EmbedListConversationsResponse{Conversations: []struct {
-				ID        string `json:"id"`
-				Title     string `json:"title"`
-				CreatedAt string `json:"created_at"`
-			}{}}, nil
-		}
 		return nil, err
 	}
 
-	var conversations []struct {
+	conversations := make([]struct {
 		ID        string `json:"id"`
 		Title     string `json:"title"`
 		CreatedAt string `json:"created_at"`
-	}
-
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
-			convPath := filepath.Join(chatsPath, entry.Name())
-			conv, err := loadConversation(convPath)
-			if err != nil {
-				continue
-			}
-
-			conversations = append(conversations, struct {
-				ID        string `json:"id"`
-				Title     string `json:"title"`
-				CreatedAt string `json:"created_at"`
-			}{
-				ID:        conv.ID,
-				Title:     conv.Title,
-				CreatedAt: conv.CreatedAt.Format(time.RFC3339),
-			})
-		}
+	}, len(summaries))
+	for i, conv := range summaries {
+		conversations[i].ID = conv.ID
+		conversations[i].Title = conv.Title
+		conversations[i].CreatedAt = conv.CreatedAt
 	}
 
 	return &EmbedListConversationsResponse{Conversations: conversations}, nil
@@ -211,8 +183,8 @@ type EmbedCreateConversationResponse struct {
 
 //encore:api public method=POST path=/embed/:projectID/conversations
 func CreateEmbedConversation(ctx context.Context, projectID string, req *EmbedCreateConversationRequest) (*EmbedCreateConversationResponse, error) {
-	if req == nil || strings.TrimSpace(req.Title) == "" {
-		return nil, badRequest("title is required")
+	if req == nil {
+		req = &EmbedCreateConversationRequest{}
 	}
 
 	// Get tenantID from the project
@@ -221,30 +193,13 @@ func CreateEmbedConversation(ctx context.Context, projectID string, req *EmbedCr
 		return nil, &errs.Error{Code: errs.NotFound, Message: "project not found"}
 	}
 
-	// Ensure directories exist
-	chatsPath := filepath.Join(getProjectPath(project.TenantID, projectID), "chats")
-	if err := os.MkdirAll(chatsPath, 0755); err != nil {
-		return nil, err
-	}
-
-	convID := generateConvID()
-	now := time.Now()
-
-	conv := &Conversation{
-		ID:        convID,
-		Title:     strings.TrimSpace(req.Title),
-		CreatedAt: now,
-		UpdatedAt: now,
-		Messages:  []ChatMessage{},
-	}
-
-	convPath := filepath.Join(chatsPath, convID+".json")
-	if err := saveConversation(convPath, conv); err != nil {
+	conv, err := createConversation(ctx, conversationScope{TenantID: project.TenantID, ProjectID: projectID}, strings.TrimSpace(req.Title))
+	if err != nil {
 		return nil, err
 	}
 
 	return &EmbedCreateConversationResponse{
-		ID:    convID,
+		ID:    conv.ID,
 		Title: conv.Title,
 	}, nil
 }
@@ -282,29 +237,9 @@ func CreateEmbedMessage(ctx context.Context, projectID string, conversationID st
 		return nil, &errs.Error{Code: errs.NotFound, Message: "project not found"}
 	}
 
-	// Get conversation
-	convPath := filepath.Join(getProjectPath(project.TenantID, projectID), "chats", conversationID+".json")
-	conv, err := loadConversation(convPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, &errs.Error{Code: errs.NotFound, Message: "conversation not found"}
-		}
-		return nil, err
-	}
-
 	// Add user message
-	now := time.Now()
-	userMsg := ChatMessage{
-		ID:        generateMsgID(),
-		Role:      "user",
-		Content:   strings.TrimSpace(req.Content),
-		Timestamp: now,
-	}
-	conv.Messages = append(conv.Messages, userMsg)
-	conv.UpdatedAt = now
-
-	// Save conversation
-	if err := saveConversation(convPath, conv); err != nil {
+	scope := conversationScope{TenantID: project.TenantID, ProjectID: projectID}
+	if _, err := appendMessage(ctx, scope, conversationID, &ChatMessage{Role: "user", Content: strings.TrimSpace(req.Content)}); err != nil {
 		return nil, err
 	}
 
@@ -316,8 +251,10 @@ func CreateEmbedMessage(ctx context.Context, projectID string, conversationID st
 	}
 
 	// Build project context for LLM
+	// The LLM service loads earlier turns from the stored conversation
 	llmReq := map[string]interface{}{
-		"prompt": req.Content,
+		"prompt":          req.Content,
+		"conversation_id": conversationID,
 		"project_context": map[string]interface{}{
 			"project_id":    projectID,
 			"project_name":  project.Name,
@@ -365,31 +302,28 @@ func CreateEmbedMessage(ctx context.Context, projectID string, conversationID st
 	}
 
 	var llmResp struct {
-		Content string `json:"content"`
+		Content            string `json:"content"`
+		EndpointID         string `json:"endpoint_id"`
+		Model              string `json:"model"`
+		ContextRole        string `json:"context_role"`
+		ContextRoleVersion int    `json:"context_role_version"`
 	}
 
-	var aiMsg ChatMessage
+	reply := &ChatMessage{Role: "assistant"}
 	if err := json.NewDecoder(resp.Body).Decode(&llmResp); err != nil {
 		// If LLM fails, return a fallback response
-		aiMsg = ChatMessage{
-			ID:        generateMsgID(),
-			Role:      "assistant",
-			Content:   "I apologize, but I'm having trouble responding right now. Please try again later.",
-			Timestamp: now.Add(1 * time.Second),
-		}
+		reply.Content = "I apologize, but I'm having trouble responding right now. Please try again later."
 	} else {
-		// Add LLM response to conversation
-		aiMsg = ChatMessage{
-			ID:        generateMsgID(),
-			Role:      "assistant",
-			Content:   llmResp.Content,
-			Timestamp: now.Add(1 * time.Second),
-		}
+		reply.Content = llmResp.Content
+		reply.EndpointID = llmResp.EndpointID
+		reply.Model = llmResp.Model
+		reply.ContextRole = llmResp.ContextRole
+		reply.ContextRoleVersion = llmResp.ContextRoleVersion
 	}
-	conv.Messages = append(conv.Messages, aiMsg)
 
-	// Save conversation with AI response
-	if err := saveConversation(convPath, conv); err != nil {
+	// Add LLM response to conversation
+	aiMsg, err := appendMessage(ctx, scope, conversationID, reply)
+	if err != nil {
 		return nil, err
 	}
 
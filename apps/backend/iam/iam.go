@@ -45,7 +45,8 @@ func setupSQLite(ctx context.Context) (*sql.DB, error) {
 
 	dbPath := filepath.Join(dataDir, "iam.db")
 	fmt.Printf("[setupSQLite] Database path: %s\n", dbPath)
-	db, err := sql.Open("sqlite", dbPath)
+	// busy_timeout lets concurrent writers wait for the lock instead of failing
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -61,6 +62,13 @@ func setupSQLite(ctx context.Context) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	if err := seedGlobalRoles(ctx, db, dataDir); err != nil {
+		return nil, fmt.Errorf("failed to seed chat roles: %w", err)
+	}
+
+	// One-time import of chats/*.json written by older versions
+	importConversationFiles(ctx, db, dataDir)
+
 	return db, nil
 }
 
@@ -115,11 +123,16 @@ type AuthData struct {
 	ScopeType   scopeType
 	ScopeID     string
 	Username    string
+	// APIKeyID and APIKeyScopes are set when the request used an API key
+	APIKeyID     string
+	APIKeyScopes []string
 }
 
 type authParams struct {
 	SessionCookie *http.Cookie `cookie:"aicore_session"`
 	Host          string       `header:"Host"`
+	// Authorization carries an API key as "Bearer <key>", see api_keys.go
+	Authorization string `header:"Authorization"`
 }
 
 type licenseVerifyResponse struct {
@@ -133,6 +146,11 @@ type licenseVerifyResponse struct {
 
 //encore:authhandler
 func AuthHandler(ctx context.Context, p *authParams) (auth.UID, *AuthData, error) {
+	if p != nil {
+		if token := bearerToken(p.Authorization); token != "" {
+			return apiKeyAuth(ctx, token, p.Host)
+		}
+	}
 	if p == nil || p.SessionCookie == nil || p.SessionCookie.Value == "" {
 		return "", nil, &errs.Error{Code: errs.Unauthenticated, Message: "missing session"}
 	}
@@ -2862,6 +2880,108 @@ func runMigrations(ctx context.Context, db *sql.DB) error {
 		}
 	}
 
+	if currentVersion < 11 {
+		if err := applyMigration(ctx, db, 11); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 12 {
+		if err := applyMigration(ctx, db, 12); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 13 {
+		if err := applyMigration(ctx, db, 13); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 14 {
+		if err := applyMigration(ctx, db, 14); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 15 {
+		if err := applyMigration(ctx, db, 15); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 16 {
+		if err := applyMigration(ctx, db, 16); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 17 {
+		if err := applyMigration(ctx, db, 17); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 18 {
+		if err := applyMigration(ctx, db, 18); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 19 {
+		if err := applyMigration(ctx, db, 19); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 20 {
+		if err := applyMigration(ctx, db, 20); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 21 {
+		if err := applyMigration(ctx, db, 21); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 22 {
+		if err := applyMigration(ctx, db, 22); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 23 {
+		if err := applyMigration(ctx, db, 23); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 24 {
+		if err := applyMigration(ctx, db, 24); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 25 {
+		if err := applyMigration(ctx, db, 25); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 26 {
+		if err := applyMigration(ctx, db, 26); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion < 27 {
+		if err := applyMigration(ctx, db, 27); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -3008,10 +3128,14 @@ func newID(prefix string) string {
 
 type getProjectRoleResponse struct {
 	ContextRole string `json:"context_role"`
+	// ContextRoleVersion is the pinned role version, 0 when following the latest
+	ContextRoleVersion int `json:"context_role_version"`
 }
 
 type updateProjectRoleRequest struct {
 	ContextRole string `json:"context_role" validate:"required"`
+	// ContextRoleVersion pins a role version; 0 follows the latest
+	ContextRoleVersion int `json:"context_role_version"`
 }
 
 // GetProjectRole retrieves the context role for a project
@@ -3038,7 +3162,8 @@ func GetProjectRole(ctx context.Context, projectId string) (*getProjectRoleRespo
 
 	// Get context_role from project
 	var contextRole string
-	err = db.QueryRowContext(ctx, "SELECT context_role FROM projects WHERE id = ? AND tenant_id = ?", projectId, data.TenantID).Scan(&contextRole)
+	var contextRoleVersion int
+	err = db.QueryRowContext(ctx, "SELECT context_role, context_role_version FROM projects WHERE id = ? AND tenant_id = ?", projectId, data.TenantID).Scan(&contextRole, &contextRoleVersion)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, &errs.Error{Code: errs.NotFound, Message: "project not found"}
@@ -3047,7 +3172,8 @@ func GetProjectRole(ctx context.Context, projectId string) (*getProjectRoleRespo
 	}
 
 	return &getProjectRoleResponse{
-		ContextRole: contextRole,
+		ContextRole:        contextRole,
+		ContextRoleVersion: contextRoleVersion,
 	}, nil
 }
 
@@ -3077,75 +3203,25 @@ func UpdateProjectRole(ctx context.Context, projectId string, req *updateProject
 		return nil, err
 	}
 
-	// Validate role exists
-	role := getRoleByID(req.ContextRole)
-	if role == nil {
-		return nil, badRequest("invalid role ID")
+	// Validate role (and pinned version) exists
+	if req.ContextRoleVersion < 0 {
+		return nil, badRequest("invalid role version")
+	}
+	if _, err := findRole(ctx, data.TenantID, req.ContextRole, req.ContextRoleVersion); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, badRequest("invalid role ID or version")
+		}
+		return nil, err
 	}
 
 	// Update project role
-	_, err = db.ExecContext(ctx, "UPDATE projects SET context_role = ? WHERE id = ? AND tenant_id = ?", req.ContextRole, projectId, data.TenantID)
+	_, err = db.ExecContext(ctx, "UPDATE projects SET context_role = ?, context_role_version = ? WHERE id = ? AND tenant_id = ?", req.ContextRole, req.ContextRoleVersion, projectId, data.TenantID)
 	if err != nil {
 		return nil, err
 	}
 
 	return &getProjectRoleResponse{
-		ContextRole: req.ContextRole,
+		ContextRole:        req.ContextRole,
+		ContextRoleVersion: req.ContextRoleVersion,
 	}, nil
 }
-
-// CheckQuestionScope checks if a question is within the project's role scope
-//
-//encore:api auth method=POST path=/projects/:projectId/check-scope
-func CheckQuestionScope(ctx context.Context, projectId string, req *checkQuestionScopeRequest) (*checkQuestionScopeResponse, error) {
-	if req == nil || strings.TrimSpace(req.Question) == "" {
-		return nil, badRequest("question is required")
-	}
-
-	raw := auth.Data()
-	data, ok := raw.(*AuthData)
-	if !ok || data == nil || data.ScopeType != scopeTenant {
-		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "tenant session required"}
-	}
-
-	// Get project role
-	var contextRole string
-	err := db.QueryRowContext(ctx, "SELECT COALESCE(context_role, 'general') FROM projects WHERE id = ? AND tenant_id = ?", projectId, data.TenantID).Scan(&contextRole)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, &errs.Error{Code: errs.NotFound, Message: "project not found"}
-		}
-		return nil, err
-	}
-
-	if contextRole == "" {
-		contextRole = "general"
-	}
-
-	// Get role definition
-	role := getRoleByID(contextRole)
-
-	// Check if question is in scope
-	inScope := isQuestionInScope(req.Question, role)
-
-	response := &checkQuestionScopeResponse{
-		InScope: inScope,
-		Role:    contextRole,
-	}
-
-	if !inScope && role != nil {
-		response.RefusalMessage = getOutOfScopeResponse(role)
-	}
-
-	return response, nil
-}
-
-type checkQuestionScopeRequest struct {
-	Question string `json:"question"`
-}
-
-type checkQuestionScopeResponse struct {
-	InScope         bool   `json:"in_scope"`
-	Role            string `json:"role"`
-	RefusalMessage  string `json:"refusal_message,omitempty"`
-}
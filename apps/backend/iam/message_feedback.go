@@ -0,0 +1,349 @@
+package iam
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+// Feedback is a thumbs up or down with an optional comment on an assistant
+// message. Each rater has one rating per message; rating again replaces it.
+// Dashboard feedback is keyed by user, embed feedback by the embed source
+// alone since visitors are anonymous.
+
+const (
+	feedbackSourceDashboard = "dashboard"
+	feedbackSourceEmbed     = "embed"
+
+	maxFeedbackComment  = 2000
+	defaultFeedbackPage = 50
+	maxFeedbackPage     = 200
+)
+
+// replyProvenanceTTL is how long recorded provenance waits for its reply to
+// be saved.
+const replyProvenanceTTL = time.Hour
+
+// ReplyProvenance is the endpoint, model and chat role that produced a reply.
+type ReplyProvenance struct {
+	EndpointID         string
+	Model              string
+	ContextRole        string
+	ContextRoleVersion int
+}
+
+// RecordReplyProvenance is called by the llm service after generating a
+// reply for a stored conversation. The next assistant message saved to the
+// conversation takes it, so provenance never comes from the client.
+func RecordReplyProvenance(ctx context.Context, conversationID string, prov ReplyProvenance) error {
+	now := time.Now()
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM conversation_reply_provenance WHERE conversation_id = ? AND created_at < ?
+	`, conversationID, formatStoredTime(now.Add(-replyProvenanceTTL))); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO conversation_reply_provenance (conversation_id, endpoint_id, model, context_role, context_role_version, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, conversationID, prov.EndpointID, prov.Model, prov.ContextRole, prov.ContextRoleVersion, formatStoredTime(now))
+	return err
+}
+
+// takeReplyProvenance removes the newest provenance recorded for the
+// conversation and copies it onto msg.
+func takeReplyProvenance(ctx context.Context, tx *sql.Tx, conversationID string, msg *ChatMessage) error {
+	var prov ReplyProvenance
+	err := tx.QueryRowContext(ctx, `
+		DELETE FROM conversation_reply_provenance
+		WHERE id = (
+			SELECT id FROM conversation_reply_provenance
+			WHERE conversation_id = ? AND created_at >= ?
+			ORDER BY id DESC LIMIT 1
+		)
+		RETURNING endpoint_id, model, context_role, context_role_version
+	`, conversationID, formatStoredTime(time.Now().Add(-replyProvenanceTTL))).Scan(&prov.EndpointID, &prov.Model, &prov.ContextRole, &prov.ContextRoleVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	msg.EndpointID, msg.Model = prov.EndpointID, prov.Model
+	msg.ContextRole, msg.ContextRoleVersion = prov.ContextRole, prov.ContextRoleVersion
+	return nil
+}
+
+type MessageFeedback struct {
+	ID                 string `json:"id"`
+	MessageID          string `json:"message_id"`
+	ConversationID     string `json:"conversation_id"`
+	ProjectID          string `json:"project_id"`
+	SubclientID        string `json:"subclient_id,omitempty"`
+	Source             string `json:"source"`
+	UserID             string `json:"user_id,omitempty"`
+	Rating             string `json:"rating"` // up or down
+	Comment            string `json:"comment,omitempty"`
+	EndpointID         string `json:"endpoint_id,omitempty"`
+	Model              string `json:"model,omitempty"`
+	ContextRole        string `json:"context_role,omitempty"`
+	ContextRoleVersion int    `json:"context_role_version,omitempty"`
+	CreatedAt          string `json:"created_at"`
+	UpdatedAt          string `json:"updated_at"`
+}
+
+type SubmitFeedbackRequest struct {
+	// Rating is "up" or "down"
+	Rating  string `json:"rating"`
+	Comment string `json:"comment"`
+}
+
+func parseRating(rating string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(rating)) {
+	case "up":
+		return 1, nil
+	case "down":
+		return -1, nil
+	}
+	return 0, badRequest("rating must be up or down")
+}
+
+func ratingName(rating int) string {
+	if rating > 0 {
+		return "up"
+	}
+	return "down"
+}
+
+// saveFeedback records a rating on an assistant message of the conversation,
+// copying the message's endpoint, model and role.
+func saveFeedback(ctx context.Context, scope conversationScope, conversationID, messageID, source, userID string, req *SubmitFeedbackRequest) (*MessageFeedback, error) {
+	if req == nil {
+		return nil, badRequest("rating is required")
+	}
+	rating, err := parseRating(req.Rating)
+	if err != nil {
+		return nil, err
+	}
+	comment := strings.TrimSpace(req.Comment)
+	if len(comment) > maxFeedbackComment {
+		return nil, badRequest("comment is too long")
+	}
+
+	ok, err := conversationExists(ctx, scope, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conversationNotFound()
+	}
+	msg, err := getMessage(ctx, conversationID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Role != "assistant" {
+		return nil, badRequest("feedback is only accepted on assistant messages")
+	}
+
+	now := formatStoredTime(time.Now())
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO message_feedback (id, message_id, conversation_id, tenant_id, project_id, subclient_id, source, user_id,
+			rating, comment, endpoint_id, model, context_role, context_role_version, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(message_id, source, user_id) DO UPDATE SET
+			rating = excluded.rating, comment = excluded.comment, updated_at = excluded.updated_at
+	`, newID("fb"), messageID, conversationID, scope.TenantID, scope.ProjectID, scope.SubclientID, source, userID,
+		rating, comment, msg.EndpointID, msg.Model, msg.ContextRole, msg.ContextRoleVersion, now, now); err != nil {
+		return nil, err
+	}
+
+	fb, err := scanFeedback(db.QueryRowContext(ctx, `
+		SELECT `+feedbackColumns+` FROM message_feedback f
+		WHERE f.message_id = ? AND f.source = ? AND f.user_id = ?
+	`, messageID, source, userID))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("[IAM] Feedback %s on message %s (project=%s role=%s model=%s)\n", fb.Rating, messageID, scope.ProjectID, fb.ContextRole, fb.Model)
+	return fb, nil
+}
+
+const feedbackColumns = `f.id, f.message_id, f.conversation_id, f.project_id, f.subclient_id, f.source, f.user_id,
+	f.rating, f.comment, f.endpoint_id, f.model, f.context_role, f.context_role_version, f.created_at, f.updated_at`
+
+func scanFeedback(row rowScanner, extra ...interface{}) (*MessageFeedback, error) {
+	fb := &MessageFeedback{}
+	var rating int
+	dest := []interface{}{&fb.ID, &fb.MessageID, &fb.ConversationID, &fb.ProjectID, &fb.SubclientID, &fb.Source, &fb.UserID,
+		&rating, &fb.Comment, &fb.EndpointID, &fb.Model, &fb.ContextRole, &fb.ContextRoleVersion, &fb.CreatedAt, &fb.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	fb.Rating = ratingName(rating)
+	fb.CreatedAt = parseStoredTime(fb.CreatedAt).Format(time.RFC3339)
+	fb.UpdatedAt = parseStoredTime(fb.UpdatedAt).Format(time.RFC3339)
+	return fb, nil
+}
+
+// SubmitProjectMessageFeedback rates an assistant message of a project conversation.
+//
+//encore:api auth method=POST path=/projects/:projectID/conversations/:conversationID/messages/:messageID/feedback
+func SubmitProjectMessageFeedback(ctx context.Context, projectID, conversationID, messageID string, req *SubmitFeedbackRequest) (*MessageFeedback, error) {
+	scope, err := conversationAccessScope(ctx, projectID, "")
+	if err != nil {
+		return nil, err
+	}
+	data, _ := auth.Data().(*AuthData)
+	return saveFeedback(ctx, scope, conversationID, messageID, feedbackSourceDashboard, data.UserID, req)
+}
+
+// SubmitSubclientMessageFeedback rates an assistant message of a subclient conversation.
+//
+//encore:api auth method=POST path=/subclients/:subclientID/conversations/:conversationID/messages/:messageID/feedback
+func SubmitSubclientMessageFeedback(ctx context.Context, subclientID, conversationID, messageID string, req *SubmitFeedbackRequest) (*MessageFeedback, error) {
+	scope, err := conversationAccessScope(ctx, "", subclientID)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := auth.Data().(*AuthData)
+	return saveFeedback(ctx, scope, conversationID, messageID, feedbackSourceDashboard, data.UserID, req)
+}
+
+// SubmitEmbedMessageFeedback rates an assistant message from the public embed (no auth required)
+//
+//encore:api public method=POST path=/embed/:projectID/conversations/:conversationID/messages/:messageID/feedback
+func SubmitEmbedMessageFeedback(ctx context.Context, projectID, conversationID, messageID string, req *SubmitFeedbackRequest) (*MessageFeedback, error) {
+	project, err := GetEmbedProject(ctx, projectID)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "project not found"}
+	}
+	scope := conversationScope{TenantID: project.TenantID, ProjectID: projectID}
+	return saveFeedback(ctx, scope, conversationID, messageID, feedbackSourceEmbed, "", req)
+}
+
+type ListFeedbackRequest struct {
+	ProjectID   string `query:"project_id"`
+	SubclientID string `query:"subclient_id"`
+	// Rating is down (default), up or all
+	Rating      string `query:"rating"`
+	Source      string `query:"source"`
+	ContextRole string `query:"context_role"`
+	Model       string `query:"model"`
+	EndpointID  string `query:"endpoint_id"`
+	// Since and Until bound the last update time (RFC 3339)
+	Since  string `query:"since"`
+	Until  string `query:"until"`
+	Limit  int    `query:"limit"`
+	Offset int    `query:"offset"`
+}
+
+// FeedbackReviewItem is a rating with the exchange it refers to.
+type FeedbackReviewItem struct {
+	Feedback *MessageFeedback `json:"feedback"`
+	Question string           `json:"question"`
+	Answer   string           `json:"answer"`
+}
+
+type ListFeedbackResponse struct {
+	Items []FeedbackReviewItem `json:"items"`
+	Total int                  `json:"total"`
+}
+
+// ListMessageFeedback is the review queue: feedback across the tenant's
+// projects, newest first, with the question and answer that were rated.
+// Only tenant admins can read it.
+//
+//encore:api auth method=GET path=/feedback
+func ListMessageFeedback(ctx context.Context, req *ListFeedbackRequest) (*ListFeedbackResponse, error) {
+	data, ok := auth.Data().(*AuthData)
+	if !ok || data == nil || data.ScopeType != scopeTenant {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "tenant session required"}
+	}
+	if data.Role != roleAdmin {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "only tenant admin can review feedback"}
+	}
+	if req == nil {
+		req = &ListFeedbackRequest{}
+	}
+
+	where := []string{"f.tenant_id = ?"}
+	args := []interface{}{data.TenantID}
+	switch strings.ToLower(strings.TrimSpace(req.Rating)) {
+	case "", "down":
+		where = append(where, "f.rating < 0")
+	case "up":
+		where = append(where, "f.rating > 0")
+	case "all":
+	default:
+		return nil, badRequest("rating must be down, up or all")
+	}
+	filters := []struct{ column, value string }{
+		{"f.project_id", req.ProjectID},
+		{"f.subclient_id", req.SubclientID},
+		{"f.source", req.Source},
+		{"f.context_role", req.ContextRole},
+		{"f.model", req.Model},
+		{"f.endpoint_id", req.EndpointID},
+	}
+	for _, f := range filters {
+		if v := strings.TrimSpace(f.value); v != "" {
+			where = append(where, f.column+" = ?")
+			args = append(args, v)
+		}
+	}
+	bounds := []struct{ op, value string }{{">=", req.Since}, {"<=", req.Until}}
+	for _, b := range bounds {
+		if v := strings.TrimSpace(b.value); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, badRequest("since and until must be RFC 3339 timestamps")
+			}
+			where = append(where, "f.updated_at "+b.op+" ?")
+			args = append(args, formatStoredTime(t))
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > maxFeedbackPage {
+		limit = defaultFeedbackPage
+	}
+	offset := req.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	filter := strings.Join(where, " AND ")
+	resp := &ListFeedbackResponse{Items: []FeedbackReviewItem{}}
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM message_feedback f WHERE `+filter, args...).Scan(&resp.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+feedbackColumns+`, m.content, COALESCE(p.content, '')
+		FROM message_feedback f
+		JOIN conversation_messages m ON m.id = f.message_id
+		LEFT JOIN conversation_messages p ON p.id = m.parent_id
+		WHERE `+filter+`
+		ORDER BY f.updated_at DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item FeedbackReviewItem
+		fb, err := scanFeedback(rows, &item.Answer, &item.Question)
+		if err != nil {
+			return nil, err
+		}
+		item.Feedback = fb
+		resp.Items = append(resp.Items, item)
+	}
+	return resp, rows.Err()
+}
@@ -0,0 +1,170 @@
+package iam
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRating(t *testing.T) {
+	tests := []struct {
+		rating  string
+		want    int
+		wantErr bool
+	}{
+		{"up", 1, false},
+		{" DOWN ", -1, false},
+		{"Up", 1, false},
+		{"", 0, true},
+		{"meh", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRating(tt.rating)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseRating(%q) = %d, %v", tt.rating, got, err)
+		}
+	}
+	if ratingName(1) != "up" || ratingName(-1) != "down" {
+		t.Errorf("ratingName(1) = %s, ratingName(-1) = %s", ratingName(1), ratingName(-1))
+	}
+}
+
+func TestSaveFeedback(t *testing.T) {
+	ctx := context.Background()
+	scope := testConversationScope()
+	conv, err := createConversation(ctx, scope, "Feedback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	question, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{Role: "user", Content: "Berapa dosis paracetamol?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{
+		Role: "assistant", Content: "500 mg.",
+		EndpointID: "ep1", Model: "gpt-4o-mini", ContextRole: "pharmacist", ContextRoleVersion: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Provenance is stored with the message and loaded back
+	got, err := getConversation(ctx, scope, conv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := got.Messages[1]
+	if stored.EndpointID != "ep1" || stored.Model != "gpt-4o-mini" || stored.ContextRole != "pharmacist" || stored.ContextRoleVersion != 2 {
+		t.Errorf("stored provenance = %+v", stored)
+	}
+
+	if _, err := saveFeedback(ctx, scope, conv.ID, question.ID, feedbackSourceDashboard, "u1", &SubmitFeedbackRequest{Rating: "up"}); err == nil {
+		t.Error("accepted feedback on a user message")
+	}
+	if _, err := saveFeedback(ctx, scope, conv.ID, answer.ID, feedbackSourceDashboard, "u1", &SubmitFeedbackRequest{Rating: "sideways"}); err == nil {
+		t.Error("accepted an invalid rating")
+	}
+	other := scope
+	other.ProjectID = newID("prj")
+	if _, err := saveFeedback(ctx, other, conv.ID, answer.ID, feedbackSourceDashboard, "u1", &SubmitFeedbackRequest{Rating: "up"}); err == nil {
+		t.Error("accepted feedback on another project's conversation")
+	}
+
+	fb, err := saveFeedback(ctx, scope, conv.ID, answer.ID, feedbackSourceDashboard, "u1", &SubmitFeedbackRequest{Rating: "up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fb.Rating != "up" || fb.Model != "gpt-4o-mini" || fb.ContextRole != "pharmacist" || fb.ContextRoleVersion != 2 || fb.EndpointID != "ep1" {
+		t.Errorf("feedback = %+v", fb)
+	}
+
+	// Rating again replaces the rater's earlier rating
+	again, err := saveFeedback(ctx, scope, conv.ID, answer.ID, feedbackSourceDashboard, "u1", &SubmitFeedbackRequest{Rating: "down", Comment: " wrong dose "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != fb.ID || again.Rating != "down" || again.Comment != "wrong dose" {
+		t.Errorf("updated feedback = %+v, want the same row rated down", again)
+	}
+	if _, err := saveFeedback(ctx, scope, conv.ID, answer.ID, feedbackSourceEmbed, "", &SubmitFeedbackRequest{Rating: "up"}); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM message_feedback WHERE message_id = ?", answer.ID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("stored %d feedback rows, want one per rater", count)
+	}
+}
+
+func TestReplyProvenance(t *testing.T) {
+	ctx := context.Background()
+	scope := testConversationScope()
+	conv, err := createConversation(ctx, scope, "Provenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov := ReplyProvenance{EndpointID: "ep1", Model: "gpt-4o-mini", ContextRole: "pharmacist", ContextRoleVersion: 2}
+
+	// The user message saved after generating doesn't take the reply's provenance
+	if err := RecordReplyProvenance(ctx, conv.ID, prov); err != nil {
+		t.Fatal(err)
+	}
+	question, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{Role: "user", Content: "Berapa dosis paracetamol?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if question.EndpointID != "" {
+		t.Errorf("user message provenance = %+v", question)
+	}
+	answer, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{Role: "assistant", Content: "500 mg."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.EndpointID != "ep1" || answer.Model != "gpt-4o-mini" || answer.ContextRole != "pharmacist" || answer.ContextRoleVersion != 2 {
+		t.Errorf("answer provenance = %+v", answer)
+	}
+
+	// Provenance is used once
+	again, err := appendMessage(ctx, scope, conv.ID, &ChatMessage{Role: "assistant", Content: "Anything else?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.EndpointID != "" || again.Model != "" {
+		t.Errorf("second answer provenance = %+v", again)
+	}
+
+	// A regenerated reply takes the newest provenance
+	if err := RecordReplyProvenance(ctx, conv.ID, prov); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordReplyProvenance(ctx, conv.ID, ReplyProvenance{EndpointID: "ep2", Model: "claude-sonnet"}); err != nil {
+		t.Fatal(err)
+	}
+	regenerated, err := addSibling(ctx, scope, conv.ID, answer.ID, &ChatMessage{Role: "assistant", Content: "250-500 mg."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regenerated.EndpointID != "ep2" || regenerated.Model != "claude-sonnet" || regenerated.ContextRole != "" {
+		t.Errorf("regenerated provenance = %+v", regenerated)
+	}
+
+	// Provenance older than the TTL is ignored
+	other, err := createConversation(ctx, scope, "Stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO conversation_reply_provenance (conversation_id, endpoint_id, model, created_at) VALUES (?, 'ep1', 'gpt-4o-mini', ?)
+	`, other.ID, formatStoredTime(time.Now().Add(-2*replyProvenanceTTL))); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := appendMessage(ctx, scope, other.ID, &ChatMessage{Role: "assistant", Content: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.EndpointID != "" {
+		t.Errorf("stale provenance used: %+v", stale)
+	}
+}
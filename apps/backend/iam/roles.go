@@ -2,23 +2,31 @@ package iam
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
+
+	"encore.dev/beta/errs"
 )
 
 // RoleDefinition defines a chat role with its scope and behavior
 type RoleDefinition struct {
-	ID          string   `json:"id"`
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Category    string   `json:"category"` // medical, tech, business, general, etc.
-	Scope       []string `json:"scope"`     // Topics this role can address
-	RefusalMsg  string   `json:"refusal_msg"`
-	SystemPrompt string  `json:"system_prompt"`
-	Suggestions  []string `json:"suggestions"` // Suggested external resources for out-of-scope questions
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Category     string   `json:"category"` // medical, tech, business, general, etc.
+	Scope        []string `json:"scope"`    // Topics this role can address
+	RefusalMsg   string   `json:"refusal_msg"`
+	SystemPrompt string   `json:"system_prompt"`
+	Suggestions  []string `json:"suggestions"`         // Suggested external resources for out-of-scope questions
+	TenantID     string   `json:"tenant_id,omitempty"` // Empty for global roles
+	Version      int      `json:"version,omitempty"`
+	UpdatedAt    string   `json:"updated_at,omitempty"`
 }
 
 // RoleResponse contains role definitions
@@ -263,24 +271,11 @@ For diagnosis questions, refer to a doctor. Pharmacists cannot diagnose diseases
 	},
 }
 
-// getRolesFilePath returns the path to the roles configuration file
-func getRolesFilePath() string {
-	return filepath.Join(getDataDir(), "roles.json")
-}
-
-// loadRoles loads role definitions from file or returns defaults
-func loadRoles() []RoleDefinition {
-	rolesPath := getRolesFilePath()
-
-	data, err := os.ReadFile(rolesPath)
+// legacyRoles returns the roles from a roles.json left in the data dir by
+// older versions, or the built-in defaults. They seed the global chat roles.
+func legacyRoles(dataDir string) []RoleDefinition {
+	data, err := os.ReadFile(filepath.Join(dataDir, "roles.json"))
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Create default roles file
-			if err := saveRoles(defaultRoles); err != nil {
-				return defaultRoles
-			}
-			return defaultRoles
-		}
 		return defaultRoles
 	}
 
@@ -299,66 +294,48 @@ func loadRoles() []RoleDefinition {
 	return roles.Roles
 }
 
-// saveRoles saves role definitions to file
-func saveRoles(roles []RoleDefinition) error {
-	rolesPath := getRolesFilePath()
-
-	data := struct {
-		Roles []RoleDefinition `json:"roles"`
-	}{
-		Roles: roles,
-	}
-
-	jsonData, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(rolesPath), 0755); err != nil {
-		return err
-	}
-
-	return os.WriteFile(rolesPath, jsonData, 0644)
-}
-
-// getRoleByID retrieves a role definition by ID
-func getRoleByID(roleID string) *RoleDefinition {
-	roles := loadRoles()
-	for _, role := range roles {
-		if role.ID == roleID {
-			return &role
-		}
+// MatchScopeKeyword returns the first scope keyword found in the question, or
+// "" if none matches. Keywords match at word boundaries, so "obat" matches
+// "obat" and "obatnya" but not a word that merely contains it. The last word
+// of a keyword may take a suffix; keywords of three letters or less must
+// match a whole word.
+func MatchScopeKeyword(question string, role *RoleDefinition) string {
+	if role == nil {
+		return ""
 	}
-	// Return general role as fallback
-	for _, role := range roles {
-		if role.ID == "general" {
-			return &role
+	words := scopeWords(question)
+	for _, keyword := range role.Scope {
+		kw := scopeWords(keyword)
+		if len(kw) > 0 && matchScopeWords(words, kw) {
+			return keyword
 		}
 	}
-	return nil
+	return ""
 }
 
-// isQuestionInScope checks if a question is within the role's scope
-func isQuestionInScope(question string, role *RoleDefinition) bool {
-	if role == nil {
-		return true // No restriction if no role
-	}
-
-	questionLower := strings.ToLower(question)
+func scopeWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
 
-	// Check if any scope keyword matches
-	for _, keyword := range role.Scope {
-		if strings.Contains(questionLower, strings.ToLower(keyword)) {
+// matchScopeWords reports whether the keyword words appear in order in words.
+func matchScopeWords(words, kw []string) bool {
+	for i := 0; i+len(kw) <= len(words); i++ {
+		ok := true
+		for j, k := range kw {
+			w := words[i+j]
+			last := j == len(kw)-1
+			if w == k || (last && len([]rune(k)) > 3 && strings.HasPrefix(w, k)) {
+				continue
+			}
+			ok = false
+			break
+		}
+		if ok {
 			return true
 		}
 	}
-
-	// If role is general, everything is in scope
-	if role.ID == "general" {
-		return true
-	}
-
 	return false
 }
 
@@ -379,20 +356,80 @@ func getOutOfScopeResponse(role *RoleDefinition) string {
 	return response
 }
 
-// GetRolesResponse returns all available roles
-//
-//encore:api auth method=GET path=/roles
-func GetRolesResponse(ctx context.Context) (*RoleResponse, error) {
-	roles := loadRoles()
+// GetRoleDefinition returns a role as a tenant sees it, at the given version
+// (0 for the current one). It falls back to the general role when the role
+// or version does not exist.
+func GetRoleDefinition(ctx context.Context, tenantID, roleID string, version int) *RoleDefinition {
+	role, err := findRole(ctx, tenantID, roleID, version)
+	if err == nil {
+		return role
+	}
+	if roleID != "general" {
+		fmt.Printf("[WARN] chat role %s v%d not found for tenant %s, using general: %v\n", roleID, version, tenantID, err)
+	}
+	role, err = findRole(ctx, tenantID, "general", 0)
+	if err != nil {
+		return nil
+	}
+	return role
+}
 
-	return &RoleResponse{Roles: roles}, nil
+// OutOfScopeResponse returns the refusal text for a role, including its suggestions.
+func OutOfScopeResponse(role *RoleDefinition) string {
+	return getOutOfScopeResponse(role)
 }
 
-// GetSystemPromptForRole returns the system prompt for a given role
-func GetSystemPromptForRole(roleID string) string {
-	role := getRoleByID(roleID)
-	if role == nil {
-		return ""
+// ProjectPromptSettings holds the stored project fields the llm service uses
+// to compose a system prompt.
+type ProjectPromptSettings struct {
+	ProjectID   string
+	ProjectName string
+	ContextRole string
+	// ContextRoleVersion is the pinned role version, 0 to follow the latest
+	ContextRoleVersion int
+	Instructions       string
+}
+
+// LoadProjectPromptSettings returns the project name, chat role and
+// Workspace > Context instructions of a tenant's project.
+func LoadProjectPromptSettings(ctx context.Context, tenantID, projectID string) (*ProjectPromptSettings, error) {
+	if strings.ContainsAny(projectID, `/\`) || strings.Contains(projectID, "..") ||
+		strings.ContainsAny(tenantID, `/\`) || strings.Contains(tenantID, "..") {
+		return nil, badRequest("invalid project id")
+	}
+
+	settings := &ProjectPromptSettings{ProjectID: projectID}
+	err := db.QueryRowContext(ctx, "SELECT name, COALESCE(context_role, 'general'), context_role_version FROM projects WHERE id = ? AND tenant_id = ?", projectID, tenantID).
+		Scan(&settings.ProjectName, &settings.ContextRole, &settings.ContextRoleVersion)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "project not found"}
+		}
+		return nil, err
+	}
+	if settings.ContextRole == "" {
+		settings.ContextRole = "general"
+	}
+
+	content, err := os.ReadFile(filepath.Join(getProjectPath(tenantID, projectID), "context.md"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	settings.Instructions = string(content)
+	return settings, nil
+}
+
+// GetProjectContextRole returns the chat role of a tenant's project and its
+// pinned version (0 to follow the latest).
+func GetProjectContextRole(ctx context.Context, tenantID, projectID string) (string, int, error) {
+	var contextRole string
+	var version int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(context_role, 'general'), context_role_version FROM projects WHERE id = ? AND tenant_id = ?", projectID, tenantID).Scan(&contextRole, &version)
+	if err != nil {
+		return "", 0, err
+	}
+	if contextRole == "" {
+		contextRole = "general"
 	}
-	return role.SystemPrompt
+	return contextRole, version, nil
 }
@@ -0,0 +1,23 @@
+-- Migration 12: LLM token and request quotas
+
+CREATE TABLE IF NOT EXISTS llm_quotas (
+  id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  scope_type TEXT NOT NULL CHECK (scope_type IN ('tenant', 'project', 'subclient')),
+  scope_id TEXT NOT NULL,
+  daily_tokens INTEGER NOT NULL DEFAULT 0,
+  monthly_tokens INTEGER NOT NULL DEFAULT 0,
+  requests_per_minute INTEGER NOT NULL DEFAULT 0,
+  soft_limit_percent REAL NOT NULL DEFAULT 80 CHECK (soft_limit_percent >= 0 AND soft_limit_percent <= 100),
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (scope_type, scope_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_llm_quotas_tenant_id ON llm_quotas(tenant_id);
+
+-- Usage rows can now be attributed to a subclient
+ALTER TABLE llm_usage ADD COLUMN subclient_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_llm_usage_project_created ON llm_usage(project_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_llm_usage_subclient_created ON llm_usage(subclient_id, created_at);
@@ -0,0 +1,7 @@
+-- Migration 13: last known health state of managed LLM endpoints
+
+ALTER TABLE llm_endpoints ADD COLUMN health_status TEXT NOT NULL DEFAULT 'unknown';
+ALTER TABLE llm_endpoints ADD COLUMN health_checked_at TEXT NOT NULL DEFAULT '';
+ALTER TABLE llm_endpoints ADD COLUMN health_latency_ms INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE llm_endpoints ADD COLUMN health_error TEXT NOT NULL DEFAULT '';
+ALTER TABLE llm_endpoints ADD COLUMN health_error_class TEXT NOT NULL DEFAULT '';
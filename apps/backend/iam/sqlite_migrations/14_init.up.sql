@@ -0,0 +1,5 @@
+-- Migration 14: chat role per project (previously only in schema.sql)
+
+ALTER TABLE projects ADD COLUMN context_role TEXT NOT NULL DEFAULT 'general';
+
+CREATE INDEX IF NOT EXISTS projects_context_role_idx ON projects(context_role);
@@ -0,0 +1,15 @@
+-- Migration 15: questions refused by role scope enforcement
+
+CREATE TABLE IF NOT EXISTS scope_refusals (
+  id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL DEFAULT '',
+  project_id TEXT NOT NULL DEFAULT '',
+  subclient_id TEXT NOT NULL DEFAULT '',
+  conversation_id TEXT NOT NULL DEFAULT '',
+  context_role TEXT NOT NULL,
+  question TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_scope_refusals_tenant_created ON scope_refusals(tenant_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_scope_refusals_project_created ON scope_refusals(project_id, created_at);
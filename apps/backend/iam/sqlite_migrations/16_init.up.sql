@@ -0,0 +1,31 @@
+-- Migration 16: chat roles in SQLite with versions
+-- tenant_id '' holds the global roles, and tenant rows add to or override them.
+
+CREATE TABLE IF NOT EXISTS chat_roles (
+  tenant_id TEXT NOT NULL DEFAULT '',
+  id TEXT NOT NULL,
+  current_version INTEGER NOT NULL DEFAULT 1,
+  created_by TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (tenant_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS chat_role_versions (
+  tenant_id TEXT NOT NULL DEFAULT '',
+  role_id TEXT NOT NULL,
+  version INTEGER NOT NULL,
+  name TEXT NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  category TEXT NOT NULL DEFAULT '',
+  scope TEXT NOT NULL DEFAULT '[]',
+  refusal_msg TEXT NOT NULL DEFAULT '',
+  system_prompt TEXT NOT NULL DEFAULT '',
+  suggestions TEXT NOT NULL DEFAULT '[]',
+  created_by TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (tenant_id, role_id, version)
+);
+
+-- 0 follows the role's current version
+ALTER TABLE projects ADD COLUMN context_role_version INTEGER NOT NULL DEFAULT 0;
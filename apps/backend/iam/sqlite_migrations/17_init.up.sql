@@ -0,0 +1,35 @@
+-- Migration 17: conversations and messages in SQLite with full-text search
+-- Replaces the chats/*.json files, and existing files are imported at startup.
+
+CREATE TABLE IF NOT EXISTS conversations (
+  id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL,
+  project_id TEXT NOT NULL,
+  subclient_id TEXT NOT NULL DEFAULT '',
+  title TEXT NOT NULL DEFAULT '',
+  message_count INTEGER NOT NULL DEFAULT 0,
+  last_message TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversations_scope_updated ON conversations(tenant_id, project_id, subclient_id, updated_at);
+
+CREATE TABLE IF NOT EXISTS conversation_messages (
+  id TEXT PRIMARY KEY,
+  conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+  seq INTEGER NOT NULL,
+  role TEXT NOT NULL,
+  content TEXT NOT NULL,
+  created_at DATETIME NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_conversation_messages_seq ON conversation_messages(conversation_id, seq);
+
+-- Kept in sync by the conversation store in the same transaction as conversation_messages
+CREATE VIRTUAL TABLE IF NOT EXISTS conversation_messages_fts USING fts5(
+  message_id UNINDEXED,
+  conversation_id UNINDEXED,
+  content,
+  tokenize = 'unicode61 remove_diacritics 2'
+)
@@ -0,0 +1,23 @@
+-- Migration 18: message branching
+-- Each message points at the message it answers or follows (parent_id, empty
+-- for the first message). Editing or regenerating a message adds a sibling,
+-- and active_leaf_id marks the branch the conversation currently shows.
+
+ALTER TABLE conversation_messages ADD COLUMN parent_id TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE conversations ADD COLUMN active_leaf_id TEXT NOT NULL DEFAULT '';
+
+-- Existing conversations are linear: each message follows the previous one
+UPDATE conversation_messages SET parent_id = COALESCE((
+  SELECT p.id FROM conversation_messages p
+  WHERE p.conversation_id = conversation_messages.conversation_id AND p.seq < conversation_messages.seq
+  ORDER BY p.seq DESC LIMIT 1
+), '');
+
+UPDATE conversations SET active_leaf_id = COALESCE((
+  SELECT m.id FROM conversation_messages m
+  WHERE m.conversation_id = conversations.id
+  ORDER BY m.seq DESC LIMIT 1
+), '');
+
+CREATE INDEX IF NOT EXISTS idx_conversation_messages_parent ON conversation_messages(conversation_id, parent_id)
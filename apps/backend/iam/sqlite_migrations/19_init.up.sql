@@ -0,0 +1,36 @@
+-- Migration 19: message provenance and feedback
+-- Assistant messages record the endpoint, model and chat role that produced
+-- them. Feedback copies those values so the review queue can filter on them
+-- without joining every message.
+
+ALTER TABLE conversation_messages ADD COLUMN endpoint_id TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE conversation_messages ADD COLUMN model TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE conversation_messages ADD COLUMN context_role TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE conversation_messages ADD COLUMN context_role_version INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS message_feedback (
+  id TEXT PRIMARY KEY,
+  message_id TEXT NOT NULL REFERENCES conversation_messages(id) ON DELETE CASCADE,
+  conversation_id TEXT NOT NULL,
+  tenant_id TEXT NOT NULL,
+  project_id TEXT NOT NULL,
+  subclient_id TEXT NOT NULL DEFAULT '',
+  source TEXT NOT NULL,
+  user_id TEXT NOT NULL DEFAULT '',
+  rating INTEGER NOT NULL,
+  comment TEXT NOT NULL DEFAULT '',
+  endpoint_id TEXT NOT NULL DEFAULT '',
+  model TEXT NOT NULL DEFAULT '',
+  context_role TEXT NOT NULL DEFAULT '',
+  context_role_version INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL
+);
+
+-- One rating per message and rater, embed visitors share user_id ''
+CREATE UNIQUE INDEX IF NOT EXISTS idx_message_feedback_rater ON message_feedback(message_id, source, user_id);
+
+CREATE INDEX IF NOT EXISTS idx_message_feedback_review ON message_feedback(tenant_id, rating, created_at)
@@ -0,0 +1,6 @@
+-- Migration 20: conversation title source
+-- default is the placeholder set when the client sends no title, client is a
+-- title sent at creation, generated comes from the first exchange and user is
+-- a rename. Only default and client titles are replaced by generated ones.
+
+ALTER TABLE conversations ADD COLUMN title_source TEXT NOT NULL DEFAULT 'client'
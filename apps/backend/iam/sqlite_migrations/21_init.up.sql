@@ -0,0 +1,19 @@
+-- Migration 21: context windows and conversation summaries
+-- Endpoints can set their context window and output limit, 0 infers them
+-- from the model name. Long conversations keep a rolling summary of the
+-- messages up to through_message_id on the branch it was built from.
+
+ALTER TABLE llm_endpoints ADD COLUMN context_window INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE llm_endpoints ADD COLUMN max_output_tokens INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS conversation_summaries (
+  conversation_id TEXT PRIMARY KEY REFERENCES conversations(id) ON DELETE CASCADE,
+  through_message_id TEXT NOT NULL,
+  message_count INTEGER NOT NULL DEFAULT 0,
+  summary TEXT NOT NULL,
+  token_estimate INTEGER NOT NULL DEFAULT 0,
+  model TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL
+)
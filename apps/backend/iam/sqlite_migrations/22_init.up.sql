@@ -0,0 +1,30 @@
+-- Migration 22: generation parameters
+-- NULL temperature and top_p use the defaults, stop_sequences is a JSON array
+-- and timeout_seconds 0 keeps the default timeout. Projects may override the
+-- parameters of endpoints with allow_project_overrides, clamped to the
+-- endpoint's own limits and max_temperature.
+
+ALTER TABLE llm_endpoints ADD COLUMN temperature REAL;
+
+ALTER TABLE llm_endpoints ADD COLUMN top_p REAL;
+
+ALTER TABLE llm_endpoints ADD COLUMN stop_sequences TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE llm_endpoints ADD COLUMN timeout_seconds INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE llm_endpoints ADD COLUMN max_temperature REAL NOT NULL DEFAULT 1;
+
+ALTER TABLE llm_endpoints ADD COLUMN allow_project_overrides INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS project_llm_settings (
+  project_id TEXT PRIMARY KEY REFERENCES projects(id) ON DELETE CASCADE,
+  tenant_id TEXT NOT NULL,
+  temperature REAL,
+  top_p REAL,
+  max_output_tokens INTEGER NOT NULL DEFAULT 0,
+  context_window INTEGER NOT NULL DEFAULT 0,
+  stop_sequences TEXT NOT NULL DEFAULT '',
+  timeout_seconds INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL
+)
@@ -0,0 +1,18 @@
+-- Migration 23: API keys for the OpenAI-compatible API
+-- Keys are stored as the sha256 of the token, like sessions.token_hash, and
+-- key_prefix keeps the first characters for display. project_id is empty for
+-- keys that can use every project of the tenant.
+
+CREATE TABLE IF NOT EXISTS api_keys (
+  id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  project_id TEXT NOT NULL DEFAULT '',
+  name TEXT NOT NULL,
+  key_prefix TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  created_by TEXT NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL,
+  revoked_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_tenant ON api_keys(tenant_id, project_id)
@@ -0,0 +1,10 @@
+-- Migration 24: API key scopes, expiry and last use
+-- scopes is a JSON array of conversations:read, generate and files:manage.
+-- Keys created before scopes existed were only used for the OpenAI-compatible
+-- API, so they keep generate. expires_at NULL means the key does not expire.
+
+ALTER TABLE api_keys ADD COLUMN scopes TEXT NOT NULL DEFAULT '["generate"]';
+
+ALTER TABLE api_keys ADD COLUMN expires_at DATETIME;
+
+ALTER TABLE api_keys ADD COLUMN last_used_at DATETIME
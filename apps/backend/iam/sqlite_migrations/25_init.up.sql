@@ -0,0 +1,48 @@
+-- Migration 25: retrieval over project files
+-- Files uploaded to a project are split into chunks with an embedding each.
+-- Embeddings are little-endian float32 vectors from the tenant's endpoint,
+-- model records which embedding model produced them. project_file_index
+-- tracks the indexing state of every file. Retrieval is enabled per project.
+
+CREATE TABLE IF NOT EXISTS file_chunks (
+  id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL,
+  project_id TEXT NOT NULL,
+  file_id TEXT NOT NULL,
+  file_name TEXT NOT NULL,
+  chunk_index INTEGER NOT NULL,
+  content TEXT NOT NULL,
+  token_estimate INTEGER NOT NULL DEFAULT 0,
+  embedding BLOB NOT NULL,
+  dimensions INTEGER NOT NULL,
+  model TEXT NOT NULL,
+  created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_chunks_project ON file_chunks(project_id, model);
+
+CREATE INDEX IF NOT EXISTS idx_file_chunks_file ON file_chunks(file_id);
+
+CREATE TABLE IF NOT EXISTS project_file_index (
+  file_id TEXT PRIMARY KEY,
+  tenant_id TEXT NOT NULL,
+  project_id TEXT NOT NULL,
+  file_name TEXT NOT NULL,
+  status TEXT NOT NULL,
+  chunk_count INTEGER NOT NULL DEFAULT 0,
+  error TEXT NOT NULL DEFAULT '',
+  model TEXT NOT NULL DEFAULT '',
+  indexed_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_project_file_index_project ON project_file_index(project_id);
+
+CREATE TABLE IF NOT EXISTS project_retrieval_settings (
+  project_id TEXT PRIMARY KEY REFERENCES projects(id) ON DELETE CASCADE,
+  tenant_id TEXT NOT NULL,
+  enabled INTEGER NOT NULL DEFAULT 0,
+  top_k INTEGER NOT NULL DEFAULT 0,
+  min_score REAL NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL
+)
@@ -0,0 +1,27 @@
+-- Migration 26: vector store
+-- Embedding vectors live in named collections, e.g. the chunks of one
+-- project's files for one embedding model. encoding is f32 for
+-- little-endian float32 values or i8 for int8 values multiplied by scale.
+-- metadata is a JSON object of strings. Chunk embeddings move here from
+-- file_chunks.
+
+CREATE TABLE IF NOT EXISTS vectors (
+  collection TEXT NOT NULL,
+  id TEXT NOT NULL,
+  dimensions INTEGER NOT NULL,
+  encoding TEXT NOT NULL DEFAULT 'f32',
+  scale REAL NOT NULL DEFAULT 1,
+  data BLOB NOT NULL,
+  metadata TEXT NOT NULL DEFAULT '{}',
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (collection, id)
+);
+
+INSERT OR IGNORE INTO vectors (collection, id, dimensions, encoding, scale, data, metadata, created_at)
+SELECT 'files:' || project_id || ':' || model, id, dimensions, 'f32', 1, embedding,
+  json_object('file_id', file_id), created_at
+FROM file_chunks;
+
+ALTER TABLE file_chunks DROP COLUMN embedding;
+
+ALTER TABLE file_chunks DROP COLUMN dimensions
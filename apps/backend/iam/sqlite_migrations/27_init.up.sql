@@ -0,0 +1,16 @@
+-- Migration 27: reply provenance recorded by the llm service
+-- Generating a reply for a stored conversation records the endpoint, model
+-- and chat role that produced it. Saving the assistant message takes the
+-- newest row, so clients never supply provenance themselves.
+
+CREATE TABLE IF NOT EXISTS conversation_reply_provenance (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  conversation_id TEXT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+  endpoint_id TEXT NOT NULL DEFAULT '',
+  model TEXT NOT NULL DEFAULT '',
+  context_role TEXT NOT NULL DEFAULT '',
+  context_role_version INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_reply_provenance_conversation ON conversation_reply_provenance(conversation_id, id)
@@ -0,0 +1,253 @@
+package llm
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/eino/components/model"
+)
+
+// In-memory caches of the llm service. Each is a bounded LRU with an
+// optional TTL and hit/miss counters. Writes that change what a cache holds
+// invalidate it right away: endpoint and allocation changes drop the
+// affected tenants' endpoints and the endpoint's chat models, key rotation
+// drops every model. System admins can read the counters and flush caches.
+
+const (
+	cacheEndpoints     = "endpoints"
+	cacheModels        = "models"
+	cacheSystemPrompts = "system_prompts"
+	cacheScopeScores   = "scope_scores"
+)
+
+// lruCache is a size-bounded LRU cache. Entries older than ttl (when set)
+// count as misses and are dropped on access.
+type lruCache[V any] struct {
+	name    string
+	maxSize int
+	ttl     time.Duration
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+
+	hits, misses, evictions, invalidations uint64
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[V any](name string, maxSize int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{
+		name:    name,
+		maxSize: maxSize,
+		ttl:     ttl,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return zero, false
+	}
+	e := el.Value.(*lruEntry[V])
+	if c.ttl > 0 && time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		c.misses++
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	c.hits++
+	return e.value, true
+}
+
+func (c *lruCache[V]) set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry[V])
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expires: expires})
+	for c.maxSize > 0 && c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+		c.evictions++
+	}
+}
+
+func (c *lruCache[V]) delete(key string) {
+	c.deleteFunc(func(k string, _ V) bool { return k == key })
+}
+
+// deleteFunc removes the entries matching fn and returns how many were removed.
+func (c *lruCache[V]) deleteFunc(fn func(key string, value V) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, el := range c.items {
+		if fn(key, el.Value.(*lruEntry[V]).value) {
+			c.order.Remove(el)
+			delete(c.items, key)
+			removed++
+		}
+	}
+	c.invalidations += uint64(removed)
+	return removed
+}
+
+// purge empties the cache and returns how many entries it held.
+func (c *lruCache[V]) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.order.Len()
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.invalidations += uint64(n)
+	return n
+}
+
+// CacheStats are the counters of one cache since the process started.
+type CacheStats struct {
+	Name          string  `json:"name"`
+	Size          int     `json:"size"`
+	MaxSize       int     `json:"max_size"`
+	TTLSeconds    int     `json:"ttl_seconds"` // 0 means entries do not expire
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	HitRate       float64 `json:"hit_rate"`
+	Evictions     uint64  `json:"evictions"`
+	Invalidations uint64  `json:"invalidations"`
+}
+
+func (c *lruCache[V]) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := CacheStats{
+		Name:          c.name,
+		Size:          c.order.Len(),
+		MaxSize:       c.maxSize,
+		TTLSeconds:    int(c.ttl / time.Second),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Invalidations: c.invalidations,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		st.HitRate = float64(c.hits) / float64(total)
+	}
+	return st
+}
+
+// cacheControl is the part of a cache the admin endpoints use.
+type cacheControl interface {
+	purge() int
+	stats() CacheStats
+}
+
+func (s *Service) caches() []cacheControl {
+	return []cacheControl{s.endpointCache, s.modelCache, s.systemPromptCache, s.scopeCache}
+}
+
+// invalidateEndpointCache drops all cached endpoint candidates
+func (s *Service) invalidateEndpointCache() {
+	s.endpointCache.purge()
+}
+
+// invalidateTenantEndpoints drops the cached endpoint candidates of one tenant.
+func (s *Service) invalidateTenantEndpoints(tenantID string) {
+	s.endpointCache.delete(tenantID)
+}
+
+// invalidateEndpoint drops everything cached for a managed endpoint: its
+// chat models and the endpoint candidates of all tenants, since activating
+// an endpoint adds it to tenants whose cached list does not have it.
+func (s *Service) invalidateEndpoint(endpointID string) {
+	tenants := s.endpointCache.purge()
+	models := s.modelCache.deleteFunc(func(key string, _ model.ToolCallingChatModel) bool {
+		return strings.HasPrefix(key, endpointID+"|")
+	})
+	fmt.Printf("[LLM] Invalidated endpoint %s: %d tenant(s), %d model(s)\n", endpointID, tenants, models)
+}
+
+// keyFingerprint identifies an api key in cache keys without storing it.
+func keyFingerprint(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:6])
+}
+
+type CacheStatsResponse struct {
+	Items []CacheStats `json:"items"`
+}
+
+// GetCacheStats returns size, hit and eviction counters of the llm caches.
+//
+//encore:api auth method=GET path=/llm/cache
+func (s *Service) GetCacheStats(ctx context.Context) (*CacheStatsResponse, error) {
+	if err := requireSystemRole(); err != nil {
+		return nil, err
+	}
+	resp := &CacheStatsResponse{Items: make([]CacheStats, 0, len(s.caches()))}
+	for _, c := range s.caches() {
+		resp.Items = append(resp.Items, c.stats())
+	}
+	return resp, nil
+}
+
+type FlushCacheParams struct {
+	// Cache is one of endpoints, models, system_prompts or scope_scores;
+	// empty flushes all of them.
+	Cache string `json:"cache"`
+}
+
+type FlushCacheResponse struct {
+	Flushed map[string]int `json:"flushed"`
+}
+
+// FlushCache empties one or all llm caches and reports how many entries
+// each held.
+//
+//encore:api auth method=POST path=/llm/cache/flush
+func (s *Service) FlushCache(ctx context.Context, p *FlushCacheParams) (*FlushCacheResponse, error) {
+	if err := requireSystemRole(); err != nil {
+		return nil, err
+	}
+	name := ""
+	if p != nil {
+		name = strings.TrimSpace(p.Cache)
+	}
+	resp := &FlushCacheResponse{Flushed: make(map[string]int)}
+	for _, c := range s.caches() {
+		if st := c.stats(); name == "" || st.Name == name {
+			resp.Flushed[st.Name] = c.purge()
+		}
+	}
+	if len(resp.Flushed) == 0 {
+		return nil, badRequest("unknown cache " + name)
+	}
+	fmt.Printf("[LLM] Flushed caches: %v\n", resp.Flushed)
+	return resp, nil
+}
@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudwego/eino/components/model"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := newLRUCache[int]("test", 2, 0)
+	c.set("a", 1)
+	c.set("b", 2)
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Fatalf("get(a) = %d, %v", v, ok)
+	}
+	// b is now the least recently used entry and makes room for c
+	c.set("c", 3)
+	if _, ok := c.get("b"); ok {
+		t.Error("b survived eviction")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("recently used a was evicted")
+	}
+	c.set("c", 30)
+	if v, _ := c.get("c"); v != 30 {
+		t.Errorf("get(c) = %d after update, want 30", v)
+	}
+
+	st := c.stats()
+	if st.Name != "test" || st.Size != 2 || st.MaxSize != 2 || st.Hits != 3 || st.Misses != 1 || st.Evictions != 1 || st.HitRate != 0.75 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c := newLRUCache[string]("ttl", 10, time.Hour)
+	c.set("fresh", "x")
+	if _, ok := c.get("fresh"); !ok {
+		t.Error("fresh entry missed")
+	}
+	c.items["fresh"].Value.(*lruEntry[string]).expires = time.Now().Add(-time.Second)
+	if _, ok := c.get("fresh"); ok {
+		t.Error("expired entry was returned")
+	}
+	if st := c.stats(); st.Size != 0 || st.TTLSeconds != 3600 {
+		t.Errorf("stats = %+v, want the expired entry dropped", st)
+	}
+}
+
+func TestLRUCacheInvalidation(t *testing.T) {
+	c := newLRUCache[int]("inv", 10, 0)
+	for i, key := range []string{"ep1|a", "ep1|b", "ep2|a"} {
+		c.set(key, i)
+	}
+	if n := c.deleteFunc(func(key string, _ int) bool { return key[:4] == "ep1|" }); n != 2 {
+		t.Errorf("deleteFunc removed %d, want 2", n)
+	}
+	c.delete("missing")
+	if n := c.purge(); n != 1 {
+		t.Errorf("purge removed %d, want 1", n)
+	}
+	if st := c.stats(); st.Size != 0 || st.Invalidations != 3 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestInvalidateEndpoint(t *testing.T) {
+	s := &Service{
+		endpointCache: newLRUCache[[]endpointCandidate](cacheEndpoints, 10, time.Minute),
+		modelCache:    newLRUCache[model.ToolCallingChatModel](cacheModels, 10, 0),
+	}
+	s.endpointCache.set("t1", nil)
+	s.endpointCache.set("t2", nil)
+	s.modelCache.set("ep_1|openai|gpt-4o", nil)
+	s.modelCache.set("ep_10|openai|gpt-4o", nil)
+
+	s.invalidateEndpoint("ep_1")
+	if st := s.endpointCache.stats(); st.Size != 0 {
+		t.Errorf("%d tenant endpoint lists left, want none", st.Size)
+	}
+	if _, ok := s.modelCache.get("ep_1|openai|gpt-4o"); ok {
+		t.Error("model of the changed endpoint is still cached")
+	}
+	if _, ok := s.modelCache.get("ep_10|openai|gpt-4o"); !ok {
+		t.Error("model of another endpoint was dropped")
+	}
+
+	s.endpointCache.set("t1", nil)
+	s.endpointCache.set("t2", nil)
+	s.invalidateTenantEndpoints("t1")
+	if _, ok := s.endpointCache.get("t2"); !ok || s.endpointCache.stats().Size != 1 {
+		t.Error("invalidating one tenant dropped another")
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	if keyFingerprint("") != "" {
+		t.Error("empty key has a fingerprint")
+	}
+	a, b := keyFingerprint("sk-one"), keyFingerprint("sk-two")
+	if len(a) != 12 || a == b || a != keyFingerprint("sk-one") {
+		t.Errorf("fingerprints %q and %q", a, b)
+	}
+}
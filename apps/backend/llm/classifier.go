@@ -0,0 +1,266 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/backend/iam"
+
+	"github.com/cloudwego/eino/components/embedding"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// Scope classifier names, selected with LLM_SCOPE_CLASSIFIER.
+const (
+	classifierKeyword   = "keyword"
+	classifierLLM       = "llm"
+	classifierEmbedding = "embedding"
+)
+
+const (
+	scopeCacheTTL     = time.Hour
+	scopeCacheMaxSize = 5000
+)
+
+// ScopeVerdict is a classifier's answer for one question. Score is the
+// confidence that the question is in scope, from 0 to 1.
+type ScopeVerdict struct {
+	InScope    bool    `json:"in_scope"`
+	Score      float64 `json:"score"`
+	Classifier string  `json:"classifier"`
+	Reason     string  `json:"reason,omitempty"`
+	Cached     bool    `json:"cached,omitempty"`
+}
+
+// ScopeClassifier decides whether a question fits a chat role.
+type ScopeClassifier interface {
+	Name() string
+	// Score returns the confidence (0..1) that the question is in the role's scope.
+	Score(ctx context.Context, role *iam.RoleDefinition, question string) (float64, string, error)
+}
+
+// scopeClassifierName reads LLM_SCOPE_CLASSIFIER, defaulting to keyword.
+func scopeClassifierName() string {
+	switch name := strings.ToLower(strings.TrimSpace(os.Getenv("LLM_SCOPE_CLASSIFIER"))); name {
+	case classifierLLM, classifierEmbedding:
+		return name
+	default:
+		return classifierKeyword
+	}
+}
+
+// scopeThreshold reads LLM_SCOPE_THRESHOLD, or the classifier's default.
+// Embedding scores are cosine similarities and sit lower than probabilities.
+func scopeThreshold(classifier string) float64 {
+	if raw := strings.TrimSpace(os.Getenv("LLM_SCOPE_THRESHOLD")); raw != "" {
+		if v, err := strconv.ParseFloat(raw, 64); err == nil && v >= 0 && v <= 1 {
+			return v
+		}
+	}
+	if classifier == classifierEmbedding {
+		return 0.35
+	}
+	return 0.5
+}
+
+// scopeClassifier builds the named classifier for a tenant.
+func (s *Service) scopeClassifier(name, tenantID string) ScopeClassifier {
+	switch name {
+	case classifierLLM:
+		return &llmScopeClassifier{svc: s, tenantID: tenantID}
+	case classifierEmbedding:
+		return &embeddingScopeClassifier{svc: s, tenantID: tenantID}
+	default:
+		return keywordScopeClassifier{}
+	}
+}
+
+// classifyScope runs the classifier with caching. When the LLM or embedding
+// classifier fails it falls back to keyword matching so chat keeps working.
+func (s *Service) classifyScope(ctx context.Context, tenantID string, role *iam.RoleDefinition, question, classifierName string, threshold float64) ScopeVerdict {
+	key := scopeCacheKey(classifierName, tenantID, role, question)
+	if cached, ok := s.scopeCache.get(key); ok {
+		return ScopeVerdict{InScope: cached.score >= threshold, Score: cached.score, Classifier: classifierName, Reason: cached.reason, Cached: true}
+	}
+
+	classifier := s.scopeClassifier(classifierName, tenantID)
+	score, reason, err := classifier.Score(ctx, role, question)
+	if err != nil {
+		fmt.Printf("[LLM] Scope: %s classifier failed, using keyword: %v\n", classifier.Name(), err)
+		classifier = keywordScopeClassifier{}
+		score, reason, _ = classifier.Score(ctx, role, question)
+		threshold = scopeThreshold(classifierKeyword)
+		// Not cached, the next request retries the real classifier
+		return ScopeVerdict{InScope: score >= threshold, Score: score, Classifier: classifier.Name(), Reason: reason}
+	}
+
+	s.scopeCache.set(key, scopeScore{score: score, reason: reason})
+	return ScopeVerdict{InScope: score >= threshold, Score: score, Classifier: classifier.Name(), Reason: reason}
+}
+
+// scopeCacheKey hashes the normalized question together with everything
+// that can change the answer.
+func scopeCacheKey(classifier, tenantID string, role *iam.RoleDefinition, question string) string {
+	h := sha256.New()
+	roleKey, _ := json.Marshal([]interface{}{role.ID, role.Scope, role.Description})
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", classifier, tenantID, roleKey)
+	h.Write([]byte(strings.Join(strings.Fields(strings.ToLower(question)), " ")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scopeScore is a cached classifier result, kept for scopeCacheTTL.
+type scopeScore struct {
+	score  float64
+	reason string
+}
+
+// keywordScopeClassifier matches the role's scope keywords at word
+// boundaries (see iam.MatchScopeKeyword). It scores 1 or 0.
+type keywordScopeClassifier struct{}
+
+func (keywordScopeClassifier) Name() string { return classifierKeyword }
+
+func (keywordScopeClassifier) Score(_ context.Context, role *iam.RoleDefinition, question string) (float64, string, error) {
+	if role == nil || role.ID == defaultContextRole {
+		return 1, "general role", nil
+	}
+	if keyword := iam.MatchScopeKeyword(question, role); keyword != "" {
+		return 1, "keyword: " + keyword, nil
+	}
+	return 0, "no scope keyword", nil
+}
+
+// llmScopeClassifier asks the tenant's model for a zero-shot in/out decision.
+type llmScopeClassifier struct {
+	svc      *Service
+	tenantID string
+}
+
+func (c *llmScopeClassifier) Name() string { return classifierLLM }
+
+func (c *llmScopeClassifier) Score(ctx context.Context, role *iam.RoleDefinition, question string) (float64, string, error) {
+	if role == nil || role.ID == defaultContextRole {
+		return 1, "general role", nil
+	}
+	cfgs, err := c.svc.resolveConfigs(ctx, c.tenantID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	system := fmt.Sprintf(`You decide whether a user question falls within the scope of an assistant.
+Assistant: %s
+Description: %s
+Topics in scope: %s
+
+Questions may be in any language. Follow-up and paraphrased questions about in-scope topics are in scope.
+Answer with JSON only: {"in_scope": true or false, "confidence": number between 0 and 1, "reason": short reason}`,
+		role.Name, role.Description, strings.Join(role.Scope, ", "))
+	messages := []*schema.Message{schema.SystemMessage(system), schema.UserMessage(question)}
+
+	ctx = withUsageScope(ctx, c.tenantID, usageScopeFrom(ctx).ProjectID, usageScopeFrom(ctx).SubclientID, "scope_classify")
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	var resp *schema.Message
+	_, err = c.svc.withFailover(ctx, cfgs, func(ctx context.Context, cfg *ModelConfig) error {
+		chatModel, err := c.svc.getChatModel(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		resp, err = chatModel.Generate(ctx, messages, model.WithTemperature(0), model.WithMaxTokens(100))
+		recordUsage(ctx, resp, err, time.Since(start))
+		return err
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	var out struct {
+		InScope    bool    `json:"in_scope"`
+		Confidence float64 `json:"confidence"`
+		Reason     string  `json:"reason"`
+	}
+	content := strings.TrimSpace(resp.Content)
+	if i, j := strings.Index(content, "{"), strings.LastIndex(content, "}"); i >= 0 && j > i {
+		content = content[i : j+1]
+	}
+	if err := json.Unmarshal([]byte(content), &out); err != nil {
+		return 0, "", fmt.Errorf("parse classifier reply: %w", err)
+	}
+	if out.Confidence <= 0 || out.Confidence > 1 {
+		out.Confidence = 1
+	}
+	score := out.Confidence
+	if !out.InScope {
+		score = 1 - out.Confidence
+	}
+	return score, out.Reason, nil
+}
+
+// embeddingScopeClassifier compares the question embedding with embeddings
+// of the role description and each scope topic, and scores the best match.
+type embeddingScopeClassifier struct {
+	svc      *Service
+	tenantID string
+}
+
+func (c *embeddingScopeClassifier) Name() string { return classifierEmbedding }
+
+func (c *embeddingScopeClassifier) Score(ctx context.Context, role *iam.RoleDefinition, question string) (float64, string, error) {
+	if role == nil || role.ID == defaultContextRole {
+		return 1, "general role", nil
+	}
+	embedder, err := c.svc.embedderForTenant(ctx, c.tenantID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	collection, err := c.svc.roleEmbeddings(ctx, embedder, role)
+	if err != nil {
+		return 0, "", err
+	}
+	vectors, err := embedder.EmbedStrings(ctx, []string{question})
+	if err != nil {
+		return 0, "", err
+	}
+	matches, err := c.svc.vectors.Search(ctx, collection, vectors[0], VectorSearchOptions{Limit: 1})
+	if err != nil {
+		return 0, "", err
+	}
+
+	if len(matches) == 0 || matches[0].Score <= 0 {
+		return 0, "closest: ", nil
+	}
+	return matches[0].Score, "closest: " + matches[0].Metadata["text"], nil
+}
+
+// roleEmbeddings embeds the role's description and scope topics once per
+// role definition and embedding model into a vector store collection, and
+// returns the collection.
+func (s *Service) roleEmbeddings(ctx context.Context, embedder embedding.Embedder, role *iam.RoleDefinition) (string, error) {
+	collection := "roles:" + scopeCacheKey(classifierEmbedding, "", role, embeddingModel())
+	if n, err := s.vectors.Count(ctx, collection); err != nil || n > 0 {
+		return collection, err
+	}
+
+	texts := []string{role.Name + ": " + role.Description}
+	texts = append(texts, role.Scope...)
+	vectors, err := embedder.EmbedStrings(ctx, texts)
+	if err != nil {
+		return "", err
+	}
+	items := make([]VectorItem, len(texts))
+	for i := range texts {
+		items[i] = VectorItem{ID: fmt.Sprintf("p%d", i), Vector: vectors[i], Metadata: map[string]string{"text": texts[i]}}
+	}
+	return collection, s.vectors.Upsert(ctx, collection, items)
+}
@@ -0,0 +1,150 @@
+package llm
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/backend/iam"
+)
+
+func TestScopeClassifierName(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"", classifierKeyword},
+		{"keyword", classifierKeyword},
+		{"LLM", classifierLLM},
+		{" embedding ", classifierEmbedding},
+		{"bayes", classifierKeyword},
+	}
+	for _, tt := range tests {
+		t.Setenv("LLM_SCOPE_CLASSIFIER", tt.env)
+		if got := scopeClassifierName(); got != tt.want {
+			t.Errorf("LLM_SCOPE_CLASSIFIER=%q: classifier = %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestScopeThreshold(t *testing.T) {
+	tests := []struct {
+		classifier string
+		env        string
+		want       float64
+	}{
+		{classifierKeyword, "", 0.5},
+		{classifierLLM, "", 0.5},
+		{classifierEmbedding, "", 0.35},
+		{classifierLLM, "0.7", 0.7},
+		{classifierEmbedding, "0", 0},
+		{classifierEmbedding, "1", 1},
+		// Out of range and unparsable values fall back to the default
+		{classifierLLM, "1.5", 0.5},
+		{classifierEmbedding, "-0.1", 0.35},
+		{classifierLLM, "high", 0.5},
+	}
+	for _, tt := range tests {
+		t.Setenv("LLM_SCOPE_THRESHOLD", tt.env)
+		if got := scopeThreshold(tt.classifier); got != tt.want {
+			t.Errorf("%s with LLM_SCOPE_THRESHOLD=%q: threshold = %v, want %v", tt.classifier, tt.env, got, tt.want)
+		}
+	}
+}
+
+func pharmacistRole() *iam.RoleDefinition {
+	return &iam.RoleDefinition{
+		ID:          "pharmacist",
+		Name:        "Pharmacist",
+		Description: "Answers questions about medicines",
+		Scope:       []string{"obat", "dosis", "side effect"},
+	}
+}
+
+func TestClassifyScopeThresholds(t *testing.T) {
+	role := pharmacistRole()
+	tests := []struct {
+		name      string
+		score     float64
+		threshold float64
+		wantIn    bool
+	}{
+		{"above threshold", 0.9, 0.5, true},
+		{"at threshold", 0.5, 0.5, true},
+		{"just below threshold", 0.49, 0.5, false},
+		{"embedding similarity above", 0.36, 0.35, true},
+		{"embedding similarity below", 0.2, 0.35, false},
+		{"zero threshold admits everything", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{scopeCache: newLRUCache[scopeScore](cacheScopeScores, 10, scopeCacheTTL)}
+			question := "Berapa dosis paracetamol?"
+			s.scopeCache.set(scopeCacheKey(classifierLLM, "t1", role, question), scopeScore{score: tt.score, reason: "stub"})
+
+			v := s.classifyScope(context.Background(), "t1", role, question, classifierLLM, tt.threshold)
+			if v.InScope != tt.wantIn || v.Score != tt.score || !v.Cached || v.Classifier != classifierLLM {
+				t.Errorf("verdict = %+v, want in_scope=%v score=%v from cache", v, tt.wantIn, tt.score)
+			}
+		})
+	}
+}
+
+func TestClassifyScopeKeyword(t *testing.T) {
+	role := pharmacistRole()
+	tests := []struct {
+		question string
+		wantIn   bool
+	}{
+		{"Berapa dosis paracetamol untuk anak?", true},
+		{"Apakah obatnya aman?", true},
+		{"What is the side effect of ibuprofen?", true},
+		{"Siapa juara liga kemarin?", false},
+	}
+	for _, tt := range tests {
+		s := &Service{scopeCache: newLRUCache[scopeScore](cacheScopeScores, 10, scopeCacheTTL)}
+		v := s.classifyScope(context.Background(), "t1", role, tt.question, classifierKeyword, scopeThreshold(classifierKeyword))
+		if v.InScope != tt.wantIn {
+			t.Errorf("%q: verdict = %+v, want in_scope=%v", tt.question, v, tt.wantIn)
+		}
+		// A repeated question is answered from the cache
+		if again := s.classifyScope(context.Background(), "t1", role, "  "+tt.question, classifierKeyword, 0.5); !again.Cached || again.InScope != tt.wantIn {
+			t.Errorf("%q: repeated verdict = %+v", tt.question, again)
+		}
+	}
+}
+
+func TestClassifyScopeFallsBackToKeyword(t *testing.T) {
+	t.Setenv("LLM_SCOPE_THRESHOLD", "")
+	// No endpoints and no default model, so the llm classifier fails
+	s := &Service{scopeCache: newLRUCache[scopeScore](cacheScopeScores, 10, scopeCacheTTL)}
+	role := pharmacistRole()
+
+	v := s.classifyScope(context.Background(), "", role, "Berapa dosis paracetamol?", classifierLLM, 0.9)
+	if v.Classifier != classifierKeyword || !v.InScope {
+		t.Fatalf("verdict = %+v, want an in-scope keyword verdict", v)
+	}
+	if _, ok := s.scopeCache.get(scopeCacheKey(classifierLLM, "", role, "Berapa dosis paracetamol?")); ok {
+		t.Error("fallback verdict was cached for the llm classifier")
+	}
+}
+
+func TestScopeCacheKey(t *testing.T) {
+	role := pharmacistRole()
+	base := scopeCacheKey(classifierLLM, "t1", role, "Berapa dosis obat?")
+
+	if got := scopeCacheKey(classifierLLM, "t1", role, "  berapa   DOSIS obat? "); got != base {
+		t.Error("case and spacing changed the cache key")
+	}
+	changed := *role
+	changed.Scope = append([]string{"vitamin"}, role.Scope...)
+	for name, key := range map[string]string{
+		"classifier": scopeCacheKey(classifierEmbedding, "t1", role, "Berapa dosis obat?"),
+		"tenant":     scopeCacheKey(classifierLLM, "t2", role, "Berapa dosis obat?"),
+		"role scope": scopeCacheKey(classifierLLM, "t1", &changed, "Berapa dosis obat?"),
+		"question":   scopeCacheKey(classifierLLM, "t1", role, "Berapa harga obat?"),
+	} {
+		if key == base {
+			t.Errorf("changing the %s kept the cache key", name)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"encore.app/backend/iam"
+	"encore.app/backend/llm/providers"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"github.com/cloudwego/eino/components/embedding"
+)
+
+// defaultEmbeddingModel is used when LLM_EMBEDDING_MODEL is not set.
+const defaultEmbeddingModel = "text-embedding-3-small"
+
+// Limits of one Embeddings request.
+const (
+	maxEmbeddingInputs     = 256
+	maxEmbeddingInputBytes = 1 << 20
+)
+
+type EmbeddingsParams struct {
+	Input []string `json:"input"`
+	// ProjectID meters usage and quotas on a project of the caller's tenant;
+	// project-bound callers always use their project.
+	ProjectID string `json:"project_id,omitempty"`
+}
+
+type EmbeddingsResponse struct {
+	Model        string `json:"model"`
+	EndpointID   string `json:"endpoint_id,omitempty"`
+	EndpointName string `json:"endpoint_name,omitempty"`
+	Dimensions   int    `json:"dimensions"`
+	// Embeddings holds one vector per input, in input order
+	Embeddings    [][]float64 `json:"embeddings"`
+	Usage         *TokenUsage `json:"usage,omitempty"`
+	QuotaWarnings []string    `json:"quota_warnings,omitempty"`
+}
+
+// Embeddings returns embedding vectors for the input texts. Requests go to
+// the tenant's endpoints in allocation order and count against its quotas,
+// like Generate.
+//
+//encore:api auth method=POST path=/llm/embeddings
+func (s *Service) Embeddings(ctx context.Context, p *EmbeddingsParams) (*EmbeddingsResponse, error) {
+	if p == nil || len(p.Input) == 0 {
+		return nil, badRequest("input is required")
+	}
+	if len(p.Input) > maxEmbeddingInputs {
+		return nil, badRequest(fmt.Sprintf("input accepts at most %d texts", maxEmbeddingInputs))
+	}
+	size := 0
+	for _, text := range p.Input {
+		if strings.TrimSpace(text) == "" {
+			return nil, badRequest("input texts must not be empty")
+		}
+		size += len(text)
+	}
+	if size > maxEmbeddingInputBytes {
+		return nil, badRequest(fmt.Sprintf("input must not exceed %d MB", maxEmbeddingInputBytes>>20))
+	}
+
+	data, ok := auth.Data().(*iam.AuthData)
+	if !ok || data == nil || data.TenantID == "" {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "a tenant account is required"}
+	}
+	projectID, err := authorizedProject(ctx, data, p.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	subclientID := firstNonEmpty(sessionSubclientID(data), data.SubclientID)
+	ctx = withUsageScope(ctx, data.TenantID, projectID, subclientID, "embed")
+	quotaWarnings, err := checkQuotas(ctx, data.TenantID, projectID, subclientID)
+	if err != nil {
+		return nil, err
+	}
+	embedder, err := s.embedderForTenant(ctx, data.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	vectors, served, tokens, err := embedder.embed(ctx, p.Input)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Internal, Message: fmt.Sprintf("embeddings failed: %v", err)}
+	}
+
+	out := &EmbeddingsResponse{
+		Model:         embeddingModel(),
+		EndpointID:    served.EndpointID,
+		EndpointName:  served.EndpointName,
+		Embeddings:    vectors,
+		QuotaWarnings: quotaWarnings,
+	}
+	if len(vectors) > 0 {
+		out.Dimensions = len(vectors[0])
+	}
+	if tokens > 0 {
+		out.Usage = &TokenUsage{PromptTokens: tokens, TotalTokens: tokens}
+	}
+	return out, nil
+}
+
+// openAIEmbedder calls an OpenAI-compatible /embeddings endpoint. It
+// implements eino's embedding.Embedder.
+type openAIEmbedder struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+var _ embedding.Embedder = (*openAIEmbedder)(nil)
+
+func embeddingModel() string {
+	return firstNonEmpty(strings.TrimSpace(os.Getenv("LLM_EMBEDDING_MODEL")), defaultEmbeddingModel)
+}
+
+func newOpenAIEmbedder(cfg *ModelConfig) *openAIEmbedder {
+	return &openAIEmbedder{
+		baseURL: strings.TrimRight(firstNonEmpty(cfg.BaseURL, "https://api.openai.com/v1"), "/"),
+		apiKey:  cfg.APIKey,
+		model:   embeddingModel(),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// EmbedStrings returns one vector per text, in input order.
+func (e *openAIEmbedder) EmbedStrings(ctx context.Context, texts []string, opts ...embedding.Option) ([][]float64, error) {
+	vectors, _, err := e.embed(ctx, texts, opts...)
+	return vectors, err
+}
+
+// embed returns one vector per text and the prompt tokens the endpoint
+// reported.
+func (e *openAIEmbedder) embed(ctx context.Context, texts []string, opts ...embedding.Option) ([][]float64, int, error) {
+	if len(texts) == 0 {
+		return nil, 0, nil
+	}
+	modelName := e.model
+	o := embedding.GetCommonOptions(&embedding.Options{Model: &modelName}, opts...)
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"model": *o.Model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.baseURL+"/embeddings", bytes.NewReader(payload))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("embeddings: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, 0, fmt.Errorf("embeddings: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, 0, fmt.Errorf("embeddings: decode response: %w", err)
+	}
+	if len(out.Data) != len(texts) {
+		return nil, 0, fmt.Errorf("embeddings: got %d vectors for %d inputs", len(out.Data), len(texts))
+	}
+	sort.Slice(out.Data, func(i, j int) bool { return out.Data[i].Index < out.Data[j].Index })
+	vectors := make([][]float64, len(out.Data))
+	for i, d := range out.Data {
+		vectors[i] = d.Embedding
+	}
+	return vectors, out.Usage.PromptTokens, nil
+}
+
+// allocatedEmbedder embeds through the tenant's endpoints in allocation
+// order, like chat requests, and records usage for every call. Failures
+// move on to the next endpoint but don't trip the circuit breaker: an
+// endpoint without an embeddings route can still serve chat.
+type allocatedEmbedder struct {
+	tenantID string
+	cfgs     []*ModelConfig
+}
+
+var _ embedding.Embedder = (*allocatedEmbedder)(nil)
+
+func (a *allocatedEmbedder) EmbedStrings(ctx context.Context, texts []string, opts ...embedding.Option) ([][]float64, error) {
+	vectors, _, _, err := a.embed(ctx, texts, opts...)
+	return vectors, err
+}
+
+// embed returns the vectors, the config that served them and the prompt
+// tokens used.
+func (a *allocatedEmbedder) embed(ctx context.Context, texts []string, opts ...embedding.Option) ([][]float64, *ModelConfig, int, error) {
+	scope := usageScopeFrom(ctx)
+	ctx = withUsageScope(ctx, firstNonEmpty(scope.TenantID, a.tenantID), scope.ProjectID, scope.SubclientID, "embed")
+
+	var lastErr error
+	for _, cfg := range a.cfgs {
+		if ctx.Err() != nil {
+			break
+		}
+		embedder := newOpenAIEmbedder(cfg)
+		start := time.Now()
+		vectors, tokens, err := embedder.embed(ctx, texts, opts...)
+		usageCtx := withUsageEndpoint(ctx, &ModelConfig{EndpointID: cfg.EndpointID, Model: embedder.model})
+		recordTokenUsage(usageCtx, tokens, 0, tokens, err, time.Since(start))
+		if err == nil {
+			return vectors, cfg, tokens, nil
+		}
+		lastErr = err
+		if isRateLimitError(err) {
+			return nil, nil, 0, err
+		}
+		fmt.Printf("[WARN] Embeddings on endpoint %s (%s) failed: %v\n", cfg.EndpointName, cfg.EndpointID, err)
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, nil, 0, lastErr
+}
+
+// embedderForTenant returns an embedder on the tenant's OpenAI-compatible
+// endpoints, or on the default environment config.
+func (s *Service) embedderForTenant(ctx context.Context, tenantID string) (*allocatedEmbedder, error) {
+	cfgs, err := s.resolveConfigs(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	var usable []*ModelConfig
+	for _, cfg := range cfgs {
+		if providers.Normalize(cfg.Provider) == providers.OpenAICompatible && cfg.APIKey != "" {
+			usable = append(usable, cfg)
+		}
+	}
+	if len(usable) == 0 {
+		def := defaultConfig()
+		if def.APIKey == "" {
+			return nil, &errs.Error{Code: errs.Unavailable, Message: "no OpenAI-compatible endpoint available for embeddings"}
+		}
+		usable = append(usable, def)
+	}
+	return &allocatedEmbedder{tenantID: tenantID, cfgs: usable}, nil
+}
+
+// cosineSimilarity returns the cosine of the angle between a and b.
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,340 @@
+package llm
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Text extraction for indexing project files, see retrieval.go. Plain text,
+// Markdown, CSV and JSON are read as they are, HTML without its markup and
+// PDF through a small content stream reader.
+
+var errUnsupportedDocument = errors.New("unsupported file type")
+
+// documentKind names the extractor for a file, or "" when it has none.
+func documentKind(name, mimeType string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	switch {
+	case ext == ".pdf" || mimeType == "application/pdf":
+		return "pdf"
+	case ext == ".html" || ext == ".htm" || strings.HasPrefix(mimeType, "text/html"):
+		return "html"
+	case ext == ".json" || mimeType == "application/json":
+		return "json"
+	case ext == ".csv" || mimeType == "text/csv":
+		return "csv"
+	case ext == ".md" || ext == ".markdown" || mimeType == "text/markdown":
+		return "markdown"
+	case ext == ".txt" || strings.HasPrefix(mimeType, "text/"):
+		return "text"
+	}
+	return ""
+}
+
+// extractText returns the readable text of a file.
+func extractText(name, mimeType string, data []byte) (string, error) {
+	var text string
+	switch documentKind(name, mimeType) {
+	case "pdf":
+		text = extractPDFText(data)
+	case "html":
+		text = stripHTML(string(data))
+	case "json":
+		// Indented JSON splits into chunks on line boundaries
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, data, "", "  "); err == nil {
+			text = buf.String()
+		} else {
+			text = string(data)
+		}
+	case "csv", "markdown", "text":
+		text = string(data)
+	default:
+		return "", errUnsupportedDocument
+	}
+	text = strings.ToValidUTF8(strings.ReplaceAll(text, "\r\n", "\n"), "")
+	return strings.TrimSpace(text), nil
+}
+
+var (
+	htmlHiddenRe = regexp.MustCompile(`(?is)<(script|style|noscript|template|head)\b.*?</(script|style|noscript|template|head)\s*>`)
+	htmlBreakRe  = regexp.MustCompile(`(?i)<(br|hr)\b[^>]*>|</(p|div|li|tr|h[1-6]|section|article|table|blockquote|pre)\s*>`)
+	htmlTagRe    = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+	blankLinesRe = regexp.MustCompile(`\n{3,}`)
+)
+
+// stripHTML returns the visible text of an HTML document, one line per block.
+func stripHTML(doc string) string {
+	doc = htmlHiddenRe.ReplaceAllString(doc, " ")
+	doc = htmlBreakRe.ReplaceAllString(doc, "\n")
+	doc = html.UnescapeString(htmlTagRe.ReplaceAllString(doc, " "))
+	lines := strings.Split(doc, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return blankLinesRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+}
+
+// extractPDFText returns the text drawn by a PDF's page content streams. It
+// reads uncompressed and FlateDecode streams and the Tj, TJ, ' and "
+// operators. Strings are read as single-byte text, so fonts with custom
+// encodings and scanned pages give little or no text.
+func extractPDFText(data []byte) string {
+	var out strings.Builder
+	pos := 0
+	for {
+		start := bytes.Index(data[pos:], []byte("stream"))
+		if start < 0 {
+			break
+		}
+		start += pos
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		end += start
+		pos = end + len("endstream")
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+
+		dictStart := bytes.LastIndex(data[:start], []byte("obj"))
+		if dictStart < 0 {
+			dictStart = 0
+		}
+		dict := string(data[dictStart:start])
+		if !isContentStreamDict(dict) {
+			continue
+		}
+		body := data[start+len("stream") : end]
+		body = bytes.TrimLeft(body, "\r\n")
+		if strings.Contains(dict, "/FlateDecode") {
+			r, err := zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				continue
+			}
+			// Keep what decompressed before any error in a damaged stream
+			body, _ = io.ReadAll(r)
+			r.Close()
+		}
+		if text := pdfContentText(body); strings.TrimSpace(text) != "" {
+			out.WriteString(text)
+			out.WriteString("\n\n")
+		}
+	}
+	return out.String()
+}
+
+// isContentStreamDict reports whether a stream dictionary may hold page
+// content rather than images, fonts or cross-reference data.
+func isContentStreamDict(dict string) bool {
+	compact := strings.ReplaceAll(dict, " ", "")
+	for _, skip := range []string{"/Subtype/Image", "/Type/XRef", "/Type/ObjStm", "/Length1", "/Subtype/Type1C", "/Subtype/CIDFontType0C", "/Type/Metadata", "/DCTDecode", "/JPXDecode", "/CCITTFaxDecode", "/JBIG2Decode"} {
+		if strings.Contains(compact, skip) {
+			return false
+		}
+	}
+	return true
+}
+
+// pdfContentText interprets the text operators of a content stream.
+func pdfContentText(content []byte) string {
+	if !bytes.Contains(content, []byte("BT")) {
+		return ""
+	}
+	var out strings.Builder
+	var operands []string
+	var array []string
+	inArray := false
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			s, next := pdfLiteralString(content, i)
+			i = next
+			if inArray {
+				array = append(array, s)
+			} else {
+				operands = append(operands, s)
+			}
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			s, next := pdfHexString(content, i)
+			i = next
+			if inArray {
+				array = append(array, s)
+			} else {
+				operands = append(operands, s)
+			}
+		case c == '[':
+			inArray, array = true, nil
+			i++
+		case c == ']':
+			inArray = false
+			i++
+		case inArray && (c == '-' || (c >= '0' && c <= '9')):
+			// A large negative kerning inside TJ is a word space
+			j := i + 1
+			for j < len(content) && (content[j] == '.' || (content[j] >= '0' && content[j] <= '9')) {
+				j++
+			}
+			if c == '-' && j-i > 3 {
+				array = append(array, " ")
+			}
+			i = j
+		case isPDFOperatorByte(c):
+			j := i
+			for j < len(content) && isPDFOperatorByte(content[j]) {
+				j++
+			}
+			switch string(content[i:j]) {
+			case "Tj":
+				if n := len(operands); n > 0 {
+					out.WriteString(operands[n-1])
+				}
+			case "'", "\"":
+				out.WriteString("\n")
+				if n := len(operands); n > 0 {
+					out.WriteString(operands[n-1])
+				}
+			case "TJ":
+				out.WriteString(strings.Join(array, ""))
+				array = nil
+			case "T*", "Td", "TD":
+				out.WriteString("\n")
+			case "ET":
+				out.WriteString("\n")
+			}
+			operands = operands[:0]
+			i = j
+		default:
+			i++
+		}
+	}
+	return out.String()
+}
+
+func isPDFOperatorByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '*' || c == '\'' || c == '"'
+}
+
+// pdfLiteralString reads a (string) starting at i and returns it with the
+// index after its closing parenthesis.
+func pdfLiteralString(content []byte, i int) (string, int) {
+	var b []byte
+	depth := 0
+	for i++; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '\\' && i+1 < len(content):
+			i++
+			switch e := content[i]; e {
+			case 'n':
+				b = append(b, '\n')
+			case 'r':
+				b = append(b, '\r')
+			case 't':
+				b = append(b, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for k := 0; k < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; k++ {
+						v = v*8 + int(content[i]-'0')
+						i++
+					}
+					i--
+					b = append(b, byte(v))
+				} else {
+					b = append(b, e)
+				}
+			}
+		case c == '(':
+			depth++
+			b = append(b, c)
+		case c == ')':
+			if depth == 0 {
+				return pdfBytesText(b), i + 1
+			}
+			depth--
+			b = append(b, c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return pdfBytesText(b), i
+}
+
+// pdfHexString reads a <hex string> starting at i.
+func pdfHexString(content []byte, i int) (string, int) {
+	var digits []byte
+	for i++; i < len(content) && content[i] != '>'; i++ {
+		if c := content[i]; (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	b := make([]byte, len(digits)/2)
+	for k := range b {
+		b[k] = hexNibble(digits[2*k])<<4 | hexNibble(digits[2*k+1])
+	}
+	// Two-byte strings with a zero high byte are UTF-16 or CID text
+	if len(b) >= 2 && len(b)%2 == 0 {
+		wide := true
+		for k := 0; k < len(b); k += 2 {
+			if b[k] != 0 {
+				wide = false
+				break
+			}
+		}
+		if wide {
+			narrow := make([]byte, 0, len(b)/2)
+			for k := 1; k < len(b); k += 2 {
+				narrow = append(narrow, b[k])
+			}
+			b = narrow
+		}
+	}
+	return pdfBytesText(b), i + 1
+}
+
+func hexNibble(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// pdfBytesText reads single-byte PDF text as Latin-1, dropping control
+// characters.
+func pdfBytesText(b []byte) string {
+	if utf8.Valid(b) && bytes.IndexFunc(b, func(r rune) bool { return r >= 0x80 }) >= 0 {
+		return string(b)
+	}
+	runes := make([]rune, 0, len(b))
+	for _, c := range b {
+		if c >= 0x20 || c == '\n' || c == '\t' {
+			runes = append(runes, rune(c))
+		}
+	}
+	return string(runes)
+}
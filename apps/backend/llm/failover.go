@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerFailureThreshold is how many consecutive failures open the circuit.
+	breakerFailureThreshold = 3
+	// breakerCooldown is how long an open circuit keeps traffic away.
+	breakerCooldown = 60 * time.Second
+)
+
+// circuitBreaker tracks consecutive failures per endpoint. After
+// threshold failures an endpoint is skipped for the cooldown period; once the
+// cooldown ends a single request is let through to probe it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	states    map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		states:    make(map[string]*breakerState),
+	}
+}
+
+// allow reports whether traffic may be sent to the endpoint.
+func (b *circuitBreaker) allow(endpointID string) bool {
+	if b == nil || endpointID == "" {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.states[endpointID]
+	if !ok || st.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(st.openUntil) {
+		return false
+	}
+	// Half-open: let one request through and re-open straight away,
+	// success() will close the circuit if it works.
+	st.openUntil = time.Now().Add(b.cooldown)
+	return true
+}
+
+// success closes the circuit for the endpoint.
+func (b *circuitBreaker) success(endpointID string) {
+	if b == nil || endpointID == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.states, endpointID)
+}
+
+// failure records a failed call and opens the circuit once the threshold is hit.
+func (b *circuitBreaker) failure(endpointID string) {
+	if b == nil || endpointID == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.states[endpointID]
+	if !ok {
+		st = &breakerState{}
+		b.states[endpointID] = st
+	}
+	st.failures++
+	if st.failures >= b.threshold {
+		st.openUntil = time.Now().Add(b.cooldown)
+		fmt.Printf("[LLM] Circuit opened for endpoint %s after %d failures (cooldown %v)\n", endpointID, st.failures, b.cooldown)
+	}
+}
+
+// withFailover runs fn against each config in order until one succeeds and
+// returns the config that served the request. Rate limit errors are not failed
+// over (generateWithRetry already backs off); other errors and timeouts move on
+// to the next candidate.
+func (s *Service) withFailover(ctx context.Context, cfgs []*ModelConfig, fn func(ctx context.Context, cfg *ModelConfig) error) (*ModelConfig, error) {
+	var lastErr error
+	for i, cfg := range cfgs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		err := fn(withUsageEndpoint(ctx, cfg), cfg)
+		if err == nil {
+			s.breaker.success(cfg.EndpointID)
+			if i > 0 {
+				fmt.Printf("[LLM] Failover: served by endpoint %s (%s) after %d failed attempt(s)\n", cfg.EndpointName, cfg.EndpointID, i)
+			}
+			return cfg, nil
+		}
+		lastErr = err
+
+		if isRateLimitError(err) && !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		s.breaker.failure(cfg.EndpointID)
+		if i < len(cfgs)-1 {
+			fmt.Printf("[WARN] Endpoint %s (%s) failed: %v - failing over to next candidate\n", cfg.EndpointName, cfg.EndpointID, err)
+		}
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, lastErr
+}
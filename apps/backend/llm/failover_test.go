@@ -0,0 +1,162 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// Steps: "fail", "ok", "expire" (cooldown ends), then the expected allow()
+	// results checked after each step.
+	type step struct {
+		do    string
+		allow bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"closed below threshold", []step{{"fail", true}, {"fail", true}}},
+		{"opens at threshold", []step{{"fail", true}, {"fail", true}, {"fail", false}}},
+		{"success resets the count", []step{{"fail", true}, {"fail", true}, {"ok", true}, {"fail", true}, {"fail", true}}},
+		{"half open after cooldown", []step{{"fail", true}, {"fail", true}, {"fail", false}, {"expire", true}}},
+		{"probe failure reopens", []step{{"fail", true}, {"fail", true}, {"fail", false}, {"expire", true}, {"fail", false}}},
+		{"probe success closes", []step{{"fail", true}, {"fail", true}, {"fail", false}, {"expire", true}, {"ok", true}, {"fail", true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(3, time.Hour)
+			for i, st := range tt.steps {
+				switch st.do {
+				case "fail":
+					b.failure("ep1")
+				case "ok":
+					b.success("ep1")
+				case "expire":
+					b.states["ep1"].openUntil = time.Now().Add(-time.Second)
+				}
+				if got := b.allow("ep1"); got != st.allow {
+					t.Fatalf("step %d (%s): allow = %v, want %v", i, st.do, got, st.allow)
+				}
+			}
+			if !b.allow("other") {
+				t.Error("breaker state leaked to another endpoint")
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpenLetsOneThrough(t *testing.T) {
+	b := newCircuitBreaker(1, time.Hour)
+	b.failure("ep1")
+	b.states["ep1"].openUntil = time.Now().Add(-time.Second)
+	if !b.allow("ep1") {
+		t.Fatal("first request after cooldown should probe")
+	}
+	if b.allow("ep1") {
+		t.Fatal("only one probe may go through while half open")
+	}
+}
+
+func TestWithFailover(t *testing.T) {
+	errDown := errors.New("connection refused")
+	errLimited := errors.New("status 429: too many requests")
+
+	tests := []struct {
+		name       string
+		results    []error // per endpoint, in order
+		wantServed string  // endpoint ID, "" when all fail
+		wantCalls  int
+		wantErr    error
+	}{
+		{"first serves", []error{nil, nil}, "ep0", 1, nil},
+		{"fails over to the next", []error{errDown, nil}, "ep1", 2, nil},
+		{"fails over past several", []error{errDown, errDown, nil}, "ep2", 3, nil},
+		{"all fail returns the last error", []error{errDown, errLimited}, "", 2, errLimited},
+		{"rate limit is not failed over", []error{errLimited, nil}, "", 1, errLimited},
+		{"timeouts fail over", []error{fmt.Errorf("429 wait: %w", context.DeadlineExceeded), nil}, "ep1", 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{breaker: newCircuitBreaker(1, time.Hour)}
+			var cfgs []*ModelConfig
+			for i := range tt.results {
+				cfgs = append(cfgs, &ModelConfig{EndpointID: fmt.Sprintf("ep%d", i)})
+			}
+
+			calls := 0
+			served, err := s.withFailover(context.Background(), cfgs, func(ctx context.Context, cfg *ModelConfig) error {
+				calls++
+				return tt.results[calls-1]
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantServed == "" {
+				if served != nil || !errors.Is(err, tt.wantErr) {
+					t.Fatalf("served = %v, err = %v; want error %v", served, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || served == nil || served.EndpointID != tt.wantServed {
+				t.Fatalf("served = %v, err = %v; want %s", served, err, tt.wantServed)
+			}
+			// Failed endpoints trip the threshold-1 breaker, the serving one stays closed
+			for i, res := range tt.results[:calls] {
+				id := fmt.Sprintf("ep%d", i)
+				if want := res == nil; s.breaker.allow(id) != want {
+					t.Errorf("breaker allow(%s) = %v, want %v", id, !want, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithFailoverStopsOnCancel(t *testing.T) {
+	s := &Service{breaker: newCircuitBreaker(3, time.Hour)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cfgs := []*ModelConfig{{EndpointID: "ep0"}, {EndpointID: "ep1"}}
+
+	calls := 0
+	_, err := s.withFailover(ctx, cfgs, func(ctx context.Context, cfg *ModelConfig) error {
+		calls++
+		cancel()
+		return ctx.Err()
+	})
+	if calls != 1 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("calls = %d, err = %v; want one call and context.Canceled", calls, err)
+	}
+}
+
+func TestOrderCandidates(t *testing.T) {
+	candidates := []endpointCandidate{
+		{endpoint: ResolvedEndpoint{ID: "a"}, weight: 70},
+		{endpoint: ResolvedEndpoint{ID: "b"}, weight: 30},
+		{endpoint: ResolvedEndpoint{ID: "c"}, weight: 0.5},
+	}
+	first := map[string]int{}
+	for i := 0; i < 500; i++ {
+		ordered, err := orderCandidates(candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ordered) != len(candidates) {
+			t.Fatalf("ordered %d endpoints, want %d", len(ordered), len(candidates))
+		}
+		seen := map[string]bool{}
+		for _, e := range ordered {
+			if seen[e.ID] {
+				t.Fatalf("endpoint %s ordered twice", e.ID)
+			}
+			seen[e.ID] = true
+		}
+		first[ordered[0].ID]++
+	}
+	// With 70/30 weights "a" leads most of the time but not always
+	if first["a"] <= first["b"] || first["b"] == 0 {
+		t.Errorf("first picks = %v, want weighted toward a", first)
+	}
+}
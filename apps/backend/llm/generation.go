@@ -0,0 +1,362 @@
+package llm
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Generation parameters. Endpoints set temperature, top_p, stop sequences,
+// output and context limits and a timeout. Projects can override them on
+// endpoints that allow it: temperature up to the endpoint's max_temperature,
+// limits and timeout only downwards, and stop sequences are added to the
+// endpoint's own.
+
+const (
+	defaultTemperature = 0.7
+	maxTemperature     = 2.0
+	// maxStopSequences is the most stop sequences providers accept.
+	maxStopSequences = 4
+	maxStopLength    = 100
+	maxTimeout       = 600 * time.Second
+)
+
+// validateGenerationParams checks parameter ranges shared by endpoints and
+// project overrides. Nil values are not set.
+func validateGenerationParams(temperature, topP *float64, stop []string, timeoutSeconds int) error {
+	if temperature != nil && (*temperature < 0 || *temperature > maxTemperature) {
+		return badRequest(fmt.Sprintf("temperature must be between 0 and %g", maxTemperature))
+	}
+	if topP != nil && (*topP <= 0 || *topP > 1) {
+		return badRequest("top_p must be greater than 0 and at most 1")
+	}
+	if len(stop) > maxStopSequences {
+		return badRequest(fmt.Sprintf("at most %d stop_sequences are allowed", maxStopSequences))
+	}
+	for _, s := range stop {
+		if s == "" || len(s) > maxStopLength {
+			return badRequest(fmt.Sprintf("stop_sequences must be 1 to %d characters", maxStopLength))
+		}
+	}
+	if timeoutSeconds < 0 || time.Duration(timeoutSeconds)*time.Second > maxTimeout {
+		return badRequest(fmt.Sprintf("timeout_seconds must be between 0 and %d", int(maxTimeout/time.Second)))
+	}
+	return nil
+}
+
+func encodeStopSequences(stop []string) string {
+	if len(stop) == 0 {
+		return ""
+	}
+	raw, _ := json.Marshal(stop)
+	return string(raw)
+}
+
+func decodeStopSequences(raw string) []string {
+	var stop []string
+	if strings.TrimSpace(raw) != "" {
+		if err := json.Unmarshal([]byte(raw), &stop); err != nil {
+			fmt.Printf("[WARN] Invalid stop_sequences %q: %v\n", raw, err)
+		}
+	}
+	return stop
+}
+
+func nullFloat(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
+
+func float32Ptr(v *float64) *float32 {
+	if v == nil {
+		return nil
+	}
+	f := float32(*v)
+	return &f
+}
+
+// temperature is the sampling temperature sent to the model.
+func (c *ModelConfig) temperature() float32 {
+	if c.Temperature != nil {
+		return *c.Temperature
+	}
+	return defaultTemperature
+}
+
+// requestTimeout is the endpoint timeout, or def when it has none.
+func (c *ModelConfig) requestTimeout(def time.Duration) time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return def
+}
+
+// Endpoint rows are read with endpointColumns and scanEndpoint.
+const endpointColumns = `id, name, provider, COALESCE(base_url, ''), model, is_active, health_status, health_checked_at, health_latency_ms, health_error,
+	context_window, max_output_tokens, temperature, top_p, stop_sequences, timeout_seconds, max_temperature, allow_project_overrides, created_at, updated_at`
+
+type endpointRow interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEndpoint(row endpointRow, extra ...interface{}) (*Endpoint, error) {
+	e := &Endpoint{}
+	var isActive, allowOverrides int
+	var temperature, topP sql.NullFloat64
+	var stop string
+	dest := []interface{}{&e.ID, &e.Name, &e.Provider, &e.BaseURL, &e.Model, &isActive, &e.HealthStatus, &e.HealthCheckedAt, &e.HealthLatencyMs, &e.HealthError,
+		&e.ContextWindow, &e.MaxOutputTokens, &temperature, &topP, &stop, &e.TimeoutSeconds, &e.MaxTemperature, &allowOverrides, &e.CreatedAt, &e.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	e.IsActive = intToBool(isActive)
+	e.AllowProjectOverrides = intToBool(allowOverrides)
+	e.Temperature = nullFloat(temperature)
+	e.TopP = nullFloat(topP)
+	e.StopSequences = decodeStopSequences(stop)
+	return e, nil
+}
+
+// ProjectGenerationSettings are a project's overrides of the endpoint
+// parameters. Unset values (null or 0) keep the endpoint's.
+type ProjectGenerationSettings struct {
+	ProjectID       string   `json:"project_id"`
+	Temperature     *float64 `json:"temperature"`
+	TopP            *float64 `json:"top_p"`
+	MaxOutputTokens int      `json:"max_output_tokens"`
+	ContextWindow   int      `json:"context_window"`
+	StopSequences   []string `json:"stop_sequences"`
+	TimeoutSeconds  int      `json:"timeout_seconds"`
+	UpdatedAt       string   `json:"updated_at,omitempty"`
+}
+
+type UpdateProjectGenerationSettingsParams struct {
+	Temperature     *float64 `json:"temperature"`
+	TopP            *float64 `json:"top_p"`
+	MaxOutputTokens int      `json:"max_output_tokens"`
+	ContextWindow   int      `json:"context_window"`
+	StopSequences   []string `json:"stop_sequences"`
+	TimeoutSeconds  int      `json:"timeout_seconds"`
+}
+
+// loadProjectGenerationSettings returns the project's overrides, or nil.
+func loadProjectGenerationSettings(ctx context.Context, db *sql.DB, tenantID, projectID string) (*ProjectGenerationSettings, error) {
+	ps := &ProjectGenerationSettings{ProjectID: projectID}
+	var temperature, topP sql.NullFloat64
+	var stop string
+	err := db.QueryRowContext(ctx, `
+		SELECT temperature, top_p, max_output_tokens, context_window, stop_sequences, timeout_seconds, updated_at
+		FROM project_llm_settings
+		WHERE project_id = ? AND tenant_id = ?
+	`, projectID, tenantID).Scan(&temperature, &topP, &ps.MaxOutputTokens, &ps.ContextWindow, &stop, &ps.TimeoutSeconds, &ps.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ps.Temperature = nullFloat(temperature)
+	ps.TopP = nullFloat(topP)
+	ps.StopSequences = decodeStopSequences(stop)
+	return ps, nil
+}
+
+// GetProjectGenerationSettings returns a project's generation overrides.
+//
+//encore:api auth method=GET path=/llm/projects/:projectID/generation-settings
+func (s *Service) GetProjectGenerationSettings(ctx context.Context, projectID string) (*ProjectGenerationSettings, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	tenantID, _, err := quotaScopeTenantID(ctx, db, quotaScopeProject, strings.TrimSpace(projectID))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := quotaAdmin(tenantID); err != nil {
+		return nil, err
+	}
+	ps, err := loadProjectGenerationSettings(ctx, db, tenantID, strings.TrimSpace(projectID))
+	if err != nil {
+		return nil, err
+	}
+	if ps == nil {
+		ps = &ProjectGenerationSettings{ProjectID: strings.TrimSpace(projectID)}
+	}
+	return ps, nil
+}
+
+// UpdateProjectGenerationSettings replaces a project's generation overrides.
+// They only apply on endpoints that allow project overrides and are clamped
+// to the endpoint's limits.
+//
+//encore:api auth method=PUT path=/llm/projects/:projectID/generation-settings
+func (s *Service) UpdateProjectGenerationSettings(ctx context.Context, projectID string, p *UpdateProjectGenerationSettingsParams) (*ProjectGenerationSettings, error) {
+	if p == nil {
+		return nil, badRequest("request body is required")
+	}
+	projectID = strings.TrimSpace(projectID)
+	if err := validateGenerationParams(p.Temperature, p.TopP, p.StopSequences, p.TimeoutSeconds); err != nil {
+		return nil, err
+	}
+	if p.MaxOutputTokens < 0 || p.ContextWindow < 0 {
+		return nil, badRequest("max_output_tokens and context_window must not be negative")
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	tenantID, _, err := quotaScopeTenantID(ctx, db, quotaScopeProject, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := quotaAdmin(tenantID); err != nil {
+		return nil, err
+	}
+
+	now := nowRFC3339()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO project_llm_settings
+		(project_id, tenant_id, temperature, top_p, max_output_tokens, context_window, stop_sequences, timeout_seconds, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(project_id) DO UPDATE SET
+			temperature = excluded.temperature,
+			top_p = excluded.top_p,
+			max_output_tokens = excluded.max_output_tokens,
+			context_window = excluded.context_window,
+			stop_sequences = excluded.stop_sequences,
+			timeout_seconds = excluded.timeout_seconds,
+			updated_at = excluded.updated_at
+	`, projectID, tenantID, p.Temperature, p.TopP, p.MaxOutputTokens, p.ContextWindow, encodeStopSequences(p.StopSequences), p.TimeoutSeconds, now, now)
+	if err != nil {
+		return nil, err
+	}
+	return loadProjectGenerationSettings(ctx, db, tenantID, projectID)
+}
+
+// applyProjectSettings returns the configs with the project's overrides on
+// the endpoints that allow them. The input configs are not modified.
+func (s *Service) applyProjectSettings(ctx context.Context, cfgs []*ModelConfig, tenantID, projectID string) []*ModelConfig {
+	if tenantID == "" || projectID == "" {
+		return cfgs
+	}
+	db, err := getDB()
+	if err != nil {
+		return cfgs
+	}
+	ps, err := loadProjectGenerationSettings(ctx, db, tenantID, projectID)
+	if err != nil {
+		fmt.Printf("[WARN] Loading generation settings of project %s failed: %v\n", projectID, err)
+		return cfgs
+	}
+	if ps == nil {
+		return cfgs
+	}
+	return overrideConfigs(cfgs, ps)
+}
+
+// overrideConfigs applies overrides to the endpoints that allow them,
+// within each endpoint's limits.
+func overrideConfigs(cfgs []*ModelConfig, ps *ProjectGenerationSettings) []*ModelConfig {
+	out := make([]*ModelConfig, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if !cfg.AllowProjectOverrides {
+			out = append(out, cfg)
+			continue
+		}
+		c := *cfg
+		if ps.Temperature != nil {
+			t := float32(*ps.Temperature)
+			if t > cfg.MaxTemperature {
+				t = cfg.MaxTemperature
+			}
+			c.Temperature = &t
+		}
+		if ps.TopP != nil {
+			c.TopP = float32Ptr(ps.TopP)
+		}
+		if ps.ContextWindow > 0 && ps.ContextWindow < cfg.contextWindow() {
+			c.ContextWindow = ps.ContextWindow
+		}
+		if ps.MaxOutputTokens > 0 && ps.MaxOutputTokens < cfg.maxOutputTokens() {
+			c.MaxOutputTokens = ps.MaxOutputTokens
+		}
+		if ps.TimeoutSeconds > 0 {
+			if t := time.Duration(ps.TimeoutSeconds) * time.Second; cfg.Timeout == 0 || t < cfg.Timeout {
+				c.Timeout = t
+			}
+		}
+		c.Stop = mergeStopSequences(cfg.Stop, ps.StopSequences)
+		out = append(out, &c)
+	}
+	return out
+}
+
+// GenerationOptions are sampling parameters set by the caller of a single
+// request. They are applied like project overrides, after them.
+type GenerationOptions struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"top_p,omitempty"`
+	MaxOutputTokens int      `json:"max_output_tokens,omitempty"`
+	StopSequences   []string `json:"stop_sequences,omitempty"`
+}
+
+// applyGenerationOptions validates the request's options and applies them
+// to the endpoints that allow overrides.
+func applyGenerationOptions(cfgs []*ModelConfig, o *GenerationOptions) ([]*ModelConfig, error) {
+	if o == nil {
+		return cfgs, nil
+	}
+	if err := validateGenerationParams(o.Temperature, o.TopP, o.StopSequences, 0); err != nil {
+		return nil, err
+	}
+	if o.MaxOutputTokens < 0 {
+		return nil, badRequest("max_output_tokens must not be negative")
+	}
+	return overrideConfigs(cfgs, &ProjectGenerationSettings{
+		Temperature:     o.Temperature,
+		TopP:            o.TopP,
+		MaxOutputTokens: o.MaxOutputTokens,
+		StopSequences:   o.StopSequences,
+	}), nil
+}
+
+// mergeStopSequences adds extra to base without duplicates, keeping at most
+// maxStopSequences.
+func mergeStopSequences(base, extra []string) []string {
+	merged := append([]string(nil), base...)
+	for _, s := range extra {
+		if len(merged) >= maxStopSequences {
+			break
+		}
+		dup := false
+		for _, m := range merged {
+			if m == s {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
+
+// generationKey identifies the parameters a chat model was created with.
+func generationKey(cfg *ModelConfig) string {
+	topP := ""
+	if cfg.TopP != nil {
+		topP = strconv.FormatFloat(float64(*cfg.TopP), 'g', -1, 32)
+	}
+	return fmt.Sprintf("%s|%s|%s|%s", strconv.FormatFloat(float64(cfg.temperature()), 'g', -1, 32), topP,
+		strconv.Quote(strings.Join(cfg.Stop, "\x00")), cfg.Timeout)
+}
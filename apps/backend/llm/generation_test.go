@@ -0,0 +1,168 @@
+package llm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testProject inserts a tenant with one project and returns their IDs.
+func testProject(t *testing.T) (string, string) {
+	t.Helper()
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantID, projectID := "tnt_"+randomHex(8), "prj_"+randomHex(8)
+	if _, err := db.Exec(`INSERT INTO tenants (id, name, domain) VALUES (?, ?, ?)`, tenantID, tenantID, tenantID+".test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO projects (id, tenant_id, name, created_by_user_id) VALUES (?, ?, 'Project', 'usr_test')`, projectID, tenantID); err != nil {
+		t.Fatal(err)
+	}
+	return tenantID, projectID
+}
+
+func TestValidateGenerationParams(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name        string
+		temperature *float64
+		topP        *float64
+		stop        []string
+		timeout     int
+		wantErr     bool
+	}{
+		{"unset", nil, nil, nil, 0, false},
+		{"in range", f(0), f(1), []string{"###", "\n\nUser:"}, 600, false},
+		{"temperature too high", f(2.1), nil, nil, 0, true},
+		{"negative temperature", f(-0.1), nil, nil, 0, true},
+		{"zero top_p", nil, f(0), nil, 0, true},
+		{"top_p above 1", nil, f(1.01), nil, 0, true},
+		{"too many stop sequences", nil, nil, []string{"a", "b", "c", "d", "e"}, 0, true},
+		{"empty stop sequence", nil, nil, []string{""}, 0, true},
+		{"timeout too long", nil, nil, nil, 601, true},
+		{"negative timeout", nil, nil, nil, -1, true},
+	}
+	for _, tt := range tests {
+		if err := validateGenerationParams(tt.temperature, tt.topP, tt.stop, tt.timeout); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStopSequences(t *testing.T) {
+	if got := encodeStopSequences(nil); got != "" {
+		t.Errorf("encode(nil) = %q", got)
+	}
+	stop := []string{"###", "\nUser:"}
+	if got := decodeStopSequences(encodeStopSequences(stop)); len(got) != 2 || got[0] != stop[0] || got[1] != stop[1] {
+		t.Errorf("round trip = %q", got)
+	}
+	if got := decodeStopSequences("not json"); got != nil {
+		t.Errorf("decode(invalid) = %q", got)
+	}
+
+	merged := mergeStopSequences([]string{"a", "b"}, []string{"b", "c", "d", "e"})
+	if len(merged) != maxStopSequences || merged[2] != "c" || merged[3] != "d" {
+		t.Errorf("merged = %q", merged)
+	}
+}
+
+func TestGenerationKey(t *testing.T) {
+	temperature, topP := float32(0.2), float32(0.9)
+	base := &ModelConfig{Model: "gpt-4o-mini"}
+	if base.temperature() != defaultTemperature {
+		t.Errorf("default temperature = %v", base.temperature())
+	}
+	if base.requestTimeout(time.Minute) != time.Minute || (&ModelConfig{Timeout: time.Second}).requestTimeout(time.Minute) != time.Second {
+		t.Error("requestTimeout did not prefer the endpoint timeout")
+	}
+	key := generationKey(base)
+	for name, cfg := range map[string]*ModelConfig{
+		"temperature": {Model: "gpt-4o-mini", Temperature: &temperature},
+		"top_p":       {Model: "gpt-4o-mini", TopP: &topP},
+		"stop":        {Model: "gpt-4o-mini", Stop: []string{"###"}},
+		"timeout":     {Model: "gpt-4o-mini", Timeout: time.Second},
+	} {
+		if generationKey(cfg) == key {
+			t.Errorf("changing the %s kept the generation key", name)
+		}
+	}
+}
+
+func TestApplyProjectSettings(t *testing.T) {
+	ctx := context.Background()
+	tenantID, projectID := testProject(t)
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := &ModelConfig{EndpointID: "locked", Model: "gpt-4o-mini"}
+	open := &ModelConfig{
+		EndpointID: "open", Model: "gpt-4o-mini", AllowProjectOverrides: true, MaxTemperature: 1,
+		MaxOutputTokens: 2000, Timeout: 30 * time.Second, Stop: []string{"###"},
+	}
+	cfgs := []*ModelConfig{locked, open}
+
+	s := &Service{}
+	if got := s.applyProjectSettings(ctx, cfgs, tenantID, projectID); got[1] != open {
+		t.Error("configs changed without project settings")
+	}
+
+	now := nowRFC3339()
+	if _, err := db.Exec(`
+		INSERT INTO project_llm_settings (project_id, tenant_id, temperature, top_p, max_output_tokens, context_window, stop_sequences, timeout_seconds, created_at, updated_at)
+		VALUES (?, ?, 1.5, 0.8, 8000, 4096, '["\nUser:","###"]', 10, ?, ?)
+	`, projectID, tenantID, now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.applyProjectSettings(ctx, cfgs, tenantID, projectID)
+	if got[0] != locked {
+		t.Error("overrides applied to an endpoint that does not allow them")
+	}
+	c := got[1]
+	if c == open || open.Temperature != nil {
+		t.Fatal("the endpoint config was modified in place")
+	}
+	// Temperature is capped, limits and timeout only go down, stop sequences are added
+	if *c.Temperature != 1 || *c.TopP != 0.8 || c.ContextWindow != 4096 || c.MaxOutputTokens != 2000 || c.Timeout != 10*time.Second {
+		t.Errorf("config = %+v", c)
+	}
+	if len(c.Stop) != 2 || c.Stop[0] != "###" || c.Stop[1] != "\nUser:" {
+		t.Errorf("stop = %q", c.Stop)
+	}
+
+	// Another tenant's project settings do not apply
+	if got := s.applyProjectSettings(ctx, cfgs, "tnt_other", projectID); got[1] != open {
+		t.Error("applied settings of another tenant's project")
+	}
+}
+
+func TestApplyGenerationOptions(t *testing.T) {
+	temperature, tooHot := 0.3, 3.0
+	locked := &ModelConfig{EndpointID: "locked"}
+	open := &ModelConfig{EndpointID: "open", AllowProjectOverrides: true, MaxTemperature: 1, MaxOutputTokens: 1000}
+	cfgs := []*ModelConfig{locked, open}
+
+	if got, err := applyGenerationOptions(cfgs, nil); err != nil || got[1] != open {
+		t.Errorf("nil options changed the configs: %v", err)
+	}
+	got, err := applyGenerationOptions(cfgs, &GenerationOptions{Temperature: &temperature, MaxOutputTokens: 200, StopSequences: []string{"END"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != locked {
+		t.Error("options applied to an endpoint that does not allow overrides")
+	}
+	if c := got[1]; *c.Temperature != 0.3 || c.MaxOutputTokens != 200 || len(c.Stop) != 1 {
+		t.Errorf("config = %+v", c)
+	}
+	for _, o := range []*GenerationOptions{{Temperature: &tooHot}, {MaxOutputTokens: -1}, {StopSequences: []string{""}}} {
+		if _, err := applyGenerationOptions(cfgs, o); err == nil {
+			t.Errorf("options %+v accepted", o)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package llm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// Endpoint health states stored in llm_endpoints.health_status.
+const (
+	healthUnknown   = "unknown"
+	healthHealthy   = "healthy"
+	healthDegraded  = "degraded"  // reachable but rate limited or out of quota
+	healthUnhealthy = "unhealthy" // auth, network or server errors
+)
+
+const (
+	// defaultHealthProbeInterval is how often the background prober checks
+	// every active endpoint. Override with LLM_HEALTH_PROBE_INTERVAL, "0" disables.
+	defaultHealthProbeInterval = 5 * time.Minute
+	// healthProbeTimeout bounds a single endpoint check.
+	healthProbeTimeout = 20 * time.Second
+	healthProbePrompt  = "Reply with the single word: OK"
+)
+
+// EndpointTestResult is the outcome of a connection test against an endpoint.
+type EndpointTestResult struct {
+	EndpointID string `json:"endpoint_id"`
+	Status     string `json:"status"`
+	Provider   string `json:"provider"`
+	Model      string `json:"model"`
+	// Reply is what the model answered, trimmed to a short preview.
+	Reply      string `json:"reply"`
+	LatencyMs  int64  `json:"latency_ms"`
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+	CheckedAt  string `json:"checked_at"`
+}
+
+type EndpointHealthSummary struct {
+	Total     int `json:"total"`
+	Healthy   int `json:"healthy"`
+	Degraded  int `json:"degraded"`
+	Unhealthy int `json:"unhealthy"`
+	Unknown   int `json:"unknown"`
+}
+
+// TestEndpoint sends a tiny prompt to a managed endpoint and stores the result
+// as its health state.
+//
+//encore:api auth method=POST path=/llm/endpoints/:id/test
+func (s *Service) TestEndpoint(ctx context.Context, id string) (*EndpointTestResult, error) {
+	if err := requireSystemRole(); err != nil {
+		return nil, err
+	}
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return nil, badRequest("id is required")
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ResolvedEndpoint{}
+	err = db.QueryRowContext(ctx, `
+		SELECT id, name, provider, COALESCE(base_url, ''), api_key, model
+		FROM llm_endpoints
+		WHERE id = ?
+	`, id).Scan(&e.ID, &e.Name, &e.Provider, &e.BaseURL, &e.APIKey, &e.Model)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "endpoint not found"}
+		}
+		return nil, err
+	}
+	if e.APIKey, err = decryptAPIKey(e.ID, e.APIKey); err != nil {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: err.Error()}
+	}
+
+	result := s.probeEndpoint(ctx, e)
+	if err := s.saveEndpointHealth(ctx, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// probeEndpoint sends the probe prompt with a fresh (uncached) chat model so
+// the stored key and settings are what gets tested.
+func (s *Service) probeEndpoint(ctx context.Context, e *ResolvedEndpoint) *EndpointTestResult {
+	cfg := toConfig(e)
+	result := &EndpointTestResult{
+		EndpointID: e.ID,
+		Provider:   cfg.Provider,
+		Model:      cfg.Model,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := func() (*schema.Message, error) {
+		chatModel, err := newChatModel(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return chatModel.Generate(ctx, []*schema.Message{schema.UserMessage(healthProbePrompt)},
+			model.WithMaxTokens(16), model.WithTemperature(0))
+	}()
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.CheckedAt = nowRFC3339()
+
+	if err != nil {
+		result.Error = truncateString(err.Error(), 500)
+		result.ErrorClass = classifyError(err)
+		result.Status = healthUnhealthy
+		if result.ErrorClass == "rate_limit" {
+			result.Status = healthDegraded
+		}
+		return result
+	}
+	result.Status = healthHealthy
+	if resp != nil {
+		result.Reply = truncateString(strings.TrimSpace(resp.Content), 200)
+	}
+	return result
+}
+
+// saveEndpointHealth stores a probe result and keeps the circuit breaker and
+// endpoint cache in step with it.
+func (s *Service) saveEndpointHealth(ctx context.Context, r *EndpointTestResult) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+
+	var previous string
+	err = db.QueryRowContext(ctx, `SELECT health_status FROM llm_endpoints WHERE id = ?`, r.EndpointID).Scan(&previous)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &errs.Error{Code: errs.NotFound, Message: "endpoint not found"}
+		}
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE llm_endpoints
+		SET health_status = ?, health_checked_at = ?, health_latency_ms = ?, health_error = ?, health_error_class = ?
+		WHERE id = ?
+	`, r.Status, r.CheckedAt, r.LatencyMs, r.Error, r.ErrorClass, r.EndpointID)
+	if err != nil {
+		return err
+	}
+
+	if r.Status == healthHealthy {
+		s.breaker.success(r.EndpointID)
+	}
+	if previous != r.Status {
+		fmt.Printf("[LLM] Endpoint %s health changed: %s -> %s\n", r.EndpointID, previous, r.Status)
+		s.invalidateEndpointCache()
+	}
+	return nil
+}
+
+// healthProbeInterval reads LLM_HEALTH_PROBE_INTERVAL (a Go duration).
+func healthProbeInterval() time.Duration {
+	raw := strings.TrimSpace(os.Getenv("LLM_HEALTH_PROBE_INTERVAL"))
+	if raw == "" {
+		return defaultHealthProbeInterval
+	}
+	if raw == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		fmt.Printf("[WARN] Invalid LLM_HEALTH_PROBE_INTERVAL %q, using %v\n", raw, defaultHealthProbeInterval)
+		return defaultHealthProbeInterval
+	}
+	return d
+}
+
+// startHealthProber checks every active endpoint in the background until the
+// process exits.
+func (s *Service) startHealthProber(interval time.Duration) {
+	if interval <= 0 {
+		fmt.Printf("[LLM] Endpoint health prober disabled\n")
+		return
+	}
+	go func() {
+		// Let the database come up before the first round
+		time.Sleep(30 * time.Second)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.probeAllEndpoints(context.Background())
+			<-ticker.C
+		}
+	}()
+}
+
+// probeAllEndpoints checks every active endpoint one after another.
+func (s *Service) probeAllEndpoints(ctx context.Context) {
+	db, err := getDB()
+	if err != nil {
+		fmt.Printf("[LLM] Health prober: db unavailable: %v\n", err)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, provider, COALESCE(base_url, ''), api_key, model
+		FROM llm_endpoints
+		WHERE is_active = 1
+	`)
+	if err != nil {
+		fmt.Printf("[LLM] Health prober: list endpoints failed: %v\n", err)
+		return
+	}
+	endpoints := make([]*ResolvedEndpoint, 0)
+	for rows.Next() {
+		e := &ResolvedEndpoint{}
+		if err := rows.Scan(&e.ID, &e.Name, &e.Provider, &e.BaseURL, &e.APIKey, &e.Model); err != nil {
+			rows.Close()
+			fmt.Printf("[LLM] Health prober: scan failed: %v\n", err)
+			return
+		}
+		endpoints = append(endpoints, e)
+	}
+	rows.Close()
+
+	for _, e := range endpoints {
+		if e.APIKey, err = decryptAPIKey(e.ID, e.APIKey); err != nil {
+			// probeEndpoint reports the missing key as unhealthy
+			fmt.Printf("[WARN] Health prober: %v\n", err)
+		}
+	}
+
+	for _, e := range endpoints {
+		result := s.probeEndpoint(ctx, e)
+		if err := s.saveEndpointHealth(ctx, result); err != nil {
+			fmt.Printf("[LLM] Health prober: save %s failed: %v\n", e.ID, err)
+			continue
+		}
+		if result.Status != healthHealthy {
+			fmt.Printf("[WARN] Endpoint %s (%s) is %s: %s\n", e.Name, e.ID, result.Status, result.Error)
+		}
+	}
+}
+
+// endpointHealthSummary counts active endpoints by their last health state.
+func endpointHealthSummary(ctx context.Context) (*EndpointHealthSummary, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT health_status, COUNT(*) FROM llm_endpoints WHERE is_active = 1 GROUP BY health_status
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := &EndpointHealthSummary{}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		summary.Total += count
+		switch status {
+		case healthHealthy:
+			summary.Healthy += count
+		case healthDegraded:
+			summary.Degraded += count
+		case healthUnhealthy:
+			summary.Unhealthy += count
+		default:
+			summary.Unknown += count
+		}
+	}
+	return summary, rows.Err()
+}
@@ -0,0 +1,141 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProbeEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus string
+		wantClass  string
+		wantReply  string
+	}{
+		{
+			name:       "healthy",
+			status:     http.StatusOK,
+			body:       `{"id":"c1","object":"chat.completion","model":"gpt-4o-mini","choices":[{"index":0,"message":{"role":"assistant","content":" OK "},"finish_reason":"stop"}]}`,
+			wantStatus: healthHealthy,
+			wantReply:  "OK",
+		},
+		{
+			name:       "rate limited is degraded",
+			status:     http.StatusTooManyRequests,
+			body:       `{"error":{"message":"Rate limit reached","type":"requests"}}`,
+			wantStatus: healthDegraded,
+			wantClass:  "rate_limit",
+		},
+		{
+			name:       "bad key is unhealthy",
+			status:     http.StatusUnauthorized,
+			body:       `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error"}}`,
+			wantStatus: healthUnhealthy,
+			wantClass:  "auth",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			s := &Service{}
+			result := s.probeEndpoint(context.Background(), &ResolvedEndpoint{
+				ID:       "ep_probe",
+				Provider: "openai-compatible",
+				BaseURL:  srv.URL,
+				APIKey:   "sk-test",
+				Model:    "gpt-4o-mini",
+			})
+			if result.Status != tt.wantStatus || result.ErrorClass != tt.wantClass || result.Reply != tt.wantReply {
+				t.Errorf("result = %+v", result)
+			}
+			if result.EndpointID != "ep_probe" || result.Model != "gpt-4o-mini" || result.CheckedAt == "" {
+				t.Errorf("result = %+v", result)
+			}
+			if (tt.wantStatus == healthHealthy) != (result.Error == "") {
+				t.Errorf("error = %q", result.Error)
+			}
+		})
+	}
+}
+
+func TestSaveEndpointHealth(t *testing.T) {
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	before, err := endpointHealthSummary(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := "ep_health_" + randomHex(6)
+	if _, err := db.Exec(`INSERT INTO llm_endpoints (id, name, provider, api_key, model) VALUES (?, ?, 'openai-compatible', 'sk-test', 'gpt-4o-mini')`, id, id); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{breaker: newCircuitBreaker(1, time.Hour), endpointCache: newLRUCache[[]endpointCandidate](cacheEndpoints, 10, time.Minute)}
+	s.breaker.failure(id)
+	if s.breaker.allow(id) {
+		t.Fatal("breaker should be open")
+	}
+
+	err = s.saveEndpointHealth(ctx, &EndpointTestResult{EndpointID: id, Status: healthUnhealthy, Error: "boom", ErrorClass: "server", LatencyMs: 42, CheckedAt: nowRFC3339()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := endpointHealthSummary(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Total != before.Total+1 || after.Unhealthy != before.Unhealthy+1 {
+		t.Errorf("summary before = %+v, after = %+v", before, after)
+	}
+
+	if err := s.saveEndpointHealth(ctx, &EndpointTestResult{EndpointID: id, Status: healthHealthy, CheckedAt: nowRFC3339()}); err != nil {
+		t.Fatal(err)
+	}
+	var status, class string
+	if err := db.QueryRow(`SELECT health_status, health_error_class FROM llm_endpoints WHERE id = ?`, id).Scan(&status, &class); err != nil {
+		t.Fatal(err)
+	}
+	if status != healthHealthy || class != "" {
+		t.Errorf("stored status = %q, class = %q", status, class)
+	}
+	if !s.breaker.allow(id) {
+		t.Error("a healthy probe should close the breaker")
+	}
+
+	if err := s.saveEndpointHealth(ctx, &EndpointTestResult{EndpointID: "ep_missing"}); err == nil {
+		t.Error("saving health of a missing endpoint should fail")
+	}
+}
+
+func TestHealthProbeInterval(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", defaultHealthProbeInterval},
+		{"0", 0},
+		{"90s", 90 * time.Second},
+		{"soon", defaultHealthProbeInterval},
+		{"-1m", defaultHealthProbeInterval},
+	}
+	for _, tt := range tests {
+		t.Setenv("LLM_HEALTH_PROBE_INTERVAL", tt.env)
+		if got := healthProbeInterval(); got != tt.want {
+			t.Errorf("LLM_HEALTH_PROBE_INTERVAL=%q: got %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
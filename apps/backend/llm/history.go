@@ -0,0 +1,282 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"encore.app/backend/iam"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+const (
+	// defaultContextWindow is the assumed context size in tokens for models
+	// without a known profile, see tokens.go.
+	defaultContextWindow = 16384
+	// maxHistoryMessages caps how many previous turns are considered at all.
+	maxHistoryMessages = 50
+)
+
+// HistoryMessage is a previous conversation turn sent explicitly by the client.
+type HistoryMessage struct {
+	Role    string `json:"role"` // user or assistant
+	Content string `json:"content"`
+}
+
+// requestTenantID returns the tenant for a generate request: the tenant_id
+// metadata, falling back to the authenticated tenant.
+func requestTenantID(p *GenerateParams) string {
+	tenantID := ""
+	if p.ProjectContext != nil && p.ProjectContext.Metadata != nil {
+		tenantID = strings.TrimSpace(p.ProjectContext.Metadata["tenant_id"])
+	}
+	if tenantID == "" {
+		if data, ok := auth.Data().(*iam.AuthData); ok && data != nil {
+			tenantID = data.TenantID
+		}
+	}
+	return tenantID
+}
+
+// sessionSubclientID returns the subclient a session is signed in to, or ""
+// for tenant sessions.
+func sessionSubclientID(data *iam.AuthData) string {
+	if data == nil || string(data.ScopeType) != "subclient" {
+		return ""
+	}
+	return data.ScopeID
+}
+
+// pinSessionSubclient limits a generate request from a subclient session to
+// that subclient, so its usage and quotas can't be charged elsewhere.
+func pinSessionSubclient(p *GenerateParams, data *iam.AuthData) error {
+	subclientID := sessionSubclientID(data)
+	if subclientID == "" {
+		return nil
+	}
+	if requested := strings.TrimSpace(p.SubclientID); requested != "" && requested != subclientID {
+		return &errs.Error{Code: errs.PermissionDenied, Message: "access to this subclient is not allowed"}
+	}
+	p.SubclientID = subclientID
+	return nil
+}
+
+// pinAPIKeyScope limits a generate request made with an API key to the key's
+// tenant and, for project keys, its project. The project context, subclient
+// and conversation named in the body must belong to them; an empty project
+// is filled in from the key.
+func pinAPIKeyScope(ctx context.Context, p *GenerateParams, data *iam.AuthData) error {
+	if data == nil || data.APIKeyID == "" {
+		return nil
+	}
+	denied := &errs.Error{Code: errs.PermissionDenied, Message: "api key is not allowed to access this project"}
+	pc := p.ProjectContext
+	if pc.Metadata == nil {
+		pc.Metadata = map[string]string{}
+	}
+	if tenantID := strings.TrimSpace(pc.Metadata["tenant_id"]); tenantID != "" && tenantID != data.TenantID {
+		return denied
+	}
+	pc.Metadata["tenant_id"] = data.TenantID
+
+	projectID, err := authorizedProject(ctx, data, pc.ProjectID)
+	if err != nil {
+		return err
+	}
+	pc.ProjectID = projectID
+
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	subclientID := strings.TrimSpace(p.SubclientID)
+	if subclientID != "" {
+		tenantID, subclientProject, err := quotaScopeTenantID(ctx, db, quotaScopeSubclient, subclientID)
+		if err != nil || tenantID != data.TenantID || subclientProject != projectID {
+			return denied
+		}
+	}
+	if conversationID := strings.TrimSpace(p.ConversationID); conversationID != "" {
+		ok, err := iam.ConversationExists(ctx, data.TenantID, projectID, subclientID, conversationID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &errs.Error{Code: errs.PermissionDenied, Message: "conversation not found"}
+		}
+	}
+	return nil
+}
+
+// authorizedProject returns the project a session may use: its own project
+// when it is bound to one, otherwise projectID if the tenant owns it.
+func authorizedProject(ctx context.Context, data *iam.AuthData, projectID string) (string, error) {
+	projectID = strings.TrimSpace(projectID)
+	if data.ProjectID != "" {
+		if projectID != "" && projectID != data.ProjectID {
+			return "", &errs.Error{Code: errs.PermissionDenied, Message: "access to this project is not allowed"}
+		}
+		projectID = data.ProjectID
+	}
+	if projectID == "" {
+		return "", nil
+	}
+	db, err := getDB()
+	if err != nil {
+		return "", err
+	}
+	tenantID, _, err := quotaScopeTenantID(ctx, db, quotaScopeProject, projectID)
+	if err != nil {
+		return "", err
+	}
+	if tenantID != data.TenantID {
+		return "", &errs.Error{Code: errs.NotFound, Message: "project not found"}
+	}
+	return projectID, nil
+}
+
+// loadHistory returns previous conversation turns as model messages for the
+// session in data. An explicit History wins over ConversationID and is only
+// trimmed to the budget; stored conversations that outgrow it are
+// summarized, see summary.go.
+func (s *Service) loadHistory(ctx context.Context, p *GenerateParams, tenantID string, data *iam.AuthData, cfgs []*ModelConfig, limits *ModelConfig, budget int) ([]*schema.Message, error) {
+	switch {
+	case len(p.History) > 0:
+		return historyMessages(p.History), nil
+	case strings.TrimSpace(p.ConversationID) != "":
+		if err := authorizeHistory(ctx, p, tenantID, data); err != nil {
+			return nil, err
+		}
+		stored, err := iam.LoadConversationBranch(ctx, tenantID, p.ProjectContext.ProjectID, strings.TrimSpace(p.SubclientID), strings.TrimSpace(p.ConversationID), strings.TrimSpace(p.ParentMessageID))
+		if err != nil {
+			return nil, err
+		}
+		// The caller may already have saved the current prompt
+		if n := len(stored); n > 0 && stored[n-1].Role == "user" && strings.TrimSpace(stored[n-1].Content) == strings.TrimSpace(p.Prompt) {
+			stored = stored[:n-1]
+		}
+		return s.summarizedHistory(ctx, p, tenantID, stored, cfgs, limits, budget), nil
+	}
+	return nil, nil
+}
+
+// recordReplyProvenance stores the endpoint, model and chat role of a reply
+// to a stored conversation for the assistant message saved next. Only
+// replies generated from the conversation itself count: the caller passed
+// authorizeHistory for it.
+func recordReplyProvenance(ctx context.Context, p *GenerateParams, served *ModelConfig, role *iam.RoleDefinition) {
+	conversationID := strings.TrimSpace(p.ConversationID)
+	if conversationID == "" || len(p.History) > 0 || served == nil {
+		return
+	}
+	prov := iam.ReplyProvenance{EndpointID: served.EndpointID, Model: served.Model}
+	if role != nil {
+		prov.ContextRole, prov.ContextRoleVersion = role.ID, role.Version
+	}
+	if err := iam.RecordReplyProvenance(ctx, conversationID, prov); err != nil {
+		fmt.Printf("[WARN] Recording provenance for conversation %s failed: %v\n", conversationID, err)
+	}
+}
+
+// authorizeHistory checks that the caller may read the stored conversation.
+// Sessions must match it: subclient sessions their own subclient, tenant
+// sessions a project of their tenant. Generate is public, so without auth
+// data the project must resolve through the embed API to the same tenant;
+// subclient conversations need auth.
+func authorizeHistory(ctx context.Context, p *GenerateParams, tenantID string, data *iam.AuthData) error {
+	denied := &errs.Error{Code: errs.PermissionDenied, Message: "conversation not found"}
+	projectID := strings.TrimSpace(p.ProjectContext.ProjectID)
+	if data != nil {
+		if data.TenantID != "" && data.TenantID != tenantID {
+			return denied
+		}
+		switch string(data.ScopeType) {
+		case "subclient":
+			if strings.TrimSpace(p.SubclientID) != data.ScopeID {
+				return denied
+			}
+		case "tenant":
+			db, err := getDB()
+			if err != nil {
+				return err
+			}
+			owner, _, err := quotaScopeTenantID(ctx, db, quotaScopeProject, projectID)
+			if err != nil || owner != tenantID {
+				return denied
+			}
+		}
+		return nil
+	}
+	if tenantID == "" || strings.TrimSpace(p.SubclientID) != "" {
+		return denied
+	}
+	project, err := iam.GetEmbedProject(ctx, projectID)
+	if err != nil || project.TenantID != tenantID {
+		return denied
+	}
+	return nil
+}
+
+// historyMessages converts turns to model messages, keeping the last
+// maxHistoryMessages.
+func historyMessages(turns []HistoryMessage) []*schema.Message {
+	var history []*schema.Message
+	for _, t := range turns {
+		content := strings.TrimSpace(t.Content)
+		if content == "" {
+			continue
+		}
+		switch t.Role {
+		case "user":
+			history = append(history, schema.UserMessage(content))
+		case "assistant":
+			history = append(history, schema.AssistantMessage(content, nil))
+		}
+	}
+	if len(history) > maxHistoryMessages {
+		history = history[len(history)-maxHistoryMessages:]
+	}
+	return history
+}
+
+// fitHistory drops the oldest turns until the history fits in the token
+// budget. A leading summary note is always kept.
+func fitHistory(history []*schema.Message, budget int, modelName string) []*schema.Message {
+	var note []*schema.Message
+	if len(history) > 0 && history[0].Role == schema.System {
+		note = []*schema.Message{history[0]}
+		history = history[1:]
+		budget -= estimateTokensFor(modelName, note[0].Content)
+	}
+	used := 0
+	start := len(history)
+	for i := len(history) - 1; i >= 0; i-- {
+		cost := estimateTokensFor(modelName, history[i].Content)
+		if used+cost > budget {
+			break
+		}
+		used += cost
+		start = i
+	}
+	// Keep the history starting on a user turn
+	for start < len(history) && history[start].Role != schema.User {
+		start++
+	}
+	if start > 0 {
+		fmt.Printf("[LLM] fitHistory: dropped %d oldest message(s) to fit %d tokens\n", start, budget)
+	}
+	return append(note, history[start:]...)
+}
+
+// historyBudget is the token budget left for history after the system prompt,
+// the current prompt and the reserved output tokens of the given endpoint.
+func historyBudget(cfg *ModelConfig, systemPrompt, prompt string) int {
+	budget := cfg.contextWindow() - cfg.maxOutputTokens() - estimateTokensFor(cfg.Model, systemPrompt) - estimateTokensFor(cfg.Model, prompt)
+	if budget < 0 {
+		return 0
+	}
+	return budget
+}
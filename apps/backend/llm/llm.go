@@ -19,10 +19,12 @@ import (
 
 	"encore.app/backend/iam"
 	"encore.app/backend/llm/extensions"
+	"encore.app/backend/llm/providers"
 	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
 
 	"github.com/cloudwego/eino-ext/components/model/openai"
+	"github.com/cloudwego/eino/components/model"
 	"github.com/cloudwego/eino/schema"
 )
 
@@ -31,20 +33,23 @@ var _ = os.ErrNotExist
 
 //encore:service
 type Service struct {
-	defaultModel *openai.ChatModel
+	defaultModel model.ToolCallingChatModel
 	defaultErr   error
 	executor     extensions.Executor
-	// Cache for resolved endpoints to avoid repeated DB queries
-	endpointCache      map[string]*ResolvedEndpoint
-	endpointCacheMutex sync.RWMutex
-	endpointCacheTime  map[string]time.Time
-	cacheDuration      time.Duration
+	// Endpoint candidates per tenant, to avoid repeated DB queries
+	endpointCache *lruCache[[]endpointCandidate]
+	// Circuit breaker for endpoints that keep failing
+	breaker *circuitBreaker
 	// Cache for system prompts to avoid repeated string building
-	systemPromptCache      map[string]string
-	systemPromptCacheMutex sync.RWMutex
+	systemPromptCache *lruCache[string]
 	// Cache for chat models to avoid recreating them for each request
-	modelCache      map[string]*openai.ChatModel
-	modelCacheMutex sync.RWMutex
+	modelCache *lruCache[model.ToolCallingChatModel]
+	// Scope classifier scores
+	scopeCache *lruCache[scopeScore]
+	// Embeddings of project files and chat roles, see vectorstore.go
+	vectors VectorStore
+	// Projects whose file index is being synced, see retrieval.go
+	indexing sync.Map
 }
 
 type ModelConfig struct {
@@ -52,6 +57,20 @@ type ModelConfig struct {
 	BaseURL  string
 	APIKey   string
 	Model    string
+	// EndpointID and EndpointName identify the managed endpoint; empty for the default config.
+	EndpointID   string
+	EndpointName string
+	// ContextWindow and MaxOutputTokens override the model's limits; 0 means automatic, see tokens.go.
+	ContextWindow   int
+	MaxOutputTokens int
+	// Sampling parameters and timeout, see generation.go; nil and 0 use the defaults.
+	Temperature *float32
+	TopP        *float32
+	Stop        []string
+	Timeout     time.Duration
+	// Project overrides, see applyProjectSettings
+	AllowProjectOverrides bool
+	MaxTemperature        float32
 }
 
 type Endpoint struct {
@@ -63,8 +82,24 @@ type Endpoint struct {
 	IsActive     bool   `json:"is_active"`
 	HasAPIKey    bool   `json:"has_api_key"`
 	APIKeyMasked string `json:"api_key_masked"`
-	CreatedAt    string `json:"created_at"`
-	UpdatedAt    string `json:"updated_at"`
+	// Last health probe result, see health.go
+	HealthStatus    string `json:"health_status"`
+	HealthCheckedAt string `json:"health_checked_at"`
+	HealthLatencyMs int64  `json:"health_latency_ms"`
+	HealthError     string `json:"health_error"`
+	// Token limits, 0 when inferred from the model
+	ContextWindow   int `json:"context_window"`
+	MaxOutputTokens int `json:"max_output_tokens"`
+	// Generation parameters, null temperature and top_p use the defaults
+	Temperature    *float64 `json:"temperature"`
+	TopP           *float64 `json:"top_p"`
+	StopSequences  []string `json:"stop_sequences"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+	// Projects may override the parameters, up to MaxTemperature
+	MaxTemperature        float64 `json:"max_temperature"`
+	AllowProjectOverrides bool    `json:"allow_project_overrides"`
+	CreatedAt             string  `json:"created_at"`
+	UpdatedAt             string  `json:"updated_at"`
 }
 
 type TenantAllocation struct {
@@ -75,6 +110,7 @@ type TenantAllocation struct {
 	Provider          string  `json:"provider"`
 	BaseURL           string  `json:"base_url"`
 	Model             string  `json:"model"`
+	HealthStatus      string  `json:"health_status"`
 	AllocationPercent float64 `json:"allocation_percent"`
 	Requests          int     `json:"requests"`
 	TotalTokens       int     `json:"total_tokens"`
@@ -85,12 +121,23 @@ type TenantAllocation struct {
 }
 
 type ResolvedEndpoint struct {
-	ID       string
-	Name     string
-	Provider string
-	BaseURL  string
-	APIKey   string
-	Model    string
+	ID           string
+	Name         string
+	Provider     string
+	BaseURL      string
+	APIKey       string
+	Model        string
+	HealthStatus string
+	// Token limits, 0 when inferred from the model
+	ContextWindow   int
+	MaxOutputTokens int
+	// Generation parameters
+	Temperature           *float64
+	TopP                  *float64
+	StopSequences         []string
+	TimeoutSeconds        int
+	MaxTemperature        float64
+	AllowProjectOverrides bool
 }
 
 type CreateEndpointParams struct {
@@ -100,6 +147,17 @@ type CreateEndpointParams struct {
 	APIKey   string `json:"api_key"`
 	Model    string `json:"model"`
 	IsActive bool   `json:"is_active"`
+	// ContextWindow and MaxOutputTokens are token limits; 0 infers them from the model
+	ContextWindow   int `json:"context_window"`
+	MaxOutputTokens int `json:"max_output_tokens"`
+	// Temperature (0-2) and TopP (0-1]; null uses the defaults
+	Temperature    *float64 `json:"temperature"`
+	TopP           *float64 `json:"top_p"`
+	StopSequences  []string `json:"stop_sequences"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+	// MaxTemperature caps project temperature overrides, 1 when null
+	MaxTemperature        *float64 `json:"max_temperature"`
+	AllowProjectOverrides bool     `json:"allow_project_overrides"`
 }
 
 type UpdateEndpointParams struct {
@@ -110,6 +168,17 @@ type UpdateEndpointParams struct {
 	APIKey   string `json:"api_key"`
 	Model    string `json:"model"`
 	IsActive bool   `json:"is_active"`
+	// Token limits; omitted keeps the stored value, 0 infers them from the model
+	ContextWindow   *int `json:"context_window,omitempty"`
+	MaxOutputTokens *int `json:"max_output_tokens,omitempty"`
+	// Generation parameters; omitted keeps the stored value. A negative
+	// temperature or top_p restores the default and [] clears stop_sequences.
+	Temperature           *float64 `json:"temperature,omitempty"`
+	TopP                  *float64 `json:"top_p,omitempty"`
+	StopSequences         []string `json:"stop_sequences,omitempty"`
+	TimeoutSeconds        *int     `json:"timeout_seconds,omitempty"`
+	MaxTemperature        *float64 `json:"max_temperature,omitempty"`
+	AllowProjectOverrides *bool    `json:"allow_project_overrides,omitempty"`
 }
 
 type ListEndpointsResponse struct {
@@ -134,21 +203,31 @@ type UpsertTenantAllocationParams struct {
 
 func initService() (*Service, error) {
 	ctx := context.Background()
+	keys, err := loadKeyring()
+	if err != nil {
+		return nil, fmt.Errorf("load llm master key: %w", err)
+	}
+	endpointKeys = keys
+	if err := encryptStoredAPIKeys(ctx); err != nil {
+		fmt.Printf("[WARN] Encrypting stored endpoint api keys failed: %v\n", err)
+	}
+
 	cfg := defaultConfig()
-	model, err := newChatModel(ctx, cfg)
+	chatModel, err := newChatModel(ctx, cfg)
 	executor := extensions.NewGojaExecutor("")
-	return &Service{
-		defaultModel:          model,
-		defaultErr:            err,
-		executor:              executor,
-		endpointCache:         make(map[string]*ResolvedEndpoint),
-		endpointCacheTime:     make(map[string]time.Time),
-		cacheDuration:         10 * time.Minute, // Increased from 5 to 10 minutes for better performance
-		systemPromptCache:     make(map[string]string),
-		systemPromptCacheMutex: sync.RWMutex{},
-		modelCache:            make(map[string]*openai.ChatModel),
-		modelCacheMutex:        sync.RWMutex{},
-	}, nil
+	svc := &Service{
+		defaultModel:      chatModel,
+		defaultErr:        err,
+		executor:          executor,
+		endpointCache:     newLRUCache[[]endpointCandidate](cacheEndpoints, 1000, 10*time.Minute),
+		systemPromptCache: newLRUCache[string](cacheSystemPrompts, 1000, time.Hour),
+		modelCache:        newLRUCache[model.ToolCallingChatModel](cacheModels, 200, 0),
+		breaker:           newCircuitBreaker(breakerFailureThreshold, breakerCooldown),
+		scopeCache:        newLRUCache[scopeScore](cacheScopeScores, scopeCacheMaxSize, scopeCacheTTL),
+		vectors:           newVectorStore(),
+	}
+	svc.startHealthProber(healthProbeInterval())
+	return svc, nil
 }
 
 func defaultConfig() *ModelConfig {
@@ -157,32 +236,70 @@ func defaultConfig() *ModelConfig {
 		APIKey:   strings.TrimSpace(os.Getenv("OPENAI_API_KEY")),
 		Model:    firstNonEmpty(strings.TrimSpace(os.Getenv("OPENAI_MODEL")), "gpt-4o-mini"),
 		BaseURL:  strings.TrimSpace(os.Getenv("OPENAI_BASE_URL")),
+		// Projects may tune the environment default like an endpoint
+		AllowProjectOverrides: true,
+		MaxTemperature:        1,
 	}
 }
 
-func newChatModel(ctx context.Context, cfg *ModelConfig) (*openai.ChatModel, error) {
-	if cfg == nil || strings.TrimSpace(cfg.APIKey) == "" {
+// defaultMaxTokens is the max output tokens requested from the model.
+const defaultMaxTokens = 4096
+
+func newChatModel(ctx context.Context, cfg *ModelConfig) (model.ToolCallingChatModel, error) {
+	if cfg == nil {
 		return nil, errors.New("OPENAI_API_KEY is not set")
 	}
+	provider := providers.Normalize(cfg.Provider)
+	if providers.RequiresAPIKey(provider) && strings.TrimSpace(cfg.APIKey) == "" {
+		if provider == providers.OpenAICompatible {
+			return nil, errors.New("OPENAI_API_KEY is not set")
+		}
+		return nil, fmt.Errorf("api key is not set for %s endpoint", provider)
+	}
 
-	// Create model with optimized parameters for complete responses
-	// Increased max_tokens to ensure long responses are not truncated
-	maxTokens := 4096 // Increased to 4096 to prevent responses from being cut off
-	temperature := float32(0.7)
+	// Generation parameters come from the endpoint, falling back to
+	// defaultMaxTokens and the default temperature
+	maxTokens := cfg.maxOutputTokens()
+	temperature := cfg.temperature()
 
-	fmt.Printf("[LLM] Creating new ChatModel: model=%s, baseURL=%s, maxTokens=%d, temperature=%.1f\n",
-		cfg.Model, cfg.BaseURL, maxTokens, temperature)
+	fmt.Printf("[LLM] Creating new ChatModel: provider=%s, model=%s, baseURL=%s, maxTokens=%d, temperature=%.1f\n",
+		provider, cfg.Model, cfg.BaseURL, maxTokens, temperature)
 
-	chatModel, err := openai.NewChatModel(ctx, &openai.ChatModelConfig{
-		APIKey:  cfg.APIKey,
-		Model:   cfg.Model,
-		BaseURL: cfg.BaseURL,
-		// Configuration for complete responses:
-		// - Max tokens at 4096 to handle long lists, detailed explanations without truncation
-		// - Temperature 0.7 for balanced creativity
-		MaxTokens:   &maxTokens,
+	var (
+		chatModel model.ToolCallingChatModel
+		err       error
+	)
+	native := providers.Config{
+		APIKey:      cfg.APIKey,
+		BaseURL:     cfg.BaseURL,
+		Model:       cfg.Model,
+		MaxTokens:   maxTokens,
 		Temperature: &temperature,
-	})
+		TopP:        cfg.TopP,
+		Stop:        cfg.Stop,
+		Timeout:     cfg.Timeout,
+	}
+	switch provider {
+	case providers.Anthropic:
+		chatModel, err = providers.NewAnthropic(native)
+	case providers.Gemini:
+		chatModel, err = providers.NewGemini(native)
+	case providers.Ollama:
+		chatModel, err = providers.NewOllama(native)
+	case providers.OpenAICompatible:
+		chatModel, err = openai.NewChatModel(ctx, &openai.ChatModelConfig{
+			APIKey:      cfg.APIKey,
+			Model:       cfg.Model,
+			BaseURL:     cfg.BaseURL,
+			MaxTokens:   &maxTokens,
+			Temperature: &temperature,
+			TopP:        cfg.TopP,
+			Stop:        cfg.Stop,
+			Timeout:     cfg.Timeout,
+		})
+	default:
+		err = fmt.Errorf("unsupported provider %q", provider)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("init llm: %w", err)
 	}
@@ -233,6 +350,15 @@ func requireSystemRole() error {
 	return nil
 }
 
+// dataDir returns DATA_DIR, or the data directory next to the executable.
+func dataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	exePath, _ := os.Executable()
+	return filepath.Join(filepath.Dir(exePath), "data")
+}
+
 func getDB() (*sql.DB, error) {
 	return iam.GetDB()
 }
@@ -242,11 +368,7 @@ func nowRFC3339() string {
 }
 
 func normalizeProvider(p string) string {
-	p = strings.TrimSpace(strings.ToLower(p))
-	if p == "" {
-		return "openai-compatible"
-	}
-	return p
+	return providers.Normalize(p)
 }
 
 func toConfig(e *ResolvedEndpoint) *ModelConfig {
@@ -254,10 +376,20 @@ func toConfig(e *ResolvedEndpoint) *ModelConfig {
 		return defaultConfig()
 	}
 	return &ModelConfig{
-		Provider: normalizeProvider(e.Provider),
-		BaseURL:  strings.TrimSpace(e.BaseURL),
-		APIKey:   strings.TrimSpace(e.APIKey),
-		Model:    firstNonEmpty(strings.TrimSpace(e.Model), "gpt-4o-mini"),
+		Provider:              normalizeProvider(e.Provider),
+		BaseURL:               strings.TrimSpace(e.BaseURL),
+		APIKey:                strings.TrimSpace(e.APIKey),
+		Model:                 firstNonEmpty(strings.TrimSpace(e.Model), "gpt-4o-mini"),
+		EndpointID:            e.ID,
+		EndpointName:          e.Name,
+		ContextWindow:         e.ContextWindow,
+		MaxOutputTokens:       e.MaxOutputTokens,
+		Temperature:           float32Ptr(e.Temperature),
+		TopP:                  float32Ptr(e.TopP),
+		Stop:                  e.StopSequences,
+		Timeout:               time.Duration(e.TimeoutSeconds) * time.Second,
+		AllowProjectOverrides: e.AllowProjectOverrides,
+		MaxTemperature:        float32(e.MaxTemperature),
 	}
 }
 
@@ -266,23 +398,24 @@ func generateWithConfig(ctx context.Context, cfg *ModelConfig, messages []*schem
 	if err != nil {
 		return nil, err
 	}
-	return chatModel.Generate(ctx, messages)
+	startCall := time.Now()
+	resp, err := chatModel.Generate(ctx, messages)
+	recordUsage(ctx, resp, err, time.Since(startCall))
+	return resp, err
 }
 
 // generateWithConfigCached uses cached models to avoid recreating them for each request
 func (s *Service) generateWithConfigCached(ctx context.Context, cfg *ModelConfig, messages []*schema.Message) (*schema.Message, error) {
 	// Add timeout to prevent hanging - increased to 60s for reliability
 	// The LLM API needs time to process, but we don't want to wait forever
-	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, cfg.requestTimeout(60*time.Second))
 	defer cancel()
 
 	// Create cache key from config
-	key := fmt.Sprintf("%s|%s|%s", cfg.Provider, cfg.BaseURL, cfg.Model)
+	key := modelCacheKey(cfg)
 
 	// Try cache first with validation
-	s.modelCacheMutex.RLock()
-	cached, ok := s.modelCache[key]
-	s.modelCacheMutex.RUnlock()
+	cached, ok := s.modelCache.get(key)
 
 	if ok && cached != nil {
 		// Try using cached model first with retry for rate limits
@@ -295,9 +428,7 @@ func (s *Service) generateWithConfigCached(ctx context.Context, cfg *ModelConfig
 		if !isRateLimitError(err) {
 			// Cached model failed - remove it and create a new one
 			fmt.Printf("[WARN] Cached model failed (key=%s): %v - recreating...\n", key, err)
-			s.modelCacheMutex.Lock()
-			delete(s.modelCache, key)
-			s.modelCacheMutex.Unlock()
+			s.modelCache.delete(key)
 		}
 	}
 
@@ -314,15 +445,13 @@ func (s *Service) generateWithConfigCached(ctx context.Context, cfg *ModelConfig
 	}
 
 	// Store in cache for future use
-	s.modelCacheMutex.Lock()
-	s.modelCache[key] = chatModel
-	s.modelCacheMutex.Unlock()
+	s.modelCache.set(key, chatModel)
 
 	return resp, nil
 }
 
 // generateWithRetry attempts to generate with retry on rate limit errors
-func (s *Service) generateWithRetry(ctx context.Context, chatModel *openai.ChatModel, messages []*schema.Message) (*schema.Message, error) {
+func (s *Service) generateWithRetry(ctx context.Context, chatModel model.BaseChatModel, messages []*schema.Message, opts ...model.Option) (*schema.Message, error) {
 	maxRetries := 3
 	baseDelay := 2 * time.Second // Start with 2 seconds
 
@@ -341,8 +470,9 @@ func (s *Service) generateWithRetry(ctx context.Context, chatModel *openai.ChatM
 		}
 
 		startCall := time.Now()
-		resp, err := chatModel.Generate(ctx, messages)
+		resp, err := chatModel.Generate(ctx, messages, opts...)
 		callDuration := time.Since(startCall)
+		recordUsage(ctx, resp, err, callDuration)
 
 		if err == nil {
 			fmt.Printf("[LLM] generateWithRetry: SUCCESS in %v (attempt %d)\n", callDuration, attempt+1)
@@ -427,8 +557,25 @@ func (s *Service) CreateEndpoint(ctx context.Context, p *CreateEndpointParams) (
 	name := strings.TrimSpace(p.Name)
 	apiKey := strings.TrimSpace(p.APIKey)
 	model := strings.TrimSpace(p.Model)
-	if name == "" || apiKey == "" || model == "" {
-		return nil, badRequest("name, api_key, and model are required")
+	provider := normalizeProvider(p.Provider)
+	if name == "" || model == "" {
+		return nil, badRequest("name and model are required")
+	}
+	if err := providers.Validate(provider, p.BaseURL, apiKey, model); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if p.ContextWindow < 0 || p.MaxOutputTokens < 0 {
+		return nil, badRequest("context_window and max_output_tokens must not be negative")
+	}
+	if err := validateGenerationParams(p.Temperature, p.TopP, p.StopSequences, p.TimeoutSeconds); err != nil {
+		return nil, err
+	}
+	maxTemp := 1.0
+	if p.MaxTemperature != nil {
+		maxTemp = *p.MaxTemperature
+	}
+	if err := validateGenerationParams(&maxTemp, nil, nil, 0); err != nil {
+		return nil, badRequest("max_temperature must be between 0 and 2")
 	}
 
 	db, err := getDB()
@@ -438,28 +585,24 @@ func (s *Service) CreateEndpoint(ctx context.Context, p *CreateEndpointParams) (
 
 	now := nowRFC3339()
 	id := "lep_" + randomHex(10)
-	endpoint := &Endpoint{}
-	err = db.QueryRowContext(ctx, `
-		INSERT INTO llm_endpoints (id, name, provider, base_url, api_key, model, is_active, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		RETURNING id, name, provider, COALESCE(base_url, ''), model, is_active, created_at, updated_at
-	`, id, name, normalizeProvider(p.Provider), strings.TrimSpace(p.BaseURL), apiKey, model, boolToInt(p.IsActive), now, now).Scan(
-		&endpoint.ID,
-		&endpoint.Name,
-		&endpoint.Provider,
-		&endpoint.BaseURL,
-		&endpoint.Model,
-		&endpoint.IsActive,
-		&endpoint.CreatedAt,
-		&endpoint.UpdatedAt,
-	)
+	storedKey, err := encryptAPIKey(id, apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt api key: %w", err)
+	}
+	endpoint, err := scanEndpoint(db.QueryRowContext(ctx, `
+		INSERT INTO llm_endpoints (id, name, provider, base_url, api_key, model, is_active, context_window, max_output_tokens,
+			temperature, top_p, stop_sequences, timeout_seconds, max_temperature, allow_project_overrides, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING `+endpointColumns+`
+	`, id, name, provider, strings.TrimSpace(p.BaseURL), storedKey, model, boolToInt(p.IsActive), p.ContextWindow, p.MaxOutputTokens,
+		p.Temperature, p.TopP, encodeStopSequences(p.StopSequences), p.TimeoutSeconds, maxTemp, boolToInt(p.AllowProjectOverrides), now, now))
 	if err != nil {
 		if strings.Contains(strings.ToLower(err.Error()), "unique") {
 			return nil, &errs.Error{Code: errs.AlreadyExists, Message: "endpoint name already exists"}
 		}
 		return nil, err
 	}
-	endpoint.HasAPIKey = true
+	endpoint.HasAPIKey = apiKey != ""
 	endpoint.APIKeyMasked = maskSecret(apiKey)
 	return endpoint, nil
 }
@@ -480,8 +623,10 @@ func (s *Service) UpdateEndpoint(ctx context.Context, p *UpdateEndpointParams) (
 		return nil, err
 	}
 
-	var oldAPIKey string
-	err = db.QueryRowContext(ctx, `SELECT api_key FROM llm_endpoints WHERE id = ?`, strings.TrimSpace(p.ID)).Scan(&oldAPIKey)
+	var oldAPIKey, oldProvider, oldBaseURL, oldModel string
+	err = db.QueryRowContext(ctx, `
+		SELECT api_key, provider, COALESCE(base_url, ''), model FROM llm_endpoints WHERE id = ?
+	`, strings.TrimSpace(p.ID)).Scan(&oldAPIKey, &oldProvider, &oldBaseURL, &oldModel)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, &errs.Error{Code: errs.NotFound, Message: "endpoint not found"}
@@ -490,13 +635,63 @@ func (s *Service) UpdateEndpoint(ctx context.Context, p *UpdateEndpointParams) (
 	}
 
 	apiKey := strings.TrimSpace(p.APIKey)
+	storedKey := oldAPIKey
 	if apiKey == "" {
-		apiKey = oldAPIKey
+		apiKey, err = decryptAPIKey(strings.TrimSpace(p.ID), oldAPIKey)
+		if err != nil {
+			return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "stored api key cannot be decrypted, set a new api_key"}
+		}
+	} else {
+		storedKey, err = encryptAPIKey(strings.TrimSpace(p.ID), apiKey)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt api key: %w", err)
+		}
+	}
+	// An empty provider keeps the stored one
+	provider := ""
+	if strings.TrimSpace(p.Provider) != "" {
+		provider = normalizeProvider(p.Provider)
+	}
+	if err := providers.Validate(
+		firstNonEmpty(provider, oldProvider),
+		firstNonEmpty(p.BaseURL, oldBaseURL),
+		apiKey,
+		firstNonEmpty(p.Model, oldModel),
+	); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if (p.ContextWindow != nil && *p.ContextWindow < 0) || (p.MaxOutputTokens != nil && *p.MaxOutputTokens < 0) {
+		return nil, badRequest("context_window and max_output_tokens must not be negative")
+	}
+	// Negative temperature and top_p reset to the default (NULL)
+	var temperature, topP *float64
+	if p.Temperature != nil && *p.Temperature >= 0 {
+		temperature = p.Temperature
+	}
+	if p.TopP != nil && *p.TopP >= 0 {
+		topP = p.TopP
+	}
+	timeout := 0
+	if p.TimeoutSeconds != nil {
+		timeout = *p.TimeoutSeconds
+	}
+	if err := validateGenerationParams(temperature, topP, p.StopSequences, timeout); err != nil {
+		return nil, err
+	}
+	if p.MaxTemperature != nil && (*p.MaxTemperature < 0 || *p.MaxTemperature > maxTemperature) {
+		return nil, badRequest("max_temperature must be between 0 and 2")
+	}
+	var stop interface{}
+	if p.StopSequences != nil {
+		stop = encodeStopSequences(p.StopSequences)
+	}
+	var allowOverrides interface{}
+	if p.AllowProjectOverrides != nil {
+		allowOverrides = boolToInt(*p.AllowProjectOverrides)
 	}
 	now := nowRFC3339()
 
-	endpoint := &Endpoint{}
-	err = db.QueryRowContext(ctx, `
+	endpoint, err := scanEndpoint(db.QueryRowContext(ctx, `
 		UPDATE llm_endpoints
 		SET
 			name = CASE WHEN ? = '' THEN name ELSE ? END,
@@ -505,28 +700,35 @@ func (s *Service) UpdateEndpoint(ctx context.Context, p *UpdateEndpointParams) (
 			api_key = ?,
 			model = CASE WHEN ? = '' THEN model ELSE ? END,
 			is_active = ?,
+			context_window = COALESCE(?, context_window),
+			max_output_tokens = COALESCE(?, max_output_tokens),
+			temperature = CASE WHEN ? IS NULL THEN temperature WHEN ? < 0 THEN NULL ELSE ? END,
+			top_p = CASE WHEN ? IS NULL THEN top_p WHEN ? < 0 THEN NULL ELSE ? END,
+			stop_sequences = COALESCE(?, stop_sequences),
+			timeout_seconds = COALESCE(?, timeout_seconds),
+			max_temperature = COALESCE(?, max_temperature),
+			allow_project_overrides = COALESCE(?, allow_project_overrides),
 			updated_at = ?
 		WHERE id = ?
-		RETURNING id, name, provider, COALESCE(base_url, ''), model, is_active, created_at, updated_at
+		RETURNING `+endpointColumns+`
 	`,
 		strings.TrimSpace(p.Name), strings.TrimSpace(p.Name),
-		normalizeProvider(p.Provider), normalizeProvider(p.Provider),
+		provider, provider,
 		strings.TrimSpace(p.BaseURL), strings.TrimSpace(p.BaseURL),
-		apiKey,
+		storedKey,
 		strings.TrimSpace(p.Model), strings.TrimSpace(p.Model),
 		boolToInt(p.IsActive),
+		p.ContextWindow,
+		p.MaxOutputTokens,
+		p.Temperature, p.Temperature, p.Temperature,
+		p.TopP, p.TopP, p.TopP,
+		stop,
+		p.TimeoutSeconds,
+		p.MaxTemperature,
+		allowOverrides,
 		now,
 		strings.TrimSpace(p.ID),
-	).Scan(
-		&endpoint.ID,
-		&endpoint.Name,
-		&endpoint.Provider,
-		&endpoint.BaseURL,
-		&endpoint.Model,
-		&endpoint.IsActive,
-		&endpoint.CreatedAt,
-		&endpoint.UpdatedAt,
-	)
+	))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, &errs.Error{Code: errs.NotFound, Message: "endpoint not found"}
@@ -538,6 +740,8 @@ func (s *Service) UpdateEndpoint(ctx context.Context, p *UpdateEndpointParams) (
 	}
 	endpoint.HasAPIKey = strings.TrimSpace(apiKey) != ""
 	endpoint.APIKeyMasked = maskSecret(apiKey)
+	// Tenants pick up the new settings on their next request
+	s.invalidateEndpoint(endpoint.ID)
 	return endpoint, nil
 }
 
@@ -555,7 +759,7 @@ func (s *Service) ListEndpoints(ctx context.Context) (*ListEndpointsResponse, er
 	}
 
 	rows, err := db.QueryContext(ctx, `
-		SELECT id, name, provider, COALESCE(base_url, ''), model, is_active, created_at, updated_at, api_key
+		SELECT `+endpointColumns+`, api_key
 		FROM llm_endpoints
 		ORDER BY created_at DESC
 	`)
@@ -566,15 +770,17 @@ func (s *Service) ListEndpoints(ctx context.Context) (*ListEndpointsResponse, er
 
 	items := make([]*Endpoint, 0)
 	for rows.Next() {
-		item := &Endpoint{}
-		var isActive int
 		var apiKey string
-		if err := rows.Scan(&item.ID, &item.Name, &item.Provider, &item.BaseURL, &item.Model, &isActive, &item.CreatedAt, &item.UpdatedAt, &apiKey); err != nil {
+		item, err := scanEndpoint(rows, &apiKey)
+		if err != nil {
 			return nil, err
 		}
-		item.IsActive = intToBool(isActive)
 		item.HasAPIKey = strings.TrimSpace(apiKey) != ""
-		item.APIKeyMasked = maskSecret(apiKey)
+		if plain, err := decryptAPIKey(item.ID, apiKey); err == nil {
+			item.APIKeyMasked = maskSecret(plain)
+		} else if item.HasAPIKey {
+			item.APIKeyMasked = "****"
+		}
 		items = append(items, item)
 	}
 	if rows.Err() != nil {
@@ -617,6 +823,7 @@ func (s *Service) DeleteEndpoint(ctx context.Context, id string) error {
 	if affected == 0 {
 		return &errs.Error{Code: errs.NotFound, Message: "endpoint not found"}
 	}
+	s.invalidateEndpoint(id)
 	return nil
 }
 
@@ -636,6 +843,13 @@ func (s *Service) ListTenantAllocations(ctx context.Context, p *ListTenantAlloca
 		return nil, err
 	}
 
+	days := p.Days
+	if days <= 0 {
+		days = 30
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days).Format(time.RFC3339)
+
+	// Usage counters are aggregated from llm_usage over the requested window
 	rows, err := db.QueryContext(ctx, `
 		SELECT
 			a.id,
@@ -645,14 +859,30 @@ func (s *Service) ListTenantAllocations(ctx context.Context, p *ListTenantAlloca
 			e.provider,
 			COALESCE(e.base_url, ''),
 			e.model,
+			e.health_status,
 			a.allocation_percent,
+			COALESCE(u.requests, 0),
+			COALESCE(u.total_tokens, 0),
+			COALESCE(u.successful, 0),
+			COALESCE(u.failed, 0),
 			a.created_at,
 			a.updated_at
 		FROM tenant_llm_allocations a
 		JOIN llm_endpoints e ON e.id = a.endpoint_id
+		LEFT JOIN (
+			SELECT
+				endpoint_id,
+				COUNT(*) AS requests,
+				SUM(total_tokens) AS total_tokens,
+				SUM(CASE WHEN success = 1 THEN 1 ELSE 0 END) AS successful,
+				SUM(CASE WHEN success = 0 THEN 1 ELSE 0 END) AS failed
+			FROM llm_usage
+			WHERE tenant_id = ? AND created_at >= ?
+			GROUP BY endpoint_id
+		) u ON u.endpoint_id = a.endpoint_id
 		WHERE a.tenant_id = ?
 		ORDER BY a.allocation_percent DESC, a.created_at ASC
-	`, strings.TrimSpace(p.TenantID))
+	`, strings.TrimSpace(p.TenantID), since, strings.TrimSpace(p.TenantID))
 	if err != nil {
 		return nil, err
 	}
@@ -670,7 +900,12 @@ func (s *Service) ListTenantAllocations(ctx context.Context, p *ListTenantAlloca
 			&item.Provider,
 			&item.BaseURL,
 			&item.Model,
+			&item.HealthStatus,
 			&item.AllocationPercent,
+			&item.Requests,
+			&item.TotalTokens,
+			&item.Successful,
+			&item.Failed,
 			&item.CreatedAt,
 			&item.UpdatedAt,
 		); err != nil {
@@ -772,6 +1007,7 @@ func (s *Service) UpsertTenantAllocation(ctx context.Context, p *UpsertTenantAll
 	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
+	s.invalidateTenantEndpoints(item.TenantID)
 	return item, nil
 }
 
@@ -789,6 +1025,25 @@ func ResolveEndpointForTenant(ctx context.Context, tenantID string) (*ResolvedEn
 }
 
 func resolveEndpointFromDB(ctx context.Context, tenantID string) (*ResolvedEndpoint, error) {
+	candidates, err := loadEndpointCandidates(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	ordered, err := orderCandidates(candidates)
+	if err != nil || len(ordered) == 0 {
+		return nil, err
+	}
+	return ordered[0], nil
+}
+
+// endpointCandidate is an allocated endpoint with its allocation weight.
+type endpointCandidate struct {
+	endpoint ResolvedEndpoint
+	weight   float64
+}
+
+// loadEndpointCandidates returns all active endpoints allocated to a tenant.
+func loadEndpointCandidates(ctx context.Context, tenantID string) ([]endpointCandidate, error) {
 	tenantID = strings.TrimSpace(tenantID)
 	if tenantID == "" {
 		return nil, nil
@@ -807,6 +1062,15 @@ func resolveEndpointFromDB(ctx context.Context, tenantID string) (*ResolvedEndpo
 			COALESCE(e.base_url, ''),
 			e.api_key,
 			e.model,
+			e.health_status,
+			e.context_window,
+			e.max_output_tokens,
+			e.temperature,
+			e.top_p,
+			e.stop_sequences,
+			e.timeout_seconds,
+			e.max_temperature,
+			e.allow_project_overrides,
 			a.allocation_percent
 		FROM tenant_llm_allocations a
 		JOIN llm_endpoints e ON e.id = a.endpoint_id
@@ -818,15 +1082,12 @@ func resolveEndpointFromDB(ctx context.Context, tenantID string) (*ResolvedEndpo
 	}
 	defer rows.Close()
 
-	type candidate struct {
-		endpoint ResolvedEndpoint
-		weight   float64
-	}
-
-	candidates := make([]candidate, 0)
-	totalWeight := 0.0
+	candidates := make([]endpointCandidate, 0)
 	for rows.Next() {
-		var c candidate
+		var c endpointCandidate
+		var temperature, topP sql.NullFloat64
+		var stop string
+		var allowOverrides int
 		if err := rows.Scan(
 			&c.endpoint.ID,
 			&c.endpoint.Name,
@@ -834,134 +1095,177 @@ func resolveEndpointFromDB(ctx context.Context, tenantID string) (*ResolvedEndpo
 			&c.endpoint.BaseURL,
 			&c.endpoint.APIKey,
 			&c.endpoint.Model,
+			&c.endpoint.HealthStatus,
+			&c.endpoint.ContextWindow,
+			&c.endpoint.MaxOutputTokens,
+			&temperature,
+			&topP,
+			&stop,
+			&c.endpoint.TimeoutSeconds,
+			&c.endpoint.MaxTemperature,
+			&allowOverrides,
 			&c.weight,
 		); err != nil {
 			return nil, err
 		}
+		c.endpoint.Temperature = nullFloat(temperature)
+		c.endpoint.TopP = nullFloat(topP)
+		c.endpoint.StopSequences = decodeStopSequences(stop)
+		c.endpoint.AllowProjectOverrides = intToBool(allowOverrides)
+		apiKey, err := decryptAPIKey(c.endpoint.ID, c.endpoint.APIKey)
+		if err != nil {
+			// Leave the key empty so the resolver skips this endpoint
+			fmt.Printf("[WARN] %v\n", err)
+		}
+		c.endpoint.APIKey = apiKey
 		if c.weight <= 0 {
 			continue
 		}
-		totalWeight += c.weight
 		candidates = append(candidates, c)
 	}
 	if rows.Err() != nil {
 		return nil, rows.Err()
 	}
-	if len(candidates) == 0 || totalWeight <= 0 {
-		return nil, nil
-	}
-
-	draw, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
-	if err != nil {
-		return nil, err
-	}
-	target := (float64(draw.Int64()) / 1_000_000.0) * totalWeight
-	running := 0.0
-	for _, c := range candidates {
-		running += c.weight
-		if target < running || math.Abs(target-running) < 1e-9 {
-			selected := c.endpoint
-			return &selected, nil
-		}
-	}
-	selected := candidates[len(candidates)-1].endpoint
-	return &selected, nil
+	return candidates, nil
 }
 
-// getCachedEndpoint returns a cached endpoint if available and fresh
-func (s *Service) getCachedEndpoint(tenantID string) *ResolvedEndpoint {
-	s.endpointCacheMutex.RLock()
-	defer s.endpointCacheMutex.RUnlock()
+// orderCandidates returns the endpoints in weighted random order: the first
+// pick is drawn by weight, then the next from the remaining ones, and so on.
+func orderCandidates(candidates []endpointCandidate) ([]*ResolvedEndpoint, error) {
+	remaining := make([]endpointCandidate, len(candidates))
+	copy(remaining, candidates)
+
+	ordered := make([]*ResolvedEndpoint, 0, len(candidates))
+	for len(remaining) > 0 {
+		totalWeight := 0.0
+		for _, c := range remaining {
+			totalWeight += c.weight
+		}
+		if totalWeight <= 0 {
+			break
+		}
 
-	if cached, ok := s.endpointCache[tenantID]; ok {
-		if cacheTime, ok := s.endpointCacheTime[tenantID]; ok {
-			if time.Since(cacheTime) < s.cacheDuration {
-				return cached
+		draw, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+		if err != nil {
+			return nil, err
+		}
+		target := (float64(draw.Int64()) / 1_000_000.0) * totalWeight
+		running := 0.0
+		pick := len(remaining) - 1
+		for i, c := range remaining {
+			running += c.weight
+			if target < running || math.Abs(target-running) < 1e-9 {
+				pick = i
+				break
 			}
 		}
+
+		selected := remaining[pick].endpoint
+		ordered = append(ordered, &selected)
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
 	}
-	return nil
+	return ordered, nil
 }
 
-// setCachedEndpoint stores an endpoint in the cache
-func (s *Service) setCachedEndpoint(tenantID string, endpoint *ResolvedEndpoint) {
-	s.endpointCacheMutex.Lock()
-	defer s.endpointCacheMutex.Unlock()
-
-	s.endpointCache[tenantID] = endpoint
-	s.endpointCacheTime[tenantID] = time.Now()
+// getCachedEndpoints returns cached endpoint candidates if available and fresh
+func (s *Service) getCachedEndpoints(tenantID string) ([]endpointCandidate, bool) {
+	return s.endpointCache.get(tenantID)
 }
 
-// GenerateStream runs a single prompt and streams the model response.
-//
-//encore:api public method=POST path=/llm/generate/stream
-func (s *Service) GenerateStream(ctx context.Context, p *GenerateParams) (*GenerateStreamResponse, error) {
-	if p == nil || strings.TrimSpace(p.Prompt) == "" {
-		return nil, badRequest("prompt is required")
-	}
-	if p.ProjectContext == nil {
-		return nil, badRequest("project_context is required")
-	}
-
-	tenantID := ""
-	if p.ProjectContext.Metadata != nil {
-		tenantID = strings.TrimSpace(p.ProjectContext.Metadata["tenant_id"])
-	}
+// setCachedEndpoints stores endpoint candidates in the cache
+func (s *Service) setCachedEndpoints(tenantID string, candidates []endpointCandidate) {
+	s.endpointCache.set(tenantID, candidates)
+}
 
-	// Try cache first for faster responses
-	var resolved *ResolvedEndpoint
+// resolveConfigs returns the model configs to try for a tenant, in failover
+// order. Endpoints with an open circuit breaker or a failed health probe are
+// moved to the end. When the tenant has no allocations, the default
+// environment config is used.
+func (s *Service) resolveConfigs(ctx context.Context, tenantID string) ([]*ModelConfig, error) {
+	startTime := time.Now()
+	var candidates []endpointCandidate
+	cached := false
 	if tenantID != "" {
-		resolved = s.getCachedEndpoint(tenantID)
+		candidates, cached = s.getCachedEndpoints(tenantID)
+		if cached {
+			fmt.Printf("[LLM] Generate: endpoint cache hit\n")
+		}
 	}
-	if resolved == nil {
+	if !cached {
 		var err error
-		resolved, err = resolveEndpointFromDB(ctx, tenantID)
+		candidates, err = loadEndpointCandidates(ctx, tenantID)
 		if err != nil {
 			return nil, &errs.Error{Code: errs.Internal, Message: fmt.Sprintf("resolve llm endpoint failed: %v", err)}
 		}
 		// Cache for future requests
-		if tenantID != "" && resolved != nil {
-			s.setCachedEndpoint(tenantID, resolved)
+		if tenantID != "" {
+			s.setCachedEndpoints(tenantID, candidates)
 		}
+		fmt.Printf("[LLM] Generate: endpoint DB lookup took %v\n", time.Since(startTime))
 	}
-	cfg := toConfig(resolved)
-	if strings.TrimSpace(cfg.APIKey) == "" {
+
+	ordered, err := orderCandidates(candidates)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.Internal, Message: fmt.Sprintf("resolve llm endpoint failed: %v", err)}
+	}
+
+	var healthy, tripped []*ModelConfig
+	for _, e := range ordered {
+		cfg := toConfig(e)
+		if providers.RequiresAPIKey(cfg.Provider) && strings.TrimSpace(cfg.APIKey) == "" {
+			continue
+		}
+		if e.HealthStatus != healthUnhealthy && s.breaker.allow(e.ID) {
+			healthy = append(healthy, cfg)
+		} else {
+			tripped = append(tripped, cfg)
+		}
+	}
+	// Endpoints in cooldown or failing probes are only tried when nothing else is left
+	cfgs := append(healthy, tripped...)
+
+	if len(cfgs) == 0 {
 		if s.defaultErr != nil || s.defaultModel == nil {
 			return nil, &errs.Error{Code: errs.Unavailable, Message: "llm not configured"}
 		}
-		cfg = defaultConfig()
+		cfgs = []*ModelConfig{defaultConfig()}
 	}
+	return cfgs, nil
+}
 
-	// Build system prompt from project context (cached)
-	systemPrompt := s.buildSystemPromptCached(p.ProjectContext)
+// getChatModel returns a cached chat model for the config, creating it on first use.
+func (s *Service) getChatModel(ctx context.Context, cfg *ModelConfig) (model.ToolCallingChatModel, error) {
+	key := modelCacheKey(cfg)
 
-	// Execute pre-generate extension hooks (skip if no extensions for speed)
-	preprocessed := p.Prompt
-	if p.ProjectContext.Extensions != nil && len(p.ProjectContext.Extensions) > 0 {
-		preprocessed = s.applyExtensionHooks(ctx, "pre-generate", preprocessed, p.ProjectContext)
+	if cached, ok := s.modelCache.get(key); ok && cached != nil {
+		return cached, nil
 	}
 
-	// Check if Image extension is enabled
-	hasImageExtension := false
-	fmt.Printf("[LLM Stream] === MULTIMODAL DEBUG ===\n")
-	fmt.Printf("[LLM Stream] Checking extensions: %+v (total: %d)\n", p.ProjectContext.Extensions, len(p.ProjectContext.Extensions))
-	if p.ProjectContext.Extensions != nil {
-		for _, extID := range p.ProjectContext.Extensions {
-			fmt.Printf("[LLM Stream]   - Extension: '%s' (equals 'image': %v)\n", extID, extID == "image")
-			if extID == "image" {
-				hasImageExtension = true
-				fmt.Printf("[LLM Stream]   ✓ Image extension FOUND!\n")
-				break
-			}
-		}
+	chatModel, err := newChatModel(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create chat model: %w", err)
 	}
-	fmt.Printf("[LLM Stream] hasImageExtension: %v, attachments count: %d\n", hasImageExtension, len(p.Attachments))
-	for i, att := range p.Attachments {
-		fmt.Printf("[LLM Stream]   Attachment %d: %s (type: %s, dataSize: %d)\n", i, att.Name, att.Type, len(att.Data))
+
+	s.modelCache.set(key, chatModel)
+	return chatModel, nil
+}
+
+// hasExtension reports whether the project context enables the given extension.
+func hasExtension(projectCtx *ProjectContext, extID string) bool {
+	if projectCtx == nil {
+		return false
 	}
-	fmt.Printf("[LLM Stream] === END MULTIMODAL DEBUG ===\n")
+	for _, id := range projectCtx.Extensions {
+		if id == extID {
+			return true
+		}
+	}
+	return false
+}
 
-	// Build messages - handle multimodal content if attachments exist
+// buildGenerateMessages builds the system, history and user messages for a prompt,
+// turning image attachments into multimodal parts when the Image extension is enabled.
+func buildGenerateMessages(systemPrompt string, history []*schema.Message, prompt string, attachments []FileAttachment, hasImageExtension bool) []*schema.Message {
 	var messages []*schema.Message
 
 	// System message
@@ -970,13 +1274,16 @@ func (s *Service) GenerateStream(ctx context.Context, p *GenerateParams) (*Gener
 		Content: systemPrompt,
 	})
 
+	// Previous conversation turns
+	messages = append(messages, history...)
+
 	// User message with potential multimodal content
-	if len(p.Attachments) > 0 && hasImageExtension {
-		fmt.Printf("[LLM] Processing %d file attachments (stream) with multimodal content\n", len(p.Attachments))
+	if len(attachments) > 0 && hasImageExtension {
+		fmt.Printf("[LLM] Processing %d file attachments with multimodal content\n", len(attachments))
 
 		// Check if there are any image attachments
 		hasImages := false
-		for _, att := range p.Attachments {
+		for _, att := range attachments {
 			if strings.HasPrefix(att.Type, "image/") && att.Data != "" {
 				hasImages = true
 				break
@@ -990,18 +1297,20 @@ func (s *Service) GenerateStream(ctx context.Context, p *GenerateParams) (*Gener
 			// Add text part
 			parts = append(parts, schema.MessageInputPart{
 				Type: schema.ChatMessagePartTypeText,
-				Text: preprocessed,
+				Text: prompt,
 			})
 
 			// Add image parts
-			for _, att := range p.Attachments {
+			for i := range attachments {
+				att := attachments[i]
 				if strings.HasPrefix(att.Type, "image/") && att.Data != "" {
-					fmt.Printf("[LLM] Stream - Adding image: %s (%s)\n", att.Name, att.Type)
+					fmt.Printf("[LLM] Adding image: %s (%s, %d bytes)\n", att.Name, att.Type, att.Size)
+					data := att.Data
 					parts = append(parts, schema.MessageInputPart{
 						Type: schema.ChatMessagePartTypeImageURL,
 						Image: &schema.MessageInputImage{
 							MessagePartCommon: schema.MessagePartCommon{
-								Base64Data: &att.Data,
+								Base64Data: &data,
 								MIMEType:   att.Type,
 							},
 							Detail: schema.ImageURLDetailAuto,
@@ -1009,63 +1318,60 @@ func (s *Service) GenerateStream(ctx context.Context, p *GenerateParams) (*Gener
 					})
 				} else if att.Type != "" {
 					// Non-image file - add as text reference
-					parts[0].Text += fmt.Sprintf("\n\n[File Attachment: %s (%s)]", att.Name, att.Type)
+					fmt.Printf("[LLM] Skipping non-image file: %s (%s)\n", att.Name, att.Type)
+					parts[0].Text += fmt.Sprintf("\n\n[File Attachment: %s (%s, %d bytes)]", att.Name, att.Type, att.Size)
 				}
 			}
 
 			messages = append(messages, &schema.Message{
-				Role:                   schema.User,
+				Role:                  schema.User,
 				UserInputMultiContent: parts,
 			})
+			fmt.Printf("[LLM] Built multimodal message with %d parts\n", len(parts))
 		} else {
 			// No images, just add file references as text
 			var fileContext strings.Builder
-			for _, att := range p.Attachments {
-				fileContext.WriteString(fmt.Sprintf("\n\n[File Attachment: %s (%s)]", att.Name, att.Type))
+			for _, att := range attachments {
+				fileContext.WriteString(fmt.Sprintf("\n\n[File Attachment: %s (%s, %d bytes)]", att.Name, att.Type, att.Size))
 			}
 			messages = append(messages, &schema.Message{
 				Role:    schema.User,
-				Content: preprocessed + fileContext.String(),
+				Content: prompt + fileContext.String(),
 			})
 		}
 	} else {
 		// No attachments or image extension not enabled - use simple text message
-		if len(p.Attachments) > 0 {
-			fmt.Printf("[LLM] Stream - Image extension not enabled\n")
+		if len(attachments) > 0 {
+			fmt.Printf("[LLM] Image extension not enabled, treating files as text references\n")
+			var fileContext strings.Builder
+			for _, att := range attachments {
+				fileContext.WriteString(fmt.Sprintf("\n\n[File Attachment: %s (%s, %d bytes)]\nNote: The Image extension is not enabled. Please enable it to analyze image content.", att.Name, att.Type, att.Size))
+			}
+			prompt = prompt + fileContext.String()
 		}
+
 		messages = append(messages, &schema.Message{
 			Role:    schema.User,
-			Content: preprocessed,
+			Content: prompt,
 		})
 	}
 
-	// For streaming, we'll generate the full response first
-	// In a future enhancement, this could use true streaming with the eino library
-	resp, err := s.generateWithConfigCached(ctx, cfg, messages)
-	if err != nil {
-		return nil, &errs.Error{Code: errs.Internal, Message: fmt.Sprintf("generate failed: %v", err)}
-	}
+	return messages
+}
 
-	content := strings.TrimSpace(resp.Content)
+// postProcessContent runs post-generate hooks and the weather enhancement
+// on the final model text.
+func (s *Service) postProcessContent(ctx context.Context, content string, p *GenerateParams) string {
 	if p.ProjectContext.Extensions != nil && len(p.ProjectContext.Extensions) > 0 {
 		content = s.applyExtensionHooks(ctx, "post-generate", content, p.ProjectContext)
 	}
 
-	// Process tool calls if extension-creator is enabled
-	if p.ProjectContext.Extensions != nil {
-		for _, extID := range p.ProjectContext.Extensions {
-			if extID == "extension-creator" {
-				var messages []string
-				content, messages, _ = s.processToolCalls(ctx, content, p.ProjectContext)
-				if len(messages) > 0 {
-					fmt.Printf("[LLM] Tool call messages: %v\n", messages)
-				}
-				break
-			}
-		}
+	// Enhanced weather integration - fetch real data from wttr.in API
+	if hasExtension(p.ProjectContext, "weather-indonesia") {
+		content = s.enhanceWeatherResponse(ctx, content, p.Prompt)
 	}
 
-	return &GenerateStreamResponse{Content: content}, nil
+	return content
 }
 
 // Generate runs a single prompt and returns the model response.
@@ -1111,43 +1417,45 @@ func (s *Service) Generate(ctx context.Context, p *GenerateParams) (*GenerateRes
 	}
 	fmt.Printf("[LLM] === END MULTIMODAL DEBUG ===\n")
 
-	tenantID := ""
-	if p.ProjectContext.Metadata != nil {
-		tenantID = strings.TrimSpace(p.ProjectContext.Metadata["tenant_id"])
+	data, _ := auth.Data().(*iam.AuthData)
+	if err := pinAPIKeyScope(ctx, p, data); err != nil {
+		return nil, err
 	}
+	if err := pinSessionSubclient(p, data); err != nil {
+		return nil, err
+	}
+	tenantID := requestTenantID(p)
+	subclientID := strings.TrimSpace(p.SubclientID)
+	ctx = withUsageScope(ctx, tenantID, p.ProjectContext.ProjectID, subclientID, "generate")
 
-	// Try cache first for faster responses
-	endpointStartTime := time.Now()
-	var resolved *ResolvedEndpoint
-	if tenantID != "" {
-		resolved = s.getCachedEndpoint(tenantID)
-		if resolved != nil {
-			fmt.Printf("[LLM] Generate: endpoint cache hit\n")
-		}
+	quotaWarnings, err := checkQuotas(ctx, tenantID, p.ProjectContext.ProjectID, subclientID)
+	if err != nil {
+		return nil, err
 	}
-	if resolved == nil {
-		var err error
-		resolved, err = resolveEndpointFromDB(ctx, tenantID)
-		if err != nil {
-			return nil, &errs.Error{Code: errs.Internal, Message: fmt.Sprintf("resolve llm endpoint failed: %v", err)}
-		}
-		// Cache for future requests
-		if tenantID != "" && resolved != nil {
-			s.setCachedEndpoint(tenantID, resolved)
-		}
-		fmt.Printf("[LLM] Generate: endpoint DB lookup took %v\n", time.Since(endpointStartTime))
+
+	role := resolveContextRole(ctx, p.ProjectContext, tenantID)
+	if refusal := s.checkScope(ctx, p, role, tenantID, subclientID); refusal != nil {
+		return &GenerateResponse{
+			Content:     refusal.RefusalMessage,
+			Refused:     true,
+			ContextRole: refusal.Role,
+			Suggestions: refusal.Suggestions,
+		}, nil
 	}
-	cfg := toConfig(resolved)
-	if strings.TrimSpace(cfg.APIKey) == "" {
-		if s.defaultErr != nil || s.defaultModel == nil {
-			return nil, &errs.Error{Code: errs.Unavailable, Message: "llm not configured"}
-		}
-		cfg = defaultConfig()
+
+	endpointStartTime := time.Now()
+	cfgs, err := s.resolveConfigs(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	cfgs = s.applyProjectSettings(ctx, cfgs, tenantID, p.ProjectContext.ProjectID)
+	if cfgs, err = applyGenerationOptions(cfgs, p.Generation); err != nil {
+		return nil, err
 	}
 
 	// Build system prompt from project context (cached)
 	promptStartTime := time.Now()
-	systemPrompt := s.buildSystemPromptCached(p.ProjectContext)
+	systemPrompt := s.buildSystemPromptCached(p.ProjectContext, role)
 	fmt.Printf("[LLM] Generate: system prompt built in %v\n", time.Since(promptStartTime))
 
 	// Execute pre-generate extension hooks (skip if no extensions for speed)
@@ -1156,135 +1464,62 @@ func (s *Service) Generate(ctx context.Context, p *GenerateParams) (*GenerateRes
 		preprocessed = s.applyExtensionHooks(ctx, "pre-generate", preprocessed, p.ProjectContext)
 	}
 
-	// Build messages - handle multimodal content if attachments exist
-	var messages []*schema.Message
-
-	// System message
-	messages = append(messages, &schema.Message{
-		Role:    schema.System,
-		Content: systemPrompt,
-	})
-
-	// User message with potential multimodal content
-	if len(p.Attachments) > 0 && hasImageExtension {
-		fmt.Printf("[LLM] Processing %d file attachments with multimodal content\n", len(p.Attachments))
-
-		// Check if there are any image attachments
-		hasImages := false
-		for _, att := range p.Attachments {
-			if strings.HasPrefix(att.Type, "image/") && att.Data != "" {
-				hasImages = true
-				break
-			}
-		}
-
-		if hasImages {
-			// Build multimodal message with text + images
-			var parts []schema.MessageInputPart
-
-			// Add text part
-			parts = append(parts, schema.MessageInputPart{
-				Type: schema.ChatMessagePartTypeText,
-				Text: preprocessed,
-			})
-
-			// Add image parts
-			for _, att := range p.Attachments {
-				if strings.HasPrefix(att.Type, "image/") && att.Data != "" {
-					fmt.Printf("[LLM] Adding image: %s (%s, %d bytes)\n", att.Name, att.Type, att.Size)
-					parts = append(parts, schema.MessageInputPart{
-						Type: schema.ChatMessagePartTypeImageURL,
-						Image: &schema.MessageInputImage{
-							MessagePartCommon: schema.MessagePartCommon{
-								Base64Data: &att.Data,
-								MIMEType:   att.Type,
-							},
-							Detail: schema.ImageURLDetailAuto,
-						},
-					})
-				} else if att.Type != "" {
-					// Non-image file - add as text reference
-					fmt.Printf("[LLM] Skipping non-image file: %s (%s)\n", att.Name, att.Type)
-					parts[0].Text += fmt.Sprintf("\n\n[File Attachment: %s (%s, %d bytes)]", att.Name, att.Type, att.Size)
-				}
-			}
-
-			messages = append(messages, &schema.Message{
-				Role:                   schema.User,
-				UserInputMultiContent: parts,
-			})
-			fmt.Printf("[LLM] Built multimodal message with %d parts\n", len(parts))
-		} else {
-			// No images, just add file references as text
-			var fileContext strings.Builder
-			for _, att := range p.Attachments {
-				fileContext.WriteString(fmt.Sprintf("\n\n[File Attachment: %s (%s, %d bytes)]", att.Name, att.Type, att.Size))
-			}
-			messages = append(messages, &schema.Message{
-				Role:    schema.User,
-				Content: preprocessed + fileContext.String(),
-			})
-		}
-	} else {
-		// No attachments or image extension not enabled - use simple text message
-		if len(p.Attachments) > 0 {
-			fmt.Printf("[LLM] Image extension not enabled, treating files as text references\n")
-			var fileContext strings.Builder
-			for _, att := range p.Attachments {
-				fileContext.WriteString(fmt.Sprintf("\n\n[File Attachment: %s (%s, %d bytes)]\nNote: The Image extension is not enabled. Please enable it to analyze image content.", att.Name, att.Type, att.Size))
-			}
-			preprocessed = preprocessed + fileContext.String()
-		}
-
-		messages = append(messages, &schema.Message{
-			Role:    schema.User,
-			Content: preprocessed,
-		})
+	limits := tightestConfig(cfgs)
+	sources := s.retrieveSources(ctx, tenantID, p.ProjectContext.ProjectID, preprocessed, limits)
+	systemPrompt = withRetrievedContext(systemPrompt, sources)
+	budget := historyBudget(limits, systemPrompt, preprocessed)
+	history, err := s.loadHistory(ctx, p, tenantID, data, cfgs, limits, budget)
+	if err != nil {
+		return nil, err
 	}
+	firstTurn := len(history) == 0
+	history = fitHistory(history, budget, limits.Model)
+
+	messages := buildGenerateMessages(systemPrompt, history, preprocessed, p.Attachments, hasImageExtension)
 
 	// Call LLM
 	llmStartTime := time.Now()
-	resp, err := s.generateWithConfigCached(ctx, cfg, messages)
+	var resp *schema.Message
+	tools := s.toolsForProject(p.ProjectContext)
+	served, err := s.withFailover(ctx, cfgs, func(ctx context.Context, cfg *ModelConfig) error {
+		var genErr error
+		if len(tools) > 0 {
+			resp, genErr = s.generateWithTools(ctx, cfg, messages, tools, p.ProjectContext)
+		} else {
+			resp, genErr = s.generateWithConfigCached(ctx, cfg, messages)
+		}
+		return genErr
+	})
 	if err != nil {
 		fmt.Printf("[LLM] Generate: LLM call failed after %v: %v\n", time.Since(llmStartTime), err)
 		return nil, &errs.Error{Code: errs.Internal, Message: fmt.Sprintf("generate failed: %v", err)}
 	}
 	fmt.Printf("[LLM] Generate: LLM call completed in %v\n", time.Since(llmStartTime))
 
-	content := strings.TrimSpace(resp.Content)
-	if p.ProjectContext.Extensions != nil && len(p.ProjectContext.Extensions) > 0 {
-		content = s.applyExtensionHooks(ctx, "post-generate", content, p.ProjectContext)
-	}
-
-	// Process tool calls if extension-creator is enabled
-	if p.ProjectContext.Extensions != nil {
-		for _, extID := range p.ProjectContext.Extensions {
-			if extID == "extension-creator" {
-				var messages []string
-				content, messages, _ = s.processToolCalls(ctx, content, p.ProjectContext)
-				if len(messages) > 0 {
-					fmt.Printf("[LLM] Tool call messages: %v\n", messages)
-				}
-				break
-			}
-		}
-	}
-
-	// Enhanced weather integration - fetch real data from wttr.in API
-	if p.ProjectContext.Extensions != nil {
-		for _, extID := range p.ProjectContext.Extensions {
-			if extID == "weather-indonesia" {
-				content = s.enhanceWeatherResponse(ctx, content, p.Prompt)
-				break
-			}
-		}
-	}
+	content := s.postProcessContent(ctx, strings.TrimSpace(resp.Content), p)
 
 	totalTime := time.Since(startTime)
 	fmt.Printf("[LLM] Generate: total request took %v (validation=%v, endpoint=%v, prompt=%v, llm=%v)\n",
 		totalTime, validationTime, time.Since(endpointStartTime), time.Since(promptStartTime), time.Since(llmStartTime))
 
-	return &GenerateResponse{Content: content}, nil
+	out := &GenerateResponse{
+		Content:       content,
+		EndpointID:    served.EndpointID,
+		EndpointName:  served.EndpointName,
+		Model:         served.Model,
+		QuotaWarnings: quotaWarnings,
+		Sources:       sources,
+	}
+	if role != nil {
+		out.ContextRole, out.ContextRoleVersion = role.ID, role.Version
+	}
+	if resp.ResponseMeta != nil && resp.ResponseMeta.Usage != nil {
+		u := resp.ResponseMeta.Usage
+		out.Usage = &TokenUsage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, TotalTokens: u.TotalTokens}
+	}
+	recordReplyProvenance(ctx, p, served, role)
+	s.generateTitleAsync(titleRequestFor(p, tenantID, firstTurn, content))
+	return out, nil
 }
 
 // Status reports whether the default model is configured.
@@ -1301,11 +1536,20 @@ func (s *Service) Status(ctx context.Context) (*StatusResponse, error) {
 	}, nil
 }
 
-// Health returns a basic health status.
+// Health returns "ok", or "degraded" when an active endpoint failed its last probe.
 //
 //encore:api public method=GET path=/llm/health
 func (s *Service) Health(ctx context.Context) (*HealthResponse, error) {
-	return &HealthResponse{Status: "ok"}, nil
+	summary, err := endpointHealthSummary(ctx)
+	if err != nil {
+		fmt.Printf("[LLM] Health: endpoint summary failed: %v\n", err)
+		return &HealthResponse{Status: "ok"}, nil
+	}
+	status := "ok"
+	if summary.Unhealthy > 0 || summary.Degraded > 0 {
+		status = "degraded"
+	}
+	return &HealthResponse{Status: status, Endpoints: summary}, nil
 }
 
 // Completion handles POST /api/llm/completion - One-shot LLM completion.
@@ -1316,16 +1560,17 @@ func (s *Service) Completion(ctx context.Context, p *CompletionParams) (*Complet
 		return nil, badRequest("prompt is required")
 	}
 
-	resolved, err := ResolveEndpointForTenant(ctx, strings.TrimSpace(p.TenantID))
+	ctx = withUsageScope(ctx, strings.TrimSpace(p.TenantID), "", "", "completion")
+	quotaWarnings, err := checkQuotas(ctx, strings.TrimSpace(p.TenantID), "", "")
 	if err != nil {
-		return &CompletionResult{Success: false, Error: fmt.Sprintf("resolve llm endpoint failed: %v", err)}, nil
+		return nil, err
 	}
-	cfg := toConfig(resolved)
-	if strings.TrimSpace(cfg.APIKey) == "" {
-		if s.defaultErr != nil || s.defaultModel == nil {
+	cfgs, err := s.resolveConfigs(ctx, strings.TrimSpace(p.TenantID))
+	if err != nil {
+		if e, ok := err.(*errs.Error); ok && e.Code == errs.Unavailable {
 			return &CompletionResult{Success: false, Error: "LLM service not available"}, nil
 		}
-		cfg = defaultConfig()
+		return &CompletionResult{Success: false, Error: err.Error()}, nil
 	}
 
 	systemPrompt := "You are a helpful AI assistant."
@@ -1333,15 +1578,20 @@ func (s *Service) Completion(ctx context.Context, p *CompletionParams) (*Complet
 		systemPrompt = p.Context
 	}
 
-	resp, err := generateWithConfig(ctx, cfg, []*schema.Message{
-		{Role: schema.System, Content: systemPrompt},
-		{Role: schema.User, Content: p.Prompt},
+	var resp *schema.Message
+	_, err = s.withFailover(ctx, cfgs, func(ctx context.Context, cfg *ModelConfig) error {
+		var genErr error
+		resp, genErr = generateWithConfig(ctx, cfg, []*schema.Message{
+			{Role: schema.System, Content: systemPrompt},
+			{Role: schema.User, Content: p.Prompt},
+		})
+		return genErr
 	})
 	if err != nil {
 		return &CompletionResult{Success: false, Error: fmt.Sprintf("Generation failed: %v", err)}, nil
 	}
 
-	return &CompletionResult{Success: true, Response: strings.TrimSpace(resp.Content)}, nil
+	return &CompletionResult{Success: true, Response: strings.TrimSpace(resp.Content), QuotaWarnings: quotaWarnings}, nil
 }
 
 type CompletionParams struct {
@@ -1351,9 +1601,10 @@ type CompletionParams struct {
 }
 
 type CompletionResult struct {
-	Success  bool   `json:"success"`
-	Response string `json:"response,omitempty"`
-	Error    string `json:"error,omitempty"`
+	Success       bool     `json:"success"`
+	Response      string   `json:"response,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	QuotaWarnings []string `json:"quota_warnings,omitempty"`
 }
 
 type FileAttachment struct {
@@ -1367,6 +1618,18 @@ type GenerateParams struct {
 	Prompt         string            `json:"prompt"`
 	ProjectContext *ProjectContext   `json:"project_context"`
 	Attachments    []FileAttachment  `json:"attachments,omitempty"`
+	// ConversationID loads previous turns from a stored conversation.
+	ConversationID string `json:"conversation_id,omitempty"`
+	// SubclientID selects a subclient conversation instead of a project one.
+	SubclientID string `json:"subclient_id,omitempty"`
+	// ParentMessageID loads the branch ending at this message instead of the
+	// active one, e.g. the user message whose reply is being regenerated.
+	ParentMessageID string `json:"parent_message_id,omitempty"`
+	// History is an explicit list of previous turns; it takes precedence over
+	// ConversationID and is never summarized, only trimmed to the budget.
+	History []HistoryMessage `json:"history,omitempty"`
+	// Generation overrides sampling parameters on endpoints that allow project overrides.
+	Generation *GenerationOptions `json:"generation,omitempty"`
 }
 
 type ProjectContext struct {
@@ -1382,10 +1645,32 @@ type ProjectContext struct {
 
 type GenerateResponse struct {
 	Content string `json:"content"`
-}
-
-type GenerateStreamResponse struct {
-	Content string `json:"content"`
+	// Endpoint that served the response (empty ID for the default config)
+	EndpointID   string `json:"endpoint_id,omitempty"`
+	EndpointName string `json:"endpoint_name,omitempty"`
+	Model        string `json:"model,omitempty"`
+	// QuotaWarnings lists soft quota limits that have been reached
+	QuotaWarnings []string `json:"quota_warnings,omitempty"`
+	// Refused is set when the question is outside the project's chat role;
+	// Content then holds the refusal and no model was called.
+	Refused     bool     `json:"refused,omitempty"`
+	ContextRole string   `json:"context_role,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+	// ContextRoleVersion is the role version that answered. Pass it, the
+	// endpoint and the model back when saving the reply so feedback on it
+	// can be traced.
+	ContextRoleVersion int `json:"context_role_version,omitempty"`
+	// Usage is the token usage reported by the endpoint, if any
+	Usage *TokenUsage `json:"usage,omitempty"`
+	// Sources are the project file excerpts given to the model; the
+	// content cites them as [Index].
+	Sources []RetrievedSource `json:"sources,omitempty"`
+}
+
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type StatusResponse struct {
@@ -1394,7 +1679,8 @@ type StatusResponse struct {
 }
 
 type HealthResponse struct {
-	Status string `json:"status"`
+	Status    string                 `json:"status"`
+	Endpoints *EndpointHealthSummary `json:"endpoints,omitempty"`
 }
 
 // ToolDefinition represents a tool/function that the LLM can call
@@ -1411,13 +1697,6 @@ type ParameterDef struct {
 	Required    bool   `json:"required"`
 }
 
-// ToolCall represents a tool call from the LLM
-type ToolCall struct {
-	ID       string                 `json:"id"`
-	Name     string                 `json:"name"`
-	Arguments map[string]interface{} `json:"arguments"`
-}
-
 // GetAvailableTools returns the tools available for the LLM to call
 func (s *Service) GetAvailableTools() []ToolDefinition {
 	return []ToolDefinition{
@@ -1455,69 +1734,6 @@ func (s *Service) GetAvailableTools() []ToolDefinition {
 	}
 }
 
-// processToolCalls processes tool calls from LLM response
-func (s *Service) processToolCalls(ctx context.Context, content string, projectCtx *ProjectContext) (string, []string, error) {
-	// Check for CREATE_EXTENSION marker in the response
-	// Expected format: ```json\n{"createExtension": {...}}\n```
-
-	if !strings.Contains(content, "createExtension") && !strings.Contains(content, "CREATE_EXTENSION") {
-		return content, nil, nil
-	}
-
-	fmt.Printf("[LLM] Tool call detected in response, processing...\n")
-
-	// Extract JSON block with createExtension
-	var jsonStart, jsonEnd int
-	if idx := strings.Index(content, "```json"); idx >= 0 {
-		jsonStart = idx + 7 // len("```json")
-		if idx = strings.Index(content[jsonStart:], "```"); idx >= 0 {
-			jsonEnd = jsonStart + idx
-		}
-	} else if idx := strings.Index(content, "```"); idx >= 0 {
-		jsonStart = idx + 3 // len("```")
-		if idx = strings.Index(content[jsonStart:], "```"); idx >= 0 {
-			jsonEnd = jsonStart + idx
-		}
-	}
-
-	if jsonEnd > jsonStart {
-		jsonStr := strings.TrimSpace(content[jsonStart:jsonEnd])
-		fmt.Printf("[LLM] Extracted JSON: %s\n", jsonStr)
-
-		// Parse the tool call
-		var toolCallData map[string]interface{}
-		if err := json.Unmarshal([]byte(jsonStr), &toolCallData); err != nil {
-			fmt.Printf("[LLM] Failed to parse tool call JSON: %v\n", err)
-			return content, nil, nil
-		}
-
-		// Check for createExtension
-		if extData, ok := toolCallData["createExtension"].(map[string]interface{}); ok {
-			result, messages, err := s.executeCreateExtension(ctx, extData, projectCtx)
-			if err != nil {
-				messages = append(messages, fmt.Sprintf("Failed to create extension: %v", err))
-				return content, messages, nil
-			}
-
-			// Replace the tool call with the result
-			// Remove the JSON block and add success message
-			responseBefore := ""
-			if jsonStart >= 7 { // Make sure we don't go negative
-				responseBefore = content[:jsonStart-7] // Remove ```json or ```
-			}
-			responseAfter := ""
-			if jsonEnd+3 <= len(content) {
-				responseAfter = content[jsonEnd+3:] // Remove closing ```
-			}
-
-			newContent := responseBefore + result + responseAfter
-			return newContent, messages, nil
-		}
-	}
-
-	return content, nil, nil
-}
-
 // executeCreateExtension executes the createExtension tool call
 func (s *Service) executeCreateExtension(ctx context.Context, extData map[string]interface{}, projectCtx *ProjectContext) (string, []string, error) {
 	fmt.Printf("[LLM] executeCreateExtension called with data: %+v\n", extData)
@@ -1723,122 +1939,23 @@ func randomHex(n int) string {
 	return string(out)
 }
 
-// buildSystemPrompt constructs a system prompt from project context.
-// Optimized to be concise while maintaining functionality.
-func buildSystemPrompt(ctx *ProjectContext) string {
-	var sb strings.Builder
-
-	// CRITICAL: Instructions from Workspace > Context are MOST important
-	// They define how the AI should respond
-	if ctx.Instructions != "" && len(strings.TrimSpace(ctx.Instructions)) > 10 {
-		// Use instructions as the primary directive
-		sb.WriteString(strings.TrimSpace(ctx.Instructions))
-	} else {
-		// Fallback to generic assistant
-		sb.WriteString("You are a helpful AI assistant.")
-	}
-
-	// IMPORTANT: Add Extension Creator context REGARDLESS of custom instructions
-	// This should always be added when extension-creator is enabled
-	if ctx.Extensions != nil {
-		fmt.Printf("[buildSystemPrompt] Checking extensions: %v\n", ctx.Extensions)
-
-		// First, add extension creator
-		for _, extID := range ctx.Extensions {
-			if extID == "extension-creator" {
-				fmt.Printf("[buildSystemPrompt] Extension Creator FOUND! Adding context to system prompt.\n")
-				sb.WriteString("\n\n## Extension Creator\n\n")
-				sb.WriteString("You can create custom extensions for this project. When users ask for new functionality, ")
-				sb.WriteString("generate the extension code and create it by outputting a JSON block with this format:\n\n")
-				sb.WriteString("```json\n")
-				sb.WriteString("{\n")
-				sb.WriteString("  \"createExtension\": {\n")
-				sb.WriteString("    \"id\": \"extension-id\",\n")
-				sb.WriteString("    \"name\": \"Extension Name\",\n")
-				sb.WriteString("    \"description\": \"What it does\",\n")
-				sb.WriteString("    \"category\": \"tools\",\n")
-				sb.WriteString("    \"code\": \"// complete JavaScript code here\"\n")
-				sb.WriteString("  }\n")
-				sb.WriteString("}\n")
-				sb.WriteString("```\n\n")
-				sb.WriteString("**Important:** The JSON block MUST contain the `createExtension` key. When the system processes this, ")
-				sb.WriteString("the extension will be automatically created and available for use.\n")
-				break
-			}
-		}
-
-		// Second, add available functions from other custom extensions (weather, etc)
-		sb.WriteString("\n\n## Available Functions\n\n")
-		sb.WriteString("You can call these functions from extensions when relevant:\n\n")
-
-		for _, extID := range ctx.Extensions {
-			// Skip extension-creator and built-in extensions
-			if extID == "extension-creator" || extID == "chat-logger" || extID == "response-enhancer" {
-				continue
-			}
-
-			// Try to read extension file directly
-			extFilePath := filepath.Join("../extensions", extID, "index.js")
-			if content, err := os.ReadFile(extFilePath); err == nil {
-				code := string(content)
-
-				// Extract function names using simple parsing
-				// Look for: function name(...), async function name(...)
-				functions := []string{}
-
-				// Simple manual parsing
-				lines := strings.Split(code, "\n")
-				for _, line := range lines {
-					line = strings.TrimSpace(line)
-					if strings.HasPrefix(line, "async function ") {
-						parts := strings.Fields(line)
-						if len(parts) >= 3 {
-							fnName := strings.TrimSuffix(parts[2], "(")
-							functions = append(functions, fnName)
-						}
-					} else if strings.HasPrefix(line, "function ") {
-						parts := strings.Fields(line)
-						if len(parts) >= 2 {
-							fnName := strings.TrimSuffix(parts[1], "(")
-							functions = append(functions, fnName)
-						}
-					}
-				}
-
-				if len(functions) > 0 {
-					// Get extension name from filename or ID
-					extName := strings.Title(strings.ReplaceAll(extID, "-", " "))
-					fmt.Printf("[buildSystemPrompt] Found functions in %s: %v\n", extID, functions)
-
-					sb.WriteString(fmt.Sprintf("### %s Extension\n", extName))
-					for _, fn := range functions {
-						sb.WriteString(fmt.Sprintf("- **%s()**: Call this function to use the extension\n", fn))
-					}
-					sb.WriteString("\n")
-				}
-			}
-		}
-	}
-
-	// Add project context if meaningful
-	if ctx.ProjectName != "" && ctx.ProjectName != "Project" {
-		sb.WriteString(fmt.Sprintf("\n\nProject: %s", ctx.ProjectName))
-	}
-
-	return sb.String()
-}
-
 // buildSystemPromptCached constructs and caches system prompts for better performance.
 // Creates a cache key from the unique combination of context parameters.
-func (s *Service) buildSystemPromptCached(ctx *ProjectContext) string {
+func (s *Service) buildSystemPromptCached(ctx *ProjectContext, role *iam.RoleDefinition) string {
 	// Create cache key from relevant context fields (including extensions)
 	extensionsKey := ""
 	if ctx.Extensions != nil {
 		extensionsKey = strings.Join(ctx.Extensions, ",")
 	}
-	key := fmt.Sprintf("%s|%s|%s|%s|%s|%s",
+	roleKey := ""
+	if role != nil {
+		// Role edits create a new version, so the key changes with them
+		roleKey = fmt.Sprintf("%s/%s@%d", role.TenantID, role.ID, role.Version)
+	}
+	key := fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s",
 		ctx.ProjectID,
 		ctx.ProjectName,
+		roleKey,
 		ctx.Instructions,
 		ctx.Tone,
 		ctx.Language,
@@ -1846,20 +1963,15 @@ func (s *Service) buildSystemPromptCached(ctx *ProjectContext) string {
 	)
 
 	// Try cache first
-	s.systemPromptCacheMutex.RLock()
-	if cached, ok := s.systemPromptCache[key]; ok {
-		s.systemPromptCacheMutex.RUnlock()
+	if cached, ok := s.systemPromptCache.get(key); ok {
 		return cached
 	}
-	s.systemPromptCacheMutex.RUnlock()
 
 	// Build prompt if not cached
-	prompt := buildSystemPrompt(ctx)
+	prompt := buildSystemPrompt(ctx, role)
 
 	// Store in cache
-	s.systemPromptCacheMutex.Lock()
-	s.systemPromptCache[key] = prompt
-	s.systemPromptCacheMutex.Unlock()
+	s.systemPromptCache.set(key, prompt)
 
 	return prompt
 }
@@ -0,0 +1,489 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.app/backend/iam"
+	"encore.dev/beta/errs"
+)
+
+// OpenAI-compatible API, so OpenAI SDKs can be pointed at /v1. Clients
+// authenticate with an API key (see iam.CreateAPIKey) sent as
+// "Authorization: Bearer <key>". The model is the project id; keys of a
+// single project always use that project. Requests go through Generate and
+// generateStream with the project's context, chat role and enabled
+// extensions, so routing, quotas and usage metering are the same as in the
+// app. Nothing is stored: clients send the whole conversation each time.
+
+type chatCompletionRequest struct {
+	Model               string                  `json:"model"`
+	Messages            []chatCompletionMessage `json:"messages"`
+	Stream              bool                    `json:"stream"`
+	StreamOptions       *chatStreamOptions      `json:"stream_options"`
+	Temperature         *float64                `json:"temperature"`
+	TopP                *float64                `json:"top_p"`
+	MaxTokens           int                     `json:"max_tokens"`
+	MaxCompletionTokens int                     `json:"max_completion_tokens"`
+	// Stop is a string or an array of strings
+	Stop json.RawMessage `json:"stop"`
+	N    int             `json:"n"`
+}
+
+type chatStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatCompletionMessage struct {
+	Role string `json:"role"`
+	// Content is a string or an array of text and image_url parts
+	Content json.RawMessage `json:"content"`
+}
+
+type chatContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url"`
+}
+
+type chatCompletion struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []chatCompletionChoice `json:"choices"`
+	Usage   *TokenUsage            `json:"usage,omitempty"`
+}
+
+type chatCompletionChoice struct {
+	Index        int             `json:"index"`
+	Message      *chatMessageOut `json:"message,omitempty"`
+	Delta        *chatMessageOut `json:"delta,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+type chatMessageOut struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type modelList struct {
+	Object string        `json:"object"`
+	Data   []modelObject `json:"data"`
+}
+
+type modelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	// Name is the project name
+	Name string `json:"name"`
+}
+
+// openAIError writes err in the OpenAI error format.
+func openAIError(w http.ResponseWriter, err error) {
+	code := errs.Code(err)
+	message := err.Error()
+	var e *errs.Error
+	if errors.As(err, &e) {
+		message = e.Message
+	}
+	errType := "api_error"
+	switch code {
+	case errs.InvalidArgument:
+		errType = "invalid_request_error"
+	case errs.Unauthenticated:
+		errType = "authentication_error"
+	case errs.PermissionDenied:
+		errType = "permission_error"
+	case errs.NotFound:
+		errType = "not_found_error"
+	case errs.ResourceExhausted:
+		errType = "rate_limit_error"
+	}
+	writeJSON(w, code.HTTPStatus(), map[string]interface{}{
+		"error": map[string]string{"message": message, "type": errType, "code": code.String()},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiKeyFromRequest verifies the bearer API key of a request and that it
+// has the generate scope.
+func apiKeyFromRequest(req *http.Request) (*iam.APIKeyInfo, error) {
+	header := strings.TrimSpace(req.Header.Get("Authorization"))
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "missing api key"}
+	}
+	key, err := iam.VerifyAPIKey(req.Context(), header[7:])
+	if err != nil {
+		return nil, err
+	}
+	if !key.HasScope(iam.ScopeGenerate) {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "api key lacks the generate scope"}
+	}
+	return key, nil
+}
+
+// compatProjectContext builds the project context the chat UI would send
+// for the key's project, or for the project named by model.
+func compatProjectContext(ctx context.Context, key *iam.APIKeyInfo, model string) (*ProjectContext, error) {
+	projectID := key.ProjectID
+	if projectID == "" {
+		projectID = strings.TrimSpace(model)
+	}
+	if projectID == "" {
+		return nil, badRequest("model is required: use a project id from /v1/models")
+	}
+	settings, err := iam.LoadProjectPromptSettings(ctx, key.TenantID, projectID)
+	if err != nil {
+		if errs.Code(err) == errs.NotFound {
+			return nil, &errs.Error{Code: errs.NotFound, Message: fmt.Sprintf("model %q not found", projectID)}
+		}
+		return nil, err
+	}
+	extensions, err := enabledExtensions(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &ProjectContext{
+		ProjectID:    settings.ProjectID,
+		ProjectName:  settings.ProjectName,
+		Instructions: settings.Instructions,
+		ContextRole:  settings.ContextRole,
+		Tone:         "professional",
+		Language:     "english",
+		Extensions:   extensions,
+		Metadata:     map[string]string{"tenant_id": key.TenantID},
+	}, nil
+}
+
+// enabledExtensions lists the extensions enabled on a project.
+func enabledExtensions(ctx context.Context, projectID string) ([]string, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT id FROM project_extensions WHERE project_id = ? AND enabled = 1 ORDER BY id`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// parseChatContent returns the text of a message and its inline images.
+// Images must be data URLs.
+func parseChatContent(raw json.RawMessage) (string, []FileAttachment, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+	var parts []chatContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, badRequest("content must be a string or an array of parts")
+	}
+	var texts []string
+	var images []FileAttachment
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if part.ImageURL == nil || !strings.HasPrefix(part.ImageURL.URL, "data:") {
+				return "", nil, badRequest("image_url must be a base64 data URL")
+			}
+			meta, data, ok := strings.Cut(strings.TrimPrefix(part.ImageURL.URL, "data:"), ",")
+			if !ok || !strings.HasSuffix(meta, ";base64") {
+				return "", nil, badRequest("image_url must be a base64 data URL")
+			}
+			mimeType := strings.TrimSuffix(meta, ";base64")
+			images = append(images, FileAttachment{
+				Name: fmt.Sprintf("image-%d", len(images)+1),
+				Type: mimeType,
+				Size: int64(len(data) * 3 / 4),
+				Data: data,
+			})
+		default:
+			return "", nil, badRequest(fmt.Sprintf("content part type %q is not supported", part.Type))
+		}
+	}
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// parseStop accepts the string or array forms of stop.
+func parseStop(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, badRequest("stop must be a string or an array of strings")
+	}
+	return many, nil
+}
+
+// toGenerateParams maps an OpenAI request onto a generate request: system
+// messages are added to the project instructions, the last message is the
+// prompt and the ones before it are the history.
+func toGenerateParams(r *chatCompletionRequest, pc *ProjectContext) (*GenerateParams, error) {
+	if r.N > 1 {
+		return nil, badRequest("n greater than 1 is not supported")
+	}
+	p := &GenerateParams{ProjectContext: pc}
+	var system []string
+	for i, m := range r.Messages {
+		text, images, err := parseChatContent(m.Content)
+		if err != nil {
+			return nil, err
+		}
+		switch m.Role {
+		case "system", "developer":
+			system = append(system, text)
+		case "user", "assistant":
+			if i == len(r.Messages)-1 {
+				if m.Role != "user" {
+					return nil, badRequest("the last message must be from the user")
+				}
+				p.Prompt, p.Attachments = text, images
+				continue
+			}
+			p.History = append(p.History, HistoryMessage{Role: m.Role, Content: text})
+		default:
+			return nil, badRequest(fmt.Sprintf("message role %q is not supported", m.Role))
+		}
+	}
+	if strings.TrimSpace(p.Prompt) == "" {
+		return nil, badRequest("messages must end with a user message")
+	}
+	if len(system) > 0 {
+		pc.Instructions = strings.TrimSpace(pc.Instructions + "\n\n" + strings.Join(system, "\n\n"))
+	}
+
+	stop, err := parseStop(r.Stop)
+	if err != nil {
+		return nil, err
+	}
+	maxTokens := r.MaxCompletionTokens
+	if maxTokens == 0 {
+		maxTokens = r.MaxTokens
+	}
+	if r.Temperature != nil || r.TopP != nil || maxTokens != 0 || len(stop) > 0 {
+		p.Generation = &GenerationOptions{
+			Temperature:     r.Temperature,
+			TopP:            r.TopP,
+			MaxOutputTokens: maxTokens,
+			StopSequences:   stop,
+		}
+	}
+	return p, nil
+}
+
+// ChatCompletions is the OpenAI-compatible chat completions API.
+//
+//encore:api public raw method=POST path=/v1/chat/completions
+func (s *Service) ChatCompletions(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	key, err := apiKeyFromRequest(req)
+	if err != nil {
+		openAIError(w, err)
+		return
+	}
+
+	var r chatCompletionRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		openAIError(w, badRequest("invalid request body"))
+		return
+	}
+	pc, err := compatProjectContext(ctx, key, r.Model)
+	if err != nil {
+		openAIError(w, err)
+		return
+	}
+	p, err := toGenerateParams(&r, pc)
+	if err != nil {
+		openAIError(w, err)
+		return
+	}
+	fmt.Printf("[LLM] ChatCompletions: key=%s project=%s messages=%d stream=%v\n", key.ID, pc.ProjectID, len(r.Messages), r.Stream)
+
+	id := "chatcmpl-" + randomHex(12)
+	created := time.Now().Unix()
+	if r.Stream {
+		includeUsage := r.StreamOptions != nil && r.StreamOptions.IncludeUsage
+		s.generateStream(ctx, w, p, func(w http.ResponseWriter) streamSink {
+			return &chunkStream{sw: newSSEWriter(w), id: id, created: created, model: pc.ProjectID, includeUsage: includeUsage}
+		}, openAIError)
+		return
+	}
+
+	resp, err := s.Generate(ctx, p)
+	if err != nil {
+		openAIError(w, err)
+		return
+	}
+	stop := "stop"
+	writeJSON(w, http.StatusOK, &chatCompletion{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   pc.ProjectID,
+		Choices: []chatCompletionChoice{{
+			Message:      &chatMessageOut{Role: "assistant", Content: resp.Content},
+			FinishReason: &stop,
+		}},
+		Usage: firstUsage(resp.Usage),
+	})
+}
+
+// firstUsage returns usage, or zero usage since OpenAI clients expect the field.
+func firstUsage(usage *TokenUsage) *TokenUsage {
+	if usage == nil {
+		return &TokenUsage{}
+	}
+	return usage
+}
+
+// chunkStream translates stream events to chat.completion.chunk objects.
+// Post-generate hooks can only append to the streamed text: a replacement
+// that does not start with it is dropped.
+type chunkStream struct {
+	sw           *sseWriter
+	id           string
+	created      int64
+	model        string
+	includeUsage bool
+
+	started  bool
+	streamed strings.Builder
+	usage    *TokenUsage
+}
+
+func (c *chunkStream) send(event string, payload interface{}) error {
+	switch event {
+	case streamEventDelta:
+		return c.delta(payload.(StreamDeltaEvent).Content)
+	case streamEventReplace:
+		final, streamed := payload.(StreamReplaceEvent).Content, c.streamed.String()
+		if strings.HasPrefix(final, streamed) && len(final) > len(streamed) {
+			return c.delta(final[len(streamed):])
+		}
+	case streamEventUsage:
+		u := payload.(StreamUsageEvent)
+		c.usage = &TokenUsage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, TotalTokens: u.TotalTokens}
+	case streamEventError:
+		data, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]string{"message": payload.(StreamErrorEvent).Message, "type": "api_error"},
+		})
+		c.sw.sendData(data)
+		return c.sw.sendData([]byte("[DONE]"))
+	case streamEventDone:
+		stop := "stop"
+		if err := c.chunk([]chatCompletionChoice{{Delta: &chatMessageOut{}, FinishReason: &stop}}, nil); err != nil {
+			return err
+		}
+		if c.includeUsage {
+			if err := c.chunk([]chatCompletionChoice{}, firstUsage(c.usage)); err != nil {
+				return err
+			}
+		}
+		return c.sw.sendData([]byte("[DONE]"))
+	}
+	return nil
+}
+
+func (c *chunkStream) delta(content string) error {
+	d := &chatMessageOut{Content: content}
+	if !c.started {
+		d.Role, c.started = "assistant", true
+	}
+	c.streamed.WriteString(content)
+	return c.chunk([]chatCompletionChoice{{Delta: d}}, nil)
+}
+
+// chunk writes one chunk. The last chunk of a stream with include_usage has
+// no choices and the usage.
+func (c *chunkStream) chunk(choices []chatCompletionChoice, usage *TokenUsage) error {
+	data, err := json.Marshal(&chatCompletion{
+		ID:      c.id,
+		Object:  "chat.completion.chunk",
+		Created: c.created,
+		Model:   c.model,
+		Choices: choices,
+		Usage:   usage,
+	})
+	if err != nil {
+		return err
+	}
+	return c.sw.sendData(data)
+}
+
+// ListModels lists the projects an API key can use as models.
+//
+//encore:api public raw method=GET path=/v1/models
+func (s *Service) ListModels(w http.ResponseWriter, req *http.Request) {
+	key, err := apiKeyFromRequest(req)
+	if err != nil {
+		openAIError(w, err)
+		return
+	}
+	db, err := getDB()
+	if err != nil {
+		openAIError(w, err)
+		return
+	}
+	query := `SELECT id, name, COALESCE(CAST(strftime('%s', created_at) AS INTEGER), 0) FROM projects WHERE tenant_id = ?`
+	args := []interface{}{key.TenantID}
+	if key.ProjectID != "" {
+		query += ` AND id = ?`
+		args = append(args, key.ProjectID)
+	}
+	rows, err := db.QueryContext(req.Context(), query+` ORDER BY name`, args...)
+	if err != nil {
+		openAIError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	list := modelList{Object: "list", Data: []modelObject{}}
+	for rows.Next() {
+		m := modelObject{Object: "model", OwnedBy: key.TenantID}
+		if err := rows.Scan(&m.ID, &m.Name, &m.Created); err != nil {
+			openAIError(w, err)
+			return
+		}
+		list.Data = append(list.Data, m)
+	}
+	if err := rows.Err(); err != nil {
+		openAIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,183 @@
+package llm
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseChatContent(t *testing.T) {
+	text, images, err := parseChatContent(json.RawMessage(`"Hello"`))
+	if err != nil || text != "Hello" || images != nil {
+		t.Errorf("string content = %q, %v, %v", text, images, err)
+	}
+	text, images, err = parseChatContent(json.RawMessage(`[
+		{"type": "text", "text": "What is in"},
+		{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}},
+		{"type": "text", "text": "this picture?"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "What is in\nthis picture?" || len(images) != 1 {
+		t.Fatalf("parts content = %q, %d images", text, len(images))
+	}
+	if img := images[0]; img.Name != "image-1" || img.Type != "image/png" || img.Data != "iVBORw0KGgo=" || img.Size != 9 {
+		t.Errorf("image = %+v", img)
+	}
+	if text, _, err := parseChatContent(nil); err != nil || text != "" {
+		t.Errorf("missing content = %q, %v", text, err)
+	}
+
+	for _, raw := range []string{
+		`42`,
+		`[{"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]`,
+		`[{"type": "image_url", "image_url": {"url": "data:image/png,raw"}}]`,
+		`[{"type": "image_url"}]`,
+		`[{"type": "input_audio"}]`,
+	} {
+		if _, _, err := parseChatContent(json.RawMessage(raw)); err == nil {
+			t.Errorf("parseChatContent(%s) accepted", raw)
+		}
+	}
+}
+
+func TestParseStop(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{``, "", false},
+		{`null`, "", false},
+		{`"###"`, "###", false},
+		{`["a", "b"]`, "a,b", false},
+		{`3`, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseStop(json.RawMessage(tt.raw))
+		if (err != nil) != tt.wantErr || strings.Join(got, ",") != tt.want {
+			t.Errorf("parseStop(%s) = %q, %v", tt.raw, got, err)
+		}
+	}
+}
+
+func TestToGenerateParams(t *testing.T) {
+	temperature := 0.2
+	req := &chatCompletionRequest{
+		Messages: []chatCompletionMessage{
+			{Role: "system", Content: json.RawMessage(`"Answer in French."`)},
+			{Role: "user", Content: json.RawMessage(`"Hi"`)},
+			{Role: "assistant", Content: json.RawMessage(`"Bonjour"`)},
+			{Role: "developer", Content: json.RawMessage(`"Be brief."`)},
+			{Role: "user", Content: json.RawMessage(`"How are you?"`)},
+		},
+		Temperature: &temperature,
+		MaxTokens:   100,
+		Stop:        json.RawMessage(`"###"`),
+	}
+	pc := &ProjectContext{ProjectID: "p1", Instructions: "Project instructions."}
+	p, err := toGenerateParams(req, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Prompt != "How are you?" || len(p.History) != 2 || p.History[1].Content != "Bonjour" {
+		t.Errorf("prompt = %q, history = %+v", p.Prompt, p.History)
+	}
+	if want := "Project instructions.\n\nAnswer in French.\n\nBe brief."; pc.Instructions != want {
+		t.Errorf("instructions = %q, want %q", pc.Instructions, want)
+	}
+	g := p.Generation
+	if g == nil || *g.Temperature != 0.2 || g.MaxOutputTokens != 100 || len(g.StopSequences) != 1 {
+		t.Errorf("generation = %+v", g)
+	}
+
+	// max_completion_tokens wins over the deprecated max_tokens
+	req.MaxCompletionTokens = 50
+	if p, err := toGenerateParams(req, &ProjectContext{}); err != nil || p.Generation.MaxOutputTokens != 50 {
+		t.Errorf("max_completion_tokens ignored: %+v, %v", p, err)
+	}
+	plain := &chatCompletionRequest{Messages: []chatCompletionMessage{{Role: "user", Content: json.RawMessage(`"Hi"`)}}}
+	if p, err := toGenerateParams(plain, &ProjectContext{}); err != nil || p.Generation != nil {
+		t.Errorf("request without options has generation options: %+v, %v", p, err)
+	}
+
+	bad := []*chatCompletionRequest{
+		{N: 2, Messages: plain.Messages},
+		{Messages: nil},
+		{Messages: []chatCompletionMessage{{Role: "assistant", Content: json.RawMessage(`"Hi"`)}}},
+		{Messages: []chatCompletionMessage{{Role: "tool", Content: json.RawMessage(`"{}"`)}, {Role: "user", Content: json.RawMessage(`"Hi"`)}}},
+		{Messages: []chatCompletionMessage{{Role: "user", Content: json.RawMessage(`"  "`)}}},
+	}
+	for i, r := range bad {
+		if _, err := toGenerateParams(r, &ProjectContext{}); err == nil {
+			t.Errorf("bad request %d accepted", i)
+		}
+	}
+}
+
+// chunkData returns the data payloads of a data-only SSE body.
+func chunkData(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return data
+}
+
+func TestChunkStream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := &chunkStream{sw: newSSEWriter(rec), id: "chatcmpl-1", created: 1700000000, model: "p1", includeUsage: true}
+
+	c.send(streamEventDelta, StreamDeltaEvent{Content: "Hel"})
+	c.send(streamEventDelta, StreamDeltaEvent{Content: "lo"})
+	// A hook that appends is streamed as one more delta, a rewrite is dropped
+	c.send(streamEventReplace, StreamReplaceEvent{Content: "Hello!"})
+	c.send(streamEventReplace, StreamReplaceEvent{Content: "Goodbye"})
+	c.send(streamEventUsage, StreamUsageEvent{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7})
+	c.send(streamEventDone, struct{}{})
+
+	data := chunkData(rec.Body.String())
+	if len(data) != 6 || data[5] != "[DONE]" {
+		t.Fatalf("chunks = %q", data)
+	}
+	var chunks []chatCompletion
+	for _, d := range data[:5] {
+		var chunk chatCompletion
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatalf("chunk %q: %v", d, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || chunk.ID != "chatcmpl-1" || chunk.Model != "p1" {
+			t.Errorf("chunk = %+v", chunk)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	var text strings.Builder
+	for _, chunk := range chunks[:3] {
+		text.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if text.String() != "Hello!" || chunks[0].Choices[0].Delta.Role != "assistant" || chunks[1].Choices[0].Delta.Role != "" {
+		t.Errorf("streamed %q with roles %q, %q", text.String(), chunks[0].Choices[0].Delta.Role, chunks[1].Choices[0].Delta.Role)
+	}
+	if fr := chunks[3].Choices[0].FinishReason; fr == nil || *fr != "stop" {
+		t.Errorf("finish chunk = %+v", chunks[3])
+	}
+	if len(chunks[4].Choices) != 0 || chunks[4].Usage == nil || chunks[4].Usage.TotalTokens != 7 {
+		t.Errorf("usage chunk = %+v", chunks[4])
+	}
+}
+
+func TestChunkStreamError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := &chunkStream{sw: newSSEWriter(rec), id: "chatcmpl-2", model: "p1"}
+	c.send(streamEventError, StreamErrorEvent{Message: "quota exceeded"})
+
+	data := chunkData(rec.Body.String())
+	if len(data) != 2 || data[1] != "[DONE]" || !strings.Contains(data[0], `"message":"quota exceeded"`) {
+		t.Errorf("chunks = %q", data)
+	}
+}
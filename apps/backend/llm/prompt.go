@@ -0,0 +1,331 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"encore.app/backend/iam"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+// The system prompt is composed from layers, in this order:
+//
+//  1. role       - the project's chat role (iam roles.json) persona and scope
+//  2. instructions - Workspace > Context instructions for the project
+//  3. tone       - how to sound
+//  4. language   - which language to answer in
+//  5. extensions - extension creator and extension functions
+//  6. project    - the project name
+//
+// Later layers refine earlier ones, and the prompt says so explicitly so the
+// model lets project instructions override role defaults. The "general" role
+// is only used as a fallback persona when the project has no instructions of
+// its own; a specific role (pharmacist, ...) always comes first so its scope
+// limits stay in force.
+
+const (
+	promptLayerRole         = "role"
+	promptLayerInstructions = "instructions"
+	promptLayerTone         = "tone"
+	promptLayerLanguage     = "language"
+	promptLayerExtensions   = "extensions"
+	promptLayerProject      = "project"
+
+	defaultContextRole = "general"
+	fallbackPersona    = "You are a helpful AI assistant."
+)
+
+// PromptLayer is one section of a composed system prompt.
+type PromptLayer struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`
+	Content string `json:"content"`
+}
+
+// composeSystemPrompt builds the system prompt and returns the layers it used.
+// role is the resolved chat role; nil means general.
+func composeSystemPrompt(pc *ProjectContext, role *iam.RoleDefinition) (string, []PromptLayer) {
+	var layers []PromptLayer
+	add := func(name, source, content string) {
+		content = strings.TrimSpace(content)
+		if content != "" {
+			layers = append(layers, PromptLayer{Name: name, Source: source, Content: content})
+		}
+	}
+
+	roleID, rolePrompt, roleSource := defaultContextRole, "", "role:"+defaultContextRole
+	if role != nil {
+		roleID, rolePrompt = role.ID, role.SystemPrompt
+		roleSource = fmt.Sprintf("role:%s@v%d", role.ID, role.Version)
+	}
+	instructions := strings.TrimSpace(pc.Instructions)
+	hasInstructions := len(instructions) > 10
+
+	if roleID != defaultContextRole || !hasInstructions {
+		if strings.TrimSpace(rolePrompt) == "" && !hasInstructions {
+			rolePrompt = fallbackPersona
+		}
+		add(promptLayerRole, roleSource, rolePrompt)
+	}
+
+	if hasInstructions {
+		content := instructions
+		if len(layers) > 0 {
+			content = "## Project Instructions\n\nFollow these instructions from the project owner. " +
+				"They take precedence over the general guidance above, but do not widen the role's scope.\n\n" + instructions
+		}
+		add(promptLayerInstructions, "project:context.md", content)
+	}
+
+	add(promptLayerTone, "project:tone", toneDirective(pc.Tone))
+	add(promptLayerLanguage, "project:language", languageDirective(pc.Language))
+	add(promptLayerExtensions, "project:extensions", extensionsPrompt(pc.Extensions))
+
+	if pc.ProjectName != "" && pc.ProjectName != "Project" {
+		add(promptLayerProject, "project:name", fmt.Sprintf("Project: %s", pc.ProjectName))
+	}
+
+	parts := make([]string, 0, len(layers))
+	for _, l := range layers {
+		parts = append(parts, l.Content)
+	}
+	return strings.Join(parts, "\n\n"), layers
+}
+
+// buildSystemPrompt constructs a system prompt from project context.
+func buildSystemPrompt(ctx *ProjectContext, role *iam.RoleDefinition) string {
+	prompt, _ := composeSystemPrompt(ctx, role)
+	return prompt
+}
+
+var toneDirectives = map[string]string{
+	"professional": "Keep a professional, courteous tone.",
+	"friendly":     "Keep a warm, friendly tone.",
+	"casual":       "Keep a relaxed, conversational tone.",
+	"formal":       "Use a formal tone and avoid slang.",
+	"concise":      "Be concise: answer directly and skip filler.",
+	"empathetic":   "Be empathetic and acknowledge the user's situation before answering.",
+	"enthusiastic": "Keep an upbeat, enthusiastic tone.",
+}
+
+// toneDirective turns the project tone into an instruction.
+func toneDirective(tone string) string {
+	tone = strings.TrimSpace(tone)
+	if tone == "" {
+		return ""
+	}
+	if d, ok := toneDirectives[strings.ToLower(tone)]; ok {
+		return "## Tone\n\n" + d
+	}
+	return fmt.Sprintf("## Tone\n\nUse a %s tone.", tone)
+}
+
+var languageNames = map[string]string{
+	"en":         "English",
+	"english":    "English",
+	"id":         "Indonesian (Bahasa Indonesia)",
+	"indonesian": "Indonesian (Bahasa Indonesia)",
+	"indonesia":  "Indonesian (Bahasa Indonesia)",
+	"bahasa":     "Indonesian (Bahasa Indonesia)",
+	"ms":         "Malay",
+	"malay":      "Malay",
+	"jv":         "Javanese",
+	"javanese":   "Javanese",
+	"zh":         "Chinese",
+	"chinese":    "Chinese",
+	"ja":         "Japanese",
+	"japanese":   "Japanese",
+	"ar":         "Arabic",
+	"arabic":     "Arabic",
+}
+
+// languageDirective turns the project language into an instruction. "auto"
+// follows the user's language.
+func languageDirective(language string) string {
+	language = strings.TrimSpace(language)
+	switch strings.ToLower(language) {
+	case "":
+		return ""
+	case "auto":
+		return "## Language\n\nReply in the same language the user writes in."
+	}
+	name, ok := languageNames[strings.ToLower(language)]
+	if !ok {
+		name = language
+	}
+	return fmt.Sprintf("## Language\n\nReply in %s unless the user explicitly asks for another language.", name)
+}
+
+// extensionsPrompt describes the extension creator tool and the functions of
+// the project's other extensions.
+func extensionsPrompt(extensions []string) string {
+	if extensions == nil {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Printf("[buildSystemPrompt] Checking extensions: %v\n", extensions)
+
+	// First, add extension creator
+	for _, extID := range extensions {
+		if extID == "extension-creator" {
+			fmt.Printf("[buildSystemPrompt] Extension Creator FOUND! Adding context to system prompt.\n")
+			sb.WriteString("## Extension Creator\n\n")
+			sb.WriteString("You can create custom extensions for this project. When users ask for new functionality, ")
+			sb.WriteString("generate the complete JavaScript code and call the `createExtension` tool with the extension ")
+			sb.WriteString("id, name, description, category and code. Do not paste the tool arguments into your reply; ")
+			sb.WriteString("once the tool returns, tell the user what was created and how to use it.\n\n")
+			break
+		}
+	}
+
+	// Second, add available functions from other custom extensions (weather, etc)
+	sb.WriteString("## Available Functions\n\n")
+	sb.WriteString("You can call these functions from extensions when relevant:\n\n")
+
+	for _, extID := range extensions {
+		// Skip extension-creator and built-in extensions
+		if extID == "extension-creator" || extID == "chat-logger" || extID == "response-enhancer" {
+			continue
+		}
+
+		// Try to read extension file directly
+		extFilePath := filepath.Join("../extensions", extID, "index.js")
+		content, err := os.ReadFile(extFilePath)
+		if err != nil {
+			continue
+		}
+		functions := extensionFunctionNames(string(content))
+		if len(functions) == 0 {
+			continue
+		}
+
+		// Get extension name from filename or ID
+		extName := strings.Title(strings.ReplaceAll(extID, "-", " "))
+		fmt.Printf("[buildSystemPrompt] Found functions in %s: %v\n", extID, functions)
+
+		sb.WriteString(fmt.Sprintf("### %s Extension\n", extName))
+		for _, fn := range functions {
+			sb.WriteString(fmt.Sprintf("- **%s()**: Call this function to use the extension\n", fn))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// extensionFunctionNames finds top-level function declarations
+// (function name(...), async function name(...)) with simple line parsing.
+func extensionFunctionNames(code string) []string {
+	functions := []string{}
+	for _, line := range strings.Split(code, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "async function ") {
+			parts := strings.Fields(line)
+			if len(parts) >= 3 {
+				functions = append(functions, strings.TrimSuffix(parts[2], "("))
+			}
+		} else if strings.HasPrefix(line, "function ") {
+			parts := strings.Fields(line)
+			if len(parts) >= 2 {
+				functions = append(functions, strings.TrimSuffix(parts[1], "("))
+			}
+		}
+	}
+	return functions
+}
+
+// resolveContextRole fills in the project's chat role from the database and
+// returns its definition at the project's pinned version. The stored role
+// wins over whatever the client sent, so a caller cannot switch a restricted
+// project to a broader role.
+func resolveContextRole(ctx context.Context, pc *ProjectContext, tenantID string) *iam.RoleDefinition {
+	if pc == nil {
+		return iam.GetRoleDefinition(ctx, tenantID, defaultContextRole, 0)
+	}
+	version := 0
+	if strings.TrimSpace(pc.ProjectID) != "" && strings.TrimSpace(tenantID) != "" {
+		if role, v, err := iam.GetProjectContextRole(ctx, tenantID, strings.TrimSpace(pc.ProjectID)); err == nil {
+			pc.ContextRole, version = role, v
+		}
+	}
+	return iam.GetRoleDefinition(ctx, tenantID, firstNonEmpty(strings.TrimSpace(pc.ContextRole), defaultContextRole), version)
+}
+
+type PreviewSystemPromptParams struct {
+	// Optional overrides; the project's stored values are used when empty
+	ContextRole string `query:"context_role"`
+	// ContextRoleVersion previews a role version; 0 uses the project's pin
+	ContextRoleVersion int    `query:"context_role_version"`
+	Tone               string `query:"tone"`
+	Language           string `query:"language"`
+	// Extensions is a comma separated list of enabled extension IDs
+	Extensions string `query:"extensions"`
+}
+
+type PreviewSystemPromptResponse struct {
+	ProjectID          string        `json:"project_id"`
+	ContextRole        string        `json:"context_role"`
+	ContextRoleVersion int           `json:"context_role_version"`
+	Prompt             string        `json:"prompt"`
+	Layers             []PromptLayer `json:"layers"`
+	// EstimatedTokens is a rough size estimate of the prompt
+	EstimatedTokens int `json:"estimated_tokens"`
+}
+
+// PreviewSystemPrompt shows the final system prompt for a project.
+//
+//encore:api auth method=GET path=/llm/projects/:projectID/system-prompt
+func (s *Service) PreviewSystemPrompt(ctx context.Context, projectID string, p *PreviewSystemPromptParams) (*PreviewSystemPromptResponse, error) {
+	data, ok := auth.Data().(*iam.AuthData)
+	if !ok || data == nil || data.TenantID == "" {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "tenant session required"}
+	}
+	if data.ProjectID != "" && data.ProjectID != projectID {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "project not accessible"}
+	}
+	if p == nil {
+		p = &PreviewSystemPromptParams{}
+	}
+
+	settings, err := iam.LoadProjectPromptSettings(ctx, data.TenantID, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &ProjectContext{
+		ProjectID:    settings.ProjectID,
+		ProjectName:  settings.ProjectName,
+		Instructions: settings.Instructions,
+		ContextRole:  firstNonEmpty(p.ContextRole, settings.ContextRole),
+		// Same defaults the chat UI sends
+		Tone:     firstNonEmpty(p.Tone, "professional"),
+		Language: firstNonEmpty(p.Language, "english"),
+	}
+	for _, ext := range strings.Split(p.Extensions, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			pc.Extensions = append(pc.Extensions, ext)
+		}
+	}
+
+	version := settings.ContextRoleVersion
+	if p.ContextRoleVersion > 0 || (p.ContextRole != "" && p.ContextRole != settings.ContextRole) {
+		version = p.ContextRoleVersion
+	}
+	role := iam.GetRoleDefinition(ctx, data.TenantID, pc.ContextRole, version)
+
+	prompt, layers := composeSystemPrompt(pc, role)
+	resp := &PreviewSystemPromptResponse{
+		ProjectID:       projectID,
+		ContextRole:     pc.ContextRole,
+		Prompt:          prompt,
+		Layers:          layers,
+		EstimatedTokens: estimateTokens(prompt),
+	}
+	if role != nil {
+		resp.ContextRole, resp.ContextRoleVersion = role.ID, role.Version
+	}
+	return resp, nil
+}
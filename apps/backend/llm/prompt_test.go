@@ -0,0 +1,148 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+
+	"encore.app/backend/iam"
+)
+
+func TestComposeSystemPrompt(t *testing.T) {
+	general := &iam.RoleDefinition{ID: "general", SystemPrompt: "You are a general assistant.", Version: 1}
+	pharmacist := &iam.RoleDefinition{ID: "pharmacist", SystemPrompt: "You are a pharmacist. Only discuss medicines.", Version: 3}
+	silent := &iam.RoleDefinition{ID: "support", Version: 2}
+	instructions := "Answer questions about our pharmacy opening hours."
+
+	tests := []struct {
+		name        string
+		pc          ProjectContext
+		role        *iam.RoleDefinition
+		wantLayers  []string
+		wantSources []string
+		contains    []string
+		excludes    []string
+	}{
+		{
+			name:        "no role and no instructions falls back to the default persona",
+			pc:          ProjectContext{},
+			wantLayers:  []string{promptLayerRole},
+			wantSources: []string{"role:general"},
+			contains:    []string{fallbackPersona},
+		},
+		{
+			name:        "general role yields to project instructions",
+			pc:          ProjectContext{Instructions: instructions},
+			role:        general,
+			wantLayers:  []string{promptLayerInstructions},
+			wantSources: []string{"project:context.md"},
+			excludes:    []string{general.SystemPrompt, "## Project Instructions"},
+		},
+		{
+			name:        "general role without instructions",
+			pc:          ProjectContext{Instructions: "short"},
+			role:        general,
+			wantLayers:  []string{promptLayerRole},
+			wantSources: []string{"role:general@v1"},
+			contains:    []string{general.SystemPrompt},
+			excludes:    []string{"short"},
+		},
+		{
+			name:        "specific role comes before instructions",
+			pc:          ProjectContext{Instructions: instructions},
+			role:        pharmacist,
+			wantLayers:  []string{promptLayerRole, promptLayerInstructions},
+			wantSources: []string{"role:pharmacist@v3", "project:context.md"},
+			contains:    []string{pharmacist.SystemPrompt + "\n\n## Project Instructions", "do not widen the role's scope", instructions},
+		},
+		{
+			name:        "role without a prompt gets the default persona",
+			pc:          ProjectContext{},
+			role:        silent,
+			wantLayers:  []string{promptLayerRole},
+			wantSources: []string{"role:support@v2"},
+			contains:    []string{fallbackPersona},
+		},
+		{
+			name:        "role without a prompt leaves instructions first",
+			pc:          ProjectContext{Instructions: instructions},
+			role:        silent,
+			wantLayers:  []string{promptLayerInstructions},
+			wantSources: []string{"project:context.md"},
+			excludes:    []string{fallbackPersona, "## Project Instructions"},
+		},
+		{
+			name: "all layers in order",
+			pc: ProjectContext{
+				ProjectName:  "Apotek Sehat",
+				Instructions: instructions,
+				Tone:         "Friendly",
+				Language:     "id",
+				Extensions:   []string{"extension-creator"},
+			},
+			role:        pharmacist,
+			wantLayers:  []string{promptLayerRole, promptLayerInstructions, promptLayerTone, promptLayerLanguage, promptLayerExtensions, promptLayerProject},
+			wantSources: []string{"role:pharmacist@v3", "project:context.md", "project:tone", "project:language", "project:extensions", "project:name"},
+			contains:    []string{toneDirectives["friendly"], "Reply in Indonesian (Bahasa Indonesia)", "## Extension Creator", "Project: Apotek Sehat"},
+		},
+		{
+			name:        "placeholder project name is skipped",
+			pc:          ProjectContext{ProjectName: "Project", Language: "auto", Tone: "pirate"},
+			role:        pharmacist,
+			wantLayers:  []string{promptLayerRole, promptLayerTone, promptLayerLanguage},
+			wantSources: []string{"role:pharmacist@v3", "project:tone", "project:language"},
+			contains:    []string{"Use a pirate tone.", "Reply in the same language the user writes in."},
+			excludes:    []string{"Project: Project"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc := tt.pc
+			prompt, layers := composeSystemPrompt(&pc, tt.role)
+
+			var names, sources, contents []string
+			for _, l := range layers {
+				names = append(names, l.Name)
+				sources = append(sources, l.Source)
+				contents = append(contents, l.Content)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantLayers, ",") {
+				t.Errorf("layers = %v, want %v", names, tt.wantLayers)
+			}
+			if strings.Join(sources, ",") != strings.Join(tt.wantSources, ",") {
+				t.Errorf("sources = %v, want %v", sources, tt.wantSources)
+			}
+			if prompt != strings.Join(contents, "\n\n") {
+				t.Errorf("prompt is not the layers joined in order:\n%s", prompt)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(prompt, s) {
+					t.Errorf("prompt missing %q:\n%s", s, prompt)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(prompt, s) {
+					t.Errorf("prompt contains %q:\n%s", s, prompt)
+				}
+			}
+		})
+	}
+}
+
+func TestLanguageDirective(t *testing.T) {
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{"", ""},
+		{"  ", ""},
+		{"AUTO", "## Language\n\nReply in the same language the user writes in."},
+		{"english", "## Language\n\nReply in English unless the user explicitly asks for another language."},
+		{"Bahasa", "## Language\n\nReply in Indonesian (Bahasa Indonesia) unless the user explicitly asks for another language."},
+		{"Sundanese", "## Language\n\nReply in Sundanese unless the user explicitly asks for another language."},
+	}
+	for _, tt := range tests {
+		if got := languageDirective(tt.language); got != tt.want {
+			t.Errorf("languageDirective(%q) = %q, want %q", tt.language, got, tt.want)
+		}
+	}
+}
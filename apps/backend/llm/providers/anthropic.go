@@ -0,0 +1,318 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+const (
+	anthropicDefaultBaseURL = "https://api.anthropic.com"
+	anthropicVersion        = "2023-06-01"
+)
+
+// AnthropicChatModel talks to the Anthropic Messages API.
+type AnthropicChatModel struct {
+	cfg   Config
+	tools []*schema.ToolInfo
+}
+
+// NewAnthropic creates an Anthropic Messages adapter.
+func NewAnthropic(cfg Config) (*AnthropicChatModel, error) {
+	if strings.TrimSpace(cfg.APIKey) == "" {
+		return nil, fmt.Errorf("anthropic: api key is required")
+	}
+	if strings.TrimSpace(cfg.Model) == "" {
+		return nil, fmt.Errorf("anthropic: model is required")
+	}
+	if cfg.MaxTokens <= 0 {
+		cfg.MaxTokens = 4096
+	}
+	return &AnthropicChatModel{cfg: cfg}, nil
+}
+
+// WithTools returns a copy of the model with the tools bound.
+func (m *AnthropicChatModel) WithTools(tools []*schema.ToolInfo) (model.ToolCallingChatModel, error) {
+	return &AnthropicChatModel{cfg: m.cfg, tools: tools}, nil
+}
+
+func (m *AnthropicChatModel) GetType() string { return "Anthropic" }
+
+type anthropicContent struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Source    *anthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     json.RawMessage       `json:"input,omitempty"` // object for tool_use blocks, see toolInput
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   string                `json:"content,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"` // base64 or url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string             `json:"role"`
+	Content []anthropicContent `json:"content"`
+}
+
+type anthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model         string                 `json:"model"`
+	MaxTokens     int                    `json:"max_tokens"`
+	System        string                 `json:"system,omitempty"`
+	Messages      []anthropicMessage     `json:"messages"`
+	Tools         []anthropicTool        `json:"tools,omitempty"`
+	ToolChoice    map[string]interface{} `json:"tool_choice,omitempty"`
+	Temperature   *float32               `json:"temperature,omitempty"`
+	TopP          *float32               `json:"top_p,omitempty"`
+	StopSequences []string               `json:"stop_sequences,omitempty"`
+	Stream        bool                   `json:"stream,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Content    []anthropicContent `json:"content"`
+	StopReason string             `json:"stop_reason"`
+	Usage      anthropicUsage     `json:"usage"`
+}
+
+func (m *AnthropicChatModel) buildRequest(in []*schema.Message, stream bool, opts ...model.Option) (*anthropicRequest, error) {
+	o := m.cfg.callOptions(m.tools, opts...)
+	req := &anthropicRequest{
+		Model:         *o.Model,
+		MaxTokens:     *o.MaxTokens,
+		Temperature:   o.Temperature,
+		TopP:          o.TopP,
+		StopSequences: o.Stop,
+		Stream:        stream,
+	}
+	if req.MaxTokens <= 0 {
+		req.MaxTokens = 4096
+	}
+
+	var system []string
+	for _, msg := range in {
+		switch msg.Role {
+		case schema.System:
+			system = append(system, msg.Content)
+		case schema.User:
+			var blocks []anthropicContent
+			for _, part := range userParts(msg) {
+				switch part.Type {
+				case schema.ChatMessagePartTypeText:
+					blocks = append(blocks, anthropicContent{Type: "text", Text: part.Text})
+				case schema.ChatMessagePartTypeImageURL:
+					mimeType, data, link := imageSource(part.Image)
+					src := &anthropicImageSource{Type: "base64", MediaType: mimeType, Data: data}
+					if data == "" {
+						src = &anthropicImageSource{Type: "url", URL: link}
+					}
+					blocks = append(blocks, anthropicContent{Type: "image", Source: src})
+				}
+			}
+			req.Messages = appendAnthropic(req.Messages, "user", blocks)
+		case schema.Assistant:
+			var blocks []anthropicContent
+			if msg.Content != "" {
+				blocks = append(blocks, anthropicContent{Type: "text", Text: msg.Content})
+			}
+			for _, tc := range msg.ToolCalls {
+				blocks = append(blocks, anthropicContent{
+					Type:  "tool_use",
+					ID:    tc.ID,
+					Name:  tc.Function.Name,
+					Input: toolInput(tc.Function.Arguments),
+				})
+			}
+			req.Messages = appendAnthropic(req.Messages, "assistant", blocks)
+		case schema.Tool:
+			// Tool results go back as user turns
+			req.Messages = appendAnthropic(req.Messages, "user", []anthropicContent{{
+				Type:      "tool_result",
+				ToolUseID: msg.ToolCallID,
+				Content:   msg.Content,
+			}})
+		}
+	}
+	req.System = strings.Join(system, "\n\n")
+
+	if len(o.Tools) > 0 {
+		for _, t := range o.Tools {
+			params, err := toolParameters(t)
+			if err != nil {
+				return nil, fmt.Errorf("anthropic: %w", err)
+			}
+			req.Tools = append(req.Tools, anthropicTool{Name: t.Name, Description: t.Desc, InputSchema: params})
+		}
+		if toolsForbidden(o) {
+			req.ToolChoice = map[string]interface{}{"type": "none"}
+		}
+	}
+	return req, nil
+}
+
+// toolInput renders tool call arguments as the object the Messages API
+// requires on every tool_use block, {} when there are none.
+func toolInput(args string) json.RawMessage {
+	raw, err := json.Marshal(parseArguments(args))
+	if err != nil || string(raw) == "null" {
+		return json.RawMessage("{}")
+	}
+	return raw
+}
+
+// appendAnthropic adds content blocks, merging consecutive turns of the same role.
+func appendAnthropic(msgs []anthropicMessage, role string, blocks []anthropicContent) []anthropicMessage {
+	if len(blocks) == 0 {
+		return msgs
+	}
+	if n := len(msgs); n > 0 && msgs[n-1].Role == role {
+		msgs[n-1].Content = append(msgs[n-1].Content, blocks...)
+		return msgs
+	}
+	return append(msgs, anthropicMessage{Role: role, Content: blocks})
+}
+
+func (m *AnthropicChatModel) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         m.cfg.APIKey,
+		"anthropic-version": anthropicVersion,
+	}
+}
+
+// Generate sends the messages and returns the complete reply.
+func (m *AnthropicChatModel) Generate(ctx context.Context, in []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	req, err := m.buildRequest(in, false, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postJSON(ctx, m.cfg.client(), "anthropic", m.cfg.baseURL(anthropicDefaultBaseURL)+"/v1/messages", m.headers(), req)
+	if err != nil {
+		return nil, err
+	}
+	var out anthropicResponse
+	if err := decodeJSON(resp, "anthropic", &out); err != nil {
+		return nil, err
+	}
+
+	msg := &schema.Message{Role: schema.Assistant}
+	var text strings.Builder
+	for _, block := range out.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			args := string(block.Input)
+			if strings.TrimSpace(args) == "" || args == "null" {
+				args = "{}"
+			}
+			msg.ToolCalls = append(msg.ToolCalls, schema.ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: schema.FunctionCall{Name: block.Name, Arguments: args},
+			})
+		}
+	}
+	msg.Content = text.String()
+	msg.ResponseMeta = usageMeta(out.Usage.InputTokens, out.Usage.OutputTokens, out.StopReason)
+	return msg, nil
+}
+
+type anthropicStreamEvent struct {
+	Type         string            `json:"type"`
+	Index        int               `json:"index"`
+	Message      anthropicResponse `json:"message"`
+	ContentBlock anthropicContent  `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Stream sends the messages and streams the reply as it is generated.
+func (m *AnthropicChatModel) Stream(ctx context.Context, in []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	req, err := m.buildRequest(in, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postJSON(ctx, m.cfg.client(), "anthropic", m.cfg.baseURL(anthropicDefaultBaseURL)+"/v1/messages", m.headers(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamBody(resp, func(body io.Reader, send func(*schema.Message) error) error {
+		inputTokens := 0
+		// Anthropic block indexes include text blocks; tool calls get their own index
+		toolIndex := map[int]int{}
+		return readSSE(body, func(_ string, data string) error {
+			var ev anthropicStreamEvent
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				return fmt.Errorf("anthropic: decode stream event: %w", err)
+			}
+			switch ev.Type {
+			case "message_start":
+				inputTokens = ev.Message.Usage.InputTokens
+			case "content_block_start":
+				if ev.ContentBlock.Type == "tool_use" {
+					idx := len(toolIndex)
+					toolIndex[ev.Index] = idx
+					return send(&schema.Message{Role: schema.Assistant, ToolCalls: []schema.ToolCall{{
+						Index:    intPtr(idx),
+						ID:       ev.ContentBlock.ID,
+						Type:     "function",
+						Function: schema.FunctionCall{Name: ev.ContentBlock.Name},
+					}}})
+				}
+			case "content_block_delta":
+				switch ev.Delta.Type {
+				case "text_delta":
+					return send(&schema.Message{Role: schema.Assistant, Content: ev.Delta.Text})
+				case "input_json_delta":
+					idx, ok := toolIndex[ev.Index]
+					if !ok || ev.Delta.PartialJSON == "" {
+						return nil
+					}
+					return send(&schema.Message{Role: schema.Assistant, ToolCalls: []schema.ToolCall{{
+						Index:    intPtr(idx),
+						Function: schema.FunctionCall{Arguments: ev.Delta.PartialJSON},
+					}}})
+				}
+			case "message_delta":
+				return send(&schema.Message{
+					Role:         schema.Assistant,
+					ResponseMeta: usageMeta(inputTokens, ev.Usage.OutputTokens, ev.Delta.StopReason),
+				})
+			case "error":
+				return fmt.Errorf("anthropic: %s: %s", ev.Error.Type, ev.Error.Message)
+			}
+			return nil
+		})
+	}), nil
+}
@@ -0,0 +1,190 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+func newTestAnthropic(t *testing.T, url string) *AnthropicChatModel {
+	t.Helper()
+	m, err := NewAnthropic(Config{APIKey: "sk-test", BaseURL: url, Model: "claude-3-5-sonnet-latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAnthropicGenerate(t *testing.T) {
+	srv, calls := standIn(t, writeJSON(`{
+		"content": [{"type": "text", "text": "Hello there"}],
+		"stop_reason": "end_turn",
+		"usage": {"input_tokens": 12, "output_tokens": 3}
+	}`))
+
+	msg, err := newTestAnthropic(t, srv.URL).Generate(context.Background(), []*schema.Message{
+		schema.SystemMessage("Be brief."),
+		schema.UserMessage("Hi"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "Hello there" {
+		t.Errorf("content = %q", msg.Content)
+	}
+	if u := msg.ResponseMeta.Usage; u.PromptTokens != 12 || u.CompletionTokens != 3 || u.TotalTokens != 15 {
+		t.Errorf("usage = %+v", u)
+	}
+
+	req := (*calls)[0]
+	if req.Path != "/v1/messages" {
+		t.Errorf("path = %q", req.Path)
+	}
+	if req.Header.Get("x-api-key") != "sk-test" || req.Header.Get("anthropic-version") != anthropicVersion {
+		t.Errorf("headers = %v", req.Header)
+	}
+	if req.Body["system"] != "Be brief." {
+		t.Errorf("system = %v", req.Body["system"])
+	}
+	if msgs := req.Body["messages"].([]interface{}); len(msgs) != 1 {
+		t.Errorf("messages = %v, system prompt must not be a turn", msgs)
+	}
+}
+
+func TestAnthropicGenerateError(t *testing.T) {
+	srv, _ := standIn(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"type":"overloaded_error"}}`, http.StatusServiceUnavailable)
+	})
+
+	_, err := newTestAnthropic(t, srv.URL).Generate(context.Background(), []*schema.Message{schema.UserMessage("Hi")})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want APIError 503", err)
+	}
+}
+
+func TestAnthropicToolCalls(t *testing.T) {
+	srv, calls := standIn(t, writeJSON(`{
+		"content": [
+			{"type": "text", "text": "Checking."},
+			{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Bandung"}}
+		],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 40, "output_tokens": 9}
+	}`))
+
+	m, _ := newTestAnthropic(t, srv.URL).WithTools([]*schema.ToolInfo{weatherTool()})
+	msg, err := m.Generate(context.Background(), toolTurn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].ID != "toolu_1" || msg.ToolCalls[0].Function.Name != "get_weather" {
+		t.Fatalf("tool calls = %+v", msg.ToolCalls)
+	}
+	if args := argsOf(t, msg.ToolCalls[0]); args["city"] != "Bandung" {
+		t.Errorf("arguments = %v", args)
+	}
+
+	body := (*calls)[0].Body
+	tools := body["tools"].([]interface{})
+	if tools[0].(map[string]interface{})["name"] != "get_weather" {
+		t.Errorf("tools = %v", tools)
+	}
+	// user, assistant tool_use, user tool_result
+	msgs := body["messages"].([]interface{})
+	if len(msgs) != 3 {
+		t.Fatalf("messages = %v", msgs)
+	}
+	result := msgs[2].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})
+	if result["type"] != "tool_result" || result["tool_use_id"] != "call_1" {
+		t.Errorf("tool result block = %v", result)
+	}
+}
+
+func TestAnthropicToolUseInput(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		want int // number of keys in input
+	}{
+		{"empty", "", 0},
+		{"null", "null", 0},
+		{"invalid", "{", 0},
+		{"object", `{"city":"Jakarta"}`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := standIn(t, writeJSON(`{"content":[{"type":"text","text":"ok"}],"stop_reason":"end_turn"}`))
+			_, err := newTestAnthropic(t, srv.URL).Generate(context.Background(), []*schema.Message{
+				schema.UserMessage("Hi"),
+				schema.AssistantMessage("", []schema.ToolCall{{ID: "t1", Function: schema.FunctionCall{Name: "ping", Arguments: tt.args}}}),
+				schema.ToolMessage("pong", "t1"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			block := (*calls)[0].Body["messages"].([]interface{})[1].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})
+			input, ok := block["input"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("tool_use input = %#v, want an object", block["input"])
+			}
+			if len(input) != tt.want {
+				t.Errorf("input = %v, want %d keys", input, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnthropicStream(t *testing.T) {
+	srv, calls := standIn(t, writeStream("text/event-stream",
+		"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":20}}}\n\n",
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\",\"text\":\"\"}}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Let me \"}}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"check.\"}}\n\n",
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"tool_use\",\"id\":\"toolu_9\",\"name\":\"get_weather\",\"input\":{}}}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"city\\\":\"}}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"\\\"Medan\\\"}\"}}\n\n",
+		"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"tool_use\"},\"usage\":{\"output_tokens\":7}}\n\n",
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n",
+	))
+
+	m, _ := newTestAnthropic(t, srv.URL).WithTools([]*schema.ToolInfo{weatherTool()})
+	sr, err := m.Stream(context.Background(), []*schema.Message{schema.UserMessage("Weather in Medan?")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := collect(t, sr)
+	if msg.Content != "Let me check." {
+		t.Errorf("content = %q", msg.Content)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].ID != "toolu_9" {
+		t.Fatalf("tool calls = %+v", msg.ToolCalls)
+	}
+	if args := argsOf(t, msg.ToolCalls[0]); args["city"] != "Medan" {
+		t.Errorf("arguments = %v", args)
+	}
+	if msg.ResponseMeta == nil || msg.ResponseMeta.FinishReason != "tool_use" || msg.ResponseMeta.Usage.TotalTokens != 27 {
+		t.Errorf("response meta = %+v", msg.ResponseMeta)
+	}
+	if (*calls)[0].Body["stream"] != true {
+		t.Errorf("stream flag not set: %v", (*calls)[0].Body)
+	}
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	srv, _ := standIn(t, writeStream("text/event-stream",
+		"event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n",
+	))
+
+	sr, err := newTestAnthropic(t, srv.URL).Stream(context.Background(), []*schema.Message{schema.UserMessage("Hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	if _, err := sr.Recv(); err == nil {
+		t.Fatal("want stream error")
+	}
+}
@@ -0,0 +1,325 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+const geminiDefaultBaseURL = "https://generativelanguage.googleapis.com"
+
+// GeminiChatModel talks to the Google Gemini generateContent API.
+type GeminiChatModel struct {
+	cfg   Config
+	tools []*schema.ToolInfo
+}
+
+// NewGemini creates a Gemini adapter.
+func NewGemini(cfg Config) (*GeminiChatModel, error) {
+	if strings.TrimSpace(cfg.APIKey) == "" {
+		return nil, fmt.Errorf("gemini: api key is required")
+	}
+	cfg.Model = strings.TrimPrefix(strings.TrimSpace(cfg.Model), "models/")
+	if cfg.Model == "" {
+		return nil, fmt.Errorf("gemini: model is required")
+	}
+	return &GeminiChatModel{cfg: cfg}, nil
+}
+
+// WithTools returns a copy of the model with the tools bound.
+func (m *GeminiChatModel) WithTools(tools []*schema.ToolInfo) (model.ToolCallingChatModel, error) {
+	return &GeminiChatModel{cfg: m.cfg, tools: tools}, nil
+}
+
+func (m *GeminiChatModel) GetType() string { return "Gemini" }
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+	FileData         *geminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type geminiFunctionCall struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature     *float32 `json:"temperature,omitempty"`
+	TopP            *float32 `json:"topP,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []geminiTool            `json:"tools,omitempty"`
+	ToolConfig        map[string]interface{}  `json:"toolConfig,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func (m *GeminiChatModel) buildRequest(in []*schema.Message, opts ...model.Option) (*geminiRequest, error) {
+	o := m.cfg.callOptions(m.tools, opts...)
+	req := &geminiRequest{
+		GenerationConfig: &geminiGenerationConfig{
+			Temperature:     o.Temperature,
+			TopP:            o.TopP,
+			MaxOutputTokens: *o.MaxTokens,
+			StopSequences:   o.Stop,
+		},
+	}
+
+	names := toolNamesByID(in)
+	var system []geminiPart
+	for _, msg := range in {
+		switch msg.Role {
+		case schema.System:
+			system = append(system, geminiPart{Text: msg.Content})
+		case schema.User:
+			var parts []geminiPart
+			for _, part := range userParts(msg) {
+				switch part.Type {
+				case schema.ChatMessagePartTypeText:
+					parts = append(parts, geminiPart{Text: part.Text})
+				case schema.ChatMessagePartTypeImageURL:
+					mimeType, data, link := imageSource(part.Image)
+					if data != "" {
+						parts = append(parts, geminiPart{InlineData: &geminiBlob{MimeType: mimeType, Data: data}})
+					} else if link != "" {
+						parts = append(parts, geminiPart{FileData: &geminiFileData{MimeType: mimeType, FileURI: link}})
+					}
+				}
+			}
+			req.Contents = appendGemini(req.Contents, "user", parts)
+		case schema.Assistant:
+			var parts []geminiPart
+			if msg.Content != "" {
+				parts = append(parts, geminiPart{Text: msg.Content})
+			}
+			for _, tc := range msg.ToolCalls {
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: tc.Function.Name,
+					Args: parseArguments(tc.Function.Arguments),
+				}})
+			}
+			req.Contents = appendGemini(req.Contents, "model", parts)
+		case schema.Tool:
+			name := msg.ToolName
+			if name == "" {
+				name = names[msg.ToolCallID]
+			}
+			// Gemini wants an object; wrap plain text results
+			response := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(msg.Content), &response); err != nil || len(response) == 0 {
+				response = map[string]interface{}{"content": msg.Content}
+			}
+			req.Contents = appendGemini(req.Contents, "user", []geminiPart{{
+				FunctionResponse: &geminiFunctionResponse{Name: name, Response: response},
+			}})
+		}
+	}
+	if len(system) > 0 {
+		req.SystemInstruction = &geminiContent{Parts: system}
+	}
+
+	if len(o.Tools) > 0 {
+		var decls []geminiFunctionDeclaration
+		for _, t := range o.Tools {
+			params, err := toolParameters(t)
+			if err != nil {
+				return nil, fmt.Errorf("gemini: %w", err)
+			}
+			decls = append(decls, geminiFunctionDeclaration{Name: t.Name, Description: t.Desc, Parameters: geminiSchema(params)})
+		}
+		req.Tools = []geminiTool{{FunctionDeclarations: decls}}
+		mode := "AUTO"
+		if toolsForbidden(o) {
+			mode = "NONE"
+		}
+		req.ToolConfig = map[string]interface{}{"functionCallingConfig": map[string]interface{}{"mode": mode}}
+	}
+	return req, nil
+}
+
+// geminiSchema drops JSON schema keywords the Gemini API rejects.
+func geminiSchema(v map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(v))
+	for k, val := range v {
+		switch k {
+		case "$schema", "$id", "additionalProperties", "$defs", "definitions":
+			continue
+		}
+		switch t := val.(type) {
+		case map[string]interface{}:
+			out[k] = geminiSchema(t)
+		default:
+			out[k] = val
+		}
+	}
+	return out
+}
+
+// appendGemini adds parts, merging consecutive turns of the same role.
+func appendGemini(contents []geminiContent, role string, parts []geminiPart) []geminiContent {
+	if len(parts) == 0 {
+		return contents
+	}
+	if n := len(contents); n > 0 && contents[n-1].Role == role {
+		contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+		return contents
+	}
+	return append(contents, geminiContent{Role: role, Parts: parts})
+}
+
+func (m *GeminiChatModel) endpoint(method string, query url.Values) string {
+	u := fmt.Sprintf("%s/v1beta/models/%s:%s", m.cfg.baseURL(geminiDefaultBaseURL), url.PathEscape(m.cfg.Model), method)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func (m *GeminiChatModel) headers() map[string]string {
+	return map[string]string{"x-goog-api-key": m.cfg.APIKey}
+}
+
+// toMessage converts a (possibly partial) Gemini response into an assistant message.
+func (r *geminiResponse) toMessage(callOffset int) *schema.Message {
+	msg := &schema.Message{Role: schema.Assistant}
+	finish := ""
+	if len(r.Candidates) > 0 {
+		c := r.Candidates[0]
+		finish = c.FinishReason
+		var text strings.Builder
+		for _, part := range c.Content.Parts {
+			if part.Text != "" {
+				text.WriteString(part.Text)
+			}
+			if part.FunctionCall != nil {
+				args, _ := json.Marshal(part.FunctionCall.Args)
+				idx := callOffset + len(msg.ToolCalls)
+				msg.ToolCalls = append(msg.ToolCalls, schema.ToolCall{
+					Index:    intPtr(idx),
+					ID:       fmt.Sprintf("call_%d", idx),
+					Type:     "function",
+					Function: schema.FunctionCall{Name: part.FunctionCall.Name, Arguments: string(args)},
+				})
+			}
+		}
+		msg.Content = text.String()
+	}
+	if r.UsageMetadata.PromptTokenCount > 0 || r.UsageMetadata.CandidatesTokenCount > 0 {
+		msg.ResponseMeta = usageMeta(r.UsageMetadata.PromptTokenCount, r.UsageMetadata.CandidatesTokenCount, finish)
+	}
+	return msg
+}
+
+// Generate sends the messages and returns the complete reply.
+func (m *GeminiChatModel) Generate(ctx context.Context, in []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	req, err := m.buildRequest(in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postJSON(ctx, m.cfg.client(), "gemini", m.endpoint("generateContent", nil), m.headers(), req)
+	if err != nil {
+		return nil, err
+	}
+	var out geminiResponse
+	if err := decodeJSON(resp, "gemini", &out); err != nil {
+		return nil, err
+	}
+	if out.Error != nil {
+		return nil, &APIError{Provider: "gemini", StatusCode: out.Error.Code, Body: out.Error.Message}
+	}
+	msg := out.toMessage(0)
+	// Generate returns whole tool calls, the stream index is not needed
+	for i := range msg.ToolCalls {
+		msg.ToolCalls[i].Index = nil
+	}
+	return msg, nil
+}
+
+// Stream sends the messages and streams the reply as it is generated.
+func (m *GeminiChatModel) Stream(ctx context.Context, in []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	req, err := m.buildRequest(in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postJSON(ctx, m.cfg.client(), "gemini", m.endpoint("streamGenerateContent", url.Values{"alt": {"sse"}}), m.headers(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamBody(resp, func(body io.Reader, send func(*schema.Message) error) error {
+		calls := 0
+		return readSSE(body, func(_ string, data string) error {
+			var chunk geminiResponse
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				return fmt.Errorf("gemini: decode stream chunk: %w", err)
+			}
+			if chunk.Error != nil {
+				return &APIError{Provider: "gemini", StatusCode: chunk.Error.Code, Body: chunk.Error.Message}
+			}
+			msg := chunk.toMessage(calls)
+			calls += len(msg.ToolCalls)
+			if msg.Content == "" && len(msg.ToolCalls) == 0 && msg.ResponseMeta == nil {
+				return nil
+			}
+			return send(msg)
+		})
+	}), nil
+}
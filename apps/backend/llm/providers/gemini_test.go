@@ -0,0 +1,122 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+func newTestGemini(t *testing.T, url string) *GeminiChatModel {
+	t.Helper()
+	m, err := NewGemini(Config{APIKey: "g-test", BaseURL: url, Model: "models/gemini-1.5-flash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestGeminiGenerate(t *testing.T) {
+	srv, calls := standIn(t, writeJSON(`{
+		"candidates": [{"content": {"role": "model", "parts": [{"text": "Halo"}, {"text": "!"}]}, "finishReason": "STOP"}],
+		"usageMetadata": {"promptTokenCount": 8, "candidatesTokenCount": 2}
+	}`))
+
+	msg, err := newTestGemini(t, srv.URL).Generate(context.Background(), []*schema.Message{
+		schema.SystemMessage("Answer in Indonesian."),
+		schema.UserMessage("Hello"),
+	}, model.WithTemperature(0.2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "Halo!" {
+		t.Errorf("content = %q", msg.Content)
+	}
+	if msg.ResponseMeta == nil || msg.ResponseMeta.FinishReason != "STOP" || msg.ResponseMeta.Usage.TotalTokens != 10 {
+		t.Errorf("response meta = %+v", msg.ResponseMeta)
+	}
+
+	req := (*calls)[0]
+	if req.Path != "/v1beta/models/gemini-1.5-flash:generateContent" {
+		t.Errorf("path = %q", req.Path)
+	}
+	if req.Header.Get("x-goog-api-key") != "g-test" {
+		t.Errorf("headers = %v", req.Header)
+	}
+	if _, ok := req.Body["systemInstruction"]; !ok {
+		t.Errorf("system instruction missing: %v", req.Body)
+	}
+	if cfg := req.Body["generationConfig"].(map[string]interface{}); cfg["temperature"] != 0.2 {
+		t.Errorf("generation config = %v", cfg)
+	}
+}
+
+func TestGeminiGenerateErrorBody(t *testing.T) {
+	srv, _ := standIn(t, writeJSON(`{"error": {"code": 429, "message": "quota"}}`))
+
+	if _, err := newTestGemini(t, srv.URL).Generate(context.Background(), []*schema.Message{schema.UserMessage("Hi")}); err == nil {
+		t.Fatal("want error for an error body")
+	}
+}
+
+func TestGeminiToolCalls(t *testing.T) {
+	srv, calls := standIn(t, writeJSON(`{
+		"candidates": [{"content": {"role": "model", "parts": [{"functionCall": {"name": "get_weather", "args": {"city": "Surabaya"}}}]}, "finishReason": "STOP"}]
+	}`))
+
+	m, _ := newTestGemini(t, srv.URL).WithTools([]*schema.ToolInfo{weatherTool()})
+	msg, err := m.Generate(context.Background(), toolTurn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].Function.Name != "get_weather" || msg.ToolCalls[0].Index != nil {
+		t.Fatalf("tool calls = %+v", msg.ToolCalls)
+	}
+	if args := argsOf(t, msg.ToolCalls[0]); args["city"] != "Surabaya" {
+		t.Errorf("arguments = %v", args)
+	}
+
+	body := (*calls)[0].Body
+	decls := body["tools"].([]interface{})[0].(map[string]interface{})["functionDeclarations"].([]interface{})
+	params := decls[0].(map[string]interface{})["parameters"].(map[string]interface{})
+	if _, ok := params["additionalProperties"]; ok {
+		t.Errorf("parameters keep keywords Gemini rejects: %v", params)
+	}
+	// The tool result is sent under the name of the call it answers
+	contents := body["contents"].([]interface{})
+	last := contents[len(contents)-1].(map[string]interface{})["parts"].([]interface{})[0].(map[string]interface{})
+	resp, ok := last["functionResponse"].(map[string]interface{})
+	if !ok || resp["name"] != "get_weather" {
+		t.Errorf("function response = %v", last)
+	}
+}
+
+func TestGeminiStream(t *testing.T) {
+	srv, calls := standIn(t, writeStream("text/event-stream",
+		"data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Sebentar, \"}]}}]}\n\n",
+		"data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"saya cek.\"}]}}]}\n\n",
+		"data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"functionCall\":{\"name\":\"get_weather\",\"args\":{\"city\":\"Bali\"}}}]},\"finishReason\":\"STOP\"}],\"usageMetadata\":{\"promptTokenCount\":11,\"candidatesTokenCount\":6}}\n\n",
+	))
+
+	m, _ := newTestGemini(t, srv.URL).WithTools([]*schema.ToolInfo{weatherTool()})
+	sr, err := m.Stream(context.Background(), []*schema.Message{schema.UserMessage("Cuaca di Bali?")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := collect(t, sr)
+	if msg.Content != "Sebentar, saya cek." {
+		t.Errorf("content = %q", msg.Content)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].Function.Name != "get_weather" {
+		t.Fatalf("tool calls = %+v", msg.ToolCalls)
+	}
+	if args := argsOf(t, msg.ToolCalls[0]); args["city"] != "Bali" {
+		t.Errorf("arguments = %v", args)
+	}
+
+	req := (*calls)[0]
+	if req.Path != "/v1beta/models/gemini-1.5-flash:streamGenerateContent" || req.Query != "alt=sse" {
+		t.Errorf("url = %s?%s", req.Path, req.Query)
+	}
+}
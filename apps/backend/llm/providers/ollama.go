@@ -0,0 +1,235 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+const ollamaDefaultBaseURL = "http://localhost:11434"
+
+// OllamaChatModel talks to the Ollama /api/chat endpoint.
+type OllamaChatModel struct {
+	cfg   Config
+	tools []*schema.ToolInfo
+}
+
+// NewOllama creates an Ollama adapter. The API key is optional and is only
+// sent when Ollama sits behind an authenticating proxy.
+func NewOllama(cfg Config) (*OllamaChatModel, error) {
+	if strings.TrimSpace(cfg.Model) == "" {
+		return nil, fmt.Errorf("ollama: model is required")
+	}
+	return &OllamaChatModel{cfg: cfg}, nil
+}
+
+// WithTools returns a copy of the model with the tools bound.
+func (m *OllamaChatModel) WithTools(tools []*schema.ToolInfo) (model.ToolCallingChatModel, error) {
+	return &OllamaChatModel{cfg: m.cfg, tools: tools}, nil
+}
+
+func (m *OllamaChatModel) GetType() string { return "Ollama" }
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description,omitempty"`
+		Parameters  map[string]interface{} `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaRequest struct {
+	Model    string                 `json:"model"`
+	Messages []ollamaMessage        `json:"messages"`
+	Tools    []ollamaTool           `json:"tools,omitempty"`
+	Stream   bool                   `json:"stream"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+}
+
+type ollamaResponse struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (m *OllamaChatModel) buildRequest(in []*schema.Message, stream bool, opts ...model.Option) (*ollamaRequest, error) {
+	o := m.cfg.callOptions(m.tools, opts...)
+	req := &ollamaRequest{Model: *o.Model, Stream: stream}
+
+	options := map[string]interface{}{}
+	if o.Temperature != nil {
+		options["temperature"] = *o.Temperature
+	}
+	if o.TopP != nil {
+		options["top_p"] = *o.TopP
+	}
+	if o.MaxTokens != nil && *o.MaxTokens > 0 {
+		options["num_predict"] = *o.MaxTokens
+	}
+	if len(o.Stop) > 0 {
+		options["stop"] = o.Stop
+	}
+	if len(options) > 0 {
+		req.Options = options
+	}
+
+	names := toolNamesByID(in)
+	for _, msg := range in {
+		switch msg.Role {
+		case schema.System:
+			req.Messages = append(req.Messages, ollamaMessage{Role: "system", Content: msg.Content})
+		case schema.User:
+			out := ollamaMessage{Role: "user"}
+			var text []string
+			for _, part := range userParts(msg) {
+				switch part.Type {
+				case schema.ChatMessagePartTypeText:
+					text = append(text, part.Text)
+				case schema.ChatMessagePartTypeImageURL:
+					// Ollama only accepts inline base64 images
+					if _, data, _ := imageSource(part.Image); data != "" {
+						out.Images = append(out.Images, data)
+					}
+				}
+			}
+			out.Content = strings.Join(text, "\n")
+			req.Messages = append(req.Messages, out)
+		case schema.Assistant:
+			out := ollamaMessage{Role: "assistant", Content: msg.Content}
+			for _, tc := range msg.ToolCalls {
+				var call ollamaToolCall
+				call.Function.Name = tc.Function.Name
+				call.Function.Arguments = parseArguments(tc.Function.Arguments)
+				out.ToolCalls = append(out.ToolCalls, call)
+			}
+			req.Messages = append(req.Messages, out)
+		case schema.Tool:
+			name := msg.ToolName
+			if name == "" {
+				name = names[msg.ToolCallID]
+			}
+			req.Messages = append(req.Messages, ollamaMessage{Role: "tool", Content: msg.Content, ToolName: name})
+		}
+	}
+
+	// Ollama has no tool_choice; leaving the tools out forbids tool calls
+	if len(o.Tools) > 0 && !toolsForbidden(o) {
+		for _, t := range o.Tools {
+			params, err := toolParameters(t)
+			if err != nil {
+				return nil, fmt.Errorf("ollama: %w", err)
+			}
+			var tool ollamaTool
+			tool.Type = "function"
+			tool.Function.Name = t.Name
+			tool.Function.Description = t.Desc
+			tool.Function.Parameters = params
+			req.Tools = append(req.Tools, tool)
+		}
+	}
+	return req, nil
+}
+
+func (m *OllamaChatModel) headers() map[string]string {
+	if strings.TrimSpace(m.cfg.APIKey) == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "Bearer " + m.cfg.APIKey}
+}
+
+// toMessage converts an Ollama response (or stream chunk) into an assistant message.
+func (r *ollamaResponse) toMessage(callOffset int, indexed bool) *schema.Message {
+	msg := &schema.Message{Role: schema.Assistant, Content: r.Message.Content}
+	for _, tc := range r.Message.ToolCalls {
+		args, _ := json.Marshal(tc.Function.Arguments)
+		idx := callOffset + len(msg.ToolCalls)
+		call := schema.ToolCall{
+			ID:       fmt.Sprintf("call_%d", idx),
+			Type:     "function",
+			Function: schema.FunctionCall{Name: tc.Function.Name, Arguments: string(args)},
+		}
+		if indexed {
+			call.Index = intPtr(idx)
+		}
+		msg.ToolCalls = append(msg.ToolCalls, call)
+	}
+	if r.Done {
+		msg.ResponseMeta = usageMeta(r.PromptEvalCount, r.EvalCount, r.DoneReason)
+	}
+	return msg
+}
+
+// Generate sends the messages and returns the complete reply.
+func (m *OllamaChatModel) Generate(ctx context.Context, in []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	req, err := m.buildRequest(in, false, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postJSON(ctx, m.cfg.client(), "ollama", m.cfg.baseURL(ollamaDefaultBaseURL)+"/api/chat", m.headers(), req)
+	if err != nil {
+		return nil, err
+	}
+	var out ollamaResponse
+	if err := decodeJSON(resp, "ollama", &out); err != nil {
+		return nil, err
+	}
+	if out.Error != "" {
+		return nil, fmt.Errorf("ollama: %s", out.Error)
+	}
+	return out.toMessage(0, false), nil
+}
+
+// Stream sends the messages and streams the reply as it is generated.
+func (m *OllamaChatModel) Stream(ctx context.Context, in []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	req, err := m.buildRequest(in, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postJSON(ctx, m.cfg.client(), "ollama", m.cfg.baseURL(ollamaDefaultBaseURL)+"/api/chat", m.headers(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamBody(resp, func(body io.Reader, send func(*schema.Message) error) error {
+		calls := 0
+		return readLines(body, func(line []byte) error {
+			var chunk ollamaResponse
+			if err := json.Unmarshal(line, &chunk); err != nil {
+				return fmt.Errorf("ollama: decode stream chunk: %w", err)
+			}
+			if chunk.Error != "" {
+				return fmt.Errorf("ollama: %s", chunk.Error)
+			}
+			msg := chunk.toMessage(calls, true)
+			calls += len(msg.ToolCalls)
+			if msg.Content == "" && len(msg.ToolCalls) == 0 && msg.ResponseMeta == nil {
+				return nil
+			}
+			return send(msg)
+		})
+	}), nil
+}
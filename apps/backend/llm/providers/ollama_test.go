@@ -0,0 +1,131 @@
+package providers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+func newTestOllama(t *testing.T, url string) *OllamaChatModel {
+	t.Helper()
+	m, err := NewOllama(Config{BaseURL: url, Model: "llama3.1", MaxTokens: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestOllamaGenerate(t *testing.T) {
+	srv, calls := standIn(t, writeJSON(`{
+		"message": {"role": "assistant", "content": "Hi!"},
+		"done": true, "done_reason": "stop",
+		"prompt_eval_count": 5, "eval_count": 2
+	}`))
+
+	msg, err := newTestOllama(t, srv.URL).Generate(context.Background(), []*schema.Message{
+		schema.SystemMessage("Be brief."),
+		schema.UserMessage("Hello"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "Hi!" {
+		t.Errorf("content = %q", msg.Content)
+	}
+	if msg.ResponseMeta == nil || msg.ResponseMeta.Usage.TotalTokens != 7 {
+		t.Errorf("response meta = %+v", msg.ResponseMeta)
+	}
+
+	req := (*calls)[0]
+	if req.Path != "/api/chat" {
+		t.Errorf("path = %q", req.Path)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("authorization sent without an api key")
+	}
+	if req.Body["stream"] != false {
+		t.Errorf("stream = %v", req.Body["stream"])
+	}
+	if opts := req.Body["options"].(map[string]interface{}); opts["num_predict"] != float64(256) {
+		t.Errorf("options = %v", opts)
+	}
+}
+
+func TestOllamaGenerateErrorBody(t *testing.T) {
+	srv, _ := standIn(t, writeJSON(`{"error": "model \"llama3.1\" not found"}`))
+
+	if _, err := newTestOllama(t, srv.URL).Generate(context.Background(), []*schema.Message{schema.UserMessage("Hi")}); err == nil {
+		t.Fatal("want error for an error body")
+	}
+}
+
+func TestOllamaToolCalls(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []model.Option
+		wantTools bool
+	}{
+		{"auto", nil, true},
+		{"forbidden", []model.Option{model.WithToolChoice(schema.ToolChoiceForbidden)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := standIn(t, writeJSON(`{
+				"message": {"role": "assistant", "content": "", "tool_calls": [{"function": {"name": "get_weather", "arguments": {"city": "Depok"}}}]},
+				"done": true
+			}`))
+
+			m, _ := newTestOllama(t, srv.URL).WithTools([]*schema.ToolInfo{weatherTool()})
+			msg, err := m.Generate(context.Background(), toolTurn(), tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].Function.Name != "get_weather" {
+				t.Fatalf("tool calls = %+v", msg.ToolCalls)
+			}
+			if args := argsOf(t, msg.ToolCalls[0]); args["city"] != "Depok" {
+				t.Errorf("arguments = %v", args)
+			}
+
+			body := (*calls)[0].Body
+			if _, ok := body["tools"]; ok != tt.wantTools {
+				t.Errorf("tools sent = %v, want %v", ok, tt.wantTools)
+			}
+			msgs := body["messages"].([]interface{})
+			last := msgs[len(msgs)-1].(map[string]interface{})
+			if last["role"] != "tool" || last["tool_name"] != "get_weather" {
+				t.Errorf("tool result = %v", last)
+			}
+		})
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	srv, _ := standIn(t, writeStream("application/x-ndjson",
+		`{"message":{"role":"assistant","content":"Cek "},"done":false}`+"\n",
+		`{"message":{"role":"assistant","content":"cuaca."},"done":false}`+"\n",
+		`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Bogor"}}}]},"done":false}`+"\n",
+		`{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":9,"eval_count":4}`+"\n",
+	))
+
+	m, _ := newTestOllama(t, srv.URL).WithTools([]*schema.ToolInfo{weatherTool()})
+	sr, err := m.Stream(context.Background(), []*schema.Message{schema.UserMessage("Cuaca di Bogor?")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := collect(t, sr)
+	if msg.Content != "Cek cuaca." {
+		t.Errorf("content = %q", msg.Content)
+	}
+	if len(msg.ToolCalls) != 1 || msg.ToolCalls[0].ID != "call_0" {
+		t.Fatalf("tool calls = %+v", msg.ToolCalls)
+	}
+	if args := argsOf(t, msg.ToolCalls[0]); args["city"] != "Bogor" {
+		t.Errorf("arguments = %v", args)
+	}
+	if msg.ResponseMeta == nil || msg.ResponseMeta.Usage.TotalTokens != 13 {
+		t.Errorf("response meta = %+v", msg.ResponseMeta)
+	}
+}
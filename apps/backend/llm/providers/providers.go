@@ -0,0 +1,355 @@
+// Package providers implements native chat model adapters for LLM providers
+// that are not OpenAI-compatible: Anthropic Messages, Google Gemini and Ollama.
+//
+// Every adapter implements eino's model.ToolCallingChatModel, so the llm
+// service can use them interchangeably with the OpenAI-compatible model.
+// BaseURL and HTTPClient are configurable so adapters can be pointed at a
+// local httptest server.
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// Provider names as stored in llm_endpoints.provider.
+const (
+	OpenAICompatible = "openai-compatible"
+	Anthropic        = "anthropic"
+	Gemini           = "gemini"
+	Ollama           = "ollama"
+)
+
+// Normalize maps provider aliases to their canonical name.
+func Normalize(p string) string {
+	switch strings.TrimSpace(strings.ToLower(p)) {
+	case "", "openai", "openai-compatible", "openai_compatible":
+		return OpenAICompatible
+	case "anthropic", "claude":
+		return Anthropic
+	case "gemini", "google", "google-gemini":
+		return Gemini
+	case "ollama":
+		return Ollama
+	default:
+		return strings.TrimSpace(strings.ToLower(p))
+	}
+}
+
+// Known reports whether the provider has an adapter.
+func Known(p string) bool {
+	switch Normalize(p) {
+	case OpenAICompatible, Anthropic, Gemini, Ollama:
+		return true
+	}
+	return false
+}
+
+// RequiresAPIKey reports whether the provider needs an API key.
+func RequiresAPIKey(p string) bool {
+	return Normalize(p) != Ollama
+}
+
+// Validate checks the provider-specific endpoint fields.
+func Validate(provider, baseURL, apiKey, modelName string) error {
+	provider = Normalize(provider)
+	if !Known(provider) {
+		return fmt.Errorf("unsupported provider %q (use openai-compatible, anthropic, gemini or ollama)", provider)
+	}
+	if strings.TrimSpace(modelName) == "" {
+		return errors.New("model is required")
+	}
+	if RequiresAPIKey(provider) && strings.TrimSpace(apiKey) == "" {
+		return fmt.Errorf("api_key is required for %s", provider)
+	}
+	if baseURL = strings.TrimSpace(baseURL); baseURL != "" {
+		u, err := url.Parse(baseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("base_url must be an http(s) URL")
+		}
+	}
+	return nil
+}
+
+// Config configures a provider adapter.
+type Config struct {
+	APIKey      string
+	BaseURL     string
+	Model       string
+	MaxTokens   int
+	Temperature *float32
+	TopP        *float32
+	Stop        []string
+	// Timeout applies when HTTPClient is nil.
+	Timeout    time.Duration
+	HTTPClient *http.Client
+}
+
+func (c *Config) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 120 * time.Second
+	}
+	return &http.Client{Timeout: timeout}
+}
+
+func (c *Config) baseURL(def string) string {
+	if strings.TrimSpace(c.BaseURL) != "" {
+		return strings.TrimRight(strings.TrimSpace(c.BaseURL), "/")
+	}
+	return def
+}
+
+// callOptions merges per-call options over the adapter config.
+func (c *Config) callOptions(tools []*schema.ToolInfo, opts ...model.Option) *model.Options {
+	maxTokens := c.MaxTokens
+	modelName := c.Model
+	return model.GetCommonOptions(&model.Options{
+		Temperature: c.Temperature,
+		TopP:        c.TopP,
+		MaxTokens:   &maxTokens,
+		Model:       &modelName,
+		Stop:        c.Stop,
+		Tools:       tools,
+	}, opts...)
+}
+
+// toolsForbidden reports whether the call options disable tool use.
+func toolsForbidden(o *model.Options) bool {
+	return o.ToolChoice != nil && *o.ToolChoice == schema.ToolChoiceForbidden
+}
+
+// APIError is a non-2xx response from a provider.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: status %d: %s", e.Provider, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// postJSON sends a JSON request and returns the response for 2xx statuses.
+func postJSON(ctx context.Context, client *http.Client, provider, endpoint string, headers map[string]string, body interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: marshal request: %w", provider, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", provider, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{Provider: provider, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	return resp, nil
+}
+
+// decodeJSON reads a JSON response body.
+func decodeJSON(resp *http.Response, provider string, out interface{}) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s: decode response: %w", provider, err)
+	}
+	return nil
+}
+
+// readSSE calls fn for every Server-Sent Event in r.
+func readSSE(r io.Reader, fn func(event, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	event := ""
+	var data strings.Builder
+	flush := func() error {
+		if data.Len() == 0 {
+			event = ""
+			return nil
+		}
+		err := fn(event, data.String())
+		event = ""
+		data.Reset()
+		return err
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if err := flush(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// readLines calls fn for every non-empty line (newline-delimited JSON).
+func readLines(r io.Reader, fn func(line []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// errStopStream is returned by a send callback when the reader went away.
+var errStopStream = errors.New("stream closed by reader")
+
+// streamBody parses a streaming response body in the background and
+// forwards the chunks through an eino stream.
+func streamBody(resp *http.Response, parse func(body io.Reader, send func(*schema.Message) error) error) *schema.StreamReader[*schema.Message] {
+	sr, sw := schema.Pipe[*schema.Message](16)
+	go func() {
+		defer resp.Body.Close()
+		defer sw.Close()
+		err := parse(resp.Body, func(msg *schema.Message) error {
+			if closed := sw.Send(msg, nil); closed {
+				return errStopStream
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopStream) {
+			sw.Send(nil, err)
+		}
+	}()
+	return sr
+}
+
+// userParts returns the multimodal parts of a user message, falling back to its text.
+func userParts(msg *schema.Message) []schema.MessageInputPart {
+	if len(msg.UserInputMultiContent) > 0 {
+		return msg.UserInputMultiContent
+	}
+	if msg.Content == "" {
+		return nil
+	}
+	return []schema.MessageInputPart{{Type: schema.ChatMessagePartTypeText, Text: msg.Content}}
+}
+
+// imageSource extracts base64 data or a URL from an image part.
+func imageSource(img *schema.MessageInputImage) (mimeType, data, link string) {
+	if img == nil {
+		return "", "", ""
+	}
+	mimeType = img.MIMEType
+	if img.Base64Data != nil {
+		data = *img.Base64Data
+	}
+	if img.URL != nil {
+		link = *img.URL
+		// Split data: URLs into mime type and payload
+		if strings.HasPrefix(link, "data:") {
+			if idx := strings.Index(link, ";base64,"); idx > 0 {
+				if mimeType == "" {
+					mimeType = link[len("data:"):idx]
+				}
+				data = link[idx+len(";base64,"):]
+				link = ""
+			}
+		}
+	}
+	if mimeType == "" {
+		mimeType = "image/png"
+	}
+	return mimeType, data, link
+}
+
+// toolParameters renders a tool's parameters as a JSON schema object.
+func toolParameters(t *schema.ToolInfo) (map[string]interface{}, error) {
+	if t.ParamsOneOf == nil {
+		return map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}, nil
+	}
+	js, err := t.ParamsOneOf.ToJSONSchema()
+	if err != nil {
+		return nil, fmt.Errorf("tool %s: %w", t.Name, err)
+	}
+	raw, err := json.Marshal(js)
+	if err != nil {
+		return nil, fmt.Errorf("tool %s: %w", t.Name, err)
+	}
+	var params map[string]interface{}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("tool %s: %w", t.Name, err)
+	}
+	if params == nil {
+		params = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+	}
+	return params, nil
+}
+
+// parseArguments decodes tool call arguments into an object.
+func parseArguments(args string) map[string]interface{} {
+	out := map[string]interface{}{}
+	if strings.TrimSpace(args) != "" {
+		_ = json.Unmarshal([]byte(args), &out)
+	}
+	return out
+}
+
+// toolNamesByID maps tool call IDs to tool names from earlier assistant turns.
+func toolNamesByID(messages []*schema.Message) map[string]string {
+	names := make(map[string]string)
+	for _, m := range messages {
+		for _, tc := range m.ToolCalls {
+			names[tc.ID] = tc.Function.Name
+		}
+	}
+	return names
+}
+
+func usageMeta(prompt, completion int, finishReason string) *schema.ResponseMeta {
+	return &schema.ResponseMeta{
+		FinishReason: finishReason,
+		Usage: &schema.TokenUsage{
+			PromptTokens:     prompt,
+			CompletionTokens: completion,
+			TotalTokens:      prompt + completion,
+		},
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
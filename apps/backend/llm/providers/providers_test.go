@@ -0,0 +1,169 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+// recorded is a request captured by a stand-in server.
+type recorded struct {
+	Path   string
+	Query  string
+	Header http.Header
+	Body   map[string]interface{}
+}
+
+// standIn starts an httptest server that records every request and answers
+// with reply.
+func standIn(t *testing.T, reply func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *[]recorded) {
+	t.Helper()
+	var calls []recorded
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		rec := recorded{Path: r.URL.Path, Query: r.URL.RawQuery, Header: r.Header.Clone()}
+		if err := json.Unmarshal(raw, &rec.Body); err != nil {
+			t.Errorf("request body is not JSON: %v", err)
+		}
+		calls = append(calls, rec)
+		reply(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+// writeJSON answers with a JSON document.
+func writeJSON(body string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, body)
+	}
+}
+
+// writeStream answers with a streaming body, flushing after every chunk.
+func writeStream(contentType string, chunks ...string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		for _, c := range chunks {
+			_, _ = io.WriteString(w, c)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+}
+
+// collect drains a stream and concatenates the chunks into one message.
+func collect(t *testing.T, sr *schema.StreamReader[*schema.Message]) *schema.Message {
+	t.Helper()
+	defer sr.Close()
+	var chunks []*schema.Message
+	for {
+		msg, err := sr.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+		chunks = append(chunks, msg)
+	}
+	if len(chunks) == 0 {
+		t.Fatal("stream returned no chunks")
+	}
+	msg, err := schema.ConcatMessages(chunks)
+	if err != nil {
+		t.Fatalf("concat stream: %v", err)
+	}
+	return msg
+}
+
+// weatherTool is the tool bound in the tool call tests.
+func weatherTool() *schema.ToolInfo {
+	return &schema.ToolInfo{
+		Name: "get_weather",
+		Desc: "Current weather for a city",
+		ParamsOneOf: schema.NewParamsOneOfByParams(map[string]*schema.ParameterInfo{
+			"city": {Type: schema.String, Desc: "City name", Required: true},
+		}),
+	}
+}
+
+// toolTurn is a conversation where the model already called get_weather.
+func toolTurn() []*schema.Message {
+	return []*schema.Message{
+		schema.SystemMessage("You are helpful."),
+		schema.UserMessage("Weather in Jakarta?"),
+		schema.AssistantMessage("", []schema.ToolCall{{
+			ID:       "call_1",
+			Type:     "function",
+			Function: schema.FunctionCall{Name: "get_weather", Arguments: `{"city":"Jakarta"}`},
+		}}),
+		schema.ToolMessage(`{"temp":31}`, "call_1"),
+	}
+}
+
+// argsOf decodes tool call arguments for comparison.
+func argsOf(t *testing.T, tc schema.ToolCall) map[string]interface{} {
+	t.Helper()
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+		t.Fatalf("tool call %s arguments %q: %v", tc.Function.Name, tc.Function.Arguments, err)
+	}
+	return args
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", OpenAICompatible},
+		{"OpenAI", OpenAICompatible},
+		{"claude", Anthropic},
+		{" Google ", Gemini},
+		{"ollama", Ollama},
+		{"mistral", "mistral"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		baseURL  string
+		apiKey   string
+		model    string
+		wantErr  bool
+	}{
+		{"openai-compatible", "openai-compatible", "https://api.example.com/v1", "sk-test", "gpt-4o-mini", false},
+		{"anthropic alias", "claude", "", "sk-ant", "claude-sonnet-4-5", false},
+		{"anthropic behind a gateway", "anthropic", "https://gateway.example.com", "sk-gw", "sonnet-latest", false},
+		{"gemini with models prefix", "gemini", "", "key", "models/gemini-1.5-flash", false},
+		{"gemini tuned model", "gemini", "", "key", "tunedModels/support-bot", false},
+		{"ollama without a key", "ollama", "http://localhost:11434", "", "llama3.1", false},
+		{"unknown provider", "cohere", "", "key", "command-r", true},
+		{"missing model", "openai-compatible", "", "sk-test", " ", true},
+		{"missing key", "anthropic", "", "", "claude-sonnet-4-5", true},
+		{"relative base URL", "openai-compatible", "api.example.com", "sk-test", "gpt-4o-mini", true},
+		{"non-http base URL", "ollama", "ftp://localhost", "", "llama3.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.provider, tt.baseURL, tt.apiKey, tt.model)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
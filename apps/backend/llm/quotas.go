@@ -0,0 +1,568 @@
+package llm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.app/backend/iam"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+// Quota scopes. A system admin sets tenant quotas; a tenant admin can
+// subdivide them per project and per subclient.
+const (
+	quotaScopeTenant    = "tenant"
+	quotaScopeProject   = "project"
+	quotaScopeSubclient = "subclient"
+)
+
+// Quota limits for one scope. Zero means unlimited.
+type Quota struct {
+	ID                string  `json:"id"`
+	TenantID          string  `json:"tenant_id"`
+	ScopeType         string  `json:"scope_type"`
+	ScopeID           string  `json:"scope_id"`
+	DailyTokens       int     `json:"daily_tokens"`
+	MonthlyTokens     int     `json:"monthly_tokens"`
+	RequestsPerMinute int     `json:"requests_per_minute"`
+	SoftLimitPercent  float64 `json:"soft_limit_percent"`
+	// Current usage, filled by ListQuotas
+	UsedDailyTokens   int    `json:"used_daily_tokens"`
+	UsedMonthlyTokens int    `json:"used_monthly_tokens"`
+	UsedLastMinute    int    `json:"used_last_minute"`
+	CreatedAt         string `json:"created_at"`
+	UpdatedAt         string `json:"updated_at"`
+}
+
+type ListQuotasParams struct {
+	TenantID string `json:"tenant_id"`
+}
+
+type ListQuotasResponse struct {
+	Items []*Quota `json:"items"`
+}
+
+type UpsertQuotaParams struct {
+	ScopeType         string  `json:"scope_type"`
+	ScopeID           string  `json:"scope_id"`
+	DailyTokens       int     `json:"daily_tokens"`
+	MonthlyTokens     int     `json:"monthly_tokens"`
+	RequestsPerMinute int     `json:"requests_per_minute"`
+	SoftLimitPercent  float64 `json:"soft_limit_percent"`
+}
+
+// QuotaExceededDetails is attached to ResourceExhausted errors.
+type QuotaExceededDetails struct {
+	ScopeType string `json:"scope_type"`
+	ScopeID   string `json:"scope_id"`
+	Limit     string `json:"limit"` // daily_tokens, monthly_tokens or requests_per_minute
+	Max       int    `json:"max"`
+	Used      int    `json:"used"`
+	ResetAt   string `json:"reset_at"`
+}
+
+func (QuotaExceededDetails) ErrDetails() {}
+
+// quotaUsage is the usage of one scope over the quota windows.
+type quotaUsage struct {
+	dailyTokens   int
+	monthlyTokens int
+	lastMinute    int
+}
+
+// quotaWindows returns the start of the current UTC day and month and one minute ago.
+func quotaWindows(now time.Time) (day, month, minute time.Time) {
+	now = now.UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	minute = now.Add(-time.Minute)
+	return day, month, minute
+}
+
+// quotaUsageColumn maps a scope to the llm_usage column it is measured on.
+func quotaUsageColumn(scopeType string) string {
+	switch scopeType {
+	case quotaScopeProject:
+		return "project_id"
+	case quotaScopeSubclient:
+		return "subclient_id"
+	default:
+		return "tenant_id"
+	}
+}
+
+// loadQuotaUsage returns the tokens used by a scope today and this month,
+// and the requests admitted for it in the last minute.
+func loadQuotaUsage(ctx context.Context, db *sql.DB, scopeType, scopeID string) (*quotaUsage, error) {
+	now := time.Now()
+	day, month, _ := quotaWindows(now)
+
+	u := &quotaUsage{lastMinute: admittedRequests.count(scopeType+":"+scopeID, now)}
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			COALESCE(SUM(CASE WHEN created_at >= ? THEN total_tokens ELSE 0 END), 0),
+			COALESCE(SUM(total_tokens), 0)
+		FROM llm_usage
+		WHERE `+quotaUsageColumn(scopeType)+` = ? AND created_at >= ?
+	`, day.Format(time.RFC3339), scopeID, month.Format(time.RFC3339)).Scan(&u.dailyTokens, &u.monthlyTokens)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// requestWindow counts the requests admitted per quota scope over the last
+// minute. Usage rows are written when a call finishes, so they lag behind a
+// burst of concurrent requests; requests per minute are counted here instead,
+// as each request is admitted.
+type requestWindow struct {
+	mu        sync.Mutex
+	admitted  map[string][]time.Time
+	lastSweep time.Time
+}
+
+var admittedRequests = newRequestWindow()
+
+func newRequestWindow() *requestWindow {
+	return &requestWindow{admitted: map[string][]time.Time{}}
+}
+
+// count returns the requests admitted for key in the minute before now.
+func (w *requestWindow) count(key string, now time.Time) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.prune(key, now))
+}
+
+// admit records a request for each key at now and returns how many were
+// admitted for each in the minute before.
+func (w *requestWindow) admit(keys []string, now time.Time) []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now.Sub(w.lastSweep) > time.Minute {
+		for key := range w.admitted {
+			w.prune(key, now)
+		}
+		w.lastSweep = now
+	}
+	counts := make([]int, len(keys))
+	for i, key := range keys {
+		counts[i] = len(w.prune(key, now))
+		w.admitted[key] = append(w.admitted[key], now)
+	}
+	return counts
+}
+
+// release takes back requests admitted at now that were then refused.
+func (w *requestWindow) release(keys []string, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		times := w.admitted[key]
+		for i := len(times) - 1; i >= 0; i-- {
+			if times[i].Equal(now) {
+				w.admitted[key] = append(times[:i], times[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// prune drops the requests of key older than a minute. Callers hold w.mu.
+func (w *requestWindow) prune(key string, now time.Time) []time.Time {
+	_, _, minute := quotaWindows(now)
+	times := w.admitted[key][:0]
+	for _, t := range w.admitted[key] {
+		if t.After(minute) {
+			times = append(times, t)
+		}
+	}
+	if len(times) == 0 {
+		delete(w.admitted, key)
+		return nil
+	}
+	w.admitted[key] = times
+	return times
+}
+
+func scanQuota(row interface{ Scan(...any) error }) (*Quota, error) {
+	q := &Quota{}
+	if err := row.Scan(
+		&q.ID,
+		&q.TenantID,
+		&q.ScopeType,
+		&q.ScopeID,
+		&q.DailyTokens,
+		&q.MonthlyTokens,
+		&q.RequestsPerMinute,
+		&q.SoftLimitPercent,
+		&q.CreatedAt,
+		&q.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+const quotaColumns = `id, tenant_id, scope_type, scope_id, daily_tokens, monthly_tokens, requests_per_minute, soft_limit_percent, created_at, updated_at`
+
+func getQuota(ctx context.Context, db *sql.DB, scopeType, scopeID string) (*Quota, error) {
+	q, err := scanQuota(db.QueryRowContext(ctx, `
+		SELECT `+quotaColumns+`
+		FROM llm_quotas
+		WHERE scope_type = ? AND scope_id = ?
+	`, scopeType, scopeID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return q, err
+}
+
+// checkQuotas enforces the tenant, project and subclient quotas before a model
+// call and admits the request against the requests-per-minute limits. A hard
+// limit returns errs.ResourceExhausted with the reset time; soft limits are
+// returned as warnings.
+func checkQuotas(ctx context.Context, tenantID, projectID, subclientID string) ([]string, error) {
+	if tenantID == "" && projectID == "" && subclientID == "" {
+		return nil, nil
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var scopes []struct{ typ, id string }
+	var keys []string
+	for _, sc := range []struct{ typ, id string }{
+		{quotaScopeTenant, tenantID},
+		{quotaScopeProject, projectID},
+		{quotaScopeSubclient, subclientID},
+	} {
+		if sc.id == "" {
+			continue
+		}
+		scopes = append(scopes, sc)
+		keys = append(keys, sc.typ+":"+sc.id)
+	}
+
+	now := time.Now()
+	admitted := admittedRequests.admit(keys, now)
+	warnings, err := evaluateQuotas(ctx, db, scopes, admitted, now)
+	if err != nil {
+		admittedRequests.release(keys, now)
+		return nil, err
+	}
+	return warnings, nil
+}
+
+// evaluateQuotas checks each scope's quota given the requests admitted for it
+// in the last minute.
+func evaluateQuotas(ctx context.Context, db *sql.DB, scopes []struct{ typ, id string }, admitted []int, now time.Time) ([]string, error) {
+	var warnings []string
+	for i, sc := range scopes {
+		q, err := getQuota(ctx, db, sc.typ, sc.id)
+		if err != nil {
+			return nil, err
+		}
+		if q == nil {
+			continue
+		}
+		usage, err := loadQuotaUsage(ctx, db, sc.typ, sc.id)
+		if err != nil {
+			return nil, err
+		}
+		usage.lastMinute = admitted[i]
+		scopeWarnings, err := evaluateQuota(sc.typ, sc.id, q, usage, now)
+		if err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, scopeWarnings...)
+	}
+	return warnings, nil
+}
+
+// evaluateQuota compares one scope's usage with its quota at now. A hard
+// limit returns errs.ResourceExhausted with the window's reset time; soft
+// limits are returned as warnings.
+func evaluateQuota(scopeType, scopeID string, q *Quota, usage *quotaUsage, now time.Time) ([]string, error) {
+	day, month, _ := quotaWindows(now)
+	limits := []struct {
+		name    string
+		max     int
+		used    int
+		resetAt time.Time
+	}{
+		{"requests_per_minute", q.RequestsPerMinute, usage.lastMinute, now.UTC().Add(time.Minute).Truncate(time.Second)},
+		{"daily_tokens", q.DailyTokens, usage.dailyTokens, day.AddDate(0, 0, 1)},
+		{"monthly_tokens", q.MonthlyTokens, usage.monthlyTokens, month.AddDate(0, 1, 0)},
+	}
+	var warnings []string
+	for _, l := range limits {
+		if l.max <= 0 {
+			continue
+		}
+		if l.used >= l.max {
+			fmt.Printf("[LLM] Quota exceeded: %s %s %s used=%d max=%d\n", scopeType, scopeID, l.name, l.used, l.max)
+			return nil, &errs.Error{
+				Code:    errs.ResourceExhausted,
+				Message: fmt.Sprintf("%s quota exceeded (%s), resets at %s", scopeType, l.name, l.resetAt.Format(time.RFC3339)),
+				Details: QuotaExceededDetails{
+					ScopeType: scopeType,
+					ScopeID:   scopeID,
+					Limit:     l.name,
+					Max:       l.max,
+					Used:      l.used,
+					ResetAt:   l.resetAt.Format(time.RFC3339),
+				},
+			}
+		}
+		if q.SoftLimitPercent > 0 && float64(l.used) >= float64(l.max)*q.SoftLimitPercent/100 {
+			warning := fmt.Sprintf("%s %s quota at %d%% (%d of %d)", scopeType, l.name, l.used*100/l.max, l.used, l.max)
+			fmt.Printf("[LLM] Quota warning: %s %s\n", scopeID, warning)
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings, nil
+}
+
+// quotaAdmin returns the caller if they may manage quotas of the tenant:
+// system admins for any tenant, tenant admins only for their own.
+func quotaAdmin(tenantID string) (*iam.AuthData, error) {
+	data, ok := auth.Data().(*iam.AuthData)
+	if !ok || data == nil {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	if !canManageQuotas(data, tenantID) {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "admin role required"}
+	}
+	return data, nil
+}
+
+// canManageQuotas reports whether data is a system admin, or an admin signed
+// in to the tenant itself. Admins in a subclient session don't
+// manage tenant settings.
+func canManageQuotas(data *iam.AuthData, tenantID string) bool {
+	if string(data.Role) == "system" {
+		return true
+	}
+	return string(data.Role) == "admin" && string(data.ScopeType) == "tenant" &&
+		data.TenantID != "" && data.TenantID == tenantID
+}
+
+// quotaScopeTenantID resolves the tenant that owns a quota scope.
+func quotaScopeTenantID(ctx context.Context, db *sql.DB, scopeType, scopeID string) (tenantID string, projectID string, err error) {
+	switch scopeType {
+	case quotaScopeTenant:
+		err = db.QueryRowContext(ctx, `SELECT id FROM tenants WHERE id = ?`, scopeID).Scan(&tenantID)
+	case quotaScopeProject:
+		err = db.QueryRowContext(ctx, `SELECT tenant_id, id FROM projects WHERE id = ?`, scopeID).Scan(&tenantID, &projectID)
+	case quotaScopeSubclient:
+		err = db.QueryRowContext(ctx, `
+			SELECT p.tenant_id, p.id
+			FROM subclients s
+			JOIN projects p ON p.id = s.project_id
+			WHERE s.id = ?
+		`, scopeID).Scan(&tenantID, &projectID)
+	default:
+		return "", "", badRequest("scope_type must be tenant, project or subclient")
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", &errs.Error{Code: errs.NotFound, Message: scopeType + " not found"}
+	}
+	return tenantID, projectID, err
+}
+
+// exceedsParent reports the first limit where child is larger than a set parent limit.
+func exceedsParent(child *UpsertQuotaParams, parent *Quota) string {
+	if parent == nil {
+		return ""
+	}
+	check := []struct {
+		name          string
+		child, parent int
+	}{
+		{"daily_tokens", child.DailyTokens, parent.DailyTokens},
+		{"monthly_tokens", child.MonthlyTokens, parent.MonthlyTokens},
+		{"requests_per_minute", child.RequestsPerMinute, parent.RequestsPerMinute},
+	}
+	for _, c := range check {
+		if c.parent > 0 && (c.child == 0 || c.child > c.parent) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// ListQuotas lists the quotas of a tenant with current usage.
+//
+//encore:api auth method=GET path=/llm/quotas
+func (s *Service) ListQuotas(ctx context.Context, p *ListQuotasParams) (*ListQuotasResponse, error) {
+	if p == nil || strings.TrimSpace(p.TenantID) == "" {
+		return nil, badRequest("tenant_id is required")
+	}
+	tenantID := strings.TrimSpace(p.TenantID)
+	if _, err := quotaAdmin(tenantID); err != nil {
+		return nil, err
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+quotaColumns+`
+		FROM llm_quotas
+		WHERE tenant_id = ?
+		ORDER BY CASE scope_type WHEN 'tenant' THEN 0 WHEN 'project' THEN 1 ELSE 2 END, created_at ASC
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]*Quota, 0)
+	for rows.Next() {
+		q, err := scanQuota(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, q)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	for _, q := range items {
+		usage, err := loadQuotaUsage(ctx, db, q.ScopeType, q.ScopeID)
+		if err != nil {
+			return nil, err
+		}
+		q.UsedDailyTokens = usage.dailyTokens
+		q.UsedMonthlyTokens = usage.monthlyTokens
+		q.UsedLastMinute = usage.lastMinute
+	}
+
+	return &ListQuotasResponse{Items: items}, nil
+}
+
+// UpsertQuota creates or updates a quota. Tenant quotas need the system role;
+// project and subclient quotas can be set by the tenant admin and may not
+// exceed the tenant (or project) quota they are carved from.
+//
+//encore:api auth method=PUT path=/llm/quotas
+func (s *Service) UpsertQuota(ctx context.Context, p *UpsertQuotaParams) (*Quota, error) {
+	if p == nil {
+		return nil, badRequest("request body is required")
+	}
+	p.ScopeType = strings.TrimSpace(strings.ToLower(p.ScopeType))
+	p.ScopeID = strings.TrimSpace(p.ScopeID)
+	if p.ScopeID == "" {
+		return nil, badRequest("scope_id is required")
+	}
+	if p.DailyTokens < 0 || p.MonthlyTokens < 0 || p.RequestsPerMinute < 0 {
+		return nil, badRequest("limits must be zero (unlimited) or positive")
+	}
+	if p.SoftLimitPercent < 0 || p.SoftLimitPercent > 100 {
+		return nil, badRequest("soft_limit_percent must be between 0 and 100")
+	}
+	if p.SoftLimitPercent == 0 {
+		p.SoftLimitPercent = 80
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	tenantID, projectID, err := quotaScopeTenantID(ctx, db, p.ScopeType, p.ScopeID)
+	if err != nil {
+		return nil, err
+	}
+	if p.ScopeType == quotaScopeTenant {
+		if err := requireSystemRole(); err != nil {
+			return nil, err
+		}
+	} else if _, err := quotaAdmin(tenantID); err != nil {
+		return nil, err
+	}
+
+	// Subdivisions must fit inside their parent quotas
+	if p.ScopeType != quotaScopeTenant {
+		parent, err := getQuota(ctx, db, quotaScopeTenant, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		if limit := exceedsParent(p, parent); limit != "" {
+			return nil, badRequest(fmt.Sprintf("%s exceeds the tenant quota", limit))
+		}
+	}
+	if p.ScopeType == quotaScopeSubclient {
+		parent, err := getQuota(ctx, db, quotaScopeProject, projectID)
+		if err != nil {
+			return nil, err
+		}
+		if limit := exceedsParent(p, parent); limit != "" {
+			return nil, badRequest(fmt.Sprintf("%s exceeds the project quota", limit))
+		}
+	}
+
+	now := nowRFC3339()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO llm_quotas
+		(id, tenant_id, scope_type, scope_id, daily_tokens, monthly_tokens, requests_per_minute, soft_limit_percent, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(scope_type, scope_id) DO UPDATE SET
+			daily_tokens = excluded.daily_tokens,
+			monthly_tokens = excluded.monthly_tokens,
+			requests_per_minute = excluded.requests_per_minute,
+			soft_limit_percent = excluded.soft_limit_percent,
+			updated_at = excluded.updated_at
+	`, "lqt_"+randomHex(10), tenantID, p.ScopeType, p.ScopeID, p.DailyTokens, p.MonthlyTokens, p.RequestsPerMinute, p.SoftLimitPercent, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return getQuota(ctx, db, p.ScopeType, p.ScopeID)
+}
+
+// DeleteQuota removes a quota, making the scope unlimited again.
+//
+//encore:api auth method=DELETE path=/llm/quotas/:id
+func (s *Service) DeleteQuota(ctx context.Context, id string) error {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return badRequest("id is required")
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+
+	var tenantID, scopeType string
+	err = db.QueryRowContext(ctx, `SELECT tenant_id, scope_type FROM llm_quotas WHERE id = ?`, id).Scan(&tenantID, &scopeType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &errs.Error{Code: errs.NotFound, Message: "quota not found"}
+	}
+	if err != nil {
+		return err
+	}
+	if scopeType == quotaScopeTenant {
+		if err := requireSystemRole(); err != nil {
+			return err
+		}
+	} else if _, err := quotaAdmin(tenantID); err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `DELETE FROM llm_quotas WHERE id = ?`, id)
+	return err
+}
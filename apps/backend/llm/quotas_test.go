@@ -0,0 +1,238 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"encore.app/backend/iam"
+	"encore.dev/beta/errs"
+)
+
+func TestQuotaWindows(t *testing.T) {
+	tests := []struct {
+		name       string
+		now        time.Time
+		wantDay    time.Time
+		wantMonth  time.Time
+		wantMinute time.Time
+	}{
+		{
+			name:       "mid month",
+			now:        time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC),
+			wantDay:    time.Date(2026, 3, 14, 0, 0, 0, 0, time.UTC),
+			wantMonth:  time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+			wantMinute: time.Date(2026, 3, 14, 15, 8, 26, 0, time.UTC),
+		},
+		{
+			name:       "first minute of the month",
+			now:        time.Date(2026, 4, 1, 0, 0, 30, 0, time.UTC),
+			wantDay:    time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC),
+			wantMonth:  time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC),
+			wantMinute: time.Date(2026, 3, 31, 23, 59, 30, 0, time.UTC),
+		},
+		{
+			// Windows are UTC even when the clock is not
+			name:       "local time zone",
+			now:        time.Date(2026, 1, 1, 5, 0, 0, 0, time.FixedZone("WIB", 7*3600)),
+			wantDay:    time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC),
+			wantMonth:  time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC),
+			wantMinute: time.Date(2025, 12, 31, 21, 59, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			day, month, minute := quotaWindows(tt.now)
+			if !day.Equal(tt.wantDay) || !month.Equal(tt.wantMonth) || !minute.Equal(tt.wantMinute) {
+				t.Errorf("quotaWindows(%v) = %v, %v, %v; want %v, %v, %v", tt.now, day, month, minute, tt.wantDay, tt.wantMonth, tt.wantMinute)
+			}
+		})
+	}
+}
+
+func TestEvaluateQuota(t *testing.T) {
+	now := time.Date(2026, 2, 28, 22, 30, 15, 500, time.UTC)
+	quota := &Quota{DailyTokens: 1000, MonthlyTokens: 10000, RequestsPerMinute: 10, SoftLimitPercent: 80}
+
+	tests := []struct {
+		name         string
+		quota        *Quota
+		usage        quotaUsage
+		wantLimit    string // exceeded limit, "" when allowed
+		wantResetAt  string
+		wantWarnings int
+	}{
+		{
+			name:  "under every limit",
+			quota: quota,
+			usage: quotaUsage{dailyTokens: 100, monthlyTokens: 1000, lastMinute: 1},
+		},
+		{
+			name:         "soft daily limit",
+			quota:        quota,
+			usage:        quotaUsage{dailyTokens: 800, monthlyTokens: 1000},
+			wantWarnings: 1,
+		},
+		{
+			name:         "soft daily and monthly limits",
+			quota:        quota,
+			usage:        quotaUsage{dailyTokens: 900, monthlyTokens: 9000},
+			wantWarnings: 2,
+		},
+		{
+			name:        "requests per minute reset a minute later",
+			quota:       quota,
+			usage:       quotaUsage{lastMinute: 10},
+			wantLimit:   "requests_per_minute",
+			wantResetAt: "2026-02-28T22:31:15Z",
+		},
+		{
+			name:        "daily tokens reset at next UTC midnight",
+			quota:       quota,
+			usage:       quotaUsage{dailyTokens: 1000, monthlyTokens: 1000},
+			wantLimit:   "daily_tokens",
+			wantResetAt: "2026-03-01T00:00:00Z",
+		},
+		{
+			name:        "monthly tokens reset on the first of next month",
+			quota:       quota,
+			usage:       quotaUsage{dailyTokens: 10, monthlyTokens: 12000},
+			wantLimit:   "monthly_tokens",
+			wantResetAt: "2026-03-01T00:00:00Z",
+		},
+		{
+			name:  "zero limits are unlimited",
+			quota: &Quota{SoftLimitPercent: 80},
+			usage: quotaUsage{dailyTokens: 1 << 30, monthlyTokens: 1 << 30, lastMinute: 1000},
+		},
+		{
+			name:  "no soft limit",
+			quota: &Quota{DailyTokens: 1000},
+			usage: quotaUsage{dailyTokens: 999},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := tt.usage
+			warnings, err := evaluateQuota(quotaScopeTenant, "t1", tt.quota, &usage, now)
+			if tt.wantLimit == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(warnings) != tt.wantWarnings {
+					t.Errorf("warnings = %q, want %d", warnings, tt.wantWarnings)
+				}
+				return
+			}
+
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != errs.ResourceExhausted {
+				t.Fatalf("err = %v, want ResourceExhausted", err)
+			}
+			details, ok := e.Details.(QuotaExceededDetails)
+			if !ok {
+				t.Fatalf("details = %#v", e.Details)
+			}
+			if details.Limit != tt.wantLimit || details.ResetAt != tt.wantResetAt {
+				t.Errorf("exceeded %s resetting %s, want %s resetting %s", details.Limit, details.ResetAt, tt.wantLimit, tt.wantResetAt)
+			}
+			if details.ScopeType != quotaScopeTenant || details.ScopeID != "t1" {
+				t.Errorf("scope = %s %s", details.ScopeType, details.ScopeID)
+			}
+		})
+	}
+}
+
+func TestCanManageQuotas(t *testing.T) {
+	tests := []struct {
+		name string
+		data iam.AuthData
+		want bool
+	}{
+		{"system admin", iam.AuthData{Role: "system"}, true},
+		{"tenant admin", iam.AuthData{Role: "admin", ScopeType: "tenant", TenantID: "t1"}, true},
+		{"admin of another tenant", iam.AuthData{Role: "admin", ScopeType: "tenant", TenantID: "t2"}, false},
+		{"admin in a subclient session", iam.AuthData{Role: "admin", ScopeType: "subclient", TenantID: "t1"}, false},
+		{"admin in a system session", iam.AuthData{Role: "admin", ScopeType: "system", TenantID: "t1"}, false},
+		{"tenant user", iam.AuthData{Role: "user", ScopeType: "tenant", TenantID: "t1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canManageQuotas(&tt.data, "t1"); got != tt.want {
+				t.Errorf("canManageQuotas = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestWindow(t *testing.T) {
+	w := newRequestWindow()
+	start := time.Date(2026, 3, 14, 15, 9, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		got := w.admit([]string{"tenant:t1", "project:p1"}, start.Add(time.Duration(i)*time.Second))
+		if got[0] != i || got[1] != i {
+			t.Fatalf("admit %d = %v, want [%d %d]", i, got, i, i)
+		}
+	}
+	if got := w.count("tenant:t1", start.Add(3*time.Second)); got != 3 {
+		t.Errorf("count = %d, want 3", got)
+	}
+
+	w.release([]string{"tenant:t1"}, start.Add(2*time.Second))
+	if got := w.count("tenant:t1", start.Add(3*time.Second)); got != 2 {
+		t.Errorf("count after release = %d, want 2", got)
+	}
+	if got := w.count("project:p1", start.Add(3*time.Second)); got != 3 {
+		t.Errorf("release touched another scope: count = %d, want 3", got)
+	}
+
+	// A minute later the first request has left the window
+	if got := w.count("project:p1", start.Add(time.Minute)); got != 2 {
+		t.Errorf("count a minute later = %d, want 2", got)
+	}
+	w.admit([]string{"subclient:s1"}, start.Add(5*time.Minute))
+	if _, ok := w.admitted["tenant:t1"]; ok {
+		t.Error("expired scopes are not swept")
+	}
+}
+
+func TestCheckQuotasRequestsPerMinute(t *testing.T) {
+	tenantID, projectID := testProject(t)
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := nowRFC3339()
+	if _, err := db.Exec(`
+		INSERT INTO llm_quotas (id, tenant_id, scope_type, scope_id, requests_per_minute, created_at, updated_at)
+		VALUES (?, ?, ?, ?, 2, ?, ?)
+	`, "lqt_"+randomHex(10), tenantID, quotaScopeProject, projectID, now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := checkQuotas(ctx, tenantID, projectID, ""); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+	}
+	_, err = checkQuotas(ctx, tenantID, projectID, "")
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Code != errs.ResourceExhausted {
+		t.Fatalf("third request: err = %v, want ResourceExhausted", err)
+	}
+
+	// Refused requests don't count against the window
+	if got := admittedRequests.count(quotaScopeProject+":"+projectID, time.Now()); got != 2 {
+		t.Errorf("admitted = %d, want 2", got)
+	}
+	usage, err := loadQuotaUsage(ctx, db, quotaScopeProject, projectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.lastMinute != 2 {
+		t.Errorf("lastMinute = %d, want 2", usage.lastMinute)
+	}
+}
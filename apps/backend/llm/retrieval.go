@@ -0,0 +1,724 @@
+package llm
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cloudwego/eino/components/embedding"
+)
+
+// Retrieval over project files. Files are split into overlapping chunks,
+// stored in file_chunks, and embedded with the tenant's embedding endpoint
+// into one vector store collection per project and embedding model.
+// When retrieval is enabled for a project, Generate embeds the prompt and
+// adds the closest chunks to the system prompt with numbered citations.
+//
+// Indexing runs in the background: new files are picked up on the next
+// question, deleted files are dropped from results right away and from the
+// index on the next sync.
+
+const (
+	defaultRetrievalTopK     = 4
+	maxRetrievalTopK         = 20
+	defaultRetrievalMinScore = 0.3
+	// maxRetrievalTokens caps retrieved context; it also never takes more
+	// than a quarter of the model's context window.
+	maxRetrievalTokens = 3000
+
+	chunkSize        = 1500
+	chunkOverlap     = 200
+	maxChunksPerFile = 400
+	maxIndexFileSize = 20 << 20
+	embedBatchSize   = 32
+	indexTimeout     = 10 * time.Minute
+	excerptLength    = 200
+)
+
+// Index states of a project file.
+const (
+	fileIndexPending = "pending"
+	fileIndexIndexed = "indexed"
+	fileIndexFailed  = "failed"
+	fileIndexSkipped = "skipped"
+)
+
+type RetrievalSettings struct {
+	ProjectID string  `json:"project_id"`
+	Enabled   bool    `json:"enabled"`
+	TopK      int     `json:"top_k"`
+	MinScore  float64 `json:"min_score"`
+	UpdatedAt string  `json:"updated_at,omitempty"`
+}
+
+type UpdateRetrievalSettingsParams struct {
+	Enabled bool `json:"enabled"`
+	// TopK is the number of chunks added to the prompt; 0 uses the default.
+	TopK int `json:"top_k"`
+	// MinScore is the lowest cosine similarity a chunk needs; nil uses the default.
+	MinScore *float64 `json:"min_score"`
+}
+
+// RetrievedSource is a chunk of a project file given to the model. The
+// model cites it as [Index].
+type RetrievedSource struct {
+	Index      int     `json:"index"`
+	FileID     string  `json:"file_id"`
+	FileName   string  `json:"file_name"`
+	ChunkIndex int     `json:"chunk_index"`
+	Score      float64 `json:"score"`
+	Excerpt    string  `json:"excerpt"`
+	content    string
+}
+
+type IndexedFile struct {
+	FileID     string `json:"file_id"`
+	FileName   string `json:"file_name"`
+	Status     string `json:"status"`
+	ChunkCount int    `json:"chunk_count"`
+	Error      string `json:"error,omitempty"`
+	Model      string `json:"model,omitempty"`
+	IndexedAt  string `json:"indexed_at,omitempty"`
+}
+
+type ProjectFileIndexResponse struct {
+	Items []IndexedFile `json:"items"`
+	// Indexing is set while a sync of the project is running
+	Indexing bool `json:"indexing"`
+}
+
+type ReindexResponse struct {
+	// Started is false when the project is already being indexed
+	Started bool `json:"started"`
+}
+
+// loadRetrievalSettings returns the project's settings, or the defaults
+// with retrieval disabled.
+func loadRetrievalSettings(ctx context.Context, db *sql.DB, tenantID, projectID string) (*RetrievalSettings, error) {
+	rs := &RetrievalSettings{ProjectID: projectID}
+	var enabled int
+	err := db.QueryRowContext(ctx, `
+		SELECT enabled, top_k, min_score, updated_at
+		FROM project_retrieval_settings
+		WHERE project_id = ? AND tenant_id = ?
+	`, projectID, tenantID).Scan(&enabled, &rs.TopK, &rs.MinScore, &rs.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		rs.TopK, rs.MinScore = defaultRetrievalTopK, defaultRetrievalMinScore
+		return rs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rs.Enabled = enabled == 1
+	return rs, nil
+}
+
+// GetRetrievalSettings returns whether a project answers from its files.
+//
+//encore:api auth method=GET path=/llm/projects/:projectID/retrieval-settings
+func (s *Service) GetRetrievalSettings(ctx context.Context, projectID string) (*RetrievalSettings, error) {
+	projectID = strings.TrimSpace(projectID)
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	tenantID, _, err := quotaScopeTenantID(ctx, db, quotaScopeProject, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := quotaAdmin(tenantID); err != nil {
+		return nil, err
+	}
+	return loadRetrievalSettings(ctx, db, tenantID, projectID)
+}
+
+// UpdateRetrievalSettings turns retrieval over project files on or off.
+// Turning it on starts indexing the project's files in the background.
+//
+//encore:api auth method=PUT path=/llm/projects/:projectID/retrieval-settings
+func (s *Service) UpdateRetrievalSettings(ctx context.Context, projectID string, p *UpdateRetrievalSettingsParams) (*RetrievalSettings, error) {
+	if p == nil {
+		return nil, badRequest("request body is required")
+	}
+	projectID = strings.TrimSpace(projectID)
+	topK := p.TopK
+	if topK == 0 {
+		topK = defaultRetrievalTopK
+	}
+	if topK < 1 || topK > maxRetrievalTopK {
+		return nil, badRequest(fmt.Sprintf("top_k must be between 1 and %d", maxRetrievalTopK))
+	}
+	minScore := defaultRetrievalMinScore
+	if p.MinScore != nil {
+		minScore = *p.MinScore
+	}
+	if minScore < 0 || minScore > 1 {
+		return nil, badRequest("min_score must be between 0 and 1")
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	tenantID, _, err := quotaScopeTenantID(ctx, db, quotaScopeProject, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := quotaAdmin(tenantID); err != nil {
+		return nil, err
+	}
+
+	enabled := 0
+	if p.Enabled {
+		enabled = 1
+	}
+	now := nowRFC3339()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO project_retrieval_settings (project_id, tenant_id, enabled, top_k, min_score, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(project_id) DO UPDATE SET
+			enabled = excluded.enabled,
+			top_k = excluded.top_k,
+			min_score = excluded.min_score,
+			updated_at = excluded.updated_at
+	`, projectID, tenantID, enabled, topK, minScore, now, now)
+	if err != nil {
+		return nil, err
+	}
+	if p.Enabled {
+		s.syncProjectIndexAsync(tenantID, projectID, false)
+	}
+	return loadRetrievalSettings(ctx, db, tenantID, projectID)
+}
+
+// GetProjectFileIndex lists the project's files with their index state.
+//
+//encore:api auth method=GET path=/llm/projects/:projectID/file-index
+func (s *Service) GetProjectFileIndex(ctx context.Context, projectID string) (*ProjectFileIndexResponse, error) {
+	projectID = strings.TrimSpace(projectID)
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	tenantID, _, err := quotaScopeTenantID(ctx, db, quotaScopeProject, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := quotaAdmin(tenantID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.id, f.name, COALESCE(i.status, ?), COALESCE(i.chunk_count, 0), COALESCE(i.error, ''),
+			COALESCE(i.model, ''), COALESCE(i.indexed_at, '')
+		FROM project_files f
+		LEFT JOIN project_file_index i ON i.file_id = f.id
+		WHERE f.project_id = ?
+		ORDER BY f.uploaded_at DESC
+	`, fileIndexPending, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := &ProjectFileIndexResponse{Items: []IndexedFile{}}
+	for rows.Next() {
+		var f IndexedFile
+		if err := rows.Scan(&f.FileID, &f.FileName, &f.Status, &f.ChunkCount, &f.Error, &f.Model, &f.IndexedAt); err != nil {
+			return nil, err
+		}
+		out.Items = append(out.Items, f)
+	}
+	_, out.Indexing = s.indexing.Load(projectID)
+	return out, rows.Err()
+}
+
+// ReindexProject indexes all of the project's files again, in the
+// background. Use it after changing the embedding model or to retry
+// files that failed.
+//
+//encore:api auth method=POST path=/llm/projects/:projectID/reindex
+func (s *Service) ReindexProject(ctx context.Context, projectID string) (*ReindexResponse, error) {
+	projectID = strings.TrimSpace(projectID)
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	tenantID, _, err := quotaScopeTenantID(ctx, db, quotaScopeProject, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := quotaAdmin(tenantID); err != nil {
+		return nil, err
+	}
+	return &ReindexResponse{Started: s.syncProjectIndexAsync(tenantID, projectID, true)}, nil
+}
+
+// syncProjectIndexAsync syncs the project's index in the background unless
+// a sync of the project is already running. It reports whether it started.
+func (s *Service) syncProjectIndexAsync(tenantID, projectID string, force bool) bool {
+	if _, running := s.indexing.LoadOrStore(projectID, true); running {
+		return false
+	}
+	go func() {
+		defer s.indexing.Delete(projectID)
+		ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+		defer cancel()
+		if err := s.syncProjectIndex(ctx, tenantID, projectID, force); err != nil {
+			fmt.Printf("[WARN] Indexing files of project %s failed: %v\n", projectID, err)
+		}
+	}()
+	return true
+}
+
+type projectFile struct {
+	id       string
+	name     string
+	mimeType string
+	size     int64
+}
+
+// syncProjectIndex drops deleted files from the index and indexes files
+// that are new or were indexed with another embedding model. With force
+// every file is indexed again.
+func (s *Service) syncProjectIndex(ctx context.Context, tenantID, projectID string, force bool) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	if err := s.deleteChunks(ctx, db, `project_id = ? AND file_id NOT IN (SELECT id FROM project_files WHERE project_id = ?)`, projectID, projectID); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM project_file_index
+		WHERE project_id = ? AND file_id NOT IN (SELECT id FROM project_files WHERE project_id = ?)
+	`, projectID, projectID); err != nil {
+		return err
+	}
+
+	embeddingModelName := embeddingModel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.id, f.name, f.type, f.size
+		FROM project_files f
+		LEFT JOIN project_file_index i ON i.file_id = f.id AND i.model = ?
+		WHERE f.project_id = ? AND (? OR i.file_id IS NULL)
+		ORDER BY f.uploaded_at
+	`, embeddingModelName, projectID, force)
+	if err != nil {
+		return err
+	}
+	var files []projectFile
+	for rows.Next() {
+		var f projectFile
+		if err := rows.Scan(&f.id, &f.name, &f.mimeType, &f.size); err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	embedder, err := s.embedderForTenant(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		status, chunks, indexErr := s.indexProjectFile(ctx, db, embedder, embeddingModelName, tenantID, projectID, f)
+		errMsg := ""
+		if indexErr != nil {
+			errMsg = indexErr.Error()
+			fmt.Printf("[LLM] Index: %s %s: %v\n", f.name, status, indexErr)
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO project_file_index (file_id, tenant_id, project_id, file_name, status, chunk_count, error, model, indexed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(file_id) DO UPDATE SET
+				file_name = excluded.file_name,
+				status = excluded.status,
+				chunk_count = excluded.chunk_count,
+				error = excluded.error,
+				model = excluded.model,
+				indexed_at = excluded.indexed_at
+		`, f.id, tenantID, projectID, f.name, status, chunks, errMsg, embeddingModelName, nowRFC3339()); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	fmt.Printf("[LLM] Index: synced %d files of project %s\n", len(files), projectID)
+	return nil
+}
+
+// indexProjectFile extracts, chunks and embeds one file and replaces its
+// chunks. It returns the file's index status and chunk count.
+func (s *Service) indexProjectFile(ctx context.Context, db *sql.DB, embedder embedding.Embedder, modelName, tenantID, projectID string, f projectFile) (string, int, error) {
+	if documentKind(f.name, f.mimeType) == "" {
+		return fileIndexSkipped, 0, errUnsupportedDocument
+	}
+	if f.size > maxIndexFileSize {
+		return fileIndexSkipped, 0, fmt.Errorf("file is larger than %d MB", maxIndexFileSize>>20)
+	}
+	data, err := loadProjectFileData(ctx, db, projectID, f)
+	if err != nil {
+		return fileIndexFailed, 0, err
+	}
+	text, err := extractText(f.name, f.mimeType, data)
+	if err != nil {
+		return fileIndexSkipped, 0, err
+	}
+	chunks := chunkText(text, chunkSize, chunkOverlap)
+	if len(chunks) == 0 {
+		return fileIndexSkipped, 0, errors.New("no text found")
+	}
+	if len(chunks) > maxChunksPerFile {
+		chunks = chunks[:maxChunksPerFile]
+	}
+
+	vectors := make([][]float64, 0, len(chunks))
+	for start := 0; start < len(chunks); start += embedBatchSize {
+		end := min(start+embedBatchSize, len(chunks))
+		batch, err := embedder.EmbedStrings(ctx, chunks[start:end])
+		if err != nil {
+			return fileIndexFailed, 0, fmt.Errorf("embed: %w", err)
+		}
+		if len(batch) != end-start {
+			return fileIndexFailed, 0, fmt.Errorf("embed: got %d vectors for %d chunks", len(batch), end-start)
+		}
+		vectors = append(vectors, batch...)
+	}
+
+	if err := s.deleteChunks(ctx, db, `file_id = ?`, f.id); err != nil {
+		return fileIndexFailed, 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fileIndexFailed, 0, err
+	}
+	defer tx.Rollback()
+	now := nowRFC3339()
+	items := make([]VectorItem, len(chunks))
+	for i, chunk := range chunks {
+		id := "chunk_" + randomHex(12)
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO file_chunks (id, tenant_id, project_id, file_id, file_name, chunk_index, content, token_estimate, model, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, id, tenantID, projectID, f.id, f.name, i, chunk, estimateTokens(chunk), modelName, now)
+		if err != nil {
+			return fileIndexFailed, 0, err
+		}
+		items[i] = VectorItem{ID: id, Vector: vectors[i], Metadata: map[string]string{"file_id": f.id}}
+	}
+	if err := tx.Commit(); err != nil {
+		return fileIndexFailed, 0, err
+	}
+	if err := s.vectors.Upsert(ctx, fileCollection(projectID, modelName), items); err != nil {
+		return fileIndexFailed, 0, err
+	}
+	return fileIndexIndexed, len(chunks), nil
+}
+
+// fileCollection names the vector collection of a project's chunks for an
+// embedding model.
+func fileCollection(projectID, modelName string) string {
+	return "files:" + projectID + ":" + modelName
+}
+
+// deleteChunks removes the file chunks matching where, and their vectors.
+func (s *Service) deleteChunks(ctx context.Context, db *sql.DB, where string, args ...interface{}) error {
+	rows, err := db.QueryContext(ctx, `SELECT id, project_id, model FROM file_chunks WHERE `+where, args...)
+	if err != nil {
+		return err
+	}
+	byCollection := map[string][]string{}
+	for rows.Next() {
+		var id, projectID, modelName string
+		if err := rows.Scan(&id, &projectID, &modelName); err != nil {
+			rows.Close()
+			return err
+		}
+		collection := fileCollection(projectID, modelName)
+		byCollection[collection] = append(byCollection[collection], id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for collection, ids := range byCollection {
+		if err := s.vectors.Delete(ctx, collection, ids); err != nil {
+			return err
+		}
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM file_chunks WHERE `+where, args...)
+	return err
+}
+
+// loadProjectFileData reads a file's content from the database or, for
+// large files, from the uploads directory in the files service's layout.
+func loadProjectFileData(ctx context.Context, db *sql.DB, projectID string, f projectFile) ([]byte, error) {
+	var encoded sql.NullString
+	if err := db.QueryRowContext(ctx, `SELECT base64_data FROM project_files WHERE id = ?`, f.id).Scan(&encoded); err != nil {
+		return nil, err
+	}
+	if encoded.Valid && encoded.String != "" {
+		return base64.StdEncoding.DecodeString(encoded.String)
+	}
+
+	ext := ""
+	switch {
+	case strings.HasPrefix(f.mimeType, "image/"):
+		ext = strings.TrimPrefix(f.mimeType, "image/")
+	case strings.HasPrefix(f.mimeType, "application/pdf"):
+		ext = "pdf"
+	case f.mimeType == "application/json":
+		ext = "json"
+	case strings.HasPrefix(f.mimeType, "text/"):
+		ext = "txt"
+	}
+	return os.ReadFile(filepath.Join(".", "uploads", projectID, fmt.Sprintf("%s.%s", f.id, ext)))
+}
+
+// projectIndexStale reports whether the project has files that are not
+// indexed with the current embedding model, or index entries of deleted files.
+func projectIndexStale(ctx context.Context, db *sql.DB, projectID, modelName string) (bool, error) {
+	var stale int
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM project_files f
+			LEFT JOIN project_file_index i ON i.file_id = f.id AND i.model = ?
+			WHERE f.project_id = ? AND i.file_id IS NULL
+		) OR EXISTS (
+			SELECT 1 FROM project_file_index i
+			WHERE i.project_id = ? AND i.file_id NOT IN (SELECT id FROM project_files WHERE project_id = ?)
+		)
+	`, modelName, projectID, projectID, projectID).Scan(&stale)
+	return stale == 1, err
+}
+
+// retrieveSources returns the project's chunks closest to the prompt, or
+// nil when retrieval is off or fails. Errors are logged and the request
+// goes on without retrieved context.
+func (s *Service) retrieveSources(ctx context.Context, tenantID, projectID, prompt string, limits *ModelConfig) []RetrievedSource {
+	if tenantID == "" || projectID == "" {
+		return nil
+	}
+	db, err := getDB()
+	if err != nil {
+		return nil
+	}
+	settings, err := loadRetrievalSettings(ctx, db, tenantID, projectID)
+	if err != nil {
+		fmt.Printf("[WARN] Loading retrieval settings of project %s failed: %v\n", projectID, err)
+		return nil
+	}
+	if !settings.Enabled {
+		return nil
+	}
+
+	modelName := embeddingModel()
+	if stale, err := projectIndexStale(ctx, db, projectID, modelName); err == nil && stale {
+		s.syncProjectIndexAsync(tenantID, projectID, false)
+	}
+
+	start := time.Now()
+	embedder, err := s.embedderForTenant(ctx, tenantID)
+	if err != nil {
+		fmt.Printf("[WARN] Retrieval for project %s skipped: %v\n", projectID, err)
+		return nil
+	}
+	vectors, err := embedder.EmbedStrings(ctx, []string{prompt})
+	if err != nil || len(vectors) == 0 {
+		fmt.Printf("[WARN] Embedding prompt for project %s failed: %v\n", projectID, err)
+		return nil
+	}
+	query := vectors[0]
+
+	// Extra matches make up for chunks of deleted files and chunks over budget
+	matches, err := s.vectors.Search(ctx, fileCollection(projectID, modelName), query, VectorSearchOptions{
+		Limit:    settings.TopK * 4,
+		MinScore: settings.MinScore,
+	})
+	if err != nil {
+		fmt.Printf("[WARN] Searching chunks of project %s failed: %v\n", projectID, err)
+		return nil
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+
+	args := []interface{}{projectID, tenantID}
+	for _, m := range matches {
+		args = append(args, m.ID)
+	}
+	// Joining project_files leaves out files deleted since the last sync
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, c.file_id, c.file_name, c.chunk_index, c.content, c.token_estimate
+		FROM file_chunks c
+		JOIN project_files f ON f.id = c.file_id AND f.project_id = c.project_id
+		WHERE c.project_id = ? AND c.tenant_id = ? AND c.id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(matches)), ",")+`)
+	`, args...)
+	if err != nil {
+		fmt.Printf("[WARN] Loading chunks of project %s failed: %v\n", projectID, err)
+		return nil
+	}
+	defer rows.Close()
+
+	type candidate struct {
+		source RetrievedSource
+		tokens int
+	}
+	chunks := make(map[string]candidate, len(matches))
+	for rows.Next() {
+		var id string
+		var c candidate
+		if err := rows.Scan(&id, &c.source.FileID, &c.source.FileName, &c.source.ChunkIndex, &c.source.content, &c.tokens); err != nil {
+			fmt.Printf("[WARN] Reading chunks of project %s failed: %v\n", projectID, err)
+			return nil
+		}
+		chunks[id] = c
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Printf("[WARN] Reading chunks of project %s failed: %v\n", projectID, err)
+		return nil
+	}
+
+	budget := min(maxRetrievalTokens, limits.contextWindow()/4)
+	var sources []RetrievedSource
+	for _, m := range matches {
+		c, ok := chunks[m.ID]
+		if !ok || c.tokens > budget {
+			continue
+		}
+		if len(sources) == settings.TopK {
+			break
+		}
+		budget -= c.tokens
+		c.source.Index = len(sources) + 1
+		c.source.Score = m.Score
+		c.source.Excerpt = truncateString(strings.Join(strings.Fields(c.source.content), " "), excerptLength)
+		sources = append(sources, c.source)
+	}
+	fmt.Printf("[LLM] Retrieval: %d of %d chunks above %.2f for project %s in %v (%s)\n",
+		len(sources), len(matches), settings.MinScore, projectID, time.Since(start), s.vectors.Name())
+	return sources
+}
+
+// withRetrievedContext appends the retrieved chunks to the system prompt.
+func withRetrievedContext(systemPrompt string, sources []RetrievedSource) string {
+	if len(sources) == 0 {
+		return systemPrompt
+	}
+	var b strings.Builder
+	b.WriteString(systemPrompt)
+	b.WriteString("\n\n## Project Documents\n")
+	b.WriteString("The excerpts below come from files uploaded to this project. Use them when they help answer the question and cite each excerpt you use by its number in brackets, for example [1]. If they do not contain the answer, say so or answer from general knowledge without citing them.\n")
+	for _, src := range sources {
+		fmt.Fprintf(&b, "\n[%d] %s (part %d)\n%s\n", src.Index, src.FileName, src.ChunkIndex+1, src.content)
+	}
+	return b.String()
+}
+
+// chunkText splits text into chunks of about size bytes on paragraph,
+// line or sentence boundaries. Each chunk after the first starts with the
+// last overlap bytes of the previous one.
+func chunkText(text string, size, overlap int) []string {
+	var pieces []string
+	for _, para := range strings.Split(text, "\n\n") {
+		if para = strings.TrimSpace(para); para != "" {
+			pieces = append(pieces, splitLongText(para, size)...)
+		}
+	}
+
+	var chunks []string
+	var cur strings.Builder
+	fresh := false
+	for _, piece := range pieces {
+		if fresh && cur.Len()+len(piece)+2 > size {
+			chunks = append(chunks, cur.String())
+			tail := overlapTail(cur.String(), overlap)
+			cur.Reset()
+			cur.WriteString(tail)
+			fresh = false
+		}
+		if cur.Len() > 0 {
+			cur.WriteString("\n\n")
+		}
+		cur.WriteString(piece)
+		fresh = true
+	}
+	if fresh {
+		chunks = append(chunks, cur.String())
+	}
+	return chunks
+}
+
+// splitLongText splits a paragraph longer than size at line and sentence
+// ends, and at spaces when a single sentence is still too long.
+func splitLongText(s string, size int) []string {
+	if len(s) <= size {
+		return []string{s}
+	}
+	var sentences []string
+	last := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' || ((s[i] == '.' || s[i] == '?' || s[i] == '!') && i+1 < len(s) && s[i+1] == ' ') {
+			sentences = append(sentences, s[last:i+1])
+			last = i + 1
+		}
+	}
+	sentences = append(sentences, s[last:])
+
+	var out []string
+	var cur strings.Builder
+	for _, sentence := range sentences {
+		for len(sentence) > size {
+			cut := strings.LastIndex(sentence[:size], " ")
+			if cut <= 0 {
+				cut = size
+				for cut > 0 && !utf8.RuneStart(sentence[cut]) {
+					cut--
+				}
+			}
+			if cur.Len() > 0 {
+				out = append(out, strings.TrimSpace(cur.String()))
+				cur.Reset()
+			}
+			out = append(out, strings.TrimSpace(sentence[:cut]))
+			sentence = sentence[cut:]
+		}
+		if cur.Len()+len(sentence) > size {
+			out = append(out, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		}
+		cur.WriteString(sentence)
+	}
+	if strings.TrimSpace(cur.String()) != "" {
+		out = append(out, strings.TrimSpace(cur.String()))
+	}
+	return out
+}
+
+// overlapTail returns about the last n bytes of s, starting at a word.
+func overlapTail(s string, n int) string {
+	if n <= 0 || len(s) <= n {
+		return ""
+	}
+	tail := s[len(s)-n:]
+	if i := strings.IndexAny(tail, " \n"); i >= 0 {
+		tail = tail[i+1:]
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(tail, ""))
+}
@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitLongText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		size int
+		want []string
+	}{
+		{"fits", "Short text.", 40, []string{"Short text."}},
+		{"sentences", "One. Two two. Three three three. Four.", 15, []string{"One. Two two.", "Three three", "three. Four."}},
+		{"lines", "line one\nline two\nline three", 12, []string{"line one", "line two", "line three"}},
+		{"words", "alpha beta gamma delta epsilon", 12, []string{"alpha beta", "gamma", "delta", "epsilon"}},
+		{"question and exclamation marks", "Why? Because! Done.", 10, []string{"Why?", "Because!", "Done."}},
+		// No space to cut at, so the cut falls back to a rune boundary
+		{"multibyte without spaces", "ééééééééé", 5, []string{"éé", "éé", "éé", "éé", "é"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitLongText(tt.text, tt.size)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitLongText(%q, %d) = %q, want %q", tt.text, tt.size, got, tt.want)
+			}
+			for _, piece := range got {
+				if len(piece) > tt.size || !utf8.ValidString(piece) {
+					t.Errorf("piece %q is over %d bytes or not valid UTF-8", piece, tt.size)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkText(t *testing.T) {
+	paragraphs := "First paragraph.\n\nSecond paragraph.\n\nThird one here."
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{"empty", "", 100, 10, nil},
+		{"blank paragraphs", "\n\n  \n\n", 100, 10, nil},
+		{"one chunk", paragraphs, 200, 20, []string{paragraphs}},
+		{"paragraphs packed up to size", paragraphs, 40, 0, []string{"First paragraph.\n\nSecond paragraph.", "Third one here."}},
+		{"overlap starts at a word", paragraphs, 40, 10, []string{"First paragraph.\n\nSecond paragraph.", "paragraph.\n\nThird one here."}},
+		{"long paragraph is split", "alpha beta gamma delta epsilon", 12, 0, []string{"alpha beta", "gamma\n\ndelta", "epsilon"}},
+		{"surrounding whitespace trimmed", "\n\n  hello world  \n\n", 100, 0, []string{"hello world"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunkText(tt.text, tt.size, tt.overlap)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunkText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkTextBounds(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 60; i++ {
+		b.WriteString("Kalimat nomor ")
+		b.WriteString(strings.Repeat("panjang ", i%7))
+		b.WriteString("selesai. ")
+		if i%5 == 4 {
+			b.WriteString("\n\n")
+		}
+	}
+	text := b.String()
+
+	tests := []struct {
+		size    int
+		overlap int
+	}{
+		{200, 0},
+		{200, 40},
+		{500, 100},
+		{chunkSize, chunkOverlap},
+	}
+	for _, tt := range tests {
+		chunks := chunkText(text, tt.size, tt.overlap)
+		if len(chunks) == 0 {
+			t.Fatalf("size %d: no chunks", tt.size)
+		}
+		for i, c := range chunks {
+			// The overlap tail and its separator may push a chunk past size
+			if len(c) > tt.size+tt.overlap+2 || !utf8.ValidString(c) || strings.TrimSpace(c) != c {
+				t.Errorf("size %d overlap %d: chunk %d (%d bytes) out of bounds: %q", tt.size, tt.overlap, i, len(c), c)
+			}
+		}
+		// Without overlap every word appears exactly once, in order
+		if tt.overlap == 0 {
+			if got, want := strings.Fields(strings.Join(chunks, " ")), strings.Fields(text); !reflect.DeepEqual(got, want) {
+				t.Errorf("size %d: chunks lose or reorder words", tt.size)
+			}
+		}
+	}
+}
+
+func TestOverlapTail(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"one two three four", 0, ""},
+		{"short", 10, ""},
+		{"one two three four", 9, "four"},
+		{"one two three four", 11, "three four"},
+		{"baris satu\nbaris dua", 8, "dua"},
+	}
+	for _, tt := range tests {
+		if got := overlapTail(tt.s, tt.n); got != tt.want {
+			t.Errorf("overlapTail(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package llm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/backend/iam"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+// scopeDecision is the refusal for an out-of-scope question.
+type scopeDecision struct {
+	Role           string
+	RefusalMessage string
+	Suggestions    []string
+	Verdict        ScopeVerdict
+}
+
+// checkScope enforces the project's chat role. It returns the refusal for an
+// out-of-scope question, or nil when the model may answer. The check runs
+// after quotas, so an exhausted quota is not spent on classification; a
+// keyword refusal spends no tokens, the llm classifier makes one small call
+// that is recorded as "scope_classify" usage.
+func (s *Service) checkScope(ctx context.Context, p *GenerateParams, role *iam.RoleDefinition, tenantID, subclientID string) *scopeDecision {
+	if role == nil || role.ID == defaultContextRole {
+		return nil
+	}
+	roleID := role.ID
+
+	verdict := s.scopeVerdict(ctx, tenantID, role, p.Prompt)
+	if verdict.InScope {
+		return nil
+	}
+	fmt.Printf("[LLM] Scope: refused question for role %s (project=%s, classifier=%s, score=%.2f)\n",
+		roleID, p.ProjectContext.ProjectID, verdict.Classifier, verdict.Score)
+	recordScopeRefusal(tenantID, p.ProjectContext.ProjectID, subclientID, strings.TrimSpace(p.ConversationID), roleID, p.Prompt)
+	return &scopeDecision{
+		Role:           roleID,
+		RefusalMessage: iam.OutOfScopeResponse(role),
+		Suggestions:    role.Suggestions,
+		Verdict:        verdict,
+	}
+}
+
+// scopeVerdict classifies a question with the classifier selected by
+// LLM_SCOPE_CLASSIFIER, so enforcement and the check-scope endpoint agree.
+func (s *Service) scopeVerdict(ctx context.Context, tenantID string, role *iam.RoleDefinition, question string) ScopeVerdict {
+	classifier := scopeClassifierName()
+	return s.classifyScope(ctx, tenantID, role, question, classifier, scopeThreshold(classifier))
+}
+
+type CheckQuestionScopeParams struct {
+	Question string `json:"question"`
+}
+
+type CheckQuestionScopeResponse struct {
+	InScope        bool         `json:"in_scope"`
+	Role           string       `json:"role"`
+	RefusalMessage string       `json:"refusal_message,omitempty"`
+	Verdict        ScopeVerdict `json:"verdict"`
+}
+
+// CheckQuestionScope checks if a question is within the project's role
+// scope, using the same classifier that enforces it in Generate.
+//
+//encore:api auth method=POST path=/projects/:projectId/check-scope
+func (s *Service) CheckQuestionScope(ctx context.Context, projectId string, p *CheckQuestionScopeParams) (*CheckQuestionScopeResponse, error) {
+	if p == nil || strings.TrimSpace(p.Question) == "" {
+		return nil, badRequest("question is required")
+	}
+	data, ok := auth.Data().(*iam.AuthData)
+	if !ok || data == nil || string(data.ScopeType) != "tenant" {
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "tenant session required"}
+	}
+
+	contextRole, version, err := iam.GetProjectContextRole(ctx, data.TenantID, projectId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "project not found"}
+		}
+		return nil, err
+	}
+	role := iam.GetRoleDefinition(ctx, data.TenantID, contextRole, version)
+
+	resp := &CheckQuestionScopeResponse{InScope: true, Role: contextRole}
+	if role == nil || role.ID == defaultContextRole {
+		resp.Verdict = ScopeVerdict{InScope: true, Score: 1, Classifier: scopeClassifierName(), Reason: "general role"}
+		return resp, nil
+	}
+	ctx = withUsageScope(ctx, data.TenantID, projectId, "", "scope_classify")
+	resp.Verdict = s.scopeVerdict(ctx, data.TenantID, role, p.Question)
+	resp.InScope = resp.Verdict.InScope
+	if !resp.InScope {
+		resp.RefusalMessage = iam.OutOfScopeResponse(role)
+	}
+	return resp, nil
+}
+
+// recordScopeRefusal logs a refused question in the background.
+func recordScopeRefusal(tenantID, projectID, subclientID, conversationID, role, question string) {
+	question = truncateString(strings.TrimSpace(question), 1000)
+	go func() {
+		db, err := getDB()
+		if err != nil {
+			fmt.Printf("[LLM] recordScopeRefusal: db unavailable: %v\n", err)
+			return
+		}
+		_, err = db.ExecContext(context.Background(), `
+			INSERT INTO scope_refusals (id, tenant_id, project_id, subclient_id, conversation_id, context_role, question, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, "srf_"+randomHex(10), tenantID, projectID, subclientID, conversationID, role, question, nowRFC3339())
+		if err != nil {
+			fmt.Printf("[LLM] recordScopeRefusal: insert failed: %v\n", err)
+		}
+	}()
+}
+
+type ScopeRefusal struct {
+	ID             string `json:"id"`
+	TenantID       string `json:"tenant_id"`
+	ProjectID      string `json:"project_id"`
+	SubclientID    string `json:"subclient_id,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	ContextRole    string `json:"context_role"`
+	Question       string `json:"question"`
+	CreatedAt      string `json:"created_at"`
+}
+
+type ListScopeRefusalsParams struct {
+	TenantID    string `json:"tenant_id"`
+	ProjectID   string `json:"project_id"`
+	ContextRole string `json:"context_role"`
+	Days        int    `json:"days"`
+	Limit       int    `json:"limit"`
+}
+
+type ListScopeRefusalsResponse struct {
+	Items []*ScopeRefusal `json:"items"`
+}
+
+// ListScopeRefusals returns refused questions, newest first, so admins can
+// tune role scope lists. Tenant admins see their own tenant only.
+//
+//encore:api auth method=GET path=/llm/scope-refusals
+func (s *Service) ListScopeRefusals(ctx context.Context, p *ListScopeRefusalsParams) (*ListScopeRefusalsResponse, error) {
+	if p == nil {
+		p = &ListScopeRefusalsParams{}
+	}
+	data, ok := auth.Data().(*iam.AuthData)
+	if !ok || data == nil {
+		return nil, &errs.Error{Code: errs.Unauthenticated, Message: "not authenticated"}
+	}
+	tenantID := strings.TrimSpace(p.TenantID)
+	switch string(data.Role) {
+	case "system":
+	case "admin":
+		if tenantID != "" && tenantID != data.TenantID {
+			return nil, &errs.Error{Code: errs.PermissionDenied, Message: "tenant not accessible"}
+		}
+		tenantID = data.TenantID
+	default:
+		return nil, &errs.Error{Code: errs.PermissionDenied, Message: "admin role required"}
+	}
+
+	days := p.Days
+	if days <= 0 {
+		days = 30
+	}
+	limit := p.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 500 {
+		limit = 500
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days).Format(time.RFC3339)
+
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, tenant_id, project_id, subclient_id, conversation_id, context_role, question, created_at
+		FROM scope_refusals
+		WHERE created_at >= ?
+			AND (? = '' OR tenant_id = ?)
+			AND (? = '' OR project_id = ?)
+			AND (? = '' OR context_role = ?)
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, since,
+		tenantID, tenantID,
+		strings.TrimSpace(p.ProjectID), strings.TrimSpace(p.ProjectID),
+		strings.TrimSpace(p.ContextRole), strings.TrimSpace(p.ContextRole),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]*ScopeRefusal, 0)
+	for rows.Next() {
+		item := &ScopeRefusal{}
+		if err := rows.Scan(&item.ID, &item.TenantID, &item.ProjectID, &item.SubclientID, &item.ConversationID, &item.ContextRole, &item.Question, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return &ListScopeRefusalsResponse{Items: items}, nil
+}
@@ -0,0 +1,200 @@
+package llm
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"encore.app/backend/iam"
+	"encore.dev/beta/errs"
+)
+
+// Labeled scope eval sets, one file per role (scope_evals/<role>.json). A
+// file with the same name in <DATA_DIR>/scope_evals replaces the built-in set,
+// so custom chat roles can have their own.
+//
+//go:embed scope_evals/*.json
+var builtinScopeEvals embed.FS
+
+type ScopeEvalCase struct {
+	Question string `json:"question"`
+	InScope  bool   `json:"in_scope"`
+}
+
+type scopeEvalSet struct {
+	Role  string          `json:"role"`
+	Cases []ScopeEvalCase `json:"cases"`
+}
+
+// loadScopeEvalSet reads the eval set for a role, preferring DATA_DIR.
+func loadScopeEvalSet(role string) ([]ScopeEvalCase, error) {
+	name := filepath.Base(role) + ".json"
+	data, err := os.ReadFile(filepath.Join(dataDir(), "scope_evals", name))
+	if err != nil {
+		data, err = builtinScopeEvals.ReadFile("scope_evals/" + name)
+		if err != nil {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "no eval set for role " + role}
+		}
+	}
+	var set scopeEvalSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse eval set %s: %w", name, err)
+	}
+	return set.Cases, nil
+}
+
+// scopeEvalRoles lists the roles that have an eval set.
+func scopeEvalRoles() []string {
+	seen := map[string]bool{}
+	if entries, err := builtinScopeEvals.ReadDir("scope_evals"); err == nil {
+		for _, e := range entries {
+			seen[strings.TrimSuffix(e.Name(), ".json")] = true
+		}
+	}
+	if matches, err := filepath.Glob(filepath.Join(dataDir(), "scope_evals", "*.json")); err == nil {
+		for _, m := range matches {
+			seen[strings.TrimSuffix(filepath.Base(m), ".json")] = true
+		}
+	}
+	roles := make([]string, 0, len(seen))
+	for r := range seen {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+type EvalScopeClassifierParams struct {
+	// Role to evaluate; empty runs every role with an eval set
+	Role string `json:"role"`
+	// Classifier is keyword, llm or embedding; defaults to LLM_SCOPE_CLASSIFIER
+	Classifier string `json:"classifier"`
+	// Threshold overrides the classifier's confidence threshold when > 0
+	Threshold float64 `json:"threshold"`
+	// TenantID selects the endpoints used by the llm and embedding classifiers
+	TenantID string `json:"tenant_id"`
+	// Cases replaces the stored eval set for a single role
+	Cases []ScopeEvalCase `json:"cases"`
+}
+
+type ScopeEvalResult struct {
+	Question string       `json:"question"`
+	Expected bool         `json:"expected"`
+	Verdict  ScopeVerdict `json:"verdict"`
+	Correct  bool         `json:"correct"`
+}
+
+type ScopeEvalReport struct {
+	Role      string             `json:"role"`
+	Total     int                `json:"total"`
+	Correct   int                `json:"correct"`
+	Accuracy  float64            `json:"accuracy"`
+	Precision float64            `json:"precision"`
+	Recall    float64            `json:"recall"`
+	Results   []*ScopeEvalResult `json:"results"`
+}
+
+type EvalScopeClassifierResponse struct {
+	Classifier string             `json:"classifier"`
+	Threshold  float64            `json:"threshold"`
+	Reports    []*ScopeEvalReport `json:"reports"`
+}
+
+// EvalScopeClassifier runs a scope classifier over the labeled eval sets.
+// Precision and recall are for the in-scope class, so low recall means
+// legitimate questions get refused.
+//
+//encore:api auth method=POST path=/llm/scope-classifier/eval
+func (s *Service) EvalScopeClassifier(ctx context.Context, p *EvalScopeClassifierParams) (*EvalScopeClassifierResponse, error) {
+	if err := requireSystemRole(); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		p = &EvalScopeClassifierParams{}
+	}
+
+	classifier := strings.ToLower(strings.TrimSpace(p.Classifier))
+	switch classifier {
+	case "":
+		classifier = scopeClassifierName()
+	case classifierKeyword, classifierLLM, classifierEmbedding:
+	default:
+		return nil, badRequest("classifier must be keyword, llm or embedding")
+	}
+	threshold := scopeThreshold(classifier)
+	if p.Threshold > 0 {
+		if p.Threshold > 1 {
+			return nil, badRequest("threshold must be between 0 and 1")
+		}
+		threshold = p.Threshold
+	}
+
+	roles := []string{strings.TrimSpace(p.Role)}
+	if roles[0] == "" {
+		if len(p.Cases) > 0 {
+			return nil, badRequest("role is required with custom cases")
+		}
+		roles = scopeEvalRoles()
+	}
+
+	resp := &EvalScopeClassifierResponse{Classifier: classifier, Threshold: threshold, Reports: make([]*ScopeEvalReport, 0, len(roles))}
+	for _, roleID := range roles {
+		cases := p.Cases
+		if len(cases) == 0 {
+			var err error
+			if cases, err = loadScopeEvalSet(roleID); err != nil {
+				return nil, err
+			}
+		}
+		role := iam.GetRoleDefinition(ctx, strings.TrimSpace(p.TenantID), roleID, 0)
+		if role == nil || role.ID != roleID {
+			return nil, &errs.Error{Code: errs.NotFound, Message: "role not found: " + roleID}
+		}
+		resp.Reports = append(resp.Reports, s.runScopeEval(ctx, strings.TrimSpace(p.TenantID), role, cases, classifier, threshold))
+	}
+	return resp, nil
+}
+
+func (s *Service) runScopeEval(ctx context.Context, tenantID string, role *iam.RoleDefinition, cases []ScopeEvalCase, classifier string, threshold float64) *ScopeEvalReport {
+	report := &ScopeEvalReport{Role: role.ID, Results: make([]*ScopeEvalResult, 0, len(cases))}
+	var truePos, falsePos, falseNeg int
+	for _, c := range cases {
+		verdict := s.classifyScope(ctx, tenantID, role, c.Question, classifier, threshold)
+		result := &ScopeEvalResult{
+			Question: c.Question,
+			Expected: c.InScope,
+			Verdict:  verdict,
+			Correct:  verdict.InScope == c.InScope,
+		}
+		report.Results = append(report.Results, result)
+		report.Total++
+		if result.Correct {
+			report.Correct++
+		}
+		switch {
+		case verdict.InScope && c.InScope:
+			truePos++
+		case verdict.InScope && !c.InScope:
+			falsePos++
+		case !verdict.InScope && c.InScope:
+			falseNeg++
+		}
+	}
+	if report.Total > 0 {
+		report.Accuracy = float64(report.Correct) / float64(report.Total)
+	}
+	if truePos+falsePos > 0 {
+		report.Precision = float64(truePos) / float64(truePos+falsePos)
+	}
+	if truePos+falseNeg > 0 {
+		report.Recall = float64(truePos) / float64(truePos+falseNeg)
+	}
+	fmt.Printf("[LLM] Scope eval: role=%s classifier=%s accuracy=%.2f precision=%.2f recall=%.2f\n",
+		role.ID, classifier, report.Accuracy, report.Precision, report.Recall)
+	return report
+}
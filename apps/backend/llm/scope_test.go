@@ -0,0 +1,74 @@
+package llm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/backend/iam"
+)
+
+func TestCheckScope(t *testing.T) {
+	t.Setenv("LLM_SCOPE_CLASSIFIER", "keyword")
+	tenantID := "t_scope_" + randomHex(6)
+	tests := []struct {
+		name    string
+		role    string
+		prompt  string
+		refused bool
+	}{
+		{"no role", "", "How do I deploy a Go service?", false},
+		{"general role", "general", "How do I deploy a Go service?", false},
+		{"in scope", "pharmacist", "What is the usual dosage of paracetamol?", false},
+		{"out of scope", "pharmacist", "How do I deploy a Go service?", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &GenerateParams{
+				Prompt:         tt.prompt,
+				ConversationID: "conv1",
+				ProjectContext: &ProjectContext{ProjectID: "p1", ContextRole: tt.role},
+			}
+			var role *iam.RoleDefinition
+			if tt.role != "" {
+				role = iam.GetRoleDefinition(context.Background(), tenantID, tt.role, 0)
+			}
+			s := &Service{scopeCache: newLRUCache[scopeScore](cacheScopeScores, 10, scopeCacheTTL)}
+			decision := s.checkScope(context.Background(), p, role, tenantID, "s1")
+			if (decision != nil) != tt.refused {
+				t.Fatalf("decision = %+v, refused want %v", decision, tt.refused)
+			}
+			if decision != nil && (decision.Role != tt.role || decision.Verdict.InScope || decision.RefusalMessage == "") {
+				t.Errorf("decision = %+v", decision)
+			}
+		})
+	}
+
+	// Only the refused question is logged
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var count int
+		var question string
+		err := db.QueryRow(`
+			SELECT COUNT(*), COALESCE(MAX(question), '') FROM scope_refusals
+			WHERE tenant_id = ? AND project_id = 'p1' AND subclient_id = 's1' AND conversation_id = 'conv1' AND context_role = 'pharmacist'
+		`, tenantID).Scan(&count, &question)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 1 {
+			if question != "How do I deploy a Go service?" {
+				t.Errorf("logged question = %q", question)
+			}
+			break
+		}
+		if count > 1 || time.Now().After(deadline) {
+			t.Fatalf("refusals logged = %d, want 1", count)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,528 @@
+package llm
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"encore.dev/beta/errs"
+)
+
+// API keys in llm_endpoints.api_key are envelope encrypted: every row has
+// its own random data key (DEK) that encrypts the API key, and the DEK is
+// wrapped with the master key. Rotating the master key only re-wraps DEKs.
+//
+// Stored format: enc:v1:<master key id>:<wrapped DEK>:<encrypted API key>
+// with both blobs as nonce||ciphertext in unpadded base64. The endpoint ID is
+// bound as additional data, so a value cannot be copied to another row.
+//
+// The master key comes from LLM_MASTER_KEY (base64 or hex, 32 bytes), else
+// from LLM_MASTER_KEY_FILE, else from <DATA_DIR>/llm_master.key which is
+// created on first start. Old keys still needed for decryption can be listed
+// in LLM_MASTER_KEY_PREVIOUS (comma separated) or on the following lines of
+// the key file.
+const (
+	encryptedKeyPrefix = "enc:v1:"
+	masterKeyFileName  = "llm_master.key"
+)
+
+type masterKey struct {
+	id  string
+	key []byte
+}
+
+type keyring struct {
+	mu       sync.RWMutex
+	current  *masterKey
+	previous map[string]*masterKey
+	// source is "env" or "file"; only file keys can be rotated by the API
+	source string
+	path   string
+	// rotateMu serializes rotations
+	rotateMu sync.Mutex
+}
+
+// endpointKeys holds the master keys, loaded by initService.
+var endpointKeys *keyring
+
+func newMasterKey(key []byte) *masterKey {
+	sum := sha256.Sum256(key)
+	return &masterKey{id: hex.EncodeToString(sum[:4]), key: key}
+}
+
+// parseMasterKey accepts a 32 byte key as base64 or hex.
+func parseMasterKey(raw string) (*masterKey, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("empty master key")
+	}
+	if b, err := hex.DecodeString(raw); err == nil && len(b) == 32 {
+		return newMasterKey(b), nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(raw); err == nil && len(b) == 32 {
+			return newMasterKey(b), nil
+		}
+	}
+	return nil, errors.New("master key must be 32 bytes encoded as base64 or hex")
+}
+
+func generateMasterKey() (*masterKey, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return newMasterKey(b), nil
+}
+
+func masterKeyPath() string {
+	if p := strings.TrimSpace(os.Getenv("LLM_MASTER_KEY_FILE")); p != "" {
+		return p
+	}
+	return filepath.Join(dataDir(), masterKeyFileName)
+}
+
+// loadKeyring reads the master key from the environment or the key file,
+// creating the file with a new key if neither exists.
+func loadKeyring() (*keyring, error) {
+	kr := &keyring{previous: make(map[string]*masterKey)}
+
+	for _, raw := range strings.Split(os.Getenv("LLM_MASTER_KEY_PREVIOUS"), ",") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		mk, err := parseMasterKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("LLM_MASTER_KEY_PREVIOUS: %w", err)
+		}
+		kr.previous[mk.id] = mk
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("LLM_MASTER_KEY")); raw != "" {
+		mk, err := parseMasterKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("LLM_MASTER_KEY: %w", err)
+		}
+		kr.current = mk
+		kr.source = "env"
+		delete(kr.previous, mk.id)
+		return kr, nil
+	}
+
+	kr.source = "file"
+	kr.path = masterKeyPath()
+	keys, err := readMasterKeyFile(kr.path)
+	if errors.Is(err, os.ErrNotExist) {
+		mk, genErr := generateMasterKey()
+		if genErr != nil {
+			return nil, genErr
+		}
+		if err := writeMasterKeyFile(kr.path, mk); err != nil {
+			return nil, err
+		}
+		fmt.Printf("[LLM] Created master key %s at %s\n", mk.id, kr.path)
+		keys = []*masterKey{mk}
+	} else if err != nil {
+		return nil, err
+	}
+	kr.current = keys[0]
+	for _, mk := range keys[1:] {
+		kr.previous[mk.id] = mk
+	}
+	delete(kr.previous, kr.current.id)
+	return kr, nil
+}
+
+// readMasterKeyFile returns the keys in the file, current key first.
+func readMasterKeyFile(path string) ([]*masterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*masterKey
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mk, err := parseMasterKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, mk)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no master key found", path)
+	}
+	return keys, nil
+}
+
+// writeMasterKeyFile atomically replaces the key file, current key first.
+func writeMasterKeyFile(path string, keys ...*masterKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create key directory: %w", err)
+	}
+	var b strings.Builder
+	for _, mk := range keys {
+		b.WriteString(base64.StdEncoding.EncodeToString(mk.key))
+		b.WriteByte('\n')
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("write master key: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func (kr *keyring) currentKey() *masterKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current
+}
+
+func (kr *keyring) lookup(id string) (*masterKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if kr.current != nil && kr.current.id == id {
+		return kr.current, true
+	}
+	mk, ok := kr.previous[id]
+	return mk, ok
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func unseal(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+type sealedAPIKey struct {
+	keyID      string
+	wrappedDEK []byte
+	ciphertext []byte
+}
+
+func isEncryptedAPIKey(stored string) bool {
+	return strings.HasPrefix(stored, encryptedKeyPrefix)
+}
+
+func parseSealedAPIKey(stored string) (*sealedAPIKey, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, encryptedKeyPrefix), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed encrypted api key")
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted api key: %w", err)
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted api key: %w", err)
+	}
+	return &sealedAPIKey{keyID: parts[0], wrappedDEK: wrapped, ciphertext: ciphertext}, nil
+}
+
+func (s *sealedAPIKey) String() string {
+	return encryptedKeyPrefix + s.keyID + ":" +
+		base64.RawStdEncoding.EncodeToString(s.wrappedDEK) + ":" +
+		base64.RawStdEncoding.EncodeToString(s.ciphertext)
+}
+
+// encryptAPIKey seals an API key for the given endpoint row. Empty keys stay empty.
+func encryptAPIKey(endpointID, apiKey string) (string, error) {
+	if apiKey == "" {
+		return "", nil
+	}
+	if endpointKeys == nil {
+		return "", errors.New("llm master key not loaded")
+	}
+	mk := endpointKeys.currentKey()
+
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+	aad := []byte(endpointID)
+	ciphertext, err := seal(dek, []byte(apiKey), aad)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(mk.key, dek, aad)
+	if err != nil {
+		return "", err
+	}
+	return (&sealedAPIKey{keyID: mk.id, wrappedDEK: wrapped, ciphertext: ciphertext}).String(), nil
+}
+
+// decryptAPIKey returns the plaintext API key. Values written before
+// encryption was enabled are returned unchanged.
+func decryptAPIKey(endpointID, stored string) (string, error) {
+	if !isEncryptedAPIKey(stored) {
+		return stored, nil
+	}
+	if endpointKeys == nil {
+		return "", errors.New("llm master key not loaded")
+	}
+	sealed, err := parseSealedAPIKey(stored)
+	if err != nil {
+		return "", err
+	}
+	mk, ok := endpointKeys.lookup(sealed.keyID)
+	if !ok {
+		return "", fmt.Errorf("api key for endpoint %s is encrypted with unknown master key %s", endpointID, sealed.keyID)
+	}
+	aad := []byte(endpointID)
+	dek, err := unseal(mk.key, sealed.wrappedDEK, aad)
+	if err != nil {
+		return "", fmt.Errorf("unwrap data key for endpoint %s: %w", endpointID, err)
+	}
+	plaintext, err := unseal(dek, sealed.ciphertext, aad)
+	if err != nil {
+		return "", fmt.Errorf("decrypt api key for endpoint %s: %w", endpointID, err)
+	}
+	return string(plaintext), nil
+}
+
+// rewrapAPIKey re-wraps the data key with the current master key. Plaintext
+// values are encrypted. It reports whether the stored value changed.
+func rewrapAPIKey(endpointID, stored string) (string, bool, error) {
+	if stored == "" {
+		return stored, false, nil
+	}
+	if !isEncryptedAPIKey(stored) {
+		enc, err := encryptAPIKey(endpointID, stored)
+		return enc, err == nil, err
+	}
+	sealed, err := parseSealedAPIKey(stored)
+	if err != nil {
+		return "", false, err
+	}
+	current := endpointKeys.currentKey()
+	if sealed.keyID == current.id {
+		return stored, false, nil
+	}
+	mk, ok := endpointKeys.lookup(sealed.keyID)
+	if !ok {
+		return "", false, fmt.Errorf("endpoint %s: unknown master key %s", endpointID, sealed.keyID)
+	}
+	aad := []byte(endpointID)
+	dek, err := unseal(mk.key, sealed.wrappedDEK, aad)
+	if err != nil {
+		return "", false, fmt.Errorf("unwrap data key for endpoint %s: %w", endpointID, err)
+	}
+	wrapped, err := seal(current.key, dek, aad)
+	if err != nil {
+		return "", false, err
+	}
+	sealed.keyID = current.id
+	sealed.wrappedDEK = wrapped
+	return sealed.String(), true, nil
+}
+
+// rewrapAllAPIKeys brings every llm_endpoints row onto the current master
+// key, encrypting plaintext keys on the way. It returns how many rows were
+// updated and how many still could not be moved.
+func rewrapAllAPIKeys(ctx context.Context) (int, int, error) {
+	db, err := getDB()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT id, api_key FROM llm_endpoints WHERE api_key != ''`)
+	if err != nil {
+		return 0, 0, err
+	}
+	type row struct{ id, apiKey string }
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.apiKey); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, 0, rows.Err()
+	}
+
+	updated, failed := 0, 0
+	for _, r := range all {
+		next, changed, err := rewrapAPIKey(r.id, r.apiKey)
+		if err != nil {
+			fmt.Printf("[LLM] Re-encrypt api key: %v\n", err)
+			failed++
+			continue
+		}
+		if !changed {
+			continue
+		}
+		// Only replace the value we read, a concurrent update wins
+		res, err := db.ExecContext(ctx, `UPDATE llm_endpoints SET api_key = ? WHERE id = ? AND api_key = ?`, next, r.id, r.apiKey)
+		if err != nil {
+			return updated, failed, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			updated++
+		}
+	}
+	return updated, failed, nil
+}
+
+// encryptStoredAPIKeys runs at startup and encrypts keys left in plaintext by
+// earlier versions, plus any still wrapped with a previous master key.
+func encryptStoredAPIKeys(ctx context.Context) error {
+	updated, failed, err := rewrapAllAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if updated > 0 {
+		fmt.Printf("[LLM] Encrypted %d endpoint api key(s) with master key %s\n", updated, endpointKeys.currentKey().id)
+	}
+	if failed > 0 {
+		fmt.Printf("[WARN] %d endpoint api key(s) could not be decrypted with the configured master keys\n", failed)
+	}
+	return nil
+}
+
+type RotateMasterKeyParams struct {
+	// MasterKey optionally supplies the new key (base64 or hex, 32 bytes);
+	// a random key is generated when empty. Only used for file-based keys.
+	MasterKey string `json:"master_key"`
+}
+
+type RotateMasterKeyResponse struct {
+	KeyID         string `json:"key_id"`
+	PreviousKeyID string `json:"previous_key_id"`
+	Source        string `json:"source"`
+	Reencrypted   int    `json:"reencrypted"`
+	Failed        int    `json:"failed"`
+}
+
+// RotateMasterKey re-encrypts every endpoint API key under a new master key.
+//
+// With a key file a new key is generated (or taken from the request), written
+// to the file and all rows are re-wrapped; the old key is dropped from the
+// file once no row uses it. When the key comes from LLM_MASTER_KEY, set the
+// new key there and the old one in LLM_MASTER_KEY_PREVIOUS, restart, and call
+// this to re-wrap rows still on the old key.
+//
+//encore:api auth method=POST path=/llm/keys/rotate
+func (s *Service) RotateMasterKey(ctx context.Context, p *RotateMasterKeyParams) (*RotateMasterKeyResponse, error) {
+	if err := requireSystemRole(); err != nil {
+		return nil, err
+	}
+	if endpointKeys == nil {
+		return nil, &errs.Error{Code: errs.Unavailable, Message: "llm master key not loaded"}
+	}
+	kr := endpointKeys
+	kr.rotateMu.Lock()
+	defer kr.rotateMu.Unlock()
+
+	old := kr.currentKey()
+	resp := &RotateMasterKeyResponse{KeyID: old.id, Source: kr.source}
+
+	if kr.source == "file" {
+		var next *masterKey
+		var err error
+		if p != nil && strings.TrimSpace(p.MasterKey) != "" {
+			next, err = parseMasterKey(p.MasterKey)
+			if err != nil {
+				return nil, badRequest(err.Error())
+			}
+		} else {
+			next, err = generateMasterKey()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if next.id == old.id {
+			return nil, badRequest("new master key must differ from the current one")
+		}
+
+		// Keep the old key in the file until every row is re-wrapped
+		keep := []*masterKey{next, old}
+		kr.mu.RLock()
+		for _, mk := range kr.previous {
+			keep = append(keep, mk)
+		}
+		kr.mu.RUnlock()
+		if err := writeMasterKeyFile(kr.path, keep...); err != nil {
+			return nil, err
+		}
+
+		kr.mu.Lock()
+		kr.previous[old.id] = old
+		kr.current = next
+		delete(kr.previous, next.id)
+		kr.mu.Unlock()
+
+		resp.KeyID = next.id
+		resp.PreviousKeyID = old.id
+	} else if p != nil && strings.TrimSpace(p.MasterKey) != "" {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "master key is set by LLM_MASTER_KEY; change it there and keep the old one in LLM_MASTER_KEY_PREVIOUS"}
+	}
+
+	updated, failed, err := rewrapAllAPIKeys(ctx)
+	resp.Reencrypted = updated
+	resp.Failed = failed
+	if err != nil {
+		return nil, err
+	}
+	// Models hold the keys they were created with
+	s.invalidateEndpointCache()
+	s.modelCache.purge()
+
+	if kr.source == "file" && failed == 0 {
+		// A second pass catches rows written with the old key during rotation
+		if updated2, failed2, err := rewrapAllAPIKeys(ctx); err == nil && failed2 == 0 {
+			resp.Reencrypted += updated2
+			if err := writeMasterKeyFile(kr.path, kr.currentKey()); err != nil {
+				return nil, err
+			}
+			kr.mu.Lock()
+			kr.previous = make(map[string]*masterKey)
+			kr.mu.Unlock()
+		}
+	}
+
+	fmt.Printf("[LLM] Master key rotation: key=%s reencrypted=%d failed=%d\n", resp.KeyID, resp.Reencrypted, resp.Failed)
+	return resp, nil
+}
@@ -0,0 +1,274 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useKeyring installs a keyring with the given current and previous keys for
+// the duration of the test.
+func useKeyring(t *testing.T, current *masterKey, previous ...*masterKey) *keyring {
+	t.Helper()
+	kr := &keyring{current: current, previous: make(map[string]*masterKey), source: "env"}
+	for _, mk := range previous {
+		kr.previous[mk.id] = mk
+	}
+	saved := endpointKeys
+	endpointKeys = kr
+	t.Cleanup(func() { endpointKeys = saved })
+	return kr
+}
+
+func testMasterKey(t *testing.T, fill byte) *masterKey {
+	t.Helper()
+	mk, err := parseMasterKey(hex.EncodeToString(bytes.Repeat([]byte{fill}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mk
+}
+
+func TestParseMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{"hex", hex.EncodeToString(key), false},
+		{"base64", base64.StdEncoding.EncodeToString(key), false},
+		{"raw base64", base64.RawStdEncoding.EncodeToString(key), false},
+		{"url base64", base64.URLEncoding.EncodeToString(key), false},
+		{"surrounding space", "  " + hex.EncodeToString(key) + "\n", false},
+		{"empty", "", true},
+		{"short", hex.EncodeToString(key[:16]), true},
+		{"not encoded", "correct horse battery staple", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mk, err := parseMasterKey(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseMasterKey(%q) succeeded, want error", tt.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(mk.key, key) || mk.id != newMasterKey(key).id {
+				t.Errorf("parsed key %s does not match", mk.id)
+			}
+		})
+	}
+}
+
+func TestEncryptDecryptAPIKey(t *testing.T) {
+	current := testMasterKey(t, 1)
+	useKeyring(t, current)
+
+	sealed, err := encryptAPIKey("ep1", "sk-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, encryptedKeyPrefix+current.id+":") || strings.Contains(sealed, "sk-secret") {
+		t.Fatalf("sealed value %q", sealed)
+	}
+	again, _ := encryptAPIKey("ep1", "sk-secret")
+	if again == sealed {
+		t.Error("two encryptions produced the same value, nonces or data keys are reused")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(sealed, encryptedKeyPrefix), ":")
+	ciphertext, _ := base64.RawStdEncoding.DecodeString(parts[2])
+	ciphertext[len(ciphertext)-1] ^= 1
+	tampered := encryptedKeyPrefix + parts[0] + ":" + parts[1] + ":" + base64.RawStdEncoding.EncodeToString(ciphertext)
+
+	tests := []struct {
+		name       string
+		endpointID string
+		stored     string
+		want       string
+		wantErr    bool
+	}{
+		{"round trip", "ep1", sealed, "sk-secret", false},
+		{"legacy plaintext", "ep1", "sk-plain", "sk-plain", false},
+		{"empty", "ep1", "", "", false},
+		{"copied to another row", "ep2", sealed, "", true},
+		{"tampered ciphertext", "ep1", tampered, "", true},
+		{"unknown master key", "ep1", encryptedKeyPrefix + "deadbeef:" + parts[1] + ":" + parts[2], "", true},
+		{"malformed", "ep1", encryptedKeyPrefix + "only-one-part", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptAPIKey(tt.endpointID, tt.stored)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decrypt succeeded with %q, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("decrypt = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	if empty, err := encryptAPIKey("ep1", ""); err != nil || empty != "" {
+		t.Errorf("empty key encrypted to %q, %v", empty, err)
+	}
+}
+
+func TestRewrapAPIKey(t *testing.T) {
+	oldKey := testMasterKey(t, 1)
+	newKey := testMasterKey(t, 2)
+
+	useKeyring(t, oldKey)
+	onOld, err := encryptAPIKey("ep1", "sk-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate: the new key is current, the old one is kept for decryption
+	useKeyring(t, newKey, oldKey)
+	onNew, err := encryptAPIKey("ep1", "sk-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		stored      string
+		wantChanged bool
+		wantErr     bool
+	}{
+		{"old key is re-wrapped", onOld, true, false},
+		{"current key is left alone", onNew, false, false},
+		{"plaintext is encrypted", "sk-secret", true, false},
+		{"empty stays empty", "", false, false},
+		{"unknown key fails", encryptedKeyPrefix + "deadbeef:" + strings.SplitN(strings.TrimPrefix(onOld, encryptedKeyPrefix), ":", 2)[1], false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, changed, err := rewrapAPIKey("ep1", tt.stored)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("rewrap succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if tt.stored == "" {
+				return
+			}
+			if !strings.HasPrefix(next, encryptedKeyPrefix+newKey.id+":") {
+				t.Errorf("value %q is not on the current key", next)
+			}
+			if got, err := decryptAPIKey("ep1", next); err != nil || got != "sk-secret" {
+				t.Errorf("decrypt after rewrap = %q, %v", got, err)
+			}
+		})
+	}
+
+	// Once re-wrapped, the old key is no longer needed
+	rewrapped, _, _ := rewrapAPIKey("ep1", onOld)
+	useKeyring(t, newKey)
+	if got, err := decryptAPIKey("ep1", rewrapped); err != nil || got != "sk-secret" {
+		t.Errorf("decrypt without the old key = %q, %v", got, err)
+	}
+	if _, err := decryptAPIKey("ep1", onOld); err == nil {
+		t.Error("value on a dropped key still decrypts")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	envKey := testMasterKey(t, 7)
+	prevKey := testMasterKey(t, 8)
+
+	t.Run("creates and reloads the key file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys", masterKeyFileName)
+		t.Setenv("LLM_MASTER_KEY", "")
+		t.Setenv("LLM_MASTER_KEY_PREVIOUS", "")
+		t.Setenv("LLM_MASTER_KEY_FILE", path)
+
+		first, err := loadKeyring()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.source != "file" {
+			t.Errorf("source = %s", first.source)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("key file mode = %v", info.Mode().Perm())
+		}
+		second, err := loadKeyring()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.current.id != first.current.id {
+			t.Errorf("reloaded key %s, created %s", second.current.id, first.current.id)
+		}
+	})
+
+	t.Run("previous keys in the file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), masterKeyFileName)
+		t.Setenv("LLM_MASTER_KEY", "")
+		t.Setenv("LLM_MASTER_KEY_PREVIOUS", "")
+		t.Setenv("LLM_MASTER_KEY_FILE", path)
+		if err := writeMasterKeyFile(path, envKey, prevKey); err != nil {
+			t.Fatal(err)
+		}
+
+		kr, err := loadKeyring()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kr.current.id != envKey.id {
+			t.Errorf("current = %s, want %s", kr.current.id, envKey.id)
+		}
+		if _, ok := kr.lookup(prevKey.id); !ok {
+			t.Error("previous key from the file not loaded")
+		}
+	})
+
+	t.Run("environment wins", func(t *testing.T) {
+		t.Setenv("LLM_MASTER_KEY", base64.StdEncoding.EncodeToString(envKey.key))
+		t.Setenv("LLM_MASTER_KEY_PREVIOUS", hex.EncodeToString(prevKey.key)+", "+hex.EncodeToString(envKey.key))
+		t.Setenv("LLM_MASTER_KEY_FILE", filepath.Join(t.TempDir(), "unused.key"))
+
+		kr, err := loadKeyring()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kr.source != "env" || kr.current.id != envKey.id {
+			t.Errorf("source %s key %s, want env key %s", kr.source, kr.current.id, envKey.id)
+		}
+		if _, ok := kr.previous[envKey.id]; ok {
+			t.Error("current key also listed as previous")
+		}
+		if _, ok := kr.lookup(prevKey.id); !ok {
+			t.Error("LLM_MASTER_KEY_PREVIOUS not loaded")
+		}
+	})
+
+	t.Run("invalid environment key", func(t *testing.T) {
+		t.Setenv("LLM_MASTER_KEY", "too-short")
+		if _, err := loadKeyring(); err == nil {
+			t.Fatal("want error for an invalid LLM_MASTER_KEY")
+		}
+	})
+}
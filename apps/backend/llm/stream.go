@@ -0,0 +1,446 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.app/backend/iam"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// SSE event names sent by GenerateStream.
+const (
+	streamEventEndpoint     = "endpoint"
+	streamEventDelta        = "delta"
+	streamEventQuotaWarning = "quota_warning"
+	streamEventToolCall     = "tool_call"
+	streamEventReplace      = "replace"
+	streamEventUsage        = "usage"
+	streamEventError        = "error"
+	streamEventScopeRefusal = "scope_refusal"
+	streamEventSources      = "sources"
+	streamEventDone         = "done"
+)
+
+// StreamEndpointEvent reports which endpoint, model and chat role are
+// serving the stream.
+type StreamEndpointEvent struct {
+	EndpointID         string `json:"endpoint_id,omitempty"`
+	EndpointName       string `json:"endpoint_name,omitempty"`
+	Model              string `json:"model,omitempty"`
+	ContextRole        string `json:"context_role,omitempty"`
+	ContextRoleVersion int    `json:"context_role_version,omitempty"`
+}
+
+// StreamQuotaWarningEvent reports a soft quota limit that has been reached.
+type StreamQuotaWarningEvent struct {
+	Message string `json:"message"`
+}
+
+// StreamDeltaEvent carries a chunk of generated text.
+type StreamDeltaEvent struct {
+	Content string `json:"content"`
+}
+
+// StreamToolCallEvent marks a tool call emitted by the model while streaming.
+type StreamToolCallEvent struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// StreamReplaceEvent carries the final text after post-generate processing.
+// Clients should replace the streamed text with this content.
+type StreamReplaceEvent struct {
+	Content string `json:"content"`
+}
+
+// StreamSourcesEvent lists the project file excerpts given to the model,
+// sent before the first delta.
+type StreamSourcesEvent struct {
+	Sources []RetrievedSource `json:"sources"`
+}
+
+// StreamUsageEvent reports token usage for the streamed response.
+type StreamUsageEvent struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// StreamErrorEvent reports an error after streaming has started.
+type StreamErrorEvent struct {
+	Message string `json:"message"`
+}
+
+// StreamScopeRefusalEvent is sent instead of a model response when the
+// question is outside the project's chat role.
+type StreamScopeRefusalEvent struct {
+	ContextRole string   `json:"context_role"`
+	Message     string   `json:"message"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// streamSink receives the events of a streamed generation. sseWriter sends
+// them as they are, the OpenAI-compatible API translates them to its chunks.
+type streamSink interface {
+	send(event string, payload interface{}) error
+}
+
+// sseWriter writes Server-Sent Events and flushes after each one.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	sw := &sseWriter{w: w, flusher: flusher}
+	sw.flush()
+	return sw
+}
+
+func (sw *sseWriter) send(event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(sw.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	sw.flush()
+	return nil
+}
+
+// sendData writes a data-only event, as OpenAI streams do.
+func (sw *sseWriter) sendData(data []byte) error {
+	if _, err := fmt.Fprintf(sw.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	sw.flush()
+	return nil
+}
+
+func (sw *sseWriter) flush() {
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+}
+
+// GenerateStream runs a single prompt and streams the model response as Server-Sent Events.
+//
+// Events: "endpoint" (serving endpoint), "quota_warning", "delta" (text chunk), "tool_call" (tool call marker), "replace" (final text
+// after post-generate hooks), "usage" (token usage), "scope_refusal" (question outside the project's role), "error" and "done".
+//
+//encore:api public raw method=POST path=/llm/generate/stream
+func (s *Service) GenerateStream(w http.ResponseWriter, req *http.Request) {
+	var p GenerateParams
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+		errs.HTTPError(w, badRequest("invalid request body"))
+		return
+	}
+	s.generateStream(req.Context(), w, &p, func(w http.ResponseWriter) streamSink {
+		return newSSEWriter(w)
+	}, errs.HTTPError)
+}
+
+// generateStream runs a streamed generation. Errors before the first event
+// are written with writeError, later ones as error events. openSink starts
+// the event stream on w.
+func (s *Service) generateStream(ctx context.Context, w http.ResponseWriter, p *GenerateParams, openSink func(http.ResponseWriter) streamSink, writeError func(http.ResponseWriter, error)) {
+	startTime := time.Now()
+
+	if strings.TrimSpace(p.Prompt) == "" {
+		writeError(w, badRequest("prompt is required"))
+		return
+	}
+	if p.ProjectContext == nil {
+		writeError(w, badRequest("project_context is required"))
+		return
+	}
+
+	// Fast response for simple greetings (bypass LLM for common greetings)
+	promptLower := strings.ToLower(strings.TrimSpace(p.Prompt))
+	if isSimpleGreeting(promptLower) {
+		fmt.Printf("[LLM] GenerateStream: fast greeting detected, responding immediately\n")
+		sw := openSink(w)
+		content := getGreetingResponse(promptLower)
+		sw.send(streamEventDelta, StreamDeltaEvent{Content: content})
+		sw.send(streamEventReplace, StreamReplaceEvent{Content: content})
+		sw.send(streamEventDone, struct{}{})
+		return
+	}
+
+	data, _ := auth.Data().(*iam.AuthData)
+	if err := pinAPIKeyScope(ctx, p, data); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := pinSessionSubclient(p, data); err != nil {
+		writeError(w, err)
+		return
+	}
+	tenantID := requestTenantID(p)
+	subclientID := strings.TrimSpace(p.SubclientID)
+	ctx = withUsageScope(ctx, tenantID, p.ProjectContext.ProjectID, subclientID, "stream")
+
+	quotaWarnings, err := checkQuotas(ctx, tenantID, p.ProjectContext.ProjectID, subclientID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	role := resolveContextRole(ctx, p.ProjectContext, tenantID)
+	if refusal := s.checkScope(ctx, p, role, tenantID, subclientID); refusal != nil {
+		sw := openSink(w)
+		sw.send(streamEventScopeRefusal, StreamScopeRefusalEvent{
+			ContextRole: refusal.Role,
+			Message:     refusal.RefusalMessage,
+			Suggestions: refusal.Suggestions,
+		})
+		sw.send(streamEventReplace, StreamReplaceEvent{Content: refusal.RefusalMessage})
+		sw.send(streamEventDone, struct{}{})
+		return
+	}
+
+	cfgs, err := s.resolveConfigs(ctx, tenantID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cfgs = s.applyProjectSettings(ctx, cfgs, tenantID, p.ProjectContext.ProjectID)
+	if cfgs, err = applyGenerationOptions(cfgs, p.Generation); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	systemPrompt := s.buildSystemPromptCached(p.ProjectContext, role)
+
+	// Pre-generate hooks run before any tokens are sent
+	preprocessed := p.Prompt
+	if len(p.ProjectContext.Extensions) > 0 {
+		preprocessed = s.applyExtensionHooks(ctx, "pre-generate", preprocessed, p.ProjectContext)
+	}
+
+	limits := tightestConfig(cfgs)
+	sources := s.retrieveSources(ctx, tenantID, p.ProjectContext.ProjectID, preprocessed, limits)
+	systemPrompt = withRetrievedContext(systemPrompt, sources)
+	budget := historyBudget(limits, systemPrompt, preprocessed)
+	history, err := s.loadHistory(ctx, p, tenantID, data, cfgs, limits, budget)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	firstTurn := len(history) == 0
+	history = fitHistory(history, budget, limits.Model)
+
+	messages := buildGenerateMessages(systemPrompt, history, preprocessed, p.Attachments, hasExtension(p.ProjectContext, "image"))
+
+	tools := s.toolsForProject(p.ProjectContext)
+
+	// Fail over between endpoints while opening the stream; once tokens
+	// have been sent the request stays on the serving endpoint, within that
+	// endpoint's timeout.
+	var chatModel model.BaseChatModel
+	var stream *schema.StreamReader[*schema.Message]
+	var usageCtx context.Context
+	cancel := func() {}
+	defer func() { cancel() }()
+	served, err := s.withFailover(ctx, cfgs, func(ctx context.Context, cfg *ModelConfig) error {
+		ctx, cancelAttempt := context.WithTimeout(ctx, cfg.requestTimeout(120*time.Second))
+		baseModel, err := s.getChatModel(ctx, cfg)
+		if err != nil {
+			cancelAttempt()
+			return err
+		}
+		chatModel = baseModel
+		if len(tools) > 0 {
+			if chatModel, err = baseModel.WithTools(tools); err != nil {
+				cancelAttempt()
+				return fmt.Errorf("bind tools: %w", err)
+			}
+		}
+		if stream, err = s.streamWithRetry(ctx, chatModel, messages); err != nil {
+			cancelAttempt()
+			return err
+		}
+		usageCtx, cancel = ctx, cancelAttempt
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("[LLM] GenerateStream: failed to open stream: %v\n", err)
+		writeError(w, &errs.Error{Code: errs.Internal, Message: fmt.Sprintf("generate failed: %v", err)})
+		return
+	}
+
+	sw := openSink(w)
+	endpointEvent := StreamEndpointEvent{
+		EndpointID:   served.EndpointID,
+		EndpointName: served.EndpointName,
+		Model:        served.Model,
+	}
+	if role != nil {
+		endpointEvent.ContextRole, endpointEvent.ContextRoleVersion = role.ID, role.Version
+	}
+	sw.send(streamEventEndpoint, endpointEvent)
+	if len(sources) > 0 {
+		sw.send(streamEventSources, StreamSourcesEvent{Sources: sources})
+	}
+	for _, warning := range quotaWarnings {
+		sw.send(streamEventQuotaWarning, StreamQuotaWarningEvent{Message: warning})
+	}
+
+	content, usage, err := s.streamToolLoop(ctx, usageCtx, sw, chatModel, messages, stream, p.ProjectContext)
+	if err != nil {
+		fmt.Printf("[LLM] GenerateStream: stream failed after %v: %v\n", time.Since(startTime), err)
+		sw.send(streamEventError, StreamErrorEvent{Message: fmt.Sprintf("generate failed: %v", err)})
+		return
+	}
+
+	// Post-generate hooks run on the assembled text
+	content = s.postProcessContent(ctx, content, p)
+	sw.send(streamEventReplace, StreamReplaceEvent{Content: content})
+
+	if usage.TotalTokens > 0 {
+		sw.send(streamEventUsage, StreamUsageEvent{
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			TotalTokens:      usage.TotalTokens,
+		})
+	}
+	recordReplyProvenance(ctx, p, served, role)
+	sw.send(streamEventDone, struct{}{})
+	s.generateTitleAsync(titleRequestFor(p, tenantID, firstTurn, content))
+
+	fmt.Printf("[LLM] GenerateStream: total request took %v\n", time.Since(startTime))
+}
+
+// streamToolLoop relays stream to sw and, while the model asks for tools,
+// runs the tool calls and relays the next round, up to maxToolSteps. The
+// last round may not call tools. It returns the final text and the token
+// usage of all rounds; model calls are metered on usageCtx.
+func (s *Service) streamToolLoop(ctx, usageCtx context.Context, sw streamSink, chatModel model.BaseChatModel, messages []*schema.Message, stream *schema.StreamReader[*schema.Message], pc *ProjectContext) (string, schema.TokenUsage, error) {
+	var usage schema.TokenUsage
+	for step := 0; ; step++ {
+		roundStart := time.Now()
+		full, err := relayStream(sw, stream)
+		recordUsage(usageCtx, full, err, time.Since(roundStart))
+		if err != nil {
+			return "", usage, err
+		}
+		addUsage(&usage, full)
+
+		if len(full.ToolCalls) == 0 || step >= maxToolSteps {
+			return strings.TrimSpace(full.Content), usage, nil
+		}
+
+		// Execute tool calls and stream the next round
+		fmt.Printf("[LLM] GenerateStream: step %d requested %d tool call(s)\n", step+1, len(full.ToolCalls))
+		messages = append(messages, full)
+		toolMessages, notes := s.processToolCalls(ctx, full.ToolCalls, pc)
+		if len(notes) > 0 {
+			fmt.Printf("[LLM] Tool call messages: %v\n", notes)
+		}
+		messages = append(messages, toolMessages...)
+
+		var opts []model.Option
+		if step+1 >= maxToolSteps {
+			opts = append(opts, model.WithToolChoice(schema.ToolChoiceForbidden))
+		}
+		if stream, err = s.streamWithRetry(usageCtx, chatModel, messages, opts...); err != nil {
+			return "", usage, err
+		}
+	}
+}
+
+// relayStream forwards text chunks and tool-call markers to the client and
+// returns the assembled message. The stream is closed when done.
+func relayStream(sw streamSink, stream *schema.StreamReader[*schema.Message]) (*schema.Message, error) {
+	defer stream.Close()
+
+	var chunks []*schema.Message
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			continue
+		}
+		chunks = append(chunks, chunk)
+
+		if chunk.Content != "" {
+			if err := sw.send(streamEventDelta, StreamDeltaEvent{Content: chunk.Content}); err != nil {
+				return nil, fmt.Errorf("client disconnected: %w", err)
+			}
+		}
+		for _, tc := range chunk.ToolCalls {
+			sw.send(streamEventToolCall, StreamToolCallEvent{
+				ID:        tc.ID,
+				Name:      tc.Function.Name,
+				Arguments: tc.Function.Arguments,
+			})
+		}
+	}
+
+	if len(chunks) == 0 {
+		return &schema.Message{Role: schema.Assistant}, nil
+	}
+	full, err := schema.ConcatMessages(chunks)
+	if err != nil {
+		return nil, fmt.Errorf("assemble response: %w", err)
+	}
+	return full, nil
+}
+
+// streamWithRetry opens a model stream, retrying on rate limit errors.
+// Retries only happen before the first chunk is read.
+func (s *Service) streamWithRetry(ctx context.Context, chatModel model.BaseChatModel, messages []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	maxRetries := 3
+	baseDelay := 2 * time.Second
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		stream, err := chatModel.Stream(ctx, messages, opts...)
+		if err == nil {
+			return stream, nil
+		}
+
+		fmt.Printf("[LLM] streamWithRetry: FAILED (attempt %d): %v\n", attempt+1, err)
+		recordUsage(ctx, nil, err, 0)
+		if !isRateLimitError(err) {
+			return nil, err
+		}
+		if attempt == maxRetries {
+			return nil, fmt.Errorf("rate limit: max retries (%d) exceeded: %w", maxRetries, err)
+		}
+
+		waitTime := baseDelay * time.Duration(1<<attempt)
+		fmt.Printf("[WARN] Rate limit detected (attempt %d/%d), waiting %v before retry...\n",
+			attempt+1, maxRetries+1, waitTime)
+		select {
+		case <-time.After(waitTime):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("rate limit retry cancelled: %w", ctx.Err())
+		}
+	}
+
+	return nil, fmt.Errorf("rate limit: failed after %d retries", maxRetries+1)
+}
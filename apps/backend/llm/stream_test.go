@@ -0,0 +1,99 @@
+package llm
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type sseEvent struct {
+	Name string
+	Data string
+}
+
+// readEvents parses a Server-Sent Events body into its events.
+func readEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			current.Name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.Data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			if current.Name != "" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		default:
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	return events
+}
+
+func eventNames(events []sseEvent) string {
+	names := make([]string, len(events))
+	for i, e := range events {
+		names[i] = e.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestSSEWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw := newSSEWriter(rec)
+	if err := sw.send(streamEventDelta, StreamDeltaEvent{Content: "Hel"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.send(streamEventDone, struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := rec.Header().Get("X-Accel-Buffering"); got != "no" {
+		t.Errorf("X-Accel-Buffering = %q", got)
+	}
+	if !rec.Flushed {
+		t.Error("response was not flushed")
+	}
+	want := "event: delta\ndata: {\"content\":\"Hel\"}\n\nevent: done\ndata: {}\n\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestGenerateStreamGreeting(t *testing.T) {
+	s := &Service{}
+	body := `{"prompt":"Good morning","project_context":{"project_id":"p1"}}`
+	rec := httptest.NewRecorder()
+	s.GenerateStream(rec, httptest.NewRequest(http.MethodPost, "/llm/generate/stream", strings.NewReader(body)))
+
+	events := readEvents(t, rec.Body.String())
+	if got := eventNames(events); got != "delta,replace,done" {
+		t.Fatalf("events = %s", got)
+	}
+	var delta StreamDeltaEvent
+	if err := json.Unmarshal([]byte(events[0].Data), &delta); err != nil {
+		t.Fatal(err)
+	}
+	var replace StreamReplaceEvent
+	if err := json.Unmarshal([]byte(events[1].Data), &replace); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Content == "" || replace.Content != delta.Content {
+		t.Errorf("delta = %q, replace = %q", delta.Content, replace.Content)
+	}
+	if !strings.Contains(replace.Content, "Good morning") {
+		t.Errorf("greeting = %q", replace.Content)
+	}
+}
@@ -0,0 +1,260 @@
+package llm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/backend/iam"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// Long conversations keep a rolling summary in conversation_summaries. When
+// the unsummarized part of the active branch passes LLM_SUMMARY_THRESHOLD of
+// the history budget, everything but the last LLM_SUMMARY_KEEP_MESSAGES
+// messages is folded into the summary before the reply is generated. The
+// model then sees the summary as a system note followed by the recent turns.
+// LLM_SUMMARIES=off disables it and only the oldest turns are dropped.
+
+const (
+	defaultSummaryThreshold    = 0.75
+	defaultSummaryKeepMessages = 6
+	// summaryMaxTokens caps the generated summary.
+	summaryMaxTokens = 800
+	// maxSummaryMessageLen caps each message sent to the summarizer, in bytes.
+	maxSummaryMessageLen = 8000
+)
+
+const summarySystemPrompt = `You maintain the memory of a conversation between a user and an assistant.
+Update the summary with the new messages. Keep names, numbers, decisions, the user's goals and preferences, and open questions. Drop greetings and small talk.
+Write in the language of the conversation, in plain prose or short bullet points, at most 300 words. Reply with the summary only.`
+
+func summariesEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LLM_SUMMARIES"))) {
+	case "off", "false", "0", "no":
+		return false
+	}
+	return true
+}
+
+// summaryThreshold reads LLM_SUMMARY_THRESHOLD, the fraction of the history
+// budget the unsummarized messages may use.
+func summaryThreshold() float64 {
+	if raw := strings.TrimSpace(os.Getenv("LLM_SUMMARY_THRESHOLD")); raw != "" {
+		if v, err := strconv.ParseFloat(raw, 64); err == nil && v > 0 && v <= 1 {
+			return v
+		}
+	}
+	return defaultSummaryThreshold
+}
+
+// summaryKeepMessages reads LLM_SUMMARY_KEEP_MESSAGES, the number of recent
+// messages always sent verbatim.
+func summaryKeepMessages() int {
+	if raw := strings.TrimSpace(os.Getenv("LLM_SUMMARY_KEEP_MESSAGES")); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil && v >= 2 {
+			return v
+		}
+	}
+	return defaultSummaryKeepMessages
+}
+
+type conversationSummary struct {
+	ThroughMessageID string
+	MessageCount     int
+	Summary          string
+}
+
+func loadConversationSummary(ctx context.Context, conversationID string) (*conversationSummary, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	sum := &conversationSummary{}
+	err = db.QueryRowContext(ctx, `
+		SELECT through_message_id, message_count, summary FROM conversation_summaries WHERE conversation_id = ?
+	`, conversationID).Scan(&sum.ThroughMessageID, &sum.MessageCount, &sum.Summary)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+func saveConversationSummary(ctx context.Context, conversationID string, sum *conversationSummary, modelName string) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	now := nowRFC3339()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO conversation_summaries (conversation_id, through_message_id, message_count, summary, token_estimate, model, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(conversation_id) DO UPDATE SET
+			through_message_id = excluded.through_message_id,
+			message_count = excluded.message_count,
+			summary = excluded.summary,
+			token_estimate = excluded.token_estimate,
+			model = excluded.model,
+			updated_at = excluded.updated_at
+	`, conversationID, sum.ThroughMessageID, sum.MessageCount, sum.Summary, estimateTokensFor(modelName, sum.Summary), modelName, now, now)
+	return err
+}
+
+// summarizedHistory returns the stored branch as model messages, replacing
+// older messages with the conversation summary once they no longer fit
+// comfortably. Summarization errors fall back to the plain history, which
+// fitHistory then trims.
+func (s *Service) summarizedHistory(ctx context.Context, p *GenerateParams, tenantID string, stored []iam.ChatMessage, cfgs []*ModelConfig, limits *ModelConfig, budget int) []*schema.Message {
+	if !summariesEnabled() || len(stored) == 0 {
+		return historyMessages(storedTurns(stored))
+	}
+	conversationID := strings.TrimSpace(p.ConversationID)
+	sum, err := loadConversationSummary(ctx, conversationID)
+	if err != nil {
+		fmt.Printf("[WARN] Loading summary of conversation %s failed: %v\n", conversationID, err)
+		sum = nil
+	}
+
+	// The summary only applies while its last message is on this branch
+	tail := stored
+	if sum != nil {
+		sum = summaryOnBranch(sum, stored, &tail)
+	}
+
+	cost := 0
+	if sum != nil {
+		cost += estimateTokensFor(limits.Model, sum.Summary)
+	}
+	for _, m := range tail {
+		cost += estimateTokensFor(limits.Model, m.Content)
+	}
+	keep := summaryKeepMessages()
+	if float64(cost) <= summaryThreshold()*float64(budget) || len(tail) <= keep {
+		return withSummaryNote(sum, tail)
+	}
+
+	// Fold everything before the recent turns, which start on a user message
+	split := len(tail) - keep
+	for split < len(tail)-1 && tail[split].Role != "user" {
+		split++
+	}
+	older, recent := tail[:split], tail[split:]
+
+	start := time.Now()
+	previous := ""
+	count := 0
+	if sum != nil {
+		previous, count = sum.Summary, sum.MessageCount
+	}
+	ctx = withUsageScope(ctx, tenantID, p.ProjectContext.ProjectID, strings.TrimSpace(p.SubclientID), "summary")
+	text, modelName, err := s.summarize(ctx, cfgs, limits, previous, older)
+	if err != nil {
+		fmt.Printf("[WARN] Summarizing conversation %s failed: %v\n", conversationID, err)
+		return withSummaryNote(sum, tail)
+	}
+	next := &conversationSummary{
+		ThroughMessageID: older[len(older)-1].ID,
+		MessageCount:     count + len(older),
+		Summary:          text,
+	}
+	if err := saveConversationSummary(ctx, conversationID, next, modelName); err != nil {
+		fmt.Printf("[WARN] Saving summary of conversation %s failed: %v\n", conversationID, err)
+	}
+	fmt.Printf("[LLM] Summarized %d message(s) of conversation %s in %v\n", len(older), conversationID, time.Since(start))
+	return withSummaryNote(next, recent)
+}
+
+// summaryOnBranch returns the summary if its last message is on the branch,
+// and points tail at the messages after it.
+func summaryOnBranch(sum *conversationSummary, branch []iam.ChatMessage, tail *[]iam.ChatMessage) *conversationSummary {
+	for i, m := range branch {
+		if m.ID == sum.ThroughMessageID {
+			*tail = branch[i+1:]
+			return sum
+		}
+	}
+	return nil
+}
+
+func storedTurns(messages []iam.ChatMessage) []HistoryMessage {
+	turns := make([]HistoryMessage, 0, len(messages))
+	for _, m := range messages {
+		turns = append(turns, HistoryMessage{Role: m.Role, Content: m.Content})
+	}
+	return turns
+}
+
+// withSummaryNote puts the summary as a system note ahead of the turns.
+func withSummaryNote(sum *conversationSummary, tail []iam.ChatMessage) []*schema.Message {
+	history := historyMessages(storedTurns(tail))
+	if sum == nil || strings.TrimSpace(sum.Summary) == "" {
+		return history
+	}
+	note := schema.SystemMessage(fmt.Sprintf("Summary of the earlier conversation (%d messages not shown):\n\n%s", sum.MessageCount, strings.TrimSpace(sum.Summary)))
+	return append([]*schema.Message{note}, history...)
+}
+
+// summarize folds messages into the previous summary. Messages that do not
+// fit the summarizer's context in one call are folded in several passes.
+func (s *Service) summarize(ctx context.Context, cfgs []*ModelConfig, limits *ModelConfig, previous string, messages []iam.ChatMessage) (string, string, error) {
+	chunkBudget := limits.contextWindow() - summaryMaxTokens - estimateTokensFor(limits.Model, summarySystemPrompt)
+	summary, modelName := previous, ""
+	for len(messages) > 0 {
+		var transcript strings.Builder
+		used := estimateTokensFor(limits.Model, summary)
+		n := 0
+		for n < len(messages) {
+			speaker := "User"
+			if messages[n].Role == "assistant" {
+				speaker = "Assistant"
+			}
+			line := fmt.Sprintf("%s: %s\n\n", speaker, truncateString(strings.TrimSpace(messages[n].Content), maxSummaryMessageLen))
+			cost := estimateTokensFor(limits.Model, line)
+			if n > 0 && used+cost > chunkBudget {
+				break
+			}
+			transcript.WriteString(line)
+			used += cost
+			n++
+		}
+		messages = messages[n:]
+
+		input := "New messages:\n\n" + transcript.String()
+		if strings.TrimSpace(summary) != "" {
+			input = "Current summary:\n" + summary + "\n\n" + input
+		}
+		chat := []*schema.Message{schema.SystemMessage(summarySystemPrompt), schema.UserMessage(input)}
+		var resp *schema.Message
+		served, err := s.withFailover(ctx, cfgs, func(ctx context.Context, cfg *ModelConfig) error {
+			chatModel, err := s.getChatModel(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			start := time.Now()
+			resp, err = chatModel.Generate(ctx, chat, model.WithTemperature(0.2), model.WithMaxTokens(summaryMaxTokens))
+			recordUsage(ctx, resp, err, time.Since(start))
+			return err
+		})
+		if err != nil {
+			return "", "", err
+		}
+		if strings.TrimSpace(resp.Content) == "" {
+			return "", "", errors.New("empty summary")
+		}
+		summary = strings.TrimSpace(resp.Content)
+		if served != nil {
+			modelName = served.Model
+		}
+	}
+	return summary, modelName, nil
+}
@@ -0,0 +1,222 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"encore.app/backend/iam"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+func testBranch(n int) []iam.ChatMessage {
+	branch := make([]iam.ChatMessage, n)
+	for i := range branch {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		branch[i] = iam.ChatMessage{ID: fmt.Sprintf("msg_%d", i), Role: role, Content: fmt.Sprintf("turn %d %s", i, strings.Repeat("x", 400))}
+	}
+	return branch
+}
+
+func TestSummaryOnBranch(t *testing.T) {
+	branch := testBranch(6)
+	sum := &conversationSummary{ThroughMessageID: "msg_3", MessageCount: 4, Summary: "earlier"}
+
+	tail := branch
+	if got := summaryOnBranch(sum, branch, &tail); got != sum || len(tail) != 2 || tail[0].ID != "msg_4" {
+		t.Errorf("summary = %v, tail = %d messages", got, len(tail))
+	}
+	// A summary of another branch is ignored and the tail is untouched
+	tail = branch
+	other := &conversationSummary{ThroughMessageID: "msg_other"}
+	if got := summaryOnBranch(other, branch, &tail); got != nil || len(tail) != 6 {
+		t.Errorf("summary = %v, tail = %d messages", got, len(tail))
+	}
+}
+
+func TestWithSummaryNote(t *testing.T) {
+	tail := testBranch(2)
+	if got := withSummaryNote(nil, tail); len(got) != 2 || got[0].Role != schema.User {
+		t.Errorf("without a summary = %v", got)
+	}
+	if got := withSummaryNote(&conversationSummary{Summary: "  "}, tail); len(got) != 2 {
+		t.Errorf("with an empty summary = %v", got)
+	}
+	got := withSummaryNote(&conversationSummary{MessageCount: 8, Summary: " The user asked about doses. "}, tail)
+	if len(got) != 3 || got[0].Role != schema.System {
+		t.Fatalf("with a summary = %v", got)
+	}
+	if want := "Summary of the earlier conversation (8 messages not shown):\n\nThe user asked about doses."; got[0].Content != want {
+		t.Errorf("note = %q, want %q", got[0].Content, want)
+	}
+}
+
+func TestSummarySettings(t *testing.T) {
+	tests := []struct {
+		threshold, keep string
+		wantThreshold   float64
+		wantKeep        int
+	}{
+		{"", "", defaultSummaryThreshold, defaultSummaryKeepMessages},
+		{"0.5", "10", 0.5, 10},
+		{"1", "2", 1, 2},
+		{"0", "1", defaultSummaryThreshold, defaultSummaryKeepMessages},
+		{"1.5", "many", defaultSummaryThreshold, defaultSummaryKeepMessages},
+	}
+	for _, tt := range tests {
+		t.Setenv("LLM_SUMMARY_THRESHOLD", tt.threshold)
+		t.Setenv("LLM_SUMMARY_KEEP_MESSAGES", tt.keep)
+		if got := summaryThreshold(); got != tt.wantThreshold {
+			t.Errorf("LLM_SUMMARY_THRESHOLD=%q: %v, want %v", tt.threshold, got, tt.wantThreshold)
+		}
+		if got := summaryKeepMessages(); got != tt.wantKeep {
+			t.Errorf("LLM_SUMMARY_KEEP_MESSAGES=%q: %d, want %d", tt.keep, got, tt.wantKeep)
+		}
+	}
+	for env, want := range map[string]bool{"": true, "on": true, "off": false, "0": false, "No": false} {
+		t.Setenv("LLM_SUMMARIES", env)
+		if got := summariesEnabled(); got != want {
+			t.Errorf("LLM_SUMMARIES=%q: enabled = %v", env, got)
+		}
+	}
+}
+
+func TestSummarizedHistory(t *testing.T) {
+	t.Setenv("LLM_SUMMARIES", "")
+	t.Setenv("LLM_SUMMARY_THRESHOLD", "")
+	t.Setenv("LLM_SUMMARY_KEEP_MESSAGES", "4")
+	ctx := context.Background()
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"c1","object":"chat.completion","model":"gpt-4o-mini","choices":[{"index":0,"message":{"role":"assistant","content":"The user asked about doses."},"finish_reason":"stop"}]}`))
+	}))
+	defer srv.Close()
+	cfg := &ModelConfig{Provider: "openai-compatible", BaseURL: srv.URL, APIKey: "sk-test", Model: "gpt-4o-mini", EndpointID: "ep_summary"}
+
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversationID := "conv_" + randomHex(8)
+	now := nowRFC3339()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO conversations (id, tenant_id, project_id, title, created_at, updated_at) VALUES (?, 't1', 'p1', 'Long', ?, ?)
+	`, conversationID, now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Service{breaker: newCircuitBreaker(3, time.Hour), modelCache: newLRUCache[model.ToolCallingChatModel](cacheModels, 10, 0)}
+	p := &GenerateParams{Prompt: "next", ConversationID: conversationID, ProjectContext: &ProjectContext{ProjectID: "p1"}}
+	branch := testBranch(10)
+
+	// Over the threshold: the six oldest messages are folded into a summary
+	history := s.summarizedHistory(ctx, p, "t1", branch, []*ModelConfig{cfg}, cfg, 200)
+	if len(history) != 5 || history[0].Role != schema.System || !strings.Contains(history[0].Content, "(6 messages not shown)") {
+		t.Fatalf("history = %v", history)
+	}
+	if history[1].Content != strings.TrimSpace(branch[6].Content) {
+		t.Errorf("first recent message = %q, want msg_6", history[1].Content)
+	}
+	sum, err := loadConversationSummary(ctx, conversationID)
+	if err != nil || sum == nil {
+		t.Fatalf("stored summary = %v, err = %v", sum, err)
+	}
+	if sum.ThroughMessageID != "msg_5" || sum.MessageCount != 6 || sum.Summary != "The user asked about doses." {
+		t.Errorf("stored summary = %+v", sum)
+	}
+
+	// Within budget the stored summary is reused without another call
+	history = s.summarizedHistory(ctx, p, "t1", branch, []*ModelConfig{cfg}, cfg, 100000)
+	if len(history) != 5 || history[0].Role != schema.System || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("reused history = %d messages after %d call(s)", len(history), calls)
+	}
+
+	// Another branch does not see the summary
+	if history := s.summarizedHistory(ctx, p, "t1", branch[:4], []*ModelConfig{cfg}, cfg, 100000); len(history) != 4 || history[0].Role != schema.User {
+		t.Errorf("history of another branch = %v", history)
+	}
+
+	// Failed summaries fall back to the full history
+	srv.Close()
+	long := append(testBranch(10), testBranch(10)...)
+	for i := range long {
+		long[i].ID = fmt.Sprintf("msg_long_%d", i)
+	}
+	if history := s.summarizedHistory(ctx, p, "t1", long, []*ModelConfig{cfg}, cfg, 200); len(history) != len(long) {
+		t.Errorf("history after a failed summary = %d messages, want %d", len(history), len(long))
+	}
+
+	t.Setenv("LLM_SUMMARIES", "off")
+	if history := s.summarizedHistory(ctx, p, "t1", branch, []*ModelConfig{cfg}, cfg, 200); len(history) != 10 {
+		t.Errorf("LLM_SUMMARIES=off history = %d messages, want 10", len(history))
+	}
+}
+
+func TestLoadHistorySummarizesStoredConversation(t *testing.T) {
+	t.Setenv("LLM_SUMMARIES", "")
+	t.Setenv("LLM_SUMMARY_THRESHOLD", "")
+	t.Setenv("LLM_SUMMARY_KEEP_MESSAGES", "4")
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"c1","object":"chat.completion","model":"gpt-4o-mini","choices":[{"index":0,"message":{"role":"assistant","content":"Earlier turns."},"finish_reason":"stop"}]}`))
+	}))
+	defer srv.Close()
+	cfg := &ModelConfig{Provider: "openai-compatible", BaseURL: srv.URL, APIKey: "sk-test", Model: "gpt-4o-mini", EndpointID: "ep_summary"}
+
+	tenantID, projectID := testProject(t)
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The project chat saves the prompt before generating
+	conversationID := "conv_" + randomHex(8)
+	now := nowRFC3339()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO conversations (id, tenant_id, project_id, title, created_at, updated_at) VALUES (?, ?, ?, 'Long', ?, ?)
+	`, conversationID, tenantID, projectID, now, now); err != nil {
+		t.Fatal(err)
+	}
+	branch := append(testBranch(10), iam.ChatMessage{Role: "user", Content: "next"})
+	parent := ""
+	for i := range branch {
+		id := fmt.Sprintf("msg_%s_%d", conversationID, i)
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO conversation_messages (id, conversation_id, seq, parent_id, role, content, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, id, conversationID, i+1, parent, branch[i].Role, branch[i].Content, now); err != nil {
+			t.Fatal(err)
+		}
+		parent = id
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE conversations SET active_leaf_id = ? WHERE id = ?`, parent, conversationID); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Service{breaker: newCircuitBreaker(3, time.Hour), modelCache: newLRUCache[model.ToolCallingChatModel](cacheModels, 10, 0)}
+	p := &GenerateParams{Prompt: "next", ConversationID: conversationID, ProjectContext: &ProjectContext{ProjectID: projectID, Metadata: map[string]string{}}}
+	session := &iam.AuthData{TenantID: tenantID, ScopeType: "tenant", ScopeID: tenantID}
+	history, err := s.loadHistory(ctx, p, tenantID, session, []*ModelConfig{cfg}, cfg, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 5 || history[0].Role != schema.System || !strings.Contains(history[0].Content, "Earlier turns.") {
+		t.Fatalf("history = %v", history)
+	}
+	if last := history[len(history)-1]; last.Role != schema.Assistant {
+		t.Errorf("saved prompt kept in history: %+v", last)
+	}
+}
@@ -0,0 +1,130 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"encore.app/backend/iam"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// Conversation titles are generated from the first exchange, in the
+// background after the reply has been produced, with the tenant's endpoints.
+// LLM_AUTO_TITLES=off disables it.
+
+// titleRequest is the first exchange of a stored conversation.
+type titleRequest struct {
+	TenantID       string
+	ProjectID      string
+	SubclientID    string
+	ConversationID string
+	Language       string
+	Prompt         string
+	Reply          string
+}
+
+func autoTitlesEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LLM_AUTO_TITLES"))) {
+	case "off", "false", "0", "no":
+		return false
+	}
+	return true
+}
+
+// titleRequestFor returns the title request for a generate call that
+// answered the first message of a stored conversation, or nil. firstTurn
+// is whether the loaded history was empty.
+func titleRequestFor(p *GenerateParams, tenantID string, firstTurn bool, reply string) *titleRequest {
+	if !autoTitlesEnabled() || !firstTurn || len(p.History) > 0 || strings.TrimSpace(p.ParentMessageID) != "" {
+		return nil
+	}
+	conversationID := strings.TrimSpace(p.ConversationID)
+	if conversationID == "" || tenantID == "" || strings.TrimSpace(reply) == "" {
+		return nil
+	}
+	return &titleRequest{
+		TenantID:       tenantID,
+		ProjectID:      p.ProjectContext.ProjectID,
+		SubclientID:    strings.TrimSpace(p.SubclientID),
+		ConversationID: conversationID,
+		Language:       p.ProjectContext.Language,
+		Prompt:         p.Prompt,
+		Reply:          reply,
+	}
+}
+
+// generateTitleAsync titles the conversation in the background.
+func (s *Service) generateTitleAsync(req *titleRequest) {
+	if req == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.generateTitle(ctx, req); err != nil {
+			fmt.Printf("[LLM] generateTitle: conversation %s: %v\n", req.ConversationID, err)
+		}
+	}()
+}
+
+func (s *Service) generateTitle(ctx context.Context, req *titleRequest) error {
+	needed, err := iam.ConversationNeedsTitle(ctx, req.TenantID, req.ProjectID, req.SubclientID, req.ConversationID)
+	if err != nil || !needed {
+		return err
+	}
+	cfgs, err := s.resolveConfigs(ctx, req.TenantID)
+	if err != nil {
+		return err
+	}
+
+	language := "the same language as the conversation"
+	if l := strings.ToLower(strings.TrimSpace(req.Language)); l != "" && l != "auto" {
+		language = firstNonEmpty(languageNames[l], strings.TrimSpace(req.Language))
+	}
+	system := fmt.Sprintf(`Write a title for the conversation below in %s.
+Use at most 6 words. Reply with the title only: no quotes, no trailing punctuation, no emoji.`, language)
+	exchange := fmt.Sprintf("User: %s\n\nAssistant: %s", truncateString(req.Prompt, 1000), truncateString(req.Reply, 1000))
+	messages := []*schema.Message{schema.SystemMessage(system), schema.UserMessage(exchange)}
+
+	ctx = withUsageScope(ctx, req.TenantID, req.ProjectID, req.SubclientID, "title")
+	var resp *schema.Message
+	_, err = s.withFailover(ctx, cfgs, func(ctx context.Context, cfg *ModelConfig) error {
+		chatModel, err := s.getChatModel(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		resp, err = chatModel.Generate(ctx, messages, model.WithTemperature(0.3), model.WithMaxTokens(30))
+		recordUsage(ctx, resp, err, time.Since(start))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	title := cleanTitle(resp.Content)
+	stored, err := iam.SetGeneratedConversationTitle(ctx, req.TenantID, req.ProjectID, req.SubclientID, req.ConversationID, title)
+	if err == nil && stored {
+		fmt.Printf("[LLM] generateTitle: conversation %s titled %q\n", req.ConversationID, title)
+	}
+	return err
+}
+
+// cleanTitle keeps the first line of a model reply and strips the quotes,
+// labels and punctuation models like to add.
+func cleanTitle(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, ":"); i >= 0 && strings.EqualFold(strings.TrimSpace(s[:i]), "title") {
+		s = s[i+1:]
+	}
+	s = strings.Trim(strings.TrimSpace(s), "\"'`*#“”‘’")
+	return strings.TrimRight(strings.TrimSpace(s), ".!。")
+}
@@ -0,0 +1,81 @@
+package llm
+
+import "testing"
+
+func TestTitleRequestFor(t *testing.T) {
+	t.Setenv("LLM_AUTO_TITLES", "")
+	params := func() *GenerateParams {
+		return &GenerateParams{
+			Prompt:         "Berapa dosis paracetamol?",
+			ConversationID: " conv_1 ",
+			SubclientID:    "s1",
+			ProjectContext: &ProjectContext{ProjectID: "p1", Language: "id"},
+		}
+	}
+
+	req := titleRequestFor(params(), "t1", true, "500 mg.")
+	if req == nil {
+		t.Fatal("no title request for the first turn of a stored conversation")
+	}
+	if req.ConversationID != "conv_1" || req.TenantID != "t1" || req.ProjectID != "p1" || req.SubclientID != "s1" || req.Language != "id" {
+		t.Errorf("title request = %+v", req)
+	}
+
+	// The project chat sends the stored conversation, no subclient and no
+	// tenant metadata; the tenant comes from the session
+	dashboard := &GenerateParams{
+		Prompt:         "Berapa dosis paracetamol?",
+		ConversationID: "conv_2",
+		ProjectContext: &ProjectContext{ProjectID: "p1", Language: "english", Metadata: map[string]string{}},
+	}
+	if req := titleRequestFor(dashboard, "t1", true, "500 mg."); req == nil || req.ConversationID != "conv_2" || req.SubclientID != "" {
+		t.Errorf("dashboard chat title request = %+v", req)
+	}
+
+	tests := []struct {
+		name      string
+		edit      func(p *GenerateParams)
+		tenantID  string
+		firstTurn bool
+		reply     string
+	}{
+		{"later turn", func(p *GenerateParams) {}, "t1", false, "500 mg."},
+		{"no conversation", func(p *GenerateParams) { p.ConversationID = "" }, "t1", true, "500 mg."},
+		{"explicit history", func(p *GenerateParams) { p.History = []HistoryMessage{{Role: "user", Content: "hi"}} }, "t1", true, "500 mg."},
+		{"regenerated reply", func(p *GenerateParams) { p.ParentMessageID = "msg_1" }, "t1", true, "500 mg."},
+		{"no tenant", func(p *GenerateParams) {}, "", true, "500 mg."},
+		{"empty reply", func(p *GenerateParams) {}, "t1", true, "  "},
+	}
+	for _, tt := range tests {
+		p := params()
+		tt.edit(p)
+		if req := titleRequestFor(p, tt.tenantID, tt.firstTurn, tt.reply); req != nil {
+			t.Errorf("%s: title request = %+v, want none", tt.name, req)
+		}
+	}
+
+	t.Setenv("LLM_AUTO_TITLES", "off")
+	if req := titleRequestFor(params(), "t1", true, "500 mg."); req != nil {
+		t.Error("LLM_AUTO_TITLES=off still requested a title")
+	}
+}
+
+func TestCleanTitle(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Dosis Paracetamol Anak", "Dosis Paracetamol Anak"},
+		{"\"Dosis Paracetamol Anak.\"", "Dosis Paracetamol Anak"},
+		{"Title: Paracetamol dose for kids!", "Paracetamol dose for kids"},
+		{"**Paracetamol dose**\nHere is a title for you", "Paracetamol dose"},
+		{"“Jadwal minum obat”", "Jadwal minum obat"},
+		{"Ratio: 1:2 mixing", "Ratio: 1:2 mixing"},
+		{"  ", ""},
+	}
+	for _, tt := range tests {
+		if got := cleanTitle(tt.in); got != tt.want {
+			t.Errorf("cleanTitle(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
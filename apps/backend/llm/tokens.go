@@ -0,0 +1,124 @@
+package llm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Token estimates and context limits per model. Endpoints can set
+// context_window and max_output_tokens explicitly; otherwise the limits
+// come from the model family below, falling back to defaultContextWindow
+// and defaultMaxTokens.
+
+type modelProfile struct {
+	contextWindow int
+	// charsPerToken is the average number of ASCII characters per token
+	charsPerToken float64
+}
+
+// modelProfiles is matched by the longest prefix of the model name, after
+// any "vendor/" prefix used by routers such as OpenRouter.
+var modelProfiles = map[string]modelProfile{
+	"gpt-4o":        {128000, 4},
+	"gpt-4.1":       {1047576, 4},
+	"gpt-4-turbo":   {128000, 4},
+	"gpt-4":         {8192, 4},
+	"gpt-3.5-turbo": {16385, 4},
+	"o1":            {200000, 4},
+	"o3":            {200000, 4},
+	"o4":            {200000, 4},
+	"claude":        {200000, 3.5},
+	"gemini":        {1048576, 4},
+	"llama3.1":      {131072, 3.8},
+	"llama3.2":      {131072, 3.8},
+	"llama3.3":      {131072, 3.8},
+	"llama3":        {8192, 3.8},
+	"qwen":          {32768, 3.3},
+	"mistral":       {32768, 3.8},
+	"deepseek":      {65536, 3.5},
+}
+
+func profileFor(modelName string) modelProfile {
+	name := strings.ToLower(strings.TrimSpace(modelName))
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	best, bestLen := modelProfile{defaultContextWindow, 4}, 0
+	for prefix, profile := range modelProfiles {
+		if len(prefix) > bestLen && strings.HasPrefix(name, prefix) {
+			best, bestLen = profile, len(prefix)
+		}
+	}
+	return best
+}
+
+// contextWindow is the model's context size in tokens.
+func (c *ModelConfig) contextWindow() int {
+	if c != nil && c.ContextWindow > 0 {
+		return c.ContextWindow
+	}
+	if c == nil {
+		return defaultContextWindow
+	}
+	return profileFor(c.Model).contextWindow
+}
+
+// maxOutputTokens is the output limit requested from the model, at most
+// half the context window.
+func (c *ModelConfig) maxOutputTokens() int {
+	limit := defaultMaxTokens
+	if c != nil && c.MaxOutputTokens > 0 {
+		limit = c.MaxOutputTokens
+	}
+	if half := c.contextWindow() / 2; limit > half {
+		limit = half
+	}
+	return limit
+}
+
+// tightestConfig returns the endpoint with the least room for input, so a
+// history that fits it fits whichever endpoint serves the request.
+func tightestConfig(cfgs []*ModelConfig) *ModelConfig {
+	var tightest *ModelConfig
+	for _, cfg := range cfgs {
+		if tightest == nil || cfg.contextWindow()-cfg.maxOutputTokens() < tightest.contextWindow()-tightest.maxOutputTokens() {
+			tightest = cfg
+		}
+	}
+	if tightest == nil {
+		return defaultConfig()
+	}
+	return tightest
+}
+
+// modelCacheKey identifies a chat model instance: the endpoint first, so
+// invalidateEndpoint can find its models, then the api key, limits and
+// generation parameters it was created with.
+func modelCacheKey(cfg *ModelConfig) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%d|%s", cfg.EndpointID, cfg.Provider, cfg.BaseURL, cfg.Model, keyFingerprint(cfg.APIKey), cfg.maxOutputTokens(), generationKey(cfg))
+}
+
+// estimateTokensFor gives a rough token count of s for a model. ASCII text
+// uses the model's characters per token; CJK characters count as one token
+// each and other non-ASCII characters as half a token. Each message also
+// costs a few tokens of framing.
+func estimateTokensFor(modelName, s string) int {
+	ascii, cjk, other := 0, 0, 0
+	for _, r := range s {
+		switch {
+		case r < 0x80:
+			ascii++
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			cjk++
+		default:
+			other++
+		}
+	}
+	return int(float64(ascii)/profileFor(modelName).charsPerToken) + cjk + other/2 + 4
+}
+
+// estimateTokens estimates with the default profile (about 4 characters per token).
+func estimateTokens(s string) int {
+	return estimateTokensFor("", s)
+}
@@ -0,0 +1,81 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfileFor(t *testing.T) {
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{"gpt-4o-mini", 128000},
+		{"gpt-4", 8192},
+		{"gpt-4-turbo-preview", 128000},
+		{"openai/gpt-4.1-mini", 1047576},
+		{"anthropic/claude-3-5-sonnet", 200000},
+		{"llama3.1:8b", 131072},
+		{"llama3:8b", 8192},
+		{"unknown-model", defaultContextWindow},
+		{"", defaultContextWindow},
+	}
+	for _, tt := range tests {
+		if got := profileFor(tt.model).contextWindow; got != tt.want {
+			t.Errorf("profileFor(%q).contextWindow = %d, want %d", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestModelLimits(t *testing.T) {
+	tests := []struct {
+		cfg        *ModelConfig
+		wantWindow int
+		wantOutput int
+	}{
+		{nil, defaultContextWindow, defaultMaxTokens},
+		{&ModelConfig{Model: "gpt-4o"}, 128000, defaultMaxTokens},
+		{&ModelConfig{Model: "gpt-4"}, 8192, defaultMaxTokens},
+		{&ModelConfig{Model: "gpt-4", ContextWindow: 32000, MaxOutputTokens: 8000}, 32000, 8000},
+		// The output limit is at most half the window
+		{&ModelConfig{ContextWindow: 4096, MaxOutputTokens: 4000}, 4096, 2048},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.contextWindow(); got != tt.wantWindow {
+			t.Errorf("%+v: contextWindow = %d, want %d", tt.cfg, got, tt.wantWindow)
+		}
+		if got := tt.cfg.maxOutputTokens(); got != tt.wantOutput {
+			t.Errorf("%+v: maxOutputTokens = %d, want %d", tt.cfg, got, tt.wantOutput)
+		}
+	}
+}
+
+func TestTightestConfig(t *testing.T) {
+	small := &ModelConfig{EndpointID: "small", Model: "gpt-4"}
+	large := &ModelConfig{EndpointID: "large", Model: "gpt-4o"}
+	if got := tightestConfig([]*ModelConfig{large, small}); got != small {
+		t.Errorf("tightest = %s, want small", got.EndpointID)
+	}
+	if got := tightestConfig(nil); got == nil || got.Provider != "openai-compatible" {
+		t.Errorf("tightest of none = %+v, want the default config", got)
+	}
+}
+
+func TestEstimateTokensFor(t *testing.T) {
+	tests := []struct {
+		model string
+		text  string
+		want  int
+	}{
+		{"", "", 4},
+		{"gpt-4o", strings.Repeat("a", 400), 104},
+		{"claude-3-haiku", strings.Repeat("a", 350), 104},
+		{"gpt-4o", "你好世界", 8},
+		{"gpt-4o", "éééé", 6},
+	}
+	for _, tt := range tests {
+		if got := estimateTokensFor(tt.model, tt.text); got != tt.want {
+			t.Errorf("estimateTokensFor(%q, %q) = %d, want %d", tt.model, tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// maxToolSteps caps how many tool-call rounds a single request may run
+// before the model is forced to answer without tools.
+const maxToolSteps = 5
+
+// toToolInfo converts a ToolDefinition into the eino tool schema.
+func (t ToolDefinition) toToolInfo() *schema.ToolInfo {
+	params := make(map[string]*schema.ParameterInfo, len(t.Parameters))
+	for name, def := range t.Parameters {
+		params[name] = &schema.ParameterInfo{
+			Type:     schema.DataType(firstNonEmpty(def.Type, "string")),
+			Desc:     def.Description,
+			Required: def.Required,
+		}
+	}
+	return &schema.ToolInfo{
+		Name:        t.Name,
+		Desc:        t.Description,
+		ParamsOneOf: schema.NewParamsOneOfByParams(params),
+	}
+}
+
+// toolsForProject returns the tools the model may call for this project.
+func (s *Service) toolsForProject(projectCtx *ProjectContext) []*schema.ToolInfo {
+	if !hasExtension(projectCtx, "extension-creator") {
+		return nil
+	}
+	defs := s.GetAvailableTools()
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	tools := make([]*schema.ToolInfo, 0, len(defs))
+	for _, def := range defs {
+		tools = append(tools, def.toToolInfo())
+	}
+	return tools
+}
+
+// generateWithTools runs the tool loop: call the model, execute any tool calls,
+// feed the results back and call again, up to maxToolSteps rounds.
+func (s *Service) generateWithTools(ctx context.Context, cfg *ModelConfig, messages []*schema.Message, tools []*schema.ToolInfo, projectCtx *ProjectContext) (*schema.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	chatModel, err := s.getChatModel(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	toolModel, err := chatModel.WithTools(tools)
+	if err != nil {
+		return nil, fmt.Errorf("bind tools: %w", err)
+	}
+
+	var usage schema.TokenUsage
+	for step := 0; ; step++ {
+		var opts []model.Option
+		if step >= maxToolSteps {
+			// Out of steps - force a plain answer
+			opts = append(opts, model.WithToolChoice(schema.ToolChoiceForbidden))
+		}
+
+		resp, err := s.generateWithRetry(ctx, toolModel, messages, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("generate: %w", err)
+		}
+		addUsage(&usage, resp)
+
+		if len(resp.ToolCalls) == 0 || step >= maxToolSteps {
+			setUsage(resp, usage)
+			return resp, nil
+		}
+
+		fmt.Printf("[LLM] generateWithTools: step %d requested %d tool call(s)\n", step+1, len(resp.ToolCalls))
+		messages = append(messages, resp)
+		toolMessages, notes := s.processToolCalls(ctx, resp.ToolCalls, projectCtx)
+		if len(notes) > 0 {
+			fmt.Printf("[LLM] Tool call messages: %v\n", notes)
+		}
+		messages = append(messages, toolMessages...)
+	}
+}
+
+// processToolCalls executes native tool calls from the model and returns
+// one tool message per call to feed back into the conversation.
+func (s *Service) processToolCalls(ctx context.Context, calls []schema.ToolCall, projectCtx *ProjectContext) ([]*schema.Message, []string) {
+	var toolMessages []*schema.Message
+	var notes []string
+	for _, call := range calls {
+		result, msgs := s.executeToolCall(ctx, call, projectCtx)
+		notes = append(notes, msgs...)
+		toolMessages = append(toolMessages, schema.ToolMessage(result, call.ID, schema.WithToolName(call.Function.Name)))
+	}
+	return toolMessages, notes
+}
+
+// executeToolCall runs a single tool call and returns the result text for the model.
+func (s *Service) executeToolCall(ctx context.Context, call schema.ToolCall, projectCtx *ProjectContext) (string, []string) {
+	fmt.Printf("[LLM] Executing tool call: %s (id=%s)\n", call.Function.Name, call.ID)
+
+	var args map[string]interface{}
+	if call.Function.Arguments != "" {
+		if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+			return fmt.Sprintf("Error: invalid arguments for %s: %v", call.Function.Name, err), nil
+		}
+	}
+
+	switch call.Function.Name {
+	case "createExtension":
+		result, messages, err := s.executeCreateExtension(ctx, args, projectCtx)
+		if err != nil {
+			return fmt.Sprintf("Error: failed to create extension: %v", err), []string{fmt.Sprintf("Failed to create extension: %v", err)}
+		}
+		return result, messages
+	default:
+		return fmt.Sprintf("Error: unknown tool %q", call.Function.Name), nil
+	}
+}
+
+// addUsage adds the token usage of a model response to the running total.
+func addUsage(total *schema.TokenUsage, msg *schema.Message) {
+	if msg == nil || msg.ResponseMeta == nil || msg.ResponseMeta.Usage == nil {
+		return
+	}
+	total.PromptTokens += msg.ResponseMeta.Usage.PromptTokens
+	total.CompletionTokens += msg.ResponseMeta.Usage.CompletionTokens
+	total.TotalTokens += msg.ResponseMeta.Usage.TotalTokens
+}
+
+// setUsage stores the accumulated usage on the final response.
+func setUsage(msg *schema.Message, usage schema.TokenUsage) {
+	if usage.TotalTokens == 0 {
+		return
+	}
+	if msg.ResponseMeta == nil {
+		msg.ResponseMeta = &schema.ResponseMeta{}
+	}
+	u := usage
+	msg.ResponseMeta.Usage = &u
+}
@@ -0,0 +1,248 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+func streamOf(chunks ...*schema.Message) *schema.StreamReader[*schema.Message] {
+	sr, sw := schema.Pipe[*schema.Message](len(chunks))
+	for _, c := range chunks {
+		sw.Send(c, nil)
+	}
+	sw.Close()
+	return sr
+}
+
+func TestRelayStream(t *testing.T) {
+	index := 0
+	stream := streamOf(
+		&schema.Message{Role: schema.Assistant, Content: "Let me "},
+		&schema.Message{Role: schema.Assistant, Content: "build that."},
+		&schema.Message{Role: schema.Assistant, ToolCalls: []schema.ToolCall{{
+			Index:    &index,
+			ID:       "call_1",
+			Function: schema.FunctionCall{Name: "createExtension", Arguments: `{"id":`},
+		}}},
+		&schema.Message{Role: schema.Assistant, ToolCalls: []schema.ToolCall{{
+			Index:    &index,
+			Function: schema.FunctionCall{Arguments: `"weather"}`},
+		}}},
+	)
+
+	rec := httptest.NewRecorder()
+	full, err := relayStream(newSSEWriter(rec), stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Content != "Let me build that." {
+		t.Errorf("content = %q", full.Content)
+	}
+	if len(full.ToolCalls) != 1 {
+		t.Fatalf("tool calls = %+v", full.ToolCalls)
+	}
+	if tc := full.ToolCalls[0]; tc.ID != "call_1" || tc.Function.Name != "createExtension" || tc.Function.Arguments != `{"id":"weather"}` {
+		t.Errorf("tool call = %+v", tc)
+	}
+
+	events := readEvents(t, rec.Body.String())
+	if got := eventNames(events); got != "delta,delta,tool_call,tool_call" {
+		t.Fatalf("events = %s", got)
+	}
+	var marker StreamToolCallEvent
+	if err := json.Unmarshal([]byte(events[2].Data), &marker); err != nil {
+		t.Fatal(err)
+	}
+	if marker.ID != "call_1" || marker.Name != "createExtension" {
+		t.Errorf("tool_call event = %+v", marker)
+	}
+}
+
+func TestRelayStreamEmpty(t *testing.T) {
+	full, err := relayStream(newSSEWriter(httptest.NewRecorder()), streamOf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Role != schema.Assistant || full.Content != "" || len(full.ToolCalls) != 0 {
+		t.Errorf("empty stream = %+v", full)
+	}
+}
+
+func TestProcessToolCalls(t *testing.T) {
+	s := &Service{}
+	calls := []schema.ToolCall{
+		{ID: "call_1", Function: schema.FunctionCall{Name: "getWeather", Arguments: `{"city":"Bandung"}`}},
+		{ID: "call_2", Function: schema.FunctionCall{Name: "createExtension", Arguments: `{"id":`}},
+	}
+	messages, _ := s.processToolCalls(context.Background(), calls, &ProjectContext{})
+	if len(messages) != len(calls) {
+		t.Fatalf("got %d tool messages, want %d", len(messages), len(calls))
+	}
+	want := []string{`Error: unknown tool "getWeather"`, "Error: invalid arguments for createExtension"}
+	for i, msg := range messages {
+		if msg.Role != schema.Tool || msg.ToolCallID != calls[i].ID || msg.ToolName != calls[i].Function.Name {
+			t.Errorf("message %d = %+v", i, msg)
+		}
+		if !strings.HasPrefix(msg.Content, want[i]) {
+			t.Errorf("message %d content = %q, want prefix %q", i, msg.Content, want[i])
+		}
+	}
+}
+
+func TestToolsForProject(t *testing.T) {
+	s := &Service{}
+	if tools := s.toolsForProject(&ProjectContext{Extensions: []string{"image"}}); tools != nil {
+		t.Errorf("tools without extension-creator = %v", tools)
+	}
+	tools := s.toolsForProject(&ProjectContext{Extensions: []string{"extension-creator"}})
+	if len(tools) == 0 || tools[0].Name != "createExtension" {
+		t.Fatalf("tools = %v", tools)
+	}
+	for i := 1; i < len(tools); i++ {
+		if tools[i-1].Name > tools[i].Name {
+			t.Errorf("tools not sorted: %s before %s", tools[i-1].Name, tools[i].Name)
+		}
+	}
+}
+
+func TestAddUsage(t *testing.T) {
+	var total schema.TokenUsage
+	addUsage(&total, &schema.Message{ResponseMeta: &schema.ResponseMeta{Usage: &schema.TokenUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}}})
+	addUsage(&total, &schema.Message{})
+	addUsage(&total, nil)
+	addUsage(&total, &schema.Message{ResponseMeta: &schema.ResponseMeta{Usage: &schema.TokenUsage{PromptTokens: 20, CompletionTokens: 3, TotalTokens: 23}}})
+	if total.PromptTokens != 30 || total.CompletionTokens != 8 || total.TotalTokens != 38 {
+		t.Errorf("total = %+v", total)
+	}
+
+	msg := &schema.Message{}
+	setUsage(msg, total)
+	if msg.ResponseMeta == nil || msg.ResponseMeta.Usage.TotalTokens != 38 {
+		t.Errorf("setUsage = %+v", msg.ResponseMeta)
+	}
+	empty := &schema.Message{}
+	setUsage(empty, schema.TokenUsage{})
+	if empty.ResponseMeta != nil {
+		t.Errorf("setUsage with no usage = %+v", empty.ResponseMeta)
+	}
+}
+
+// scriptedModel streams one scripted reply per call and records what each
+// call was given.
+type scriptedModel struct {
+	replies  []*schema.Message
+	err      error
+	calls    [][]*schema.Message
+	forbids  []bool
+	fallback *schema.Message
+}
+
+func (m *scriptedModel) Generate(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	return nil, errors.New("not used")
+}
+
+func (m *scriptedModel) Stream(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	o := model.GetCommonOptions(&model.Options{}, opts...)
+	m.calls = append(m.calls, append([]*schema.Message(nil), input...))
+	m.forbids = append(m.forbids, o.ToolChoice != nil && *o.ToolChoice == schema.ToolChoiceForbidden)
+	reply := m.fallback
+	if len(m.replies) > 0 {
+		reply, m.replies = m.replies[0], m.replies[1:]
+	}
+	return streamOf(reply), nil
+}
+
+func toolCallReply(id string) *schema.Message {
+	index := 0
+	return &schema.Message{
+		Role:         schema.Assistant,
+		ToolCalls:    []schema.ToolCall{{Index: &index, ID: id, Function: schema.FunctionCall{Name: "getWeather", Arguments: `{"city":"Bandung"}`}}},
+		ResponseMeta: &schema.ResponseMeta{Usage: &schema.TokenUsage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}},
+	}
+}
+
+func TestStreamToolLoop(t *testing.T) {
+	s := &Service{}
+	ctx := context.Background()
+	first := toolCallReply("call_1")
+	chatModel := &scriptedModel{replies: []*schema.Message{{
+		Role:         schema.Assistant,
+		Content:      " Cerah, 27°C. ",
+		ResponseMeta: &schema.ResponseMeta{Usage: &schema.TokenUsage{PromptTokens: 20, CompletionTokens: 5, TotalTokens: 25}},
+	}}}
+	messages := []*schema.Message{schema.SystemMessage("You are helpful."), schema.UserMessage("Cuaca Bandung?")}
+
+	rec := httptest.NewRecorder()
+	content, usage, err := s.streamToolLoop(ctx, ctx, newSSEWriter(rec), chatModel, messages, streamOf(first), &ProjectContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "Cerah, 27°C." {
+		t.Errorf("content = %q", content)
+	}
+	if usage.PromptTokens != 30 || usage.CompletionTokens != 7 || usage.TotalTokens != 37 {
+		t.Errorf("usage = %+v", usage)
+	}
+
+	// The second round sees the tool call and its result
+	if len(chatModel.calls) != 1 {
+		t.Fatalf("model called %d times, want 1", len(chatModel.calls))
+	}
+	round := chatModel.calls[0]
+	if len(round) != 4 || round[2].Role != schema.Assistant || len(round[2].ToolCalls) != 1 {
+		t.Fatalf("second round messages = %v", round)
+	}
+	if tool := round[3]; tool.Role != schema.Tool || tool.ToolCallID != "call_1" || !strings.HasPrefix(tool.Content, `Error: unknown tool "getWeather"`) {
+		t.Errorf("tool message = %+v", tool)
+	}
+	if chatModel.forbids[0] {
+		t.Error("tools forbidden before the last step")
+	}
+	if got := eventNames(readEvents(t, rec.Body.String())); got != "tool_call,delta" {
+		t.Errorf("events = %s", got)
+	}
+}
+
+func TestStreamToolLoopStopsAfterMaxSteps(t *testing.T) {
+	s := &Service{}
+	ctx := context.Background()
+	chatModel := &scriptedModel{fallback: toolCallReply("call_n")}
+	messages := []*schema.Message{schema.UserMessage("Loop forever")}
+
+	_, usage, err := s.streamToolLoop(ctx, ctx, newSSEWriter(httptest.NewRecorder()), chatModel, messages, streamOf(toolCallReply("call_0")), &ProjectContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chatModel.calls) != maxToolSteps {
+		t.Fatalf("model called %d times, want %d", len(chatModel.calls), maxToolSteps)
+	}
+	for i, forbidden := range chatModel.forbids {
+		if want := i == maxToolSteps-1; forbidden != want {
+			t.Errorf("round %d: tools forbidden = %v, want %v", i+2, forbidden, want)
+		}
+	}
+	if usage.TotalTokens != 12*(maxToolSteps+1) {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestStreamToolLoopError(t *testing.T) {
+	s := &Service{}
+	ctx := context.Background()
+	chatModel := &scriptedModel{err: errors.New("connection reset")}
+
+	_, _, err := s.streamToolLoop(ctx, ctx, newSSEWriter(httptest.NewRecorder()), chatModel, []*schema.Message{schema.UserMessage("Hi")}, streamOf(toolCallReply("call_1")), &ProjectContext{})
+	if err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("err = %v, want the model error", err)
+	}
+}
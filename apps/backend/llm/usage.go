@@ -0,0 +1,133 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+// usageScope identifies who a model call is made for. It travels in the
+// context so every call site can record usage without extra parameters.
+type usageScope struct {
+	TenantID    string
+	ProjectID   string
+	SubclientID string
+	Operation   string
+	EndpointID  string
+	Model       string
+}
+
+type usageScopeKey struct{}
+
+// withUsageScope attaches the tenant, project, subclient and operation to the context.
+func withUsageScope(ctx context.Context, tenantID, projectID, subclientID, operation string) context.Context {
+	return context.WithValue(ctx, usageScopeKey{}, usageScope{
+		TenantID:    tenantID,
+		ProjectID:   projectID,
+		SubclientID: subclientID,
+		Operation:   operation,
+	})
+}
+
+// withUsageEndpoint records which endpoint the calls in this context go to.
+func withUsageEndpoint(ctx context.Context, cfg *ModelConfig) context.Context {
+	scope := usageScopeFrom(ctx)
+	scope.EndpointID = cfg.EndpointID
+	scope.Model = cfg.Model
+	return context.WithValue(ctx, usageScopeKey{}, scope)
+}
+
+func usageScopeFrom(ctx context.Context) usageScope {
+	scope, _ := ctx.Value(usageScopeKey{}).(usageScope)
+	if scope.Operation == "" {
+		scope.Operation = "generate"
+	}
+	return scope
+}
+
+// recordUsage writes one llm_usage row for a model call. The insert runs in
+// the background so it never slows down or fails the request.
+func recordUsage(ctx context.Context, resp *schema.Message, callErr error, latency time.Duration) {
+	var promptTokens, completionTokens, totalTokens int
+	if resp != nil && resp.ResponseMeta != nil && resp.ResponseMeta.Usage != nil {
+		promptTokens = resp.ResponseMeta.Usage.PromptTokens
+		completionTokens = resp.ResponseMeta.Usage.CompletionTokens
+		totalTokens = resp.ResponseMeta.Usage.TotalTokens
+	}
+	recordTokenUsage(ctx, promptTokens, completionTokens, totalTokens, callErr, latency)
+}
+
+// recordTokenUsage is recordUsage for calls that don't return a chat
+// message, such as embeddings.
+func recordTokenUsage(ctx context.Context, promptTokens, completionTokens, totalTokens int, callErr error, latency time.Duration) {
+	scope := usageScopeFrom(ctx)
+	if totalTokens == 0 {
+		totalTokens = promptTokens + completionTokens
+	}
+	errorClass := ""
+	if callErr != nil {
+		errorClass = classifyError(callErr)
+	}
+
+	go func() {
+		db, err := getDB()
+		if err != nil {
+			fmt.Printf("[LLM] recordUsage: db unavailable: %v\n", err)
+			return
+		}
+		_, err = db.ExecContext(context.Background(), `
+			INSERT INTO llm_usage
+			(id, tenant_id, project_id, subclient_id, endpoint_id, model, operation, prompt_tokens, completion_tokens, total_tokens, latency_ms, success, error_class, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, "usg_"+randomHex(10), scope.TenantID, scope.ProjectID, scope.SubclientID, scope.EndpointID, scope.Model, scope.Operation,
+			promptTokens, completionTokens, totalTokens, latency.Milliseconds(), boolToInt(callErr == nil), errorClass, nowRFC3339())
+		if err != nil {
+			fmt.Printf("[LLM] recordUsage: insert failed: %v\n", err)
+		}
+	}()
+}
+
+// classifyError maps a model call error to a short error class for reporting.
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if isRateLimitError(err) {
+		return "rate_limit"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "401") || strings.Contains(msg, "403") || strings.Contains(msg, "unauthorized") || strings.Contains(msg, "invalid api key"):
+		return "auth"
+	case strings.Contains(msg, "context length") || strings.Contains(msg, "maximum context") || strings.Contains(msg, "too many tokens"):
+		return "context_length"
+	case strings.Contains(msg, "400") || strings.Contains(msg, "invalid"):
+		return "bad_request"
+	case strings.Contains(msg, "500") || strings.Contains(msg, "502") || strings.Contains(msg, "503") || strings.Contains(msg, "504"):
+		return "server"
+	case strings.Contains(msg, "timeout") || strings.Contains(msg, "deadline"):
+		return "timeout"
+	case strings.Contains(msg, "connection") || strings.Contains(msg, "no such host") || strings.Contains(msg, "eof"):
+		return "network"
+	}
+	return "unknown"
+}
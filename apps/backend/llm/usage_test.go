@@ -0,0 +1,88 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{errors.New("error, status code: 429, message: Too Many Requests"), "rate_limit"},
+		{fmt.Errorf("generate: %w", context.DeadlineExceeded), "timeout"},
+		{context.Canceled, "canceled"},
+		{errors.New("status code: 401, invalid api key"), "auth"},
+		{errors.New("This model's maximum context length is 8192 tokens"), "context_length"},
+		{errors.New("status code: 400, invalid request"), "bad_request"},
+		{errors.New("status code: 502, bad gateway"), "server"},
+		{errors.New("dial tcp: lookup api.example.com: no such host"), "network"},
+		{errors.New("something odd"), "unknown"},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("classifyError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUsageScope(t *testing.T) {
+	if got := usageScopeFrom(context.Background()); got.Operation != "generate" || got.TenantID != "" {
+		t.Errorf("empty scope = %+v", got)
+	}
+
+	ctx := withUsageScope(context.Background(), "t1", "p1", "s1", "stream")
+	ctx = withUsageEndpoint(ctx, &ModelConfig{EndpointID: "ep1", Model: "gpt-4o-mini"})
+	got := usageScopeFrom(ctx)
+	want := usageScope{TenantID: "t1", ProjectID: "p1", SubclientID: "s1", Operation: "stream", EndpointID: "ep1", Model: "gpt-4o-mini"}
+	if got != want {
+		t.Errorf("scope = %+v, want %+v", got, want)
+	}
+}
+
+func TestRecordUsage(t *testing.T) {
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantID := "t_usage_" + randomHex(6)
+	ctx := withUsageEndpoint(withUsageScope(context.Background(), tenantID, "p1", "s1", "title"), &ModelConfig{EndpointID: "ep1", Model: "m1"})
+
+	waitRows := func(want int) (tokens, failures int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var rows int
+			err := db.QueryRow(`
+				SELECT COUNT(*), COALESCE(SUM(total_tokens), 0), COALESCE(SUM(CASE WHEN success = 0 AND error_class = 'rate_limit' THEN 1 ELSE 0 END), 0)
+				FROM llm_usage WHERE tenant_id = ? AND project_id = 'p1' AND subclient_id = 's1' AND operation = 'title' AND endpoint_id = 'ep1' AND model = 'm1'
+			`, tenantID).Scan(&rows, &tokens, &failures)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rows == want {
+				return tokens, failures
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("usage rows = %d, want %d", rows, want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	recordUsage(ctx, &schema.Message{ResponseMeta: &schema.ResponseMeta{Usage: &schema.TokenUsage{PromptTokens: 12, CompletionTokens: 8}}}, nil, 250*time.Millisecond)
+	if tokens, failures := waitRows(1); tokens != 20 || failures != 0 {
+		t.Errorf("tokens = %d, failures = %d", tokens, failures)
+	}
+	recordUsage(ctx, nil, errors.New("status code: 429"), time.Second)
+	if tokens, failures := waitRows(2); tokens != 20 || failures != 1 {
+		t.Errorf("tokens = %d, failures = %d", tokens, failures)
+	}
+}
@@ -0,0 +1,272 @@
+package llm
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Vector store names, selected with LLM_VECTOR_STORE.
+const (
+	vectorStoreSQLite = "sqlite"
+)
+
+const vectorDeleteBatch = 500
+
+// Vector encodings in the vectors table.
+const (
+	vectorEncodingF32 = "f32"
+	vectorEncodingI8  = "i8"
+)
+
+// VectorStore keeps embedding vectors in named collections and finds the
+// ones closest to a query vector. A collection holds vectors of a single
+// embedding model, so its scores are comparable.
+//
+// The SQLite store compares the query with every vector of the collection.
+// An approximate index such as HNSW can implement the same interface,
+// loading the vectors table into memory and keeping it in sync on Upsert
+// and Delete.
+type VectorStore interface {
+	Name() string
+	// Upsert adds the items, replacing items with the same ID.
+	Upsert(ctx context.Context, collection string, items []VectorItem) error
+	Delete(ctx context.Context, collection string, ids []string) error
+	DeleteCollection(ctx context.Context, collection string) error
+	Count(ctx context.Context, collection string) (int, error)
+	// Search returns the closest items by cosine similarity, best first.
+	Search(ctx context.Context, collection string, query []float64, opts VectorSearchOptions) ([]VectorMatch, error)
+}
+
+type VectorItem struct {
+	ID       string
+	Vector   []float64
+	Metadata map[string]string
+}
+
+type VectorSearchOptions struct {
+	// Limit is the number of matches to return; 0 returns all of them.
+	Limit int
+	// MinScore drops matches with a lower cosine similarity.
+	MinScore float64
+}
+
+type VectorMatch struct {
+	ID       string
+	Score    float64
+	Metadata map[string]string
+}
+
+// newVectorStore builds the store named by LLM_VECTOR_STORE. Setting
+// LLM_VECTOR_QUANTIZATION=int8 stores new vectors as int8, a quarter of
+// the float32 size, at a small cost in accuracy.
+func newVectorStore() VectorStore {
+	quantize := strings.EqualFold(strings.TrimSpace(os.Getenv("LLM_VECTOR_QUANTIZATION")), "int8")
+	switch name := strings.ToLower(strings.TrimSpace(os.Getenv("LLM_VECTOR_STORE"))); name {
+	case "", vectorStoreSQLite:
+	default:
+		fmt.Printf("[WARN] Unknown vector store %q, using %s\n", name, vectorStoreSQLite)
+	}
+	return &sqliteVectorStore{quantize: quantize}
+}
+
+// sqliteVectorStore keeps vectors in the vectors table and searches by
+// brute force.
+type sqliteVectorStore struct {
+	quantize bool
+}
+
+var _ VectorStore = (*sqliteVectorStore)(nil)
+
+func (v *sqliteVectorStore) Name() string { return vectorStoreSQLite }
+
+func (v *sqliteVectorStore) Upsert(ctx context.Context, collection string, items []VectorItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := nowRFC3339()
+	for _, item := range items {
+		encoding, scale, data := vectorEncodingF32, 1.0, encodeFloat32Vector(item.Vector)
+		if v.quantize {
+			encoding = vectorEncodingI8
+			scale, data = quantizeInt8(item.Vector)
+		}
+		metadata := item.Metadata
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadataJSON, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO vectors (collection, id, dimensions, encoding, scale, data, metadata, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(collection, id) DO UPDATE SET
+				dimensions = excluded.dimensions,
+				encoding = excluded.encoding,
+				scale = excluded.scale,
+				data = excluded.data,
+				metadata = excluded.metadata,
+				created_at = excluded.created_at
+		`, collection, item.ID, len(item.Vector), encoding, scale, data, string(metadataJSON), now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (v *sqliteVectorStore) Delete(ctx context.Context, collection string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	// Batches stay under SQLite's limit on bound parameters
+	for start := 0; start < len(ids); start += vectorDeleteBatch {
+		batch := ids[start:min(start+vectorDeleteBatch, len(ids))]
+		args := make([]interface{}, 0, len(batch)+1)
+		args = append(args, collection)
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+		if _, err := db.ExecContext(ctx, `DELETE FROM vectors WHERE collection = ? AND id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *sqliteVectorStore) DeleteCollection(ctx context.Context, collection string) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM vectors WHERE collection = ?`, collection)
+	return err
+}
+
+func (v *sqliteVectorStore) Count(ctx context.Context, collection string) (int, error) {
+	db, err := getDB()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM vectors WHERE collection = ?`, collection).Scan(&n)
+	return n, err
+}
+
+func (v *sqliteVectorStore) Search(ctx context.Context, collection string, query []float64, opts VectorSearchOptions) ([]VectorMatch, error) {
+	if len(query) == 0 {
+		return nil, nil
+	}
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, encoding, scale, data, metadata
+		FROM vectors
+		WHERE collection = ? AND dimensions = ?
+	`, collection, len(query))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []VectorMatch
+	var metadataJSON []string
+	for rows.Next() {
+		var id, encoding, metadata string
+		var scale float64
+		var data []byte
+		if err := rows.Scan(&id, &encoding, &scale, &data, &metadata); err != nil {
+			return nil, err
+		}
+		score := cosineSimilarity(query, decodeVector(encoding, scale, data))
+		if score < opts.MinScore {
+			continue
+		}
+		matches = append(matches, VectorMatch{ID: id, Score: score})
+		metadataJSON = append(metadataJSON, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(matches))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return matches[order[i]].Score > matches[order[j]].Score })
+	if opts.Limit > 0 && len(order) > opts.Limit {
+		order = order[:opts.Limit]
+	}
+	// Metadata is only decoded for the matches returned
+	out := make([]VectorMatch, len(order))
+	for i, k := range order {
+		out[i] = matches[k]
+		_ = json.Unmarshal([]byte(metadataJSON[k]), &out[i].Metadata)
+	}
+	return out, nil
+}
+
+// encodeFloat32Vector stores a vector as little-endian float32 values.
+func encodeFloat32Vector(vec []float64) []byte {
+	buf := make([]byte, 4*len(vec))
+	for i, f := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(f)))
+	}
+	return buf
+}
+
+// quantizeInt8 maps a vector onto int8 values; value i is data[i] * scale.
+func quantizeInt8(vec []float64) (float64, []byte) {
+	maxAbs := 0.0
+	for _, f := range vec {
+		maxAbs = math.Max(maxAbs, math.Abs(f))
+	}
+	scale := maxAbs / 127
+	data := make([]byte, len(vec))
+	if scale == 0 {
+		return 1, data
+	}
+	for i, f := range vec {
+		data[i] = byte(int8(math.Round(f / scale)))
+	}
+	return scale, data
+}
+
+func decodeVector(encoding string, scale float64, data []byte) []float64 {
+	if encoding == vectorEncodingI8 {
+		vec := make([]float64, len(data))
+		for i, b := range data {
+			vec[i] = float64(int8(b)) * scale
+		}
+		return vec
+	}
+	vec := make([]float64, len(data)/4)
+	for i := range vec {
+		vec[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+	}
+	return vec
+}
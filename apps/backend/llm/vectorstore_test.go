@@ -0,0 +1,143 @@
+package llm
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestFloat32VectorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		vec  []float64
+	}{
+		{"empty", []float64{}},
+		{"unit", []float64{1, 0, -1}},
+		{"fractions", []float64{0.125, -0.5, 0.3333333, 1e-6}},
+		{"large", []float64{12345.5, -98765.25}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeFloat32Vector(tt.vec)
+			if len(data) != 4*len(tt.vec) {
+				t.Fatalf("encoded %d bytes, want %d", len(data), 4*len(tt.vec))
+			}
+			got := decodeVector(vectorEncodingF32, 1, data)
+			if len(got) != len(tt.vec) {
+				t.Fatalf("decoded %d values, want %d", len(got), len(tt.vec))
+			}
+			for i := range tt.vec {
+				if got[i] != float64(float32(tt.vec[i])) {
+					t.Errorf("value %d = %v, want %v", i, got[i], float32(tt.vec[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestQuantizeInt8(t *testing.T) {
+	tests := []struct {
+		name      string
+		vec       []float64
+		wantScale float64
+		wantData  []int8
+	}{
+		{"zero vector", []float64{0, 0, 0}, 1, []int8{0, 0, 0}},
+		{"extremes map to 127", []float64{1, -1, 0}, 1.0 / 127, []int8{127, -127, 0}},
+		{"scale follows the largest magnitude", []float64{-2, 1, 0.5}, 2.0 / 127, []int8{-127, 64, 32}},
+		{"rounds to nearest", []float64{127, 0.4, 0.6, -0.6}, 1, []int8{127, 0, 1, -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scale, data := quantizeInt8(tt.vec)
+			if math.Abs(scale-tt.wantScale) > 1e-12 {
+				t.Errorf("scale = %v, want %v", scale, tt.wantScale)
+			}
+			for i, b := range data {
+				if int8(b) != tt.wantData[i] {
+					t.Errorf("value %d = %d, want %d", i, int8(b), tt.wantData[i])
+				}
+			}
+			// Decoding is off by at most half a step
+			decoded := decodeVector(vectorEncodingI8, scale, data)
+			for i := range tt.vec {
+				if diff := math.Abs(decoded[i] - tt.vec[i]); diff > scale/2+1e-12 {
+					t.Errorf("value %d decoded to %v, want %v (error %v > %v)", i, decoded[i], tt.vec[i], diff, scale/2)
+				}
+			}
+		})
+	}
+}
+
+func TestQuantizedCosineSimilarity(t *testing.T) {
+	a := []float64{0.12, -0.48, 0.33, 0.91, -0.05, 0.27, -0.66, 0.18}
+	b := []float64{0.10, -0.40, 0.35, 0.80, 0.02, 0.20, -0.70, 0.25}
+	want := cosineSimilarity(a, b)
+
+	scale, data := quantizeInt8(b)
+	got := cosineSimilarity(a, decodeVector(vectorEncodingI8, scale, data))
+	if math.Abs(got-want) > 0.01 {
+		t.Errorf("cosine on int8 vector = %v, want %v within 0.01", got, want)
+	}
+
+	for _, tt := range []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{"identical", []float64{1, 2, 3}, []float64{1, 2, 3}, 1},
+		{"opposite", []float64{1, 2, 3}, []float64{-1, -2, -3}, -1},
+		{"orthogonal", []float64{1, 0}, []float64{0, 1}, 0},
+		{"zero vector", []float64{0, 0}, []float64{1, 1}, 0},
+		{"length mismatch", []float64{1, 2}, []float64{1, 2, 3}, 0},
+	} {
+		if got := cosineSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: cosineSimilarity = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSQLiteVectorStoreSearch(t *testing.T) {
+	for _, quantize := range []bool{false, true} {
+		store := &sqliteVectorStore{quantize: quantize}
+		ctx := context.Background()
+		collection := "test:search"
+		if quantize {
+			collection += ":i8"
+		}
+		t.Cleanup(func() { _ = store.DeleteCollection(ctx, collection) })
+
+		err := store.Upsert(ctx, collection, []VectorItem{
+			{ID: "north", Vector: []float64{0, 1, 0}, Metadata: map[string]string{"text": "north"}},
+			{ID: "east", Vector: []float64{1, 0, 0}},
+			{ID: "northeast", Vector: []float64{0.7, 0.7, 0}},
+			{ID: "other-dims", Vector: []float64{0, 1}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matches, err := store.Search(ctx, collection, []float64{0.1, 1, 0}, VectorSearchOptions{Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 2 || matches[0].ID != "north" || matches[1].ID != "northeast" {
+			t.Fatalf("quantize=%v: matches = %+v", quantize, matches)
+		}
+		if matches[0].Metadata["text"] != "north" {
+			t.Errorf("quantize=%v: metadata = %v", quantize, matches[0].Metadata)
+		}
+
+		filtered, _ := store.Search(ctx, collection, []float64{0.1, 1, 0}, VectorSearchOptions{MinScore: 0.9})
+		if len(filtered) != 1 {
+			t.Errorf("quantize=%v: MinScore kept %d matches, want 1", quantize, len(filtered))
+		}
+
+		if err := store.Delete(ctx, collection, []string{"north"}); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := store.Count(ctx, collection); n != 3 {
+			t.Errorf("quantize=%v: count after delete = %d, want 3", quantize, n)
+		}
+	}
+}
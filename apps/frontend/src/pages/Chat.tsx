@@ -491,6 +491,32 @@ export default function ChatPage() {
     }
   };
 
+  // Helper function to pick up the title the backend generates after the
+  // first reply of a conversation
+  const refreshBackendTitle = async (pid: string, convId: string, attempts = 5): Promise<void> => {
+    for (let i = 0; i < attempts; i++) {
+      await new Promise((resolve) => setTimeout(resolve, 2000));
+      try {
+        const response = await fetch(`/projects/${pid}/conversations/${convId}`, {
+          credentials: "include",
+        });
+        if (!response.ok) return;
+
+        const data = await response.json();
+        if (data.title_source !== "generated" && data.title_source !== "user") continue;
+
+        const store = useChatStore.getState();
+        if (store.currentConversation?.id === convId && data.title) {
+          store.setCurrentConversation({ ...store.currentConversation, title: data.title });
+        }
+        return;
+      } catch (error) {
+        console.error("Failed to refresh conversation title:", error);
+        return;
+      }
+    }
+  };
+
   // Helper function to convert file to base64
   const fileToBase64 = (file: File): Promise<string> => {
     return new Promise((resolve, reject) => {
@@ -607,8 +633,31 @@ export default function ChatPage() {
       // Clear files after processing
       clearFiles();
 
-      // CRITICAL: Start LLM call IMMEDIATELY without waiting for backend ops
-      // This is the key optimization - don't block on conversation creation or message saving
+      // The backend reads earlier turns from the stored conversation, so the
+      // conversation and the user message are saved before generating
+      let convId = backendConversationId;
+      const isNewConversation = !convId;
+      if (!convId) {
+        const title = messageContent.slice(0, 50) + (messageContent.length > 50 ? "..." : "");
+        console.log("[Chat] Creating backend conversation...");
+        convId = await createBackendConversation(title, currentProjectId);
+        if (!convId) {
+          throw new Error("Failed to save the conversation");
+        }
+        setBackendConversationId(convId);
+
+        // Update conversation ID in store using FRESH reference
+        const store = useChatStore.getState();
+        if (store.currentConversation) {
+          store.setCurrentConversation({
+            ...store.currentConversation,
+            id: convId,
+            title: title,
+          });
+        }
+      }
+      await addBackendMessage("user", messageContent, currentProjectId, convId);
+
       const llmStartTime = Date.now();
 
       // Debug: Log the full request payload
@@ -616,6 +665,7 @@ export default function ChatPage() {
         prompt: messageContent,
         project_context: projectContext,
         attachments: llmAttachments,
+        conversation_id: convId,
       };
       console.log("[Chat] === SENDING LLM REQUEST ===");
       console.log("[Chat] Extensions:", projectContext.extensions);
@@ -633,11 +683,7 @@ export default function ChatPage() {
         method: "POST",
         credentials: "include",
         headers: { "Content-Type": "application/json" },
-        body: JSON.stringify({
-          prompt: messageContent,
-          project_context: projectContext,
-          attachments: llmAttachments,
-        }),
+        body: JSON.stringify(requestPayload),
         // Add timeout to prevent hanging - sync with backend timeout
         signal: AbortSignal.timeout(70000), // 70 second timeout (backend is 60s + buffer)
       });
@@ -692,55 +738,11 @@ export default function ChatPage() {
         lastMessageRole: convAfterAdd?.messages[convAfterAdd.messages.length - 1]?.role
       });
 
-      // Fire-and-forget: Save everything to backend in background
-      // CRITICAL: Use fresh state from store, not stale closure references
-      (async () => {
-        try {
-          console.log("[Chat] Background save: starting...");
-
-          // Get fresh conversation from store
-          const freshConv = useChatStore.getState().currentConversation;
-          if (!freshConv) {
-            console.error("[Chat] Background save: no conversation to save");
-            return;
-          }
-
-          // Create conversation if needed
-          let finalConvId = backendConversationId;
-          if (!finalConvId) {
-            const title = messageContent.slice(0, 50) + (messageContent.length > 50 ? "..." : "");
-            console.log("[Chat] Background save: creating conversation...");
-            finalConvId = await createBackendConversation(title, currentProjectId);
-            if (finalConvId) {
-              console.log("[Chat] Background save: conversation created with ID:", finalConvId);
-              setBackendConversationId(finalConvId);
-
-              // Update conversation ID in store using FRESH reference
-              const store = useChatStore.getState();
-              if (store.currentConversation) {
-                store.setCurrentConversation({
-                  ...store.currentConversation, // Use fresh conversation from store
-                  id: finalConvId,
-                  title: title,
-                });
-              }
-            } else {
-              console.error("[Chat] Background save: failed to create conversation");
-            }
-          }
-
-          // Save both messages
-          if (finalConvId) {
-            console.log("[Chat] Background save: saving user message...");
-            await addBackendMessage("user", messageContent, currentProjectId, finalConvId);
-            console.log("[Chat] Background save: saving assistant message...");
-            await addBackendMessage("assistant", responseContent, currentProjectId, finalConvId);
-            console.log("[Chat] Background save: completed successfully");
-          }
-        } catch (err) {
-          console.error("[Chat] Background save failed:", err);
-        }
-      })();
+      // Fire-and-forget: save the reply in the background
+      addBackendMessage("assistant", responseContent, currentProjectId, convId);
+      if (isNewConversation) {
+        refreshBackendTitle(currentProjectId, convId);
+      }
 
       // Show success toast
       addToast({